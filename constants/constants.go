@@ -3,6 +3,7 @@ package constants
 import (
 	"os"
 	"syscall"
+	"time"
 	"unsafe"
 )
 
@@ -12,41 +13,154 @@ const (
 	META_COMMAND_UNRECOGNIZED_COMMAND = "META_COMMAND_UNRECOGNIZED_COMMAND"
 	META_COMMAND_EXIT                 = "META_COMMAND_EXIT"
 
-	PREPARE_SUCCESS                = "PREPARE_SUCCESS"
-	PREPARE_UNRECOGNIZED_STATEMENT = "PREPARE_UNRECOGNIZED_STATEMENT"
-	PREPARE_SYNTAX_ERROR           = "PREPARE_SYNTAX_ERROR"
-	// PREPARE_NEGATIVE_ID            = "PREPARE_NEGATIVE_ID" // NOTE: Not needed since Regex will not match negative numbers
-	PREPARE_STRING_TOO_LONG = "PREPARE_STRING_TOO_LONG"
-	PREPARE_NON_POSITIVE_ID = "PREPARE_NON_POSITIVE_ID"
-
 	STATEMENT_INSERT = "STATEMENT_INSERT"
 	STATEMENT_SELECT = "STATEMENT_SELECT"
+	STATEMENT_DELETE = "STATEMENT_DELETE"
+	STATEMENT_UPDATE = "STATEMENT_UPDATE"
+
+	STATEMENT_CREATE_TABLE = "STATEMENT_CREATE_TABLE"
+	STATEMENT_CREATE_INDEX = "STATEMENT_CREATE_INDEX"
+
+	STATEMENT_BEGIN    = "STATEMENT_BEGIN"
+	STATEMENT_COMMIT   = "STATEMENT_COMMIT"
+	STATEMENT_ROLLBACK = "STATEMENT_ROLLBACK"
+)
+
+// The table every database the shell creates starts with, also used by the shorthand insert and select
+const (
+	DEFAULT_TABLE_NAME = "users"
+	DEFAULT_TABLE_SQL  = "CREATE TABLE users (id INTEGER PRIMARY KEY, username TEXT(32), email TEXT(255))"
+)
+
+// The catalog has a row for every table in the database, naming the table's
+// root page and holding the CREATE statement it was defined with
+const (
+	CATALOG_TABLE_NAME = "goqlite_master"
+	CATALOG_TABLE_SQL  = "CREATE TABLE goqlite_master (type TEXT, name TEXT, tbl_name TEXT, rootpage INTEGER, sql TEXT)"
+	// Names starting with this are kept for tables the database itself uses
+	RESERVED_TABLE_PREFIX = "goqlite_"
+)
+
+// Name the database/sql driver is registered under
+const DRIVER_NAME = "goqlite"
+
+// Prepared statements a connection keeps for reuse once they're closed, by their SQL text
+const STATEMENT_CACHE_SIZE = 32
+
+// How long a statement waits before trying a busy database again
+const BUSY_RETRY_INTERVAL = 5 * time.Millisecond
+
+// How far a connection has locked a database in rollback journal mode, each
+// level allowing what the ones below it do
+const (
+	LOCK_NONE = iota
+	LOCK_SHARED
+	LOCK_RESERVED
+	LOCK_PENDING
+	LOCK_EXCLUSIVE
+)
+
+const (
+	COLUMN_TYPE_INTEGER = "INTEGER"
+	COLUMN_TYPE_REAL    = "REAL"
+	COLUMN_TYPE_TEXT    = "TEXT"
+	COLUMN_TYPE_BLOB    = "BLOB"
 )
 
+// Opcodes of the bytecode programs statements are compiled to
 const (
-	EXECUTE_SUCCESS        = "EXECUTE_SUCCESS"
-	EXECUTE_TABLE_FULL     = "EXECUTE_TABLE_FULL"
-	EXECUTE_STATEMENT_FAIL = "EXECUTE_STATEMENT_FAIL"
-	EXECUTE_DUPLICATE_KEY  = "EXECUTE_DUPLICATE_KEY"
+	// Control flow
+	OP_GOTO           = "Goto"
+	OP_HALT           = "Halt"
+	OP_IF             = "If"
+	OP_IF_NOT         = "IfNot"
+	OP_IS_NULL        = "IsNull"
+	OP_IF_POS         = "IfPos"
+	OP_DECR_JUMP_ZERO = "DecrJumpZero"
+	OP_EQ             = "Eq"
+	OP_GT             = "Gt"
+	OP_SAME_KEYS      = "SameKeys"
+
+	// Registers and expressions
+	OP_INTEGER   = "Integer"
+	OP_VALUE     = "Value"
+	OP_COPY      = "Copy"
+	OP_ADD_IMM   = "AddImm"
+	OP_BINARY    = "Binary"
+	OP_AND       = "And"
+	OP_OR        = "Or"
+	OP_NOT       = "Not"
+	OP_NEGATIVE  = "Negative"
+	OP_TEST_NULL = "TestNull"
+	OP_IN        = "In"
+	OP_FUNCTION  = "Function"
+
+	// Cursors
+	OP_OPEN_READ   = "OpenRead"
+	OP_OPEN_WRITE  = "OpenWrite"
+	OP_REWIND      = "Rewind"
+	OP_NEXT        = "Next"
+	OP_SEEK_GE     = "SeekGE"
+	OP_SEEK_ROWID  = "SeekRowid"
+	OP_IDX_GT      = "IdxGT"
+	OP_IDX_ROWID   = "IdxRowid"
+	OP_COLUMN      = "Column"
+	OP_ROWID       = "Rowid"
+	OP_NULL_ROW    = "NullRow"
+	OP_IF_NULL_ROW = "IfNullRow"
+	OP_COUNT       = "Count"
+	OP_HASH_BUILD  = "HashBuild"
+	OP_HASH_PROBE  = "HashProbe"
+
+	// Grouping and sorting
+	OP_GROUP_FIND    = "GroupFind"
+	OP_AGG_STEP      = "AggStep"
+	OP_GROUP_SAVE    = "GroupSave"
+	OP_GROUP_SORT    = "GroupSort"
+	OP_GROUP_NEXT    = "GroupNext"
+	OP_SORTER_INSERT = "SorterInsert"
+	OP_SORTER_SORT   = "SorterSort"
+	OP_SORTER_NEXT   = "SorterNext"
+
+	// Rowids an update or delete collects before changing any row
+	OP_ROWSET_ADD  = "RowSetAdd"
+	OP_ROWSET_READ = "RowSetRead"
+
+	// Output and changes
+	OP_RESULT_ROW  = "ResultRow"
+	OP_NEW_ROWID   = "NewRowid"
+	OP_TYPE_CHECK  = "TypeCheck"
+	OP_MAKE_RECORD = "MakeRecord"
+	OP_INSERT      = "Insert"
+	OP_DELETE      = "Delete"
+	OP_IDX_CHECK   = "IdxCheck"
+	OP_IDX_INSERT  = "IdxInsert"
+	OP_IDX_DELETE  = "IdxDelete"
 )
 
+// What an EXPLAIN prints in place of running its statement
 const (
-	COLUMN_USERNAME_SIZE = 32
-	COLUMN_EMAIL_SIZE    = 255
+	EXPLAIN_PROGRAM    = "EXPLAIN"
+	EXPLAIN_QUERY_PLAN = "EXPLAIN QUERY PLAN"
 )
 
+// How a join reads the rows of a table for each combination of rows before it
 const (
-	ID_SIZE       = 4
-	USERNAME_SIZE = 32
-	EMAIL_SIZE    = 255
+	JOIN_ACCESS_SCAN  = "SCAN"
+	JOIN_ACCESS_ROWID = "ROWID"
+	JOIN_ACCESS_INDEX = "INDEX"
+	JOIN_ACCESS_HASH  = "HASH"
+)
 
-	ID_OFFSET       = 0
-	USERNAME_OFFSET = ID_OFFSET + ID_SIZE
-	EMAIL_OFFSET    = USERNAME_OFFSET + USERNAME_SIZE
-	ROW_SIZE        = ID_SIZE + USERNAME_SIZE + EMAIL_SIZE
+const (
+	PAGE_SIZE = 4096
+)
 
-	PAGE_SIZE       = 4096
-	TABLE_MAX_PAGES = 100
+const (
+	DEFAULT_CACHE_SIZE = 2000
+	// A single B-tree operation touches a handful of pages per level and relies
+	// on them staying cached until it is done, so the cache can't shrink below this
+	MIN_CACHE_SIZE = 32
 )
 
 const (
@@ -60,11 +174,114 @@ const (
 	S_IRUSR = syscall.S_IRUSR
 )
 
+// Page 0 holds the database header, the catalog's root lives right after it
+const (
+	HEADER_PAGE_NUM       = 0
+	CATALOG_ROOT_PAGE_NUM = 1
+
+	HEADER_MAGIC = "goqlite format\x00\x00"
+	// Both versions share the same layout, version 2 marks a database whose
+	// changes go through the write-ahead log so older builds refuse to open it
+	FORMAT_VERSION_ROLLBACK = 1
+	FORMAT_VERSION_WAL      = 2
+	HEADER_FORMAT_VERSION   = FORMAT_VERSION_WAL
+
+	HEADER_MAGIC_SIZE            = uintptr(len(HEADER_MAGIC))
+	HEADER_MAGIC_OFFSET          = 0
+	HEADER_FORMAT_VERSION_SIZE   = unsafe.Sizeof(uint32(0))
+	HEADER_FORMAT_VERSION_OFFSET = HEADER_MAGIC_OFFSET + HEADER_MAGIC_SIZE
+	HEADER_PAGE_SIZE_SIZE        = unsafe.Sizeof(uint32(0))
+	HEADER_PAGE_SIZE_OFFSET      = HEADER_FORMAT_VERSION_OFFSET + HEADER_FORMAT_VERSION_SIZE
+	HEADER_PAGE_COUNT_SIZE       = unsafe.Sizeof(uint32(0))
+	HEADER_PAGE_COUNT_OFFSET     = HEADER_PAGE_SIZE_OFFSET + HEADER_PAGE_SIZE_SIZE
+	FREE_LIST_HEAD_SIZE          = unsafe.Sizeof(uint32(0))
+	FREE_LIST_HEAD_OFFSET        = HEADER_PAGE_COUNT_OFFSET + HEADER_PAGE_COUNT_SIZE
+	FREE_PAGE_COUNT_SIZE         = unsafe.Sizeof(uint32(0))
+	FREE_PAGE_COUNT_OFFSET       = FREE_LIST_HEAD_OFFSET + FREE_LIST_HEAD_SIZE
+	HEADER_SCHEMA_COOKIE_SIZE    = unsafe.Sizeof(uint32(0))
+	HEADER_SCHEMA_COOKIE_OFFSET  = FREE_PAGE_COUNT_OFFSET + FREE_PAGE_COUNT_SIZE
+	HEADER_CHANGE_COUNTER_SIZE   = unsafe.Sizeof(uint32(0))
+	HEADER_CHANGE_COUNTER_OFFSET = HEADER_SCHEMA_COOKIE_OFFSET + HEADER_SCHEMA_COOKIE_SIZE
+	HEADER_SIZE                  = HEADER_CHANGE_COUNTER_OFFSET + HEADER_CHANGE_COUNTER_SIZE
+)
+
+// The journal starts with a header followed by one record per saved page
+const (
+	JOURNAL_MAGIC = "goqljrnl"
+
+	JOURNAL_MAGIC_OFFSET      = 0
+	JOURNAL_NONCE_OFFSET      = JOURNAL_MAGIC_OFFSET + len(JOURNAL_MAGIC)
+	JOURNAL_PAGE_COUNT_OFFSET = JOURNAL_NONCE_OFFSET + 4
+	JOURNAL_HEADER_SIZE       = JOURNAL_PAGE_COUNT_OFFSET + 4
+
+	JOURNAL_RECORD_PAGE_NUM_OFFSET = 0
+	JOURNAL_RECORD_DATA_OFFSET     = JOURNAL_RECORD_PAGE_NUM_OFFSET + 4
+	JOURNAL_RECORD_CHECKSUM_OFFSET = JOURNAL_RECORD_DATA_OFFSET + PAGE_SIZE
+	JOURNAL_RECORD_SIZE            = JOURNAL_RECORD_CHECKSUM_OFFSET + 4
+)
+
+// The WAL starts with a header followed by one frame per page image. A frame
+// with a non-zero commit size is the last frame of a transaction and records
+// the database size in pages once it committed.
+const (
+	WAL_MAGIC          = "goqlwal\x00"
+	WAL_FORMAT_VERSION = 1
+
+	WAL_MAGIC_OFFSET               = 0
+	WAL_VERSION_OFFSET             = WAL_MAGIC_OFFSET + len(WAL_MAGIC)
+	WAL_PAGE_SIZE_OFFSET           = WAL_VERSION_OFFSET + 4
+	WAL_CHECKPOINT_SEQUENCE_OFFSET = WAL_PAGE_SIZE_OFFSET + 4
+	WAL_SALT_OFFSET                = WAL_CHECKPOINT_SEQUENCE_OFFSET + 4
+	WAL_CHECKSUM_OFFSET            = WAL_SALT_OFFSET + 4
+	WAL_HEADER_SIZE                = WAL_CHECKSUM_OFFSET + 4
+
+	WAL_FRAME_PAGE_NUM_OFFSET    = 0
+	WAL_FRAME_COMMIT_SIZE_OFFSET = WAL_FRAME_PAGE_NUM_OFFSET + 4
+	WAL_FRAME_SALT_OFFSET        = WAL_FRAME_COMMIT_SIZE_OFFSET + 4
+	WAL_FRAME_CHECKSUM_OFFSET    = WAL_FRAME_SALT_OFFSET + 4
+	WAL_FRAME_DATA_OFFSET        = WAL_FRAME_CHECKSUM_OFFSET + 4
+	WAL_FRAME_SIZE               = WAL_FRAME_DATA_OFFSET + PAGE_SIZE
+
+	// A commit tries to checkpoint once the WAL holds this many frames
+	WAL_AUTOCHECKPOINT_FRAMES = 1000
+)
+
+// A free list trunk page points at the next trunk and lists free leaf pages
+const (
+	FREE_LIST_TRUNK_NEXT_SIZE         = unsafe.Sizeof(uint32(0))
+	FREE_LIST_TRUNK_NEXT_OFFSET       = 0
+	FREE_LIST_TRUNK_NUM_LEAVES_SIZE   = unsafe.Sizeof(uint32(0))
+	FREE_LIST_TRUNK_NUM_LEAVES_OFFSET = FREE_LIST_TRUNK_NEXT_OFFSET + FREE_LIST_TRUNK_NEXT_SIZE
+	FREE_LIST_TRUNK_HEADER_SIZE       = FREE_LIST_TRUNK_NEXT_SIZE + FREE_LIST_TRUNK_NUM_LEAVES_SIZE
+	FREE_LIST_TRUNK_LEAF_SIZE         = unsafe.Sizeof(uint32(0))
+	FREE_LIST_TRUNK_MAX_LEAVES        = (PAGE_SIZE - FREE_LIST_TRUNK_HEADER_SIZE) / FREE_LIST_TRUNK_LEAF_SIZE
+)
+
+type TokenType uint8
+
+const (
+	TOKEN_EOF TokenType = iota
+	TOKEN_IDENTIFIER
+	TOKEN_KEYWORD
+	TOKEN_INTEGER
+	TOKEN_FLOAT
+	TOKEN_STRING
+	TOKEN_BLOB
+	TOKEN_OPERATOR
+	// ?, ?NNN or :name, with the text as written
+	TOKEN_PARAMETER
+)
+
+// Highest number a ?NNN parameter can have
+const MAX_PARAMETER_NUMBER = 999
+
 type NodeType uint8
 
 const (
 	NODE_INTERNAL NodeType = iota
 	NODE_LEAF
+	NODE_INDEX_INTERNAL
+	NODE_INDEX_LEAF
 )
 
 const (
@@ -80,19 +297,53 @@ const (
 const (
 	LEAF_NODE_NUM_CELLS_SIZE   = unsafe.Sizeof(uint32(0))
 	LEAF_NODE_NUM_CELLS_OFFSET = COMMON_NODE_HEADER_SIZE
-	LEAF_NODE_HEADER_SIZE      = COMMON_NODE_HEADER_SIZE + LEAF_NODE_NUM_CELLS_SIZE
+	LEAF_NODE_NEXT_LEAF_SIZE   = unsafe.Sizeof(uint32(0))
+	LEAF_NODE_NEXT_LEAF_OFFSET = LEAF_NODE_NUM_CELLS_OFFSET + LEAF_NODE_NUM_CELLS_SIZE
+	// Where the cell content area starts, cells are packed at the end of the
+	// page and the area grows down towards the cell pointers
+	LEAF_NODE_CELL_CONTENT_SIZE   = unsafe.Sizeof(uint32(0))
+	LEAF_NODE_CELL_CONTENT_OFFSET = LEAF_NODE_NEXT_LEAF_OFFSET + LEAF_NODE_NEXT_LEAF_SIZE
+	LEAF_NODE_HEADER_SIZE         = COMMON_NODE_HEADER_SIZE + LEAF_NODE_NUM_CELLS_SIZE + LEAF_NODE_NEXT_LEAF_SIZE + LEAF_NODE_CELL_CONTENT_SIZE
+)
+
+// The header is followed by one pointer per cell in key order, giving the
+// cell's offset in the page. A cell holds the row's key, the size of its
+// record and as much of the record as is kept in the leaf. When the rest of
+// the record spills onto overflow pages, the cell ends with the first one.
+const (
+	LEAF_NODE_CELL_POINTER_SIZE     = unsafe.Sizeof(uint16(0))
+	LEAF_NODE_KEY_SIZE              = unsafe.Sizeof(uint32(0))
+	LEAF_NODE_KEY_OFFSET            = 0
+	LEAF_NODE_RECORD_SIZE_SIZE      = unsafe.Sizeof(uint32(0))
+	LEAF_NODE_RECORD_SIZE_OFFSET    = LEAF_NODE_KEY_OFFSET + LEAF_NODE_KEY_SIZE
+	LEAF_NODE_CELL_HEADER_SIZE      = LEAF_NODE_KEY_SIZE + LEAF_NODE_RECORD_SIZE_SIZE
+	LEAF_NODE_OVERFLOW_POINTER_SIZE = unsafe.Sizeof(uint32(0))
+	LEAF_NODE_SPACE_FOR_CELLS       = PAGE_SIZE - LEAF_NODE_HEADER_SIZE
+	// A cell and its pointer never take more than a quarter of the space, so
+	// splitting or evening out two leaves always leaves both at least a quarter full
+	LEAF_NODE_MAX_CELL_SIZE = LEAF_NODE_SPACE_FOR_CELLS / 4
+	// A leaf other than the root that uses less space than this is merged with
+	// or evened out with a sibling
+	LEAF_NODE_MIN_USED_SPACE = LEAF_NODE_SPACE_FOR_CELLS / 4
+	// Records up to LEAF_NODE_MAX_LOCAL bytes are kept whole in the leaf. A
+	// larger record keeps at least LEAF_NODE_MIN_LOCAL bytes in the leaf, plus
+	// whatever would otherwise only part fill its last overflow page.
+	LEAF_NODE_MAX_LOCAL = LEAF_NODE_MAX_CELL_SIZE - LEAF_NODE_CELL_POINTER_SIZE - LEAF_NODE_CELL_HEADER_SIZE - LEAF_NODE_OVERFLOW_POINTER_SIZE
+	LEAF_NODE_MIN_LOCAL = LEAF_NODE_MAX_LOCAL / 4
 )
 
+// An overflow page holds the next page in its chain, 0 for the last one,
+// followed by the next part of a record
 const (
-	LEAF_NODE_KEY_SIZE          = unsafe.Sizeof(uint32(0))
-	LEAF_NODE_KEY_OFFSET        = 0
-	LEAF_NODE_VALUE_SIZE        = ROW_SIZE
-	LEAF_NODE_VALUE_OFFSET      = LEAF_NODE_KEY_OFFSET + LEAF_NODE_KEY_SIZE
-	LEAF_NODE_CELL_SIZE         = LEAF_NODE_KEY_SIZE + LEAF_NODE_VALUE_SIZE
-	LEAF_NODE_SPACE_FOR_CELLS   = PAGE_SIZE - LEAF_NODE_HEADER_SIZE
-	LEAF_NODE_MAX_CELLS         = LEAF_NODE_SPACE_FOR_CELLS / LEAF_NODE_CELL_SIZE
-	LEAF_NODE_RIGHT_SPLIT_COUNT = (LEAF_NODE_MAX_CELLS + 1) / 2
-	LEAF_NODE_LEFT_SPLIT_COUNT  = (LEAF_NODE_MAX_CELLS + 1) - LEAF_NODE_RIGHT_SPLIT_COUNT
+	OVERFLOW_PAGE_NEXT_SIZE   = unsafe.Sizeof(uint32(0))
+	OVERFLOW_PAGE_NEXT_OFFSET = 0
+	OVERFLOW_PAGE_DATA_OFFSET = OVERFLOW_PAGE_NEXT_OFFSET + OVERFLOW_PAGE_NEXT_SIZE
+	OVERFLOW_PAGE_DATA_SIZE   = PAGE_SIZE - OVERFLOW_PAGE_DATA_OFFSET
+)
+
+const (
+	// Largest record a row can have, the same as SQLite's default length limit
+	RECORD_MAX_SIZE = 1000000000
 )
 
 const (
@@ -105,4 +356,41 @@ const (
 	INTERNAL_NODE_KEY_SIZE   = unsafe.Sizeof(uint32(0))
 	INTERNAL_NODE_CHILD_SIZE = unsafe.Sizeof(uint32(0))
 	INTERNAL_NODE_CELL_SIZE  = INTERNAL_NODE_CHILD_SIZE + INTERNAL_NODE_KEY_SIZE
+	INTERNAL_NODE_MAX_KEYS   = (PAGE_SIZE - INTERNAL_NODE_HEADER_SIZE) / INTERNAL_NODE_CELL_SIZE
+	// Splitting a full internal node leaves INTERNAL_NODE_MAX_KEYS + 2 children to share out
+	INTERNAL_NODE_RIGHT_SPLIT_COUNT = (INTERNAL_NODE_MAX_KEYS + 2) / 2
+	INTERNAL_NODE_LEFT_SPLIT_COUNT  = (INTERNAL_NODE_MAX_KEYS + 2) - INTERNAL_NODE_RIGHT_SPLIT_COUNT
+	INTERNAL_NODE_MIN_KEYS          = INTERNAL_NODE_MAX_KEYS / 2
+)
+
+// Index B-trees are ordered by a key made of the indexed columns followed by
+// the rowid. Both kinds of index node pack their cells at the end of the page
+// behind an array of cell pointers, like table leaves. A leaf links to the
+// next leaf and an internal node has a right child for keys above all of its
+// cells, each node only uses one of the two fields.
+const (
+	INDEX_NODE_NUM_CELLS_SIZE      = unsafe.Sizeof(uint32(0))
+	INDEX_NODE_NUM_CELLS_OFFSET    = COMMON_NODE_HEADER_SIZE
+	INDEX_NODE_CELL_CONTENT_SIZE   = unsafe.Sizeof(uint32(0))
+	INDEX_NODE_CELL_CONTENT_OFFSET = INDEX_NODE_NUM_CELLS_OFFSET + INDEX_NODE_NUM_CELLS_SIZE
+	INDEX_NODE_NEXT_LEAF_SIZE      = unsafe.Sizeof(uint32(0))
+	INDEX_NODE_NEXT_LEAF_OFFSET    = INDEX_NODE_CELL_CONTENT_OFFSET + INDEX_NODE_CELL_CONTENT_SIZE
+	INDEX_NODE_RIGHT_CHILD_SIZE    = unsafe.Sizeof(uint32(0))
+	INDEX_NODE_RIGHT_CHILD_OFFSET  = INDEX_NODE_NEXT_LEAF_OFFSET + INDEX_NODE_NEXT_LEAF_SIZE
+	INDEX_NODE_HEADER_SIZE         = INDEX_NODE_RIGHT_CHILD_OFFSET + INDEX_NODE_RIGHT_CHILD_SIZE
+)
+
+// A leaf cell is the size of its key followed by the key. An internal cell
+// starts with a child page and then holds the largest key under that child.
+const (
+	INDEX_NODE_CELL_POINTER_SIZE = unsafe.Sizeof(uint16(0))
+	INDEX_NODE_CHILD_SIZE        = unsafe.Sizeof(uint32(0))
+	INDEX_NODE_KEY_SIZE_SIZE     = unsafe.Sizeof(uint16(0))
+	INDEX_NODE_SPACE_FOR_CELLS   = PAGE_SIZE - INDEX_NODE_HEADER_SIZE
+	// Like a table leaf cell, an index cell never takes more than a quarter of
+	// the space so a split always leaves both nodes with cells
+	INDEX_KEY_MAX_SIZE = INDEX_NODE_SPACE_FOR_CELLS/4 - INDEX_NODE_CELL_POINTER_SIZE - INDEX_NODE_CHILD_SIZE - INDEX_NODE_KEY_SIZE_SIZE
+	// A node other than the root that uses less space than this is merged
+	// with a sibling if the two fit in one node
+	INDEX_NODE_MIN_USED_SPACE = INDEX_NODE_SPACE_FOR_CELLS / 4
 )
@@ -0,0 +1,436 @@
+package goqlite
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kris-gaudel/goqlite/constants"
+)
+
+// Driver Code
+//
+// Registers goqlite with database/sql, so a database is opened with
+// sql.Open("goqlite", "file.db"). Options go after the file name like in a
+// URL, as in "file.db?journal_mode=wal&busy_timeout=5000": journal_mode is
+// delete or wal, cache_size is in pages and busy_timeout in milliseconds.
+// The pooled connections to one data source name share a single DB and take
+// turns with it: each statement runs on its own, and a transaction keeps the
+// other connections waiting until it commits or rolls back. So the pool needs
+// no limit in either journal mode, though its connections never run at once.
+//
+// A query runs to the end before its first row is handed over, with every
+// row kept in memory, so the connection goes back to the others in the pool
+// straight away instead of when the rows are closed.
+//
+// Values are handed over as they are stored: int64 for INTEGER columns,
+// float64 for REAL, string for TEXT, []byte for BLOB and nil for NULL.
+// Arguments are bound to ?, ?NNN and :name parameters, named ones by
+// sql.Named("name", value), and a time.Time is bound as RFC 3339 text.
+
+func init() {
+	sql.Register(constants.DRIVER_NAME, &Driver{})
+}
+
+type Driver struct {
+	mutex sync.Mutex
+	// The open databases by data source name
+	databases map[string]*sharedDB
+}
+
+// A DB the driver's connections to one data source name share. Whichever
+// connection is running a statement or has a transaction open holds the
+// owner token, so no connection ever runs inside another one's transaction.
+type sharedDB struct {
+	db          *DB
+	owner       chan struct{}
+	connections int
+}
+
+// The name is the path of the database file, followed by any options. The
+// file is only opened by the first connection to the name.
+func (d *Driver) Open(name string) (driver.Conn, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	shared, ok := d.databases[name]
+	if !ok {
+		fileName, options, err := parseDataSourceName(name)
+		if err != nil {
+			return nil, err
+		}
+		db, err := OpenWithOptions(fileName, options)
+		if err != nil {
+			return nil, err
+		}
+		shared = &sharedDB{db: db, owner: make(chan struct{}, 1)}
+		if d.databases == nil {
+			d.databases = make(map[string]*sharedDB)
+		}
+		d.databases[name] = shared
+	}
+	shared.connections++
+	return &conn{driver: d, name: name, shared: shared, db: shared.db}, nil
+}
+
+// Splits a data source name into the file name and the options after it
+func parseDataSourceName(name string) (string, Options, error) {
+	var options Options
+	fileName, query, found := strings.Cut(name, "?")
+	if !found {
+		return name, options, nil
+	}
+	parameters, err := url.ParseQuery(query)
+	if err != nil {
+		return "", options, errorf(ErrMisuse, "Malformed options in %s: %v.", name, err)
+	}
+	for key, values := range parameters {
+		value := values[len(values)-1]
+		switch key {
+		case "journal_mode":
+			options.JournalMode = value
+		case "cache_size", "busy_timeout":
+			number, err := strconv.Atoi(value)
+			if err != nil {
+				return "", options, errorf(ErrMisuse, "Option %s takes a number, not '%s'.", key, value)
+			}
+			if key == "cache_size" {
+				options.CacheSize = number
+			} else {
+				options.BusyTimeout = time.Duration(number) * time.Millisecond
+			}
+		default:
+			return "", options, errorf(ErrMisuse, "Unknown option %s.", key)
+		}
+	}
+	return fileName, options, nil
+}
+
+func (d *Driver) OpenConnector(name string) (driver.Connector, error) {
+	return &connector{driver: d, name: name}, nil
+}
+
+type connector struct {
+	driver *Driver
+	name   string
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.driver.Open(c.name)
+}
+
+func (c *connector) Driver() driver.Driver {
+	return c.driver
+}
+
+type conn struct {
+	driver *Driver
+	name   string
+	shared *sharedDB
+	db     *DB
+	// Whether the connection keeps the owner token for a transaction it opened
+	owning bool
+}
+
+var (
+	_ driver.ConnPrepareContext = (*conn)(nil)
+	_ driver.ConnBeginTx        = (*conn)(nil)
+	_ driver.ExecerContext      = (*conn)(nil)
+	_ driver.QueryerContext     = (*conn)(nil)
+	_ driver.Pinger             = (*conn)(nil)
+)
+
+// Statements are checked for syntax when they're prepared and against the
+// schema each time they run, since the schema can change in between
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *conn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	prepared, err := c.db.Prepare(query)
+	if err != nil {
+		return nil, connError(err)
+	}
+	return &stmt{conn: c, stmt: prepared}, nil
+}
+
+// A transaction left open is rolled back, and the last connection to the
+// name closes the database
+func (c *conn) Close() error {
+	var err error
+	if c.owning {
+		_, err = c.db.Exec("ROLLBACK")
+		c.owning = false
+		<-c.shared.owner
+	}
+	c.driver.mutex.Lock()
+	defer c.driver.mutex.Unlock()
+	c.shared.connections--
+	if c.shared.connections == 0 {
+		delete(c.driver.databases, c.name)
+		if closeErr := c.db.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Waits for the other connections to finish their statement or transaction
+func (c *conn) acquire(ctx context.Context) error {
+	if c.owning {
+		return nil
+	}
+	select {
+	case c.shared.owner <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Lets the other connections in again, unless the statement left a
+// transaction open
+func (c *conn) release() {
+	if c.owning = c.db.inTransaction(); !c.owning {
+		<-c.shared.owner
+	}
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// Transactions are always serializable since only one connection writes at a time
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	isolation := sql.IsolationLevel(opts.Isolation)
+	if isolation != sql.LevelDefault && isolation != sql.LevelSerializable {
+		return nil, errorf(ErrMisuse, "Isolation level %s is not supported.", isolation)
+	}
+	if opts.ReadOnly {
+		return nil, errorf(ErrMisuse, "Read-only transactions are not supported.")
+	}
+	if _, err := c.ExecContext(ctx, "BEGIN", nil); err != nil {
+		return nil, err
+	}
+	return &tx{conn: c}, nil
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	s, err := c.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	return s.(*stmt).ExecContext(ctx, args)
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	s, err := c.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	return s.(*stmt).QueryContext(ctx, args)
+}
+
+func (c *conn) Ping(ctx context.Context) error {
+	c.db.mutex.Lock()
+	defer c.db.mutex.Unlock()
+	if c.db.database == nil {
+		return driver.ErrBadConn
+	}
+	return ctx.Err()
+}
+
+// A closed connection is reported as bad so the pool drops it
+func connError(err error) error {
+	if err == ErrClosed {
+		return driver.ErrBadConn
+	}
+	return err
+}
+
+type stmt struct {
+	conn *conn
+	stmt *Stmt
+}
+
+var (
+	_ driver.StmtExecContext  = (*stmt)(nil)
+	_ driver.StmtQueryContext = (*stmt)(nil)
+)
+
+func (s *stmt) Close() error {
+	return s.stmt.Close()
+}
+
+func (s *stmt) NumInput() int {
+	return s.stmt.ParameterCount()
+}
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), namedValues(args))
+}
+
+func (s *stmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	if err := s.bind(ctx, args); err != nil {
+		return nil, err
+	}
+	if err := s.conn.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer s.conn.release()
+	if err := s.stmt.run(nil); err != nil {
+		return nil, connError(err)
+	}
+	return driverResult{s.stmt.result}, nil
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), namedValues(args))
+}
+
+func (s *stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	if err := s.bind(ctx, args); err != nil {
+		return nil, err
+	}
+	if err := s.conn.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer s.conn.release()
+	queryRows := &Rows{position: -1}
+	if err := s.stmt.run(queryRows); err != nil {
+		return nil, connError(err)
+	}
+	return &rows{rows: queryRows}, nil
+}
+
+// Binds each argument to the parameter with its name, or its position when
+// it has none
+func (s *stmt) bind(ctx context.Context, args []driver.NamedValue) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for _, arg := range args {
+		index := arg.Ordinal
+		if arg.Name != "" {
+			if index = s.stmt.ParameterIndex(":" + arg.Name); index == 0 {
+				return errorf(ErrMisuse, "No parameter named :%s.", arg.Name)
+			}
+		}
+		value := arg.Value
+		if typed, ok := value.(time.Time); ok {
+			value = typed.Format(time.RFC3339Nano)
+		}
+		if err := s.stmt.Bind(index, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, value := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: value}
+	}
+	return named
+}
+
+type tx struct {
+	conn *conn
+}
+
+func (t *tx) Commit() error {
+	_, err := t.conn.ExecContext(context.Background(), "COMMIT", nil)
+	return err
+}
+
+func (t *tx) Rollback() error {
+	_, err := t.conn.ExecContext(context.Background(), "ROLLBACK", nil)
+	return err
+}
+
+type driverResult struct {
+	result Result
+}
+
+func (r driverResult) LastInsertId() (int64, error) {
+	return r.result.LastInsertId, nil
+}
+
+func (r driverResult) RowsAffected() (int64, error) {
+	return r.result.RowsAffected, nil
+}
+
+// The rows of a query that has already run, read back from memory
+type rows struct {
+	rows *Rows
+}
+
+var (
+	_ driver.RowsColumnTypeDatabaseTypeName = (*rows)(nil)
+	_ driver.RowsColumnTypeScanType         = (*rows)(nil)
+	_ driver.RowsColumnTypeNullable         = (*rows)(nil)
+)
+
+// Go type each column type's values come back as
+var columnScanTypes = map[string]reflect.Type{
+	constants.COLUMN_TYPE_INTEGER: reflect.TypeOf(int64(0)),
+	constants.COLUMN_TYPE_REAL:    reflect.TypeOf(float64(0)),
+	constants.COLUMN_TYPE_TEXT:    reflect.TypeOf(""),
+	constants.COLUMN_TYPE_BLOB:    reflect.TypeOf([]byte(nil)),
+}
+
+func (r *rows) Columns() []string {
+	return r.rows.Columns()
+}
+
+func (r *rows) Close() error {
+	return nil
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	if !r.rows.Next() {
+		return io.EOF
+	}
+	for i, value := range r.rows.Values() {
+		dest[i] = value
+	}
+	return nil
+}
+
+// The declared type of a table column, empty for a computed result column
+func (r *rows) ColumnTypeDatabaseTypeName(index int) string {
+	if column := r.rows.ColumnTypes()[index]; column != nil {
+		return column.Type
+	}
+	return ""
+}
+
+// A computed result column can hold a value of any type
+func (r *rows) ColumnTypeScanType(index int) reflect.Type {
+	if column := r.rows.ColumnTypes()[index]; column != nil {
+		return columnScanTypes[column.Type]
+	}
+	return reflect.TypeOf((*interface{})(nil)).Elem()
+}
+
+func (r *rows) ColumnTypeNullable(index int) (nullable bool, ok bool) {
+	if column := r.rows.ColumnTypes()[index]; column != nil {
+		return !column.NotNull && !column.PrimaryKey, true
+	}
+	return false, false
+}
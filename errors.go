@@ -0,0 +1,81 @@
+package goqlite
+
+import (
+	"fmt"
+
+	"github.com/kris-gaudel/goqlite/internal/engine"
+)
+
+// Error Code
+//
+// Every error goqlite reports is an *Error carrying an ErrorCode. The low
+// byte of a code is its primary code, which says what kind of failure it is,
+// and the extended codes add detail in the bits above, like SQLite's. An
+// ErrorCode is an error itself, so errors.Is(err, ErrConstraint) matches any
+// constraint failure and errors.Is(err, ErrConstraintUnique) only a UNIQUE one.
+// The engine raises the errors, so the codes are defined there and only
+// named again here.
+
+type ErrorCode = engine.ErrorCode
+
+type Error = engine.Error
+
+// Primary codes
+const (
+	// The statement doesn't fit the schema, like a missing table or column
+	ErrError = engine.ErrError
+	// The engine was asked to do something it never should, like change a
+	// page outside of a write
+	ErrInternal   = engine.ErrInternal
+	ErrSyntax     = engine.ErrSyntax
+	ErrConstraint = engine.ErrConstraint
+	// An UPDATE found no row with the key it was given
+	ErrNotFound = engine.ErrNotFound
+	// Another connection is writing
+	ErrBusy = engine.ErrBusy
+	// Another connection changed the schema after the statement was prepared
+	ErrSchema = engine.ErrSchema
+	ErrTooBig = engine.ErrTooBig
+	ErrFull   = engine.ErrFull
+	// A read, write or sync of the database file, its journal or its WAL failed
+	ErrIO = engine.ErrIO
+	// The database file doesn't hold what a database should
+	ErrCorrupt = engine.ErrCorrupt
+	// The API was used the wrong way, like committing without a transaction
+	ErrMisuse = engine.ErrMisuse
+)
+
+// Extended codes
+const (
+	ErrConstraintPrimaryKey = engine.ErrConstraintPrimaryKey
+	ErrConstraintUnique     = engine.ErrConstraintUnique
+
+	ErrTooBigRow      = engine.ErrTooBigRow
+	ErrTooBigIndexKey = engine.ErrTooBigIndexKey
+
+	// Every key up to the largest has been used
+	ErrFullTable = engine.ErrFullTable
+	// The file system ran out of space
+	ErrFullDisk = engine.ErrFullDisk
+
+	ErrIORead     = engine.ErrIORead
+	ErrIOWrite    = engine.ErrIOWrite
+	ErrIOFsync    = engine.ErrIOFsync
+	ErrIOOpen     = engine.ErrIOOpen
+	ErrIOClose    = engine.ErrIOClose
+	ErrIOSeek     = engine.ErrIOSeek
+	ErrIOTruncate = engine.ErrIOTruncate
+	ErrIODelete   = engine.ErrIODelete
+	ErrIOLock     = engine.ErrIOLock
+)
+
+var ErrClosed = errorf(ErrMisuse, "Database is closed.")
+
+// The error's code, or ErrError for an error that didn't come from goqlite
+func ErrorCodeOf(err error) ErrorCode {
+	return engine.ErrorCodeOf(err)
+}
+
+func errorf(code ErrorCode, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
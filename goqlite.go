@@ -0,0 +1,213 @@
+package goqlite
+
+import (
+	"container/list"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kris-gaudel/goqlite/constants"
+	"github.com/kris-gaudel/goqlite/internal/engine"
+)
+
+// Library Code
+//
+// The API for programs that use goqlite as a package instead of through the
+// shell. A DB is one connection to a database file. Every failure comes back
+// as an *Error, whose code says whether the statement was malformed, broke a
+// constraint or ran into trouble with the file.
+
+// A connection to a database file, safe to use from several goroutines
+type DB struct {
+	mutex    sync.Mutex
+	database *engine.Database
+	// Closed statements kept for reuse, most recently closed first, and where
+	// each is in the list by its SQL text
+	statementCache   *list.List
+	cachedStatements map[string]*list.Element
+	busyTimeout      time.Duration
+}
+
+// What a statement run by Exec changed
+type Result struct {
+	// The rowid of the last row an INSERT added
+	LastInsertId int64
+	// How many rows an INSERT, UPDATE or DELETE changed
+	RowsAffected int64
+}
+
+// A column of a table, as declared by CREATE TABLE
+type Column = engine.Column
+
+// The rows a statement run by Query output, read one at a time with Next.
+// Query has already run the statement to the end and kept every row in
+// memory, so a large result is best narrowed down with WHERE.
+type Rows struct {
+	columns []string
+	// The table column each result column reads, nil where it's an expression
+	columnTypes []*Column
+	rows        [][]interface{}
+	position    int
+}
+
+// Settings for OpenWithOptions, where a zero field keeps the default
+type Options struct {
+	// How many pages of the file are kept in memory at most
+	CacheSize int
+	// "delete" for a rollback journal or "wal" for a write-ahead log. The mode
+	// is kept in the file, so it applies to every connection after this one.
+	JournalMode string
+	// How long a statement keeps trying while another connection is writing,
+	// or in rollback journal mode a commit while other connections are
+	// reading, before it gives up with ErrBusy. The connection can't be used
+	// meanwhile.
+	BusyTimeout time.Duration
+}
+
+// Opens the database file, creating it if it doesn't exist
+func Open(fileName string) (*DB, error) {
+	return OpenWithOptions(fileName, Options{})
+}
+
+// Like Open, with settings other than the defaults. Opening waits out another
+// connection's commit for up to the busy timeout as well.
+func OpenWithOptions(fileName string, options Options) (db *DB, err error) {
+	deadline := time.Now().Add(options.BusyTimeout)
+	databaseInstance, err := open(fileName)
+	for errors.Is(err, ErrBusy) && time.Now().Before(deadline) {
+		time.Sleep(constants.BUSY_RETRY_INTERVAL)
+		databaseInstance, err = open(fileName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := configure(databaseInstance, options); err != nil {
+		engine.DBClose(databaseInstance)
+		return nil, err
+	}
+	return &DB{database: databaseInstance, busyTimeout: options.BusyTimeout}, nil
+}
+
+func open(fileName string) (databaseInstance *engine.Database, err error) {
+	defer engine.RecoverError(&err)
+	return engine.DBOpen(fileName), nil
+}
+
+func configure(databaseInstance *engine.Database, options Options) (err error) {
+	defer engine.RecoverError(&err)
+	pagerInstance := databaseInstance.Pager
+	if options.BusyTimeout < 0 {
+		return errorf(ErrMisuse, "Busy timeout %v is negative.", options.BusyTimeout)
+	}
+	if options.CacheSize < 0 {
+		return errorf(ErrMisuse, "Cache size %d is negative.", options.CacheSize)
+	} else if options.CacheSize > 0 {
+		engine.SetCacheSize(pagerInstance, options.CacheSize)
+	}
+	if options.JournalMode != "" {
+		return engine.SetJournalMode(pagerInstance, strings.ToLower(options.JournalMode))
+	}
+	return nil
+}
+
+// Closes the database, rolling back a transaction that was never committed
+func (db *DB) Close() (err error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.database == nil {
+		return ErrClosed
+	}
+	databaseInstance := db.database
+	db.database = nil
+	db.statementCache, db.cachedStatements = nil, nil
+	defer engine.RecoverError(&err)
+	engine.DBClose(databaseInstance)
+	return nil
+}
+
+// Whether a transaction is open on the connection
+func (db *DB) inTransaction() bool {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	return db.database != nil && db.database.Pager.InTransaction
+}
+
+// Runs a statement that doesn't output rows, or ignores the rows it outputs.
+// The arguments are bound to its parameters in order.
+func (db *DB) Exec(sql string, args ...interface{}) (Result, error) {
+	stmt, err := db.Prepare(sql)
+	if err != nil {
+		return Result{}, err
+	}
+	defer stmt.Close()
+	if err := stmt.bindAll(args); err != nil {
+		return Result{}, err
+	}
+	if err := stmt.run(nil); err != nil {
+		return Result{}, err
+	}
+	return stmt.result, nil
+}
+
+// Runs a statement and collects the rows it outputs. The arguments are bound
+// to its parameters in order.
+func (db *DB) Query(sql string, args ...interface{}) (*Rows, error) {
+	stmt, err := db.Prepare(sql)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	if err := stmt.bindAll(args); err != nil {
+		return nil, err
+	}
+	rows := &Rows{position: -1}
+	if err := stmt.run(rows); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// Names the columns after the statement that outputs the rows
+func (rows *Rows) describe(statement *engine.Statement) {
+	if statement.Explain != "" {
+		rows.columns = engine.ExplainColumns(statement)
+	} else {
+		rows.columns = statement.ColumnNames
+	}
+	rows.columnTypes = engine.ResultColumnTypes(statement)
+}
+
+// Keeps a row the machine output, which reuses its registers for the next one
+func (rows *Rows) append(values []interface{}) {
+	row := make([]interface{}, len(values))
+	copy(row, values)
+	rows.rows = append(rows.rows, row)
+}
+
+// The names of the columns, in the order Values returns them
+func (rows *Rows) Columns() []string {
+	return rows.columns
+}
+
+// The table column behind each result column, with its declared type, or nil
+// for a result column computed by an expression
+func (rows *Rows) ColumnTypes() []*Column {
+	return rows.columnTypes
+}
+
+// Moves to the next row, returning false once there are none left
+func (rows *Rows) Next() bool {
+	if rows.position < len(rows.rows) {
+		rows.position++
+	}
+	return rows.position < len(rows.rows)
+}
+
+// The values of the current row: nil, int64, float64, string or []byte
+func (rows *Rows) Values() []interface{} {
+	if rows.position < 0 || rows.position >= len(rows.rows) {
+		return nil
+	}
+	return rows.rows[rows.position]
+}
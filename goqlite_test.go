@@ -0,0 +1,967 @@
+package goqlite
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kris-gaudel/goqlite/constants"
+	"github.com/kris-gaudel/goqlite/internal/engine"
+)
+
+func tempDBFile(t *testing.T) string {
+	return filepath.Join(t.TempDir(), "test.db")
+}
+
+// Opens a new database and gives it the users table the shell starts out with
+func openUsers(t *testing.T, fileName string) *DB {
+	db, err := Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(constants.DEFAULT_TABLE_SQL); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestCorruptPagesAreReported(t *testing.T) {
+	for _, fill := range []byte{0x00, 0x01, 0xff} {
+		fileName := tempDBFile(t)
+		db := openUsers(t, fileName)
+		for id := 1; id <= 300; id++ {
+			if _, err := db.Exec("insert into users values (?, 'name', 'person@example.com')", id); err != nil {
+				t.Fatal(err)
+			}
+		}
+		db.Close()
+
+		// Cell counts and offsets in one of the table's pages are overwritten
+		file, err := os.OpenFile(fileName, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.WriteAt(bytes.Repeat([]byte{fill}, 200), 3*constants.PAGE_SIZE+10)
+		file.Close()
+
+		db, err = Open(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Query("select * from users"); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("Expected a corrupt file error reading pages filled with %#x, got %v", fill, err)
+		}
+		db.Close()
+	}
+}
+
+func TestCorruptCatalogIsReported(t *testing.T) {
+	fileName := tempDBFile(t)
+	db, err := Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("create table people (id integer primary key, name text)"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// The table's SQL in the catalog no longer parses
+	contents, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset := bytes.Index(contents, []byte("create table people"))
+	if offset < 0 {
+		t.Fatal("The catalog row was not found")
+	}
+	file, err := os.OpenFile(fileName, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte("crxate"), int64(offset))
+	file.Close()
+
+	if _, err := Open(fileName); !errors.Is(err, ErrCorrupt) || err.Error() != "Catalog row 1 is unreadable. Corrupt file." {
+		t.Errorf("Expected the catalog row to be reported as corrupt, got %v", err)
+	}
+}
+
+func TestJournalOfAnotherConnectionIsNotHot(t *testing.T) {
+	fileName := tempDBFile(t)
+	writer := openUsers(t, fileName)
+	countUsers := func(db *DB) int {
+		rows, err := db.Query("select * from users")
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := 0
+		for rows.Next() {
+			count++
+		}
+		return count
+	}
+	for _, sql := range []string{
+		"insert into users values (1, 'ann', 'ann@example.com')",
+		"begin",
+		"insert into users values (2, 'bo', 'bo@example.com')",
+		"update users set username = 'anne' where id = 1",
+	} {
+		if _, err := writer.Exec(sql); err != nil {
+			t.Fatalf("%s: %v", sql, err)
+		}
+	}
+
+	// Opening the file must not take the live journal for one left by a crash
+	reader, err := Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fileName + "-journal"); err != nil {
+		t.Fatalf("Journal of an open transaction was removed: %v", err)
+	}
+	if _, err := reader.Exec("insert into users values (3, 'cy', 'cy@example.com')"); !errors.Is(err, ErrBusy) {
+		t.Errorf("Expected a second writer to be refused, got %v", err)
+	}
+	if _, err := writer.Exec("commit"); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	// Each connection picks up what the other committed
+	if count := countUsers(reader); count != 2 {
+		t.Errorf("Reader saw %d rows after the commit, expected 2", count)
+	}
+	if _, err := reader.Exec("insert into users values (3, 'cy', 'cy@example.com')"); err != nil {
+		t.Fatalf("Expected the reader to write once the writer committed, got %v", err)
+	}
+	if _, err := writer.Exec("insert into users values (4, 'di', 'di@example.com')"); err != nil {
+		t.Fatal(err)
+	}
+	if count := countUsers(reader); count != 4 {
+		t.Errorf("Reader saw %d rows, expected 4", count)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rows, err := db.Query("select id from users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []interface{}
+	for rows.Next() {
+		ids = append(ids, rows.Values()[0])
+	}
+	if !reflect.DeepEqual(ids, []interface{}{int64(1), int64(2), int64(3), int64(4)}) {
+		t.Errorf("Database has rows %v", ids)
+	}
+}
+
+func TestAPI(t *testing.T) {
+	fileName := tempDBFile(t)
+	db, err := Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the shell starts a new database out with a table
+	if _, err := db.Query("select * from users"); !errors.Is(err, ErrError) {
+		t.Errorf("Expected a new database to have no users table, got %v", err)
+	}
+	for _, sql := range []string{
+		"create table people (id integer primary key, name text, age int)",
+		"insert into people values (1, 'ann', 30)",
+		"insert into people (id, name) values (2, 'bo')",
+	} {
+		if _, err := db.Exec(sql); err != nil {
+			t.Fatalf("%s: %v", sql, err)
+		}
+	}
+	result, err := db.Exec("insert into people values (7, 'cy', 41)")
+	if err != nil || result != (Result{LastInsertId: 7, RowsAffected: 1}) {
+		t.Fatalf("Unexpected insert result %+v, %v", result, err)
+	}
+	result, err = db.Exec("update people set age = 50 where id = 2")
+	if err != nil || result != (Result{RowsAffected: 1}) {
+		t.Fatalf("Unexpected update result %+v, %v", result, err)
+	}
+
+	rows, err := db.Query("select id, name as who, age * 2 from people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if columns := rows.Columns(); !reflect.DeepEqual(columns, []string{"id", "who", "age * 2"}) {
+		t.Errorf("Unexpected columns %q", columns)
+	}
+	var values [][]interface{}
+	for rows.Next() {
+		values = append(values, rows.Values())
+	}
+	expected := [][]interface{}{{int64(1), "ann", int64(60)}, {int64(2), "bo", int64(100)}, {int64(7), "cy", int64(82)}}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("Unexpected rows %v", values)
+	}
+
+	// EXPLAIN hands its output over as rows instead of printing it
+	rows, err = db.Query("explain query plan select * from people where id = 2")
+	if err != nil || !reflect.DeepEqual(rows.Columns(), []string{"detail"}) || !rows.Next() ||
+		!reflect.DeepEqual(rows.Values(), []interface{}{"SEARCH people USING INTEGER PRIMARY KEY (rowid=?)"}) || rows.Next() {
+		t.Errorf("Unexpected query plan %v, %v", rows, err)
+	}
+
+	// Failures come back as errors, leaving the connection usable
+	_, err = db.Exec("insert into people values (1, 'dup', 1)")
+	if !errors.Is(err, ErrConstraintPrimaryKey) || err.Error() != "Duplicate key." {
+		t.Errorf("Expected a duplicate key error, got %v", err)
+	}
+	_, err = db.Query("select from people")
+	var syntaxError *Error
+	if !errors.As(err, &syntaxError) || syntaxError.Code != ErrSyntax || syntaxError.Line != 1 || syntaxError.Column != 8 {
+		t.Errorf("Expected a syntax error at column 8, got %v", err)
+	}
+	if _, err := db.Query("select * from nobody"); err == nil {
+		t.Errorf("Expected an error selecting from a missing table")
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("select * from people"); err != ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+	if err := db.Close(); err != ErrClosed {
+		t.Errorf("Expected ErrClosed closing twice, got %v", err)
+	}
+
+	// The rows outlive the connection that wrote them
+	db, err = Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rows, err = db.Query("select count(*) from people")
+	if err != nil || !rows.Next() || !reflect.DeepEqual(rows.Values(), []interface{}{int64(3)}) {
+		t.Fatalf("Unexpected count %v, %v", rows, err)
+	}
+}
+
+func TestUpdateAndDeleteWhere(t *testing.T) {
+	db, err := Open(tempDBFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, sql := range []string{
+		"create table t (id integer primary key, name text, age integer)",
+		"create index by_name on t (name)",
+		"insert into t values (1, 'a', 10)",
+		"insert into t values (2, 'b', 99)",
+		"insert into t values (3, 'c', 99)",
+		"insert into t values (4, 'd', 40)",
+	} {
+		if _, err := db.Exec(sql); err != nil {
+			t.Fatalf("%s: %v", sql, err)
+		}
+	}
+	for _, test := range []struct {
+		sql     string
+		changes int64
+	}{
+		{"delete from t where name = 'b'", 1},
+		{"update t set age = 7 where age = 99", 1},
+		{"update t set age = age + 1 where id = 1", 1},
+		{"update t set age = age + 1 where id = 1 and name = 'z'", 0},
+		// Every new value comes from the row as it was
+		{"update t set name = age, age = age * 2 where id > 2", 2},
+		{"update t set age = 5 where age > 1000", 0},
+		{"delete from t where name = '14' or age is null", 0},
+		{"update t set age = age - 1", 3},
+	} {
+		result, err := db.Exec(test.sql)
+		if err != nil || result.RowsAffected != test.changes {
+			t.Errorf("%s: %d rows changed (%v), expected %d", test.sql, result.RowsAffected, err, test.changes)
+		}
+	}
+	if _, err := db.Exec("update t set age = name where id = 1"); err == nil || err.Error() != "Cannot store TEXT in INTEGER column age." {
+		t.Errorf("Expected a type error, got %v", err)
+	}
+
+	rows, err := db.Query("select * from t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values [][]interface{}
+	for rows.Next() {
+		values = append(values, rows.Values())
+	}
+	expected := [][]interface{}{{int64(1), "a", int64(10)}, {int64(3), "7", int64(13)}, {int64(4), "40", int64(79)}}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("Unexpected rows %v", values)
+	}
+	// The index follows the renamed rows
+	rows, err = db.Query("select id from t where name = '40'")
+	if err != nil || !rows.Next() || !reflect.DeepEqual(rows.Values(), []interface{}{int64(4)}) || rows.Next() {
+		t.Errorf("Looking up a renamed row gave %v, %v", rows, err)
+	}
+
+	// Rows found through the index can have the indexed column changed
+	if result, err := db.Exec("update t set name = 'z' where name between '5' and '9'"); err != nil || result.RowsAffected != 1 {
+		t.Errorf("Renaming through the index changed %d rows (%v), expected 1", result.RowsAffected, err)
+	}
+	rows, err = db.Query("select id from t where name = 'z'")
+	if err != nil || !rows.Next() || !reflect.DeepEqual(rows.Values(), []interface{}{int64(3)}) || rows.Next() {
+		t.Errorf("Looking up a renamed row gave %v, %v", rows, err)
+	}
+	if result, err := db.Exec("delete from t where name = 'z'"); err != nil || result.RowsAffected != 1 {
+		t.Errorf("Deleting through the index changed %d rows (%v), expected 1", result.RowsAffected, err)
+	}
+
+	if result, err := db.Exec("delete from t"); err != nil || result.RowsAffected != 2 {
+		t.Errorf("Deleting every row changed %d rows (%v), expected 2", result.RowsAffected, err)
+	}
+}
+
+func TestOpenWithOptions(t *testing.T) {
+	fileName := tempDBFile(t)
+	db, err := OpenWithOptions(fileName, Options{CacheSize: 100, JournalMode: "WAL"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pagerInstance := db.database.Pager; pagerInstance.CacheSize != 100 || engine.JournalMode(pagerInstance) != "wal" {
+		t.Errorf("Options were not applied, cache size %d and journal mode %s", pagerInstance.CacheSize, engine.JournalMode(pagerInstance))
+	}
+	db.Close()
+
+	// The journal mode is kept in the file
+	db, err = Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pagerInstance := db.database.Pager; pagerInstance.CacheSize != constants.DEFAULT_CACHE_SIZE || engine.JournalMode(pagerInstance) != "wal" {
+		t.Errorf("Expected the default cache size in WAL mode, got %d and %s", pagerInstance.CacheSize, engine.JournalMode(pagerInstance))
+	}
+	db.Close()
+
+	if _, err := OpenWithOptions(fileName, Options{JournalMode: "memory"}); !errors.Is(err, ErrError) {
+		t.Errorf("Expected an unknown journal mode to be refused, got %v", err)
+	}
+	if _, err := OpenWithOptions(fileName, Options{CacheSize: -1}); !errors.Is(err, ErrMisuse) {
+		t.Errorf("Expected a negative cache size to be refused, got %v", err)
+	}
+	// Connections turned down are closed again, so the last one out removes the WAL
+	db, err = OpenWithOptions(fileName, Options{JournalMode: "delete"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if _, err := os.Stat(fileName + "-wal"); !os.IsNotExist(err) {
+		t.Errorf("WAL still exists after leaving WAL mode: %v", err)
+	}
+}
+
+func TestBusyTimeout(t *testing.T) {
+	fileName := tempDBFile(t)
+	writer := openUsers(t, fileName)
+	defer writer.Close()
+	waiter, err := OpenWithOptions(fileName, Options{BusyTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer waiter.Close()
+
+	if _, err := writer.Exec("begin"); err != nil {
+		t.Fatal(err)
+	}
+	writer.Exec("insert into users values (1, 'ann', 'ann@example.com')")
+	done := make(chan error)
+	go func() {
+		_, err := waiter.Exec("insert into users values (2, 'bo', 'bo@example.com')")
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if _, err := writer.Exec("commit"); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Expected the write to go through once the other one committed, got %v", err)
+	}
+
+	// Without a timeout the write is turned away straight away
+	writer.Exec("begin")
+	writer.Exec("insert into users values (3, 'cy', 'cy@example.com')")
+	impatient, err := Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer impatient.Close()
+	if _, err := impatient.Exec("insert into users values (4, 'di', 'di@example.com')"); !errors.Is(err, ErrBusy) {
+		t.Errorf("Expected ErrBusy, got %v", err)
+	}
+	writer.Exec("commit")
+}
+
+func TestReadersDuringRollbackJournalWrites(t *testing.T) {
+	fileName := tempDBFile(t)
+	openSmallCache := func() *DB {
+		db, err := OpenWithOptions(fileName, Options{CacheSize: constants.MIN_CACHE_SIZE})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	countUsers := func(db *DB) (int64, error) {
+		rows, err := db.Query("select count(*) from users")
+		if err != nil {
+			return 0, err
+		}
+		rows.Next()
+		return rows.Values()[0].(int64), nil
+	}
+	insertUsers := func(db *DB, low int, high int) {
+		for id := low; id <= high; id++ {
+			if _, err := db.Exec("insert into users values (?, ?, ?)", id, "user", strings.Repeat("e", 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	writer := openUsers(t, fileName)
+	writer.Close()
+	writer = openSmallCache()
+	defer writer.Close()
+	reader := openSmallCache()
+	defer reader.Close()
+	insertUsers(writer, 1, 2000)
+
+	// A reader inside a transaction keeps seeing what was committed when it
+	// started, even though the writer's changes don't fit in its cache
+	if _, err := reader.Exec("begin"); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := countUsers(reader); err != nil || count != 2000 {
+		t.Fatalf("Reader counted %d rows (%v), expected 2000", count, err)
+	}
+	writer.Exec("begin")
+	insertUsers(writer, 2001, 4000)
+	if count, err := countUsers(reader); err != nil || count != 2000 {
+		t.Errorf("Reader counted %d rows (%v) while the writer was inserting, expected 2000", count, err)
+	}
+	if _, err := writer.Exec("commit"); !errors.Is(err, ErrBusy) {
+		t.Errorf("Expected the commit to wait for the reader, got %v", err)
+	}
+	if _, err := reader.Exec("commit"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Exec("commit"); err != nil {
+		t.Fatalf("Commit failed once the reader was done: %v", err)
+	}
+	if count, err := countUsers(reader); err != nil || count != 4000 {
+		t.Errorf("Reader counted %d rows (%v) after the commit, expected 4000", count, err)
+	}
+
+	// Once the writer has spilled pages into the file nobody can read it
+	// until the transaction is over
+	writer.Exec("begin")
+	insertUsers(writer, 4001, 6000)
+	if _, err := countUsers(reader); !errors.Is(err, ErrBusy) {
+		t.Errorf("Expected reading the file the writer is changing to be busy, got %v", err)
+	}
+	if _, err := Open(fileName); !errors.Is(err, ErrBusy) {
+		t.Errorf("Expected opening the file the writer is changing to be busy, got %v", err)
+	}
+	if _, err := writer.Exec("commit"); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := countUsers(reader); err != nil || count != 6000 {
+		t.Errorf("Reader counted %d rows (%v) after the commit, expected 6000", count, err)
+	}
+}
+
+func TestRollbackOfSpilledPagesLeavesNoPhantomRows(t *testing.T) {
+	fileName := tempDBFile(t)
+	writer := openUsers(t, fileName)
+	writer.Close()
+	writer, err := OpenWithOptions(fileName, Options{CacheSize: constants.MIN_CACHE_SIZE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	reader, err := OpenWithOptions(fileName, Options{CacheSize: constants.MIN_CACHE_SIZE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	selectIds := func(db *DB) ([]int64, error) {
+		rows, err := db.Query("select id from users")
+		if err != nil {
+			return nil, err
+		}
+		var ids []int64
+		for rows.Next() {
+			ids = append(ids, rows.Values()[0].(int64))
+		}
+		return ids, nil
+	}
+	for id := 1; id <= 2000; id++ {
+		if _, err := writer.Exec("insert into users values (?, 'user', ?)", id, strings.Repeat("e", 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The reader caches some of the pages as they were before the transaction
+	if ids, err := selectIds(reader); err != nil || len(ids) != 2000 {
+		t.Fatalf("Reader saw %d rows (%v), expected 2000", len(ids), err)
+	}
+
+	// The transaction is big enough to spill into the database file
+	writer.Exec("begin")
+	for id := 2001; id <= 5000; id++ {
+		if _, err := writer.Exec("insert into users values (?, 'user', ?)", id, strings.Repeat("e", 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := writer.Exec("delete from users where id < 1000"); err != nil {
+		t.Fatal(err)
+	}
+	// However often it reads in the middle of it, the reader must not pick
+	// up any of the spilled pages
+	for attempt := 0; attempt < 3; attempt++ {
+		if ids, err := selectIds(reader); err == nil && len(ids) != 2000 {
+			t.Errorf("Reader saw %d rows during the transaction, expected 2000", len(ids))
+		} else if err != nil && !errors.Is(err, ErrBusy) {
+			t.Fatal(err)
+		}
+	}
+	if _, err := writer.Exec("rollback"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, db := range []*DB{reader, writer} {
+		ids, err := selectIds(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) != 2000 || ids[0] != 1 || ids[1999] != 2000 {
+			t.Errorf("Saw %d rows after the rollback, expected ids 1 to 2000", len(ids))
+		}
+	}
+	fresh, err := Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Close()
+	if ids, err := selectIds(fresh); err != nil || len(ids) != 2000 {
+		t.Errorf("A new connection saw %d rows (%v) after the rollback, expected 2000", len(ids), err)
+	}
+}
+
+func TestDriver(t *testing.T) {
+	db, err := sql.Open("goqlite", tempDBFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec("create table people (id integer primary key, name text not null, score real, photo blob)"); err != nil {
+		t.Fatal(err)
+	}
+	result, err := db.Exec("insert into people values (3, 'ann', 1.5, x'cafe')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := result.LastInsertId(); id != 3 {
+		t.Errorf("Expected last insert id 3, got %d", id)
+	}
+	if count, _ := result.RowsAffected(); count != 1 {
+		t.Errorf("Expected 1 row affected, got %d", count)
+	}
+
+	// A rolled back transaction leaves nothing behind, a committed one stays
+	transaction, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	transaction.Exec("insert into people values (4, 'bo', null, null)")
+	if err := transaction.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	transaction, err = db.BeginTx(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transaction.Exec("insert into people values (5, 'cy', null, null)")
+	if err := transaction.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := db.Query("select id, name, score, photo, length(name) from people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	columnTypes, _ := rows.ColumnTypes()
+	var typeNames []string
+	for _, columnType := range columnTypes {
+		typeNames = append(typeNames, columnType.DatabaseTypeName())
+	}
+	if !reflect.DeepEqual(typeNames, []string{"INTEGER", "TEXT", "REAL", "BLOB", ""}) {
+		t.Errorf("Unexpected column types %q", typeNames)
+	}
+	if nullable, ok := columnTypes[2].Nullable(); !nullable || !ok {
+		t.Errorf("Expected score to be nullable")
+	}
+	var people []string
+	for rows.Next() {
+		var id, length int64
+		var name string
+		var score sql.NullFloat64
+		var photo []byte
+		if err := rows.Scan(&id, &name, &score, &photo, &length); err != nil {
+			t.Fatal(err)
+		}
+		people = append(people, fmt.Sprintf("%d %s %v %x %d", id, name, score, photo, length))
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(people, []string{"3 ann {1.5 true} cafe 3", "5 cy {0 false}  2"}) {
+		t.Errorf("Unexpected rows %q", people)
+	}
+
+	var name string
+	if err := db.QueryRowContext(context.Background(), "select name from people where id = 5").Scan(&name); err != nil || name != "cy" {
+		t.Errorf("Unexpected name %q, %v", name, err)
+	}
+	if err := db.QueryRow("select name from people where id = 4").Scan(&name); err != sql.ErrNoRows {
+		t.Errorf("Expected no rows, got %v", err)
+	}
+
+	// Errors come through unchanged
+	_, err = db.Exec("insert into people values (3, 'dup', null, null)")
+	if !errors.Is(err, ErrConstraint) {
+		t.Errorf("Expected a duplicate key error, got %v", err)
+	}
+	if _, err := db.Prepare("select from people"); err == nil {
+		t.Errorf("Expected a syntax error preparing")
+	}
+	if _, err := db.Exec("select * from people where id = ?", 1, 2); err == nil {
+		t.Errorf("Expected too many arguments to be rejected")
+	}
+
+	// Arguments are bound by position or by name
+	if _, err := db.Exec("insert into people values (?, ?, ?, ?)", 6, "dee", 2.5, []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("select name from people where id = :id and score > ?", sql.Named("id", 6), 2.0).Scan(&name); err != nil || name != "dee" {
+		t.Errorf("Unexpected name %q, %v", name, err)
+	}
+	prepared, err := db.Prepare("select count(*) from people where score < ?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int64
+	for _, test := range []struct {
+		score float64
+		count int64
+	}{{2, 1}, {3, 2}, {1, 0}} {
+		if err := prepared.QueryRow(test.score).Scan(&count); err != nil || count != test.count {
+			t.Errorf("Expected %d scores under %v, got %d, %v", test.count, test.score, count, err)
+		}
+	}
+	prepared.Close()
+	if _, err := db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelReadUncommitted}); err == nil {
+		t.Errorf("Expected an unsupported isolation level to be rejected")
+	}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := db.ExecContext(cancelled, "insert into people values (6, 'dee', null, null)"); err != context.Canceled {
+		t.Errorf("Expected the cancelled context's error, got %v", err)
+	}
+}
+
+func TestDriverOptions(t *testing.T) {
+	fileName, options, err := parseDataSourceName("people.db?journal_mode=wal&cache_size=50&busy_timeout=250")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (Options{CacheSize: 50, JournalMode: "wal", BusyTimeout: 250 * time.Millisecond}); fileName != "people.db" || options != expected {
+		t.Errorf("Unexpected file name %s and options %+v", fileName, options)
+	}
+	for _, name := range []string{"people.db?journal=wal", "people.db?cache_size=lots", "people.db?busy_timeout=%zz"} {
+		if _, _, err := parseDataSourceName(name); !errors.Is(err, ErrMisuse) {
+			t.Errorf("Expected %s to be refused, got %v", name, err)
+		}
+	}
+
+	// The options reach the connections the pool opens
+	fileName = tempDBFile(t)
+	db, err := sql.Open("goqlite", fileName+"?journal_mode=wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("create table people (id integer primary key, name text)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fileName + "-wal"); err != nil {
+		t.Errorf("Expected the database to be in WAL mode: %v", err)
+	}
+}
+
+func TestDriverPool(t *testing.T) {
+	db, err := sql.Open("goqlite", tempDBFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("create table people (id integer primary key, name text)"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pooled connections in rollback journal mode take turns, and none of them
+	// sees another one's transaction
+	const workers, inserts = 4, 10
+	errs := make(chan error, workers)
+	for worker := 0; worker < workers; worker++ {
+		go func(worker int) {
+			for i := 0; i < inserts; i++ {
+				transaction, err := db.Begin()
+				if err != nil {
+					errs <- err
+					return
+				}
+				id := worker*inserts + i + 1
+				if _, err := transaction.Exec("insert into people values (?, ?)", id, fmt.Sprint("person ", id)); err != nil {
+					transaction.Rollback()
+					errs <- err
+					return
+				}
+				if i%2 == 0 {
+					err = transaction.Commit()
+				} else {
+					err = transaction.Rollback()
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+				if _, err := db.Exec("select count(*) from people"); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(worker)
+	}
+	for worker := 0; worker < workers; worker++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	var count int64
+	if err := db.QueryRow("select count(*) from people").Scan(&count); err != nil || count != workers*inserts/2 {
+		t.Errorf("Expected %d people, got %d, %v", workers*inserts/2, count, err)
+	}
+
+	// A second connection waits for the first one's transaction to end
+	transaction, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, "insert into people values (100, 'waiting')"); err != context.DeadlineExceeded {
+		t.Errorf("Expected the insert to wait out its context, got %v", err)
+	}
+	if err := transaction.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("insert into people values (100, 'waiting')"); err != nil {
+		t.Errorf("Expected the insert to run after the commit, got %v", err)
+	}
+}
+
+func TestPreparedStatements(t *testing.T) {
+	db, err := Open(tempDBFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("create table people (id integer primary key, name text, age int)"); err != nil {
+		t.Fatal(err)
+	}
+
+	// ? takes the number after the highest so far and a name keeps its number
+	stmt, err := db.Prepare("select ?, :a, ?5, ?, :a, :b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := stmt.ParameterCount(); count != 7 {
+		t.Errorf("Expected 7 parameters, got %d", count)
+	}
+	if index, name := stmt.ParameterIndex(":b"), stmt.ParameterName(2); index != 7 || name != ":a" {
+		t.Errorf("Unexpected parameter %d named %q", index, name)
+	}
+	if index, name := stmt.ParameterIndex(":c"), stmt.ParameterName(1); index != 0 || name != "" {
+		t.Errorf("Unexpected parameter %d named %q", index, name)
+	}
+	stmt.BindInt64(1, 1)
+	stmt.BindText(2, "two")
+	stmt.BindFloat64(5, 2.5)
+	stmt.BindBlob(6, []byte("six"))
+	stmt.Bind(7, true)
+	if ok, err := stmt.Step(); !ok || err != nil {
+		t.Fatalf("Expected a row, got %v", err)
+	}
+	expected := []interface{}{int64(1), "two", 2.5, []byte("six"), "two", int64(1)}
+	if values := stmt.Values(); !reflect.DeepEqual(values, expected) {
+		t.Errorf("Unexpected values %v", values)
+	}
+	if ok, err := stmt.Step(); ok || err != nil {
+		t.Errorf("Expected no more rows, got %v", err)
+	}
+	stmt.Close()
+
+	// One insert runs again and again with new values
+	insert, err := db.Prepare("insert into people values (?1, :name, ?1 * 10)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, name := range []string{"ann", "bo", "cy"} {
+		insert.BindInt64(1, int64(id+1))
+		insert.BindText(2, name)
+		if _, err := insert.Step(); err != nil {
+			t.Fatal(err)
+		}
+		if result := insert.Result(); result != (Result{LastInsertId: int64(id + 1), RowsAffected: 1}) {
+			t.Errorf("Unexpected insert result %+v", result)
+		}
+		if err := insert.Bind(1, 9); !errors.Is(err, ErrMisuse) {
+			t.Errorf("Expected binding before a reset to fail, got %v", err)
+		}
+		insert.Reset()
+	}
+	// Running it again unchanged breaks the primary key, and a reset clears the error
+	if _, err := insert.Step(); !errors.Is(err, ErrConstraintPrimaryKey) {
+		t.Errorf("Expected a duplicate key error, got %v", err)
+	}
+	insert.Reset()
+	insert.ClearBindings()
+	insert.BindInt64(1, 4)
+	if _, err := insert.Step(); err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range []error{insert.Bind(0, 1), insert.Bind(3, 1), insert.Bind(1, struct{}{})} {
+		if !errors.Is(err, ErrMisuse) {
+			t.Errorf("Expected a misuse error, got %v", err)
+		}
+	}
+
+	// Closed statements are reused by their SQL text, without their bindings
+	insert.Close()
+	if _, err := insert.Step(); !errors.Is(err, ErrMisuse) {
+		t.Errorf("Expected a closed statement to fail, got %v", err)
+	}
+	again, err := db.Prepare("insert into people values (?1, :name, ?1 * 10)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == insert || again.node != insert.node {
+		t.Errorf("Expected the parsed statement to be reused")
+	}
+	if _, err := again.Step(); err != nil || again.Result().LastInsertId != 5 {
+		t.Errorf("Expected a NULL id to take the next rowid, got %+v, %v", again.Result(), err)
+	}
+	again.Close()
+
+	// The values are bound, not spliced into the text
+	if _, err := db.Exec("insert into people values (?, ?, ?)", 6, "it's'); drop table people; --", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("insert into people values (?, ?, ?)", 7); !errors.Is(err, ErrMisuse) {
+		t.Errorf("Expected too few values to be rejected, got %v", err)
+	}
+	rows, err := db.Query("select name, age from people where id > ?", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values [][]interface{}
+	for rows.Next() {
+		values = append(values, rows.Values())
+	}
+	bound := [][]interface{}{{nil, int64(40)}, {nil, nil}, {"it's'); drop table people; --", nil}}
+	if !reflect.DeepEqual(values, bound) {
+		t.Errorf("Unexpected rows %v", values)
+	}
+
+	// A statement prepared before the schema changed is checked again
+	count, err := db.Prepare("select count(*) from people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := count.Step(); !ok || !reflect.DeepEqual(count.Values(), []interface{}{int64(6)}) {
+		t.Errorf("Unexpected count %v", count.Values())
+	}
+	if _, err := db.Exec("create index people_name on people (name)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("delete from people where id = ?", 1); err != nil {
+		t.Fatal(err)
+	}
+	count.Reset()
+	if ok, _ := count.Step(); !ok || !reflect.DeepEqual(count.Values(), []interface{}{int64(5)}) {
+		t.Errorf("Unexpected count %v", count.Values())
+	}
+	count.Close()
+
+	// Only the most recently closed statements are kept
+	for i := 0; i <= constants.STATEMENT_CACHE_SIZE; i++ {
+		stmt, err := db.Prepare(fmt.Sprintf("select %d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stmt.Close()
+	}
+	if length := db.statementCache.Len(); length != constants.STATEMENT_CACHE_SIZE {
+		t.Errorf("Expected %d cached statements, got %d", constants.STATEMENT_CACHE_SIZE, length)
+	}
+	if _, ok := db.cachedStatements["select 0"]; ok {
+		t.Errorf("Expected the oldest statement to be dropped")
+	}
+}
+
+func TestErrors(t *testing.T) {
+	db := openUsers(t, tempDBFile(t))
+	defer db.Close()
+	expected := []struct {
+		sql  string
+		code ErrorCode
+	}{
+		{"select * from nobody", ErrError},
+		{"select * frm users", ErrSyntax},
+		{"commit", ErrMisuse},
+		{"update users set username = 'x' where id = 9", ErrNotFound},
+	}
+	for _, test := range expected {
+		if _, err := db.Exec(test.sql); ErrorCodeOf(err) != test.code {
+			t.Errorf("%s: expected code %d, got %v", test.sql, test.code, err)
+		}
+	}
+	db.Exec("create unique index by_name on users (username)")
+	db.Exec("insert into users values (1, 'ann', 'a@example.com')")
+	if _, err := db.Exec("insert into users values (2, 'ann', 'b@example.com')"); !errors.Is(err, ErrConstraintUnique) {
+		t.Errorf("Expected a UNIQUE constraint error, got %v", err)
+	}
+}
@@ -0,0 +1,212 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Aggregate Code
+//
+// An aggregate function folds the rows of a group into a single value. A
+// grouped select steps one aggregator per aggregate call through the rows of
+// each group, then evaluates its result columns, HAVING and ORDER BY once per
+// group, with each call standing for its final value. Like SQLite, aggregates
+// skip NULLs and columns outside an aggregate take their values from the last
+// row of the group.
+
+type Aggregator interface {
+	Step(args []interface{})
+	Final() interface{}
+}
+
+type aggregateFunction struct {
+	MinArgs int
+	MaxArgs int
+	New     func() Aggregator
+}
+
+var aggregateFunctions = map[string]aggregateFunction{
+	// count() and count(*) count every row
+	"count":        {0, 1, func() Aggregator { return &countAggregator{} }},
+	"sum":          {1, 1, func() Aggregator { return &sumAggregator{} }},
+	"avg":          {1, 1, func() Aggregator { return &avgAggregator{} }},
+	"min":          {1, 1, func() Aggregator { return &extremeAggregator{order: -1} }},
+	"max":          {1, 1, func() Aggregator { return &extremeAggregator{order: 1} }},
+	"group_concat": {1, 2, func() Aggregator { return &groupConcatAggregator{} }},
+}
+
+func isAggregate(expression Expression) bool {
+	call, ok := expression.(*FunctionExpr)
+	if !ok {
+		return false
+	}
+	_, ok = aggregateFunctions[call.Name]
+	return ok
+}
+
+// Every aggregate call in an expression, in the order they appear
+func collectAggregates(expression Expression, aggregates []*FunctionExpr) []*FunctionExpr {
+	if expression == nil {
+		return aggregates
+	}
+	walkExpression(expression, func(expression Expression) {
+		if isAggregate(expression) {
+			aggregates = append(aggregates, expression.(*FunctionExpr))
+		}
+	})
+	return aggregates
+}
+
+// count(*) and count() with no argument
+func isCountStar(call *FunctionExpr) bool {
+	return call.Name == "count" && len(call.Args) == 0
+}
+
+type countAggregator struct {
+	count int64
+}
+
+func (aggregator *countAggregator) Step(args []interface{}) {
+	if len(args) == 0 || args[0] != nil {
+		aggregator.count++
+	}
+}
+
+func (aggregator *countAggregator) Final() interface{} {
+	return aggregator.count
+}
+
+// Adds integers until the sum overflows and carries on with reals after that,
+// following the same rule as +. The sum of no values is NULL.
+type sumAggregator struct {
+	sum interface{}
+}
+
+func (aggregator *sumAggregator) Step(args []interface{}) {
+	if args[0] == nil {
+		return
+	}
+	if aggregator.sum == nil {
+		aggregator.sum = int64(0)
+	}
+	aggregator.sum = arithmetic("+", aggregator.sum, args[0])
+}
+
+func (aggregator *sumAggregator) Final() interface{} {
+	return aggregator.sum
+}
+
+type avgAggregator struct {
+	sum   float64
+	count int64
+}
+
+func (aggregator *avgAggregator) Step(args []interface{}) {
+	if args[0] == nil {
+		return
+	}
+	aggregator.sum += realValue(args[0])
+	aggregator.count++
+}
+
+// REAL even when every value was an integer, as in SQLite
+func (aggregator *avgAggregator) Final() interface{} {
+	if aggregator.count == 0 {
+		return nil
+	}
+	return aggregator.sum / float64(aggregator.count)
+}
+
+// Keeps the smallest value for order -1 and the largest for order 1
+type extremeAggregator struct {
+	order int
+	value interface{}
+}
+
+func (aggregator *extremeAggregator) Step(args []interface{}) {
+	if args[0] == nil {
+		return
+	}
+	if aggregator.value == nil || CompareValues(args[0], aggregator.value)*aggregator.order > 0 {
+		aggregator.value = args[0]
+	}
+}
+
+func (aggregator *extremeAggregator) Final() interface{} {
+	return aggregator.value
+}
+
+// Joins values with a comma, or with the separator given as the second argument
+type groupConcatAggregator struct {
+	text    strings.Builder
+	started bool
+}
+
+func (aggregator *groupConcatAggregator) Step(args []interface{}) {
+	if args[0] == nil {
+		return
+	}
+	if aggregator.started {
+		separator := ","
+		if len(args) > 1 {
+			separator = ""
+			if args[1] != nil {
+				separator = textValue(args[1])
+			}
+		}
+		aggregator.text.WriteString(separator)
+	}
+	aggregator.text.WriteString(textValue(args[0]))
+	aggregator.started = true
+}
+
+func (aggregator *groupConcatAggregator) Final() interface{} {
+	if !aggregator.started {
+		return nil
+	}
+	return aggregator.text.String()
+}
+
+// The rows of a select that share the same GROUP BY values
+type rowGroup struct {
+	keys []interface{}
+	// Values of the columns read outside aggregates, taken from the group's last row
+	values      []interface{}
+	aggregators []Aggregator
+}
+
+func newRowGroup(aggregates []*FunctionExpr, keys []interface{}) *rowGroup {
+	group := &rowGroup{keys: keys, aggregators: make([]Aggregator, len(aggregates))}
+	for i, call := range aggregates {
+		group.aggregators[i] = aggregateFunctions[call.Name].New()
+	}
+	return group
+}
+
+// Spells out GROUP BY values so that values which compare equal, like 1 and
+// 1.0, give the same string
+func groupKey(values []interface{}) string {
+	var key strings.Builder
+	for _, value := range values {
+		switch value := value.(type) {
+		case nil:
+			key.WriteString("n")
+		case int64:
+			fmt.Fprintf(&key, "i%d", value)
+		case float64:
+			if value == math.Trunc(value) && value >= math.MinInt64 && value < math.MaxInt64 {
+				fmt.Fprintf(&key, "i%d", int64(value))
+			} else {
+				key.WriteString("r" + strconv.FormatFloat(value, 'g', -1, 64))
+			}
+		case string:
+			fmt.Fprintf(&key, "t%d:%s", len(value), value)
+		case []byte:
+			fmt.Fprintf(&key, "b%d:%s", len(value), value)
+		}
+		key.WriteString(";")
+	}
+	return key.String()
+}
@@ -0,0 +1,268 @@
+package engine
+
+import (
+	"encoding/hex"
+	"strings"
+)
+
+// Syntax Tree Code
+//
+// The parser turns a statement into one of the *Stmt nodes below. Literal
+// values are int64, float64, string, []byte or nil for NULL.
+
+type StatementNode interface {
+	statementNode()
+}
+
+type Expression interface {
+	expressionNode()
+}
+
+type InsertStmt struct {
+	Table string
+	// Empty when the statement doesn't name its columns
+	Columns []string
+	Rows    [][]Expression
+}
+
+type SelectStmt struct {
+	Columns []ResultColumn
+	// Empty for the shorthand "select" that reads the default table
+	From string
+	// Name the rest of the statement refers to From by, empty to use its own name
+	FromAlias string
+	// Tables joined to From, in the order they are written
+	Joins   []JoinClause
+	Where   Expression
+	GroupBy []Expression
+	Having  Expression
+	OrderBy []OrderingTerm
+	Limit   Expression
+	Offset  Expression
+}
+
+type UpdateStmt struct {
+	Table       string
+	Assignments []Assignment
+	Where       Expression
+}
+
+type DeleteStmt struct {
+	Table string
+	Where Expression
+}
+
+type CreateTableStmt struct {
+	Name        string
+	IfNotExists bool
+	Columns     []ColumnDefinition
+}
+
+type CreateIndexStmt struct {
+	// Empty when the statement leaves the name to be made up
+	Name        string
+	Unique      bool
+	IfNotExists bool
+	Table       string
+	Columns     []string
+}
+
+// A statement to describe instead of run
+type ExplainStmt struct {
+	// EXPLAIN QUERY PLAN rather than EXPLAIN
+	QueryPlan bool
+	Statement StatementNode
+}
+
+type BeginStmt struct{}
+
+type CommitStmt struct{}
+
+type RollbackStmt struct{}
+
+// A column of a SELECT's output, Expr is nil for *
+type ResultColumn struct {
+	Expr  Expression
+	Alias string
+}
+
+// A column as declared by CREATE TABLE
+type ColumnDefinition struct {
+	Name string
+	Type string
+	// The n of a type written as TEXT(n), 0 if there was none
+	Length     int
+	PrimaryKey bool
+	NotNull    bool
+}
+
+// A table joined onto the ones before it in a FROM clause
+type JoinClause struct {
+	// "INNER", "LEFT" or "CROSS", a comma between tables is a CROSS join
+	Kind  string
+	Table string
+	Alias string
+	// nil when the join has no ON clause
+	On Expression
+	// Columns named by USING, which must be in the joined table and the ones before it
+	Using []string
+}
+
+type OrderingTerm struct {
+	Expr       Expression
+	Descending bool
+}
+
+type Assignment struct {
+	Column string
+	Value  Expression
+}
+
+type LiteralExpr struct {
+	Value interface{}
+}
+
+// A placeholder for a value bound before the statement runs, which reads as
+// NULL until one is
+type ParameterExpr struct {
+	// Number of the parameter, counting from 1. Placeholders with the same
+	// name or number share one.
+	Index int
+	// As written: "?", "?NNN" or ":name"
+	Name  string
+	Value interface{}
+}
+
+type ColumnExpr struct {
+	// Empty unless the column is qualified as table.column
+	Table  string
+	Column string
+}
+
+type UnaryExpr struct {
+	// One of "-", "+" or "NOT"
+	Operator string
+	Operand  Expression
+}
+
+type BinaryExpr struct {
+	// A comparison or arithmetic operator as written, or "AND", "OR", "LIKE" or "||"
+	Operator string
+	Left     Expression
+	Right    Expression
+}
+
+type BetweenExpr struct {
+	Operand Expression
+	Low     Expression
+	High    Expression
+	Not     bool
+}
+
+type InExpr struct {
+	Operand Expression
+	Values  []Expression
+	Not     bool
+}
+
+type IsNullExpr struct {
+	Operand Expression
+	Not     bool
+}
+
+type FunctionExpr struct {
+	Name string
+	Args []Expression
+	// Set for name(*), as in count(*)
+	Star bool
+}
+
+func (*InsertStmt) statementNode()      {}
+func (*SelectStmt) statementNode()      {}
+func (*UpdateStmt) statementNode()      {}
+func (*DeleteStmt) statementNode()      {}
+func (*CreateTableStmt) statementNode() {}
+func (*CreateIndexStmt) statementNode() {}
+func (*ExplainStmt) statementNode()     {}
+func (*BeginStmt) statementNode()       {}
+func (*CommitStmt) statementNode()      {}
+func (*RollbackStmt) statementNode()    {}
+
+func (*LiteralExpr) expressionNode()   {}
+func (*ColumnExpr) expressionNode()    {}
+func (*UnaryExpr) expressionNode()     {}
+func (*BinaryExpr) expressionNode()    {}
+func (*BetweenExpr) expressionNode()   {}
+func (*InExpr) expressionNode()        {}
+func (*IsNullExpr) expressionNode()    {}
+func (*ParameterExpr) expressionNode() {}
+func (*FunctionExpr) expressionNode()  {}
+
+// Writes an expression back out as SQL, which names the result columns that
+// have no alias. Operands that are themselves made of operators are
+// parenthesized, so the text may have more parentheses than the statement did.
+func FormatExpression(expression Expression) string {
+	switch expression := expression.(type) {
+	case *ParameterExpr:
+		return expression.Name
+	case *LiteralExpr:
+		switch value := expression.Value.(type) {
+		case string:
+			return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+		case []byte:
+			return "X'" + strings.ToUpper(hex.EncodeToString(value)) + "'"
+		}
+		return FormatValue(expression.Value)
+	case *ColumnExpr:
+		if expression.Table != "" {
+			return expression.Table + "." + expression.Column
+		}
+		return expression.Column
+	case *UnaryExpr:
+		if expression.Operator == "NOT" {
+			return "NOT " + formatSubexpression(expression.Operand)
+		}
+		return expression.Operator + formatSubexpression(expression.Operand)
+	case *BinaryExpr:
+		return formatSubexpression(expression.Left) + " " + expression.Operator + " " + formatSubexpression(expression.Right)
+	case *BetweenExpr:
+		return formatSubexpression(expression.Operand) + notText(expression.Not) + " BETWEEN " +
+			formatSubexpression(expression.Low) + " AND " + formatSubexpression(expression.High)
+	case *InExpr:
+		values := make([]string, len(expression.Values))
+		for i, value := range expression.Values {
+			values[i] = FormatExpression(value)
+		}
+		return formatSubexpression(expression.Operand) + notText(expression.Not) + " IN (" + strings.Join(values, ", ") + ")"
+	case *IsNullExpr:
+		if expression.Not {
+			return formatSubexpression(expression.Operand) + " IS NOT NULL"
+		}
+		return formatSubexpression(expression.Operand) + " IS NULL"
+	case *FunctionExpr:
+		if expression.Star {
+			return expression.Name + "(*)"
+		}
+		args := make([]string, len(expression.Args))
+		for i, arg := range expression.Args {
+			args[i] = FormatExpression(arg)
+		}
+		return expression.Name + "(" + strings.Join(args, ", ") + ")"
+	}
+	return ""
+}
+
+func formatSubexpression(expression Expression) string {
+	switch expression.(type) {
+	case *BinaryExpr, *BetweenExpr, *InExpr, *IsNullExpr:
+		return "(" + FormatExpression(expression) + ")"
+	}
+	return FormatExpression(expression)
+}
+
+func notText(not bool) string {
+	if not {
+		return " NOT"
+	}
+	return ""
+}
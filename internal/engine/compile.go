@@ -0,0 +1,705 @@
+package engine
+
+import (
+	"math"
+	"sort"
+
+	"github.com/kris-gaudel/goqlite/constants"
+)
+
+// Compile Code
+//
+// Turns a prepared statement into a program for the virtual machine. A select
+// becomes one loop per table, nested in FROM order, around the code for its
+// WHERE clause and result columns. Grouped selects fold rows into groups
+// inside the loops and output the groups in a loop of their own afterwards,
+// and ORDER BY sends rows through a sorter that a last loop reads back. An
+// update or delete loops over its table like a select to collect the rowids
+// of the rows it matches, then changes those rows in a second loop.
+// Jumps to code that hasn't been emitted yet are patched once it has.
+
+type compiler struct {
+	program *Program
+	table   *Table
+	// Cursor reading each joined table, or just the table for a plain select
+	cursors []int
+	// Registers that stand for expressions, like aggregate calls once a group
+	// has been folded
+	overrides map[Expression]int
+	// Jumps from the innermost body of a join to be pointed at the next row
+	pending []int
+}
+
+func newCompiler(tableInstance *Table) *compiler {
+	return &compiler{program: &Program{}, table: tableInstance, overrides: make(map[Expression]int)}
+}
+
+// Appends an instruction and returns its address
+func (c *compiler) emit(opcode string, p1 int, p2 int, p3 int, p4 interface{}) int {
+	c.program.Instructions = append(c.program.Instructions, Instruction{Opcode: opcode, P1: p1, P2: p2, P3: p3, P4: p4})
+	return len(c.program.Instructions) - 1
+}
+
+// Like emit, with a P5
+func (c *compiler) emit5(opcode string, p1 int, p2 int, p3 int, p4 interface{}, p5 int) int {
+	address := c.emit(opcode, p1, p2, p3, p4)
+	c.program.Instructions[address].P5 = p5
+	return address
+}
+
+// Address of the next instruction
+func (c *compiler) here() int {
+	return len(c.program.Instructions)
+}
+
+// Points the jumps at the given addresses to the next instruction
+func (c *compiler) patch(addresses ...int) {
+	for _, address := range addresses {
+		c.program.Instructions[address].P2 = c.here()
+	}
+}
+
+// Reserves n registers in a row and returns the first
+func (c *compiler) allocate(n int) int {
+	first := c.program.NumRegisters
+	c.program.NumRegisters += n
+	return first
+}
+
+func (c *compiler) openCursor(opcode string, target interface{}) int {
+	cursor := c.program.NumCursors
+	c.program.NumCursors++
+	c.emit(opcode, cursor, 0, 0, target)
+	return cursor
+}
+
+// Emits code leaving the value of an expression that has passed
+// CheckExpression in the target register
+func (c *compiler) expression(expression Expression, target int) {
+	if register, ok := c.overrides[expression]; ok {
+		c.emit(constants.OP_COPY, register, target, 1, nil)
+		return
+	}
+	switch expression := expression.(type) {
+	case *LiteralExpr:
+		c.emit(constants.OP_VALUE, 0, target, 0, expression.Value)
+	case *ParameterExpr:
+		// Statements are prepared again whenever their bindings change
+		c.emit(constants.OP_VALUE, 0, target, 0, expression.Value)
+	case *ColumnExpr:
+		c.column(expression, target)
+	case *UnaryExpr:
+		c.expression(expression.Operand, target)
+		switch expression.Operator {
+		case "NOT":
+			c.emit(constants.OP_NOT, target, target, 0, nil)
+		case "-":
+			c.emit(constants.OP_NEGATIVE, target, target, 0, nil)
+		}
+	case *BinaryExpr:
+		left := c.allocate(2)
+		right := left + 1
+		c.expression(expression.Left, left)
+		c.expression(expression.Right, right)
+		switch expression.Operator {
+		case "AND":
+			c.emit(constants.OP_AND, left, right, target, nil)
+		case "OR":
+			c.emit(constants.OP_OR, left, right, target, nil)
+		default:
+			c.emit5(constants.OP_BINARY, left, right, target, expression.Operator, flag(comparesNumerically(c.table, expression.Operator, expression.Left, expression.Right)))
+		}
+	case *BetweenExpr:
+		operands := c.allocate(5)
+		c.expression(expression.Operand, operands)
+		c.expression(expression.Low, operands+1)
+		c.expression(expression.High, operands+2)
+		numeric := flag(betweenNumerically(c.table, expression))
+		c.emit5(constants.OP_BINARY, operands, operands+1, operands+3, ">=", numeric)
+		c.emit5(constants.OP_BINARY, operands, operands+2, operands+4, "<=", numeric)
+		c.emit(constants.OP_AND, operands+3, operands+4, target, nil)
+		if expression.Not {
+			c.emit(constants.OP_NOT, target, target, 0, nil)
+		}
+	case *InExpr:
+		// The operand is followed by the values it is looked for among
+		operands := c.allocate(len(expression.Values) + 1)
+		c.expression(expression.Operand, operands)
+		for i, value := range expression.Values {
+			c.expression(value, operands+1+i)
+		}
+		c.emit5(constants.OP_IN, operands, target, len(expression.Values), nil, flag(expression.Not))
+	case *IsNullExpr:
+		operand := c.allocate(1)
+		c.expression(expression.Operand, operand)
+		c.emit5(constants.OP_TEST_NULL, operand, target, 0, nil, flag(expression.Not))
+	case *FunctionExpr:
+		args := c.allocate(len(expression.Args))
+		for i, arg := range expression.Args {
+			c.expression(arg, args+i)
+		}
+		c.emit(constants.OP_FUNCTION, args, len(expression.Args), target, expression.Name)
+	}
+}
+
+func flag(set bool) int {
+	if set {
+		return 1
+	}
+	return 0
+}
+
+// Reads a column from the cursor of the table it belongs to. A table's own
+// columns win over rowid, as in rowColumnValue.
+func (c *compiler) column(expression *ColumnExpr, target int) {
+	cursor, position := c.cursors[0], ColumnIndex(c.table, expression.Column)
+	if c.table.Sources != nil {
+		joinPosition, _ := joinColumnPosition(c.table, expression)
+		i := sourceAt(c.table, joinPosition)
+		cursor, position = c.cursors[i], joinPosition-c.table.Sources[i].Offset
+		if position == len(c.table.Sources[i].Table.Columns) {
+			position = -1
+		}
+	}
+	if position < 0 {
+		c.emit(constants.OP_ROWID, cursor, target, 0, nil)
+	} else {
+		c.emit(constants.OP_COLUMN, cursor, position, target, nil)
+	}
+}
+
+// Emits code that jumps when the condition isn't true and returns the jump
+func (c *compiler) condition(expression Expression) int {
+	register := c.allocate(1)
+	c.expression(expression, register)
+	return c.emit(constants.OP_IF_NOT, register, 0, 0, nil)
+}
+
+// Registers holding the given constants
+func (c *compiler) constants(values []interface{}) int {
+	first := c.allocate(len(values))
+	for i, value := range values {
+		c.emit(constants.OP_VALUE, 0, first+i, 0, value)
+	}
+	return first
+}
+
+// Compiles a statement prepared by PrepareStatement, or put together by hand
+// for the given table. Returns nil for statements the machine doesn't run.
+func CompileStatement(statement *Statement, tableInstance *Table) *Program {
+	switch statement.Type {
+	case constants.STATEMENT_INSERT:
+		return compileInsert(statement, tableInstance)
+	case constants.STATEMENT_SELECT:
+		return compileSelect(statement, tableInstance)
+	case constants.STATEMENT_UPDATE:
+		return compileUpdate(statement, tableInstance)
+	case constants.STATEMENT_DELETE:
+		return compileDelete(statement, tableInstance)
+	}
+	return nil
+}
+
+func compileSelect(statement *Statement, tableInstance *Table) *Program {
+	c := newCompiler(tableInstance)
+	grouped := len(statement.GroupBy) > 0 || len(statement.Aggregates) > 0
+	sorted := len(statement.OrderBy) > 0
+	// Jumps to the end, once LIMIT rows have been output
+	var done []int
+
+	limit, offset := -1, -1
+	if statement.Limit >= 0 {
+		limit = c.allocate(1)
+		c.emit(constants.OP_INTEGER, int(statement.Limit), limit, 0, nil)
+		done = append(done, c.emit(constants.OP_IF_NOT, limit, 0, 0, nil))
+	}
+	if statement.Offset > 0 {
+		offset = c.allocate(1)
+		c.emit(constants.OP_INTEGER, int(statement.Offset), offset, 0, nil)
+	}
+	resultColumns := c.allocate(len(statement.ResultColumns))
+	outputRow := func() {
+		skip := -1
+		if offset >= 0 {
+			skip = c.emit(constants.OP_IF_POS, offset, 0, 0, nil)
+		}
+		c.emit(constants.OP_RESULT_ROW, resultColumns, len(statement.ResultColumns), 0, nil)
+		if limit >= 0 {
+			done = append(done, c.emit(constants.OP_DECR_JUMP_ZERO, limit, 0, 0, nil))
+		}
+		if skip >= 0 {
+			c.patch(skip)
+		}
+	}
+	descending := make([]bool, len(statement.OrderBy))
+	for i, term := range statement.OrderBy {
+		descending[i] = term.Descending
+	}
+	// Outputs the result columns, or hands them to the sorter with their ORDER BY values
+	output := func() {
+		for i, expression := range statement.ResultColumns {
+			c.expression(expression, resultColumns+i)
+		}
+		if !sorted {
+			outputRow()
+			return
+		}
+		keys := c.allocate(len(statement.OrderBy))
+		for i, term := range statement.OrderBy {
+			c.expression(term.Expr, keys+i)
+		}
+		c.emit(constants.OP_SORTER_INSERT, resultColumns, len(statement.ResultColumns), keys, descending)
+	}
+
+	// Columns read outside aggregates are saved with each group
+	var bareColumns []Expression
+	expressions := append([]Expression{statement.Having}, statement.ResultColumns...)
+	for _, term := range statement.OrderBy {
+		expressions = append(expressions, term.Expr)
+	}
+	for _, expression := range expressions {
+		bareColumns = collectBareColumns(expression, bareColumns)
+	}
+	// Folds the row the loops are on into its group
+	step := func() {
+		keys := c.allocate(len(statement.GroupBy))
+		for i, expression := range statement.GroupBy {
+			c.expression(expression, keys+i)
+		}
+		c.emit(constants.OP_GROUP_FIND, keys, len(statement.GroupBy), 0, statement.Aggregates)
+		for i, call := range statement.Aggregates {
+			args := c.allocate(len(call.Args))
+			for j, arg := range call.Args {
+				c.expression(arg, args+j)
+			}
+			c.emit(constants.OP_AGG_STEP, i, args, len(call.Args), nil)
+		}
+		values := c.allocate(len(bareColumns))
+		for i, column := range bareColumns {
+			c.expression(column, values+i)
+		}
+		c.emit(constants.OP_GROUP_SAVE, values, len(bareColumns), 0, nil)
+	}
+
+	if tableInstance != nil {
+		if tableInstance.Sources != nil {
+			for _, source := range tableInstance.Sources {
+				if source.Access == constants.JOIN_ACCESS_HASH {
+					c.cursors = append(c.cursors, c.program.NumCursors)
+					c.program.NumCursors++
+					c.emit(constants.OP_HASH_BUILD, c.cursors[len(c.cursors)-1], 0, 0, source)
+				} else {
+					c.cursors = append(c.cursors, c.openCursor(constants.OP_OPEN_READ, source.Table))
+				}
+			}
+		} else {
+			c.cursors = []int{c.openCursor(constants.OP_OPEN_READ, tableInstance)}
+		}
+	}
+
+	if statement.CountFromLeaves {
+		// Every aggregate is count(*), so the cell counts of the leaves are
+		// enough and no row is read
+		count := c.allocate(1)
+		c.emit(constants.OP_COUNT, c.cursors[0], count, 0, nil)
+		for _, call := range statement.Aggregates {
+			c.overrides[call] = count
+		}
+		skip := -1
+		if statement.Having != nil {
+			skip = c.condition(statement.Having)
+		}
+		output()
+		if skip >= 0 {
+			c.patch(skip)
+		}
+	} else {
+		body := func() []int {
+			var next []int
+			if statement.Where != nil {
+				next = append(next, c.condition(statement.Where))
+			}
+			if grouped {
+				step()
+			} else {
+				output()
+			}
+			return next
+		}
+		switch {
+		case tableInstance == nil:
+			// A select without FROM outputs a single row
+			c.patch(body()...)
+		case tableInstance.Sources != nil:
+			c.joinLoop(0, body)
+		default:
+			c.tableLoop(statement, body)
+		}
+	}
+
+	if grouped && !statement.CountFromLeaves {
+		values, aggregates := c.allocate(len(bareColumns)), c.allocate(len(statement.Aggregates))
+		for i, column := range bareColumns {
+			c.overrides[column] = values + i
+		}
+		for i, call := range statement.Aggregates {
+			c.overrides[call] = aggregates + i
+		}
+		c.emit(constants.OP_GROUP_SORT, flag(len(statement.GroupBy) == 0), len(bareColumns), 0, statement.Aggregates)
+		top := c.emit(constants.OP_GROUP_NEXT, values, 0, aggregates, nil)
+		if statement.Having != nil {
+			c.program.Instructions[c.condition(statement.Having)].P2 = top
+		}
+		output()
+		c.emit(constants.OP_GOTO, 0, top, 0, nil)
+		c.patch(top)
+	}
+
+	if sorted {
+		c.emit(constants.OP_SORTER_SORT, 0, 0, 0, descending)
+		top := c.emit(constants.OP_SORTER_NEXT, resultColumns, 0, 0, nil)
+		outputRow()
+		c.emit(constants.OP_GOTO, 0, top, 0, nil)
+		c.patch(top)
+	}
+
+	c.patch(done...)
+	c.emit(constants.OP_HALT, 0, 0, 0, nil)
+	return c.program
+}
+
+// Columns an expression reads outside of aggregate calls
+func collectBareColumns(expression Expression, columns []Expression) []Expression {
+	switch expression := expression.(type) {
+	case nil:
+	case *ColumnExpr:
+		for _, column := range columns {
+			if column == expression {
+				return columns
+			}
+		}
+		columns = append(columns, expression)
+	case *FunctionExpr:
+		if !isAggregate(expression) {
+			for _, arg := range expression.Args {
+				columns = collectBareColumns(arg, columns)
+			}
+		}
+	case *UnaryExpr:
+		columns = collectBareColumns(expression.Operand, columns)
+	case *BinaryExpr:
+		columns = collectBareColumns(expression.Right, collectBareColumns(expression.Left, columns))
+	case *BetweenExpr:
+		columns = collectBareColumns(expression.Operand, columns)
+		columns = collectBareColumns(expression.High, collectBareColumns(expression.Low, columns))
+	case *InExpr:
+		columns = collectBareColumns(expression.Operand, columns)
+		for _, value := range expression.Values {
+			columns = collectBareColumns(value, columns)
+		}
+	case *IsNullExpr:
+		columns = collectBareColumns(expression.Operand, columns)
+	}
+	return columns
+}
+
+// Loops over the rows of a single table, through the index or over the key
+// range the statement was planned with. The body returns jumps to be pointed
+// at the next row.
+func (c *compiler) tableLoop(statement *Statement, body func() []int) {
+	cursor := c.cursors[0]
+	if statement.Index != nil {
+		// Each index entry in range leads to its row by rowid
+		index := c.openCursor(constants.OP_OPEN_READ, statement.Index)
+		var exits []int
+		if statement.IndexLow != nil {
+			low := c.constants(statement.IndexLow)
+			exits = append(exits, c.emit5(constants.OP_SEEK_GE, index, 0, low, nil, len(statement.IndexLow)))
+		} else {
+			exits = append(exits, c.emit(constants.OP_REWIND, index, 0, 0, nil))
+		}
+		high := c.constants(statement.IndexHigh)
+		rowid := c.allocate(1)
+		top := c.here()
+		if statement.IndexHigh != nil {
+			exits = append(exits, c.emit5(constants.OP_IDX_GT, index, 0, high, nil, len(statement.IndexHigh)))
+		}
+		c.emit(constants.OP_IDX_ROWID, index, rowid, 0, nil)
+		next := []int{c.emit(constants.OP_SEEK_ROWID, cursor, 0, rowid, nil)}
+		next = append(next, body()...)
+		c.patch(next...)
+		c.emit(constants.OP_NEXT, index, top, 0, nil)
+		c.patch(exits...)
+		return
+	}
+	if statement.KeyLow > statement.KeyHigh {
+		return
+	}
+
+	// Only the rows in the key range are read, seeking straight to the first
+	low, key := c.allocate(1), c.allocate(1)
+	high := c.allocate(1)
+	c.emit(constants.OP_INTEGER, int(statement.KeyLow), low, 0, nil)
+	c.emit(constants.OP_INTEGER, int(statement.KeyHigh), high, 0, nil)
+	exits := []int{c.emit(constants.OP_SEEK_GE, cursor, 0, low, nil)}
+	top := c.here()
+	if statement.KeyHigh < math.MaxUint32 {
+		c.emit(constants.OP_ROWID, cursor, key, 0, nil)
+		exits = append(exits, c.emit(constants.OP_GT, key, 0, high, nil))
+	}
+	c.patch(body()...)
+	c.emit(constants.OP_NEXT, cursor, top, 0, nil)
+	c.patch(exits...)
+}
+
+// Loops over the rows of the joined table at the given level for each
+// combination of rows of the tables before it, and over the tables after it
+// inside that. The innermost body returns jumps to be pointed at the next row.
+func (c *compiler) joinLoop(level int, body func() []int) {
+	if level == len(c.table.Sources) {
+		// The body's jumps are patched by the caller, at the innermost next row
+		c.pending = body()
+		return
+	}
+	source := c.table.Sources[level]
+	cursor := c.cursors[level]
+	left := source.Kind == "LEFT"
+	matched := 0
+	if left {
+		matched = c.allocate(1)
+		c.emit(constants.OP_INTEGER, 0, matched, 0, nil)
+	}
+
+	// Jumps to where the table has no more rows
+	var exits []int
+	lookup := c.allocate(len(source.LookupValues))
+	for i, value := range source.LookupValues {
+		c.expression(value, lookup+i)
+	}
+	index, rowid := -1, c.allocate(1)
+	switch source.Access {
+	case constants.JOIN_ACCESS_ROWID:
+		exits = append(exits, c.emit(constants.OP_SEEK_ROWID, cursor, 0, lookup, nil))
+	case constants.JOIN_ACCESS_INDEX:
+		index = c.openCursor(constants.OP_OPEN_READ, source.Index)
+		for i := range source.LookupValues {
+			// NULL is never equal to anything
+			exits = append(exits, c.emit(constants.OP_IS_NULL, lookup+i, 0, 0, nil))
+		}
+		exits = append(exits, c.emit5(constants.OP_SEEK_GE, index, 0, lookup, nil, len(source.LookupValues)))
+	case constants.JOIN_ACCESS_HASH:
+		exits = append(exits, c.emit5(constants.OP_HASH_PROBE, cursor, 0, lookup, nil, len(source.LookupValues)))
+	default:
+		exits = append(exits, c.emit(constants.OP_REWIND, cursor, 0, 0, nil))
+	}
+
+	top := c.here()
+	var next []int
+	if index >= 0 {
+		exits = append(exits, c.emit5(constants.OP_IDX_GT, index, 0, lookup, nil, len(source.LookupValues)))
+		c.emit(constants.OP_IDX_ROWID, index, rowid, 0, nil)
+		next = append(next, c.emit(constants.OP_SEEK_ROWID, cursor, 0, rowid, nil))
+	}
+	if source.On != nil {
+		next = append(next, c.condition(source.On))
+	}
+	if left {
+		c.emit(constants.OP_INTEGER, 1, matched, 0, nil)
+	}
+	inner := c.here()
+	c.joinLoop(level+1, body)
+	next = append(next, c.pending...)
+	c.pending = nil
+
+	c.patch(next...)
+	nullRowDone := -1
+	if left {
+		// The row of NULLs a LEFT join falls back on is its only row
+		nullRowDone = c.emit(constants.OP_IF_NULL_ROW, cursor, 0, 0, nil)
+	}
+	switch source.Access {
+	case constants.JOIN_ACCESS_INDEX:
+		c.emit(constants.OP_NEXT, index, top, 0, nil)
+	case constants.JOIN_ACCESS_SCAN, constants.JOIN_ACCESS_HASH:
+		c.emit(constants.OP_NEXT, cursor, top, 0, nil)
+	}
+	c.patch(exits...)
+	if left {
+		// A LEFT join with no matching row joins a row of NULLs instead
+		found := c.emit(constants.OP_IF, matched, 0, 0, nil)
+		c.emit(constants.OP_NULL_ROW, cursor, 0, 0, nil)
+		c.emit(constants.OP_INTEGER, 1, matched, 0, nil)
+		c.emit(constants.OP_GOTO, 0, inner, 0, nil)
+		c.patch(found, nullRowDone)
+	}
+}
+
+func compileInsert(statement *Statement, tableInstance *Table) *Program {
+	c := newCompiler(tableInstance)
+	cursor := c.openCursor(constants.OP_OPEN_WRITE, tableInstance)
+	row := statement.RowToInsert
+	values, key, record := c.constants(row.Values), c.allocate(1), c.allocate(1)
+
+	if row.Key == 0 {
+		c.emit(constants.OP_NEW_ROWID, cursor, key, 0, nil)
+	} else {
+		c.emit(constants.OP_INTEGER, int(row.Key), key, 0, nil)
+	}
+	c.emit(constants.OP_MAKE_RECORD, values, len(row.Values), record, tableInstance)
+	if row.Key != 0 {
+		absent := c.emit(constants.OP_SEEK_ROWID, cursor, 0, key, nil)
+		c.emit(constants.OP_HALT, 0, 0, 0, ErrConstraintPrimaryKey)
+		c.patch(absent)
+	}
+
+	// Every index key is checked before anything is written
+	indexes := c.openIndexes(tableInstance)
+	keys := c.indexKeys(tableInstance, values, key)
+	for i, indexInstance := range tableInstance.Indexes {
+		c.emit(constants.OP_IDX_CHECK, indexes[i], keys[i], len(indexInstance.Columns)+1, nil)
+	}
+	c.emit5(constants.OP_INSERT, cursor, record, key, nil, 1)
+	for i, indexInstance := range tableInstance.Indexes {
+		c.emit(constants.OP_IDX_INSERT, indexes[i], keys[i], len(indexInstance.Columns)+1, nil)
+	}
+	c.emit(constants.OP_HALT, 0, 0, 0, nil)
+	return c.program
+}
+
+// Opens a cursor on each of the table's indexes
+func (c *compiler) openIndexes(tableInstance *Table) []int {
+	cursors := make([]int, len(tableInstance.Indexes))
+	for i, indexInstance := range tableInstance.Indexes {
+		cursors[i] = c.openCursor(constants.OP_OPEN_WRITE, indexInstance)
+	}
+	return cursors
+}
+
+// Emits code putting together the key a row has in each of its table's
+// indexes, going by the row's values in registers and its key. Returns the
+// first register of each key.
+func (c *compiler) indexKeys(tableInstance *Table, values int, key int) []int {
+	keys := make([]int, len(tableInstance.Indexes))
+	for i, indexInstance := range tableInstance.Indexes {
+		keys[i] = c.allocate(len(indexInstance.Columns) + 1)
+		for j, position := range indexInstance.Columns {
+			if position == tableInstance.KeyColumn {
+				c.emit(constants.OP_COPY, key, keys[i]+j, 1, nil)
+			} else {
+				c.emit(constants.OP_COPY, values+position, keys[i]+j, 1, nil)
+			}
+		}
+		c.emit(constants.OP_COPY, key, keys[i]+len(indexInstance.Columns), 1, nil)
+	}
+	return keys
+}
+
+// Deletes every row the WHERE clause matches
+func compileDelete(statement *Statement, tableInstance *Table) *Program {
+	c := newCompiler(tableInstance)
+	c.collectRowids(statement)
+	c.changeRows(func(cursor int, indexes []int, key int) {
+		if len(tableInstance.Indexes) > 0 {
+			values := c.allocate(len(tableInstance.Columns))
+			for i := range tableInstance.Columns {
+				c.emit(constants.OP_COLUMN, cursor, i, values+i, nil)
+			}
+			keys := c.indexKeys(tableInstance, values, key)
+			for i, indexInstance := range tableInstance.Indexes {
+				c.emit(constants.OP_IDX_DELETE, indexes[i], keys[i], len(indexInstance.Columns)+1, nil)
+			}
+		}
+		c.emit(constants.OP_DELETE, cursor, 0, 0, nil)
+	})
+	c.emit(constants.OP_HALT, 0, 0, 0, nil)
+	return c.program
+}
+
+// Rewrites every row the WHERE clause matches. Keys never change, so each row
+// stays where it is in key order.
+func compileUpdate(statement *Statement, tableInstance *Table) *Program {
+	c := newCompiler(tableInstance)
+	found := c.collectRowids(statement)
+	if statement.KeyRequired {
+		ok := c.emit(constants.OP_IF, found, 0, 0, nil)
+		c.emit(constants.OP_HALT, 0, 0, 0, ErrNotFound)
+		c.patch(ok)
+	}
+
+	positions := make([]int, 0, len(statement.Assignments))
+	for position := range statement.Assignments {
+		positions = append(positions, position)
+	}
+	sort.Ints(positions)
+	c.changeRows(func(cursor int, indexes []int, key int) {
+		values, newValues := c.allocate(len(tableInstance.Columns)), c.allocate(len(tableInstance.Columns))
+		record := c.allocate(1)
+		for i := range tableInstance.Columns {
+			c.emit(constants.OP_COLUMN, cursor, i, values+i, nil)
+		}
+		oldKeys := c.indexKeys(tableInstance, values, key)
+
+		// Every new value is computed from the row as it was
+		c.emit(constants.OP_COPY, values, newValues, len(tableInstance.Columns), nil)
+		for _, position := range positions {
+			value := statement.Assignments[position]
+			c.expression(value, newValues+position)
+			if _, ok := value.(*LiteralExpr); !ok {
+				c.emit(constants.OP_TYPE_CHECK, newValues+position, position, 0, tableInstance)
+			}
+		}
+		c.emit(constants.OP_MAKE_RECORD, newValues, len(tableInstance.Columns), record, tableInstance)
+		keys := c.indexKeys(tableInstance, newValues, key)
+		for i, indexInstance := range tableInstance.Indexes {
+			c.emit(constants.OP_IDX_CHECK, indexes[i], keys[i], len(indexInstance.Columns)+1, nil)
+		}
+		c.emit(constants.OP_INSERT, cursor, record, key, nil)
+		// Only the indexes on columns that changed need their entry moved
+		for i, indexInstance := range tableInstance.Indexes {
+			size := len(indexInstance.Columns) + 1
+			same := c.emit5(constants.OP_SAME_KEYS, oldKeys[i], 0, keys[i], nil, size)
+			c.emit(constants.OP_IDX_DELETE, indexes[i], oldKeys[i], size, nil)
+			c.emit(constants.OP_IDX_INSERT, indexes[i], keys[i], size, nil)
+			c.patch(same)
+		}
+	})
+	c.emit(constants.OP_HALT, 0, 0, 0, nil)
+	return c.program
+}
+
+// Loops over the rows an update or delete works on like a select would,
+// collecting their rowids. Changing rows as the loop goes could move the rows
+// and index entries it has yet to read. Returns a register that is set once a
+// row is found.
+func (c *compiler) collectRowids(statement *Statement) int {
+	found, rowid := c.allocate(1), c.allocate(1)
+	c.emit(constants.OP_INTEGER, 0, found, 0, nil)
+	c.cursors = []int{c.openCursor(constants.OP_OPEN_READ, c.table)}
+	c.tableLoop(statement, func() []int {
+		var next []int
+		if statement.Where != nil {
+			next = append(next, c.condition(statement.Where))
+		}
+		c.emit(constants.OP_ROWID, c.cursors[0], rowid, 0, nil)
+		c.emit(constants.OP_ROWSET_ADD, rowid, 0, 0, nil)
+		c.emit(constants.OP_INTEGER, 1, found, 0, nil)
+		return next
+	})
+	return found
+}
+
+// Emits the body for each collected rowid, with a write cursor on the row
+// that has it and on each of the table's indexes. Columns in the body's
+// expressions read the row under the write cursor.
+func (c *compiler) changeRows(body func(cursor int, indexes []int, key int)) {
+	cursor := c.openCursor(constants.OP_OPEN_WRITE, c.table)
+	indexes := c.openIndexes(c.table)
+	c.cursors = []int{cursor}
+	key := c.allocate(1)
+	top := c.emit(constants.OP_ROWSET_READ, 0, 0, key, nil)
+	// Deleting can shuffle rows between leaves, so each row is looked up from the root
+	c.program.Instructions[c.emit(constants.OP_SEEK_ROWID, cursor, 0, key, nil)].P2 = top
+	body(cursor, indexes, key)
+	c.emit(constants.OP_GOTO, 0, top, 0, nil)
+	c.patch(top)
+}
@@ -0,0 +1,2765 @@
+package engine
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/kris-gaudel/goqlite/constants"
+)
+
+// Structs
+type Row struct {
+	// Key of the row in its table's B-tree, 0 until one has been picked
+	Key uint32
+	// One value per column: nil, int64, float64, string or []byte
+	Values []interface{}
+}
+
+type Statement struct {
+	Type string
+	// Table the statement works on, or the table being created. A CREATE TABLE
+	// IF NOT EXISTS for a table that already exists leaves this nil.
+	Table       *Table
+	RowToInsert Row
+	// Inclusive range of keys a select, update or delete reads
+	KeyLow  uint32
+	KeyHigh uint32
+	// New values set by an update, keyed by column position. Constants have
+	// already been converted to the column's type.
+	Assignments map[int]Expression
+	// Set for an update of the row with a single key, which fails with
+	// ErrNotFound when there's no such row
+	KeyRequired bool
+	// What a select outputs for each row, with * already expanded
+	ResultColumns []Expression
+	// Name of each result column: its alias, the column it reads, or else the
+	// expression written out
+	ColumnNames []string
+	// Rows a select, update or delete skips unless this is true, nil to keep
+	// every row
+	Where Expression
+	// GROUP BY terms with aliases and column numbers resolved
+	GroupBy []Expression
+	// Groups a grouped select skips unless this is true, nil to keep every group
+	Having Expression
+	// Aggregate calls in the result columns, HAVING and ORDER BY. A select
+	// with aggregates or a GROUP BY outputs one row per group.
+	Aggregates []*FunctionExpr
+	// Whether the select only counts rows, which can be read off the table's
+	// leaves without looking at the rows
+	CountFromLeaves bool
+	// ORDER BY terms with aliases and column numbers resolved, nil to keep key order
+	OrderBy []OrderingTerm
+	// -1 when a select has no LIMIT
+	Limit  int64
+	Offset int64
+	// Index a select, update or delete reads its rows through, or the index
+	// being created. The statement reads the index entries from the first one
+	// at or above IndexLow up to the last one whose leading values match
+	// IndexHigh, either bound can be nil.
+	Index     *Index
+	IndexLow  []interface{}
+	IndexHigh []interface{}
+	// Schema cookie at the time the statement was prepared
+	SchemaCookie uint32
+	// What the machine runs for an insert, select, update or delete
+	Program *Program
+	// One of the EXPLAIN_* constants when the statement is to be described
+	// rather than run, empty otherwise
+	Explain string
+}
+
+type Pager struct {
+	FileName       string
+	FileDescriptor int
+	FileLength     uint32
+	NumPages       uint32
+	// Cached pages by page number, bounded by CacheSize
+	Pages     map[uint32]*CachedPage
+	CacheSize int
+	// Cached pages ordered from most to least recently used
+	RecentlyUsed *list.List
+	// Rollback journal for the open transaction, nil until the first write
+	Journal *Journal
+	// Change counter of the commit the cached pages belong to, in rollback journal mode
+	ChangeCounter uint32
+	// Write-ahead log, only set when the database is in WAL mode
+	Wal *Wal
+	// Set between BEGIN and COMMIT/ROLLBACK, otherwise every statement commits on its own
+	InTransaction bool
+	// One of the LOCK_* constants, see the Lock Code
+	Lock int
+	// The pending file while this connection holds the pending lock, -1 otherwise
+	PendingFileDescriptor int
+}
+
+type CachedPage struct {
+	PageNum uint32
+	Data    []byte
+	// Set when the page has changed since it was last written to the file
+	Dirty   bool
+	element *list.Element
+}
+
+type Column struct {
+	Name string
+	// One of the COLUMN_TYPE_* constants
+	Type string
+	// Longest TEXT or BLOB value allowed in bytes, 0 for no limit
+	MaxLength  int
+	PrimaryKey bool
+	NotNull    bool
+}
+
+type Table struct {
+	Name    string
+	Columns []Column
+	// Position of the INTEGER PRIMARY KEY column, whose values are the keys of
+	// the B-tree, or -1 if keys are handed out automatically
+	KeyColumn int
+	// The CREATE TABLE statement the table was defined with
+	SQL         string
+	RootPageNum uint32
+	Pager       *Pager
+	// Indexes on the table, in the order they were created
+	Indexes []*Index
+	// Set on the pseudo table a join's rows are evaluated against, whose
+	// columns are those of the joined tables, nil for real tables
+	Sources []*JoinSource
+}
+
+type Index struct {
+	Name   string
+	Table  *Table
+	Unique bool
+	// Positions of the indexed columns in the table
+	Columns []int
+	// Layout of the index keys, the indexed columns followed by the rowid
+	KeyTable *Table
+	// The CREATE INDEX statement the index was defined with
+	SQL         string
+	RootPageNum uint32
+}
+
+type Database struct {
+	Pager *Pager
+	// Every table by lower-cased name
+	Tables map[string]*Table
+	// Schema cookie from the header when Tables was loaded
+	SchemaCookie uint32
+}
+
+type Cursor struct {
+	Table      *Table
+	PageNum    uint32
+	CellNum    uint32
+	EndOfTable bool
+}
+
+type IndexCursor struct {
+	Index      *Index
+	PageNum    uint32
+	CellNum    uint32
+	EndOfIndex bool
+}
+
+// Utility Code
+
+func Indent(level uint32) {
+	for i := uint32(0); i < level; i++ {
+		fmt.Print("  ")
+	}
+}
+
+func PrintTree(pagerInstance *Pager, pageNum uint32, indentationLevel uint32) {
+	nodeInstance := GetPage(pagerInstance, pageNum)
+	var numKeys, child uint32
+
+	switch GetNodeType(nodeInstance) {
+	case constants.NODE_LEAF:
+		numKeys = *LeafNodeNumCells(nodeInstance)
+		Indent(indentationLevel)
+		fmt.Printf("- leaf (size %d)\n", numKeys)
+		for i := uint32(0); i < numKeys; i++ {
+			Indent(indentationLevel + 1)
+			fmt.Printf("- %d\n", *LeafNodeKey(nodeInstance, i))
+		}
+		break
+	case constants.NODE_INTERNAL:
+		numKeys = *InternalNodeNumKeys(nodeInstance)
+		Indent(indentationLevel)
+		fmt.Printf("- internal (size %d)\n", numKeys)
+		for i := uint32(0); i < numKeys; i++ {
+			child = *InternalNodeChild(nodeInstance, i)
+			PrintTree(pagerInstance, child, indentationLevel+1)
+
+			Indent(indentationLevel + 1)
+			fmt.Printf("- key %d\n", *InternalNodeKey(nodeInstance, i))
+		}
+		child = *InternalNodeRightChild(nodeInstance)
+		PrintTree(pagerInstance, child, indentationLevel+1)
+		break
+	}
+}
+
+func PrintRow(row *Row) {
+	values := make([]string, len(row.Values))
+	for i, value := range row.Values {
+		values[i] = FormatValue(value)
+	}
+	fmt.Printf("(%s)\n", strings.Join(values, ", "))
+}
+
+func PrintConstants() {
+	fmt.Printf("RECORD_MAX_SIZE: %d\n", constants.RECORD_MAX_SIZE)
+	fmt.Printf("COMMON_NODE_HEADER_SIZE: %d\n", constants.COMMON_NODE_HEADER_SIZE)
+	fmt.Printf("LEAF_NODE_HEADER_SIZE: %d\n", constants.LEAF_NODE_HEADER_SIZE)
+	fmt.Printf("LEAF_NODE_SPACE_FOR_CELLS: %d\n", constants.LEAF_NODE_SPACE_FOR_CELLS)
+	fmt.Printf("LEAF_NODE_MAX_LOCAL: %d\n", constants.LEAF_NODE_MAX_LOCAL)
+	fmt.Printf("LEAF_NODE_MIN_LOCAL: %d\n", constants.LEAF_NODE_MIN_LOCAL)
+	fmt.Printf("OVERFLOW_PAGE_DATA_SIZE: %d\n", constants.OVERFLOW_PAGE_DATA_SIZE)
+}
+
+func PrintHeader(header []byte) {
+	fmt.Printf("format version: %d\n", *HeaderFormatVersion(header))
+	fmt.Printf("page size: %d\n", *HeaderPageSize(header))
+	fmt.Printf("page count: %d\n", *HeaderPageCount(header))
+	fmt.Printf("free list head: %d\n", *FreeListHead(header))
+	fmt.Printf("free pages: %d\n", *FreePageCount(header))
+	fmt.Printf("schema cookie: %d\n", *HeaderSchemaCookie(header))
+}
+
+func PrintLeafNode(nodeInstance []byte) {
+	numCells := *LeafNodeNumCells(nodeInstance)
+	fmt.Printf("leaf (size %d)\n", numCells)
+	for i := uint32(0); i < numCells; i++ {
+		key := *LeafNodeKey(nodeInstance, i)
+		fmt.Printf(" - %d : %d\n", i, key)
+	}
+}
+
+func uint32ToBytes(value uint32) []byte {
+	bytes := make([]byte, 4)
+	binary.LittleEndian.PutUint32(bytes, value)
+	return bytes
+}
+
+// Internal Node Code
+
+func InternalNodeNumKeys(nodeInstance []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&nodeInstance[constants.INTERNAL_NODE_NUM_KEYS_OFFSET]))
+}
+
+func InternalNodeRightChild(nodeInstance []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&nodeInstance[constants.INTERNAL_NODE_RIGHT_CHILD_OFFSET]))
+}
+
+func InternalNodeCell(nodeInstance []byte, cellNum uint32) []byte {
+	offset := uint32(constants.INTERNAL_NODE_HEADER_SIZE) + cellNum*uint32(constants.INTERNAL_NODE_CELL_SIZE)
+	return nodeInstance[offset : offset+uint32(constants.INTERNAL_NODE_CELL_SIZE)]
+}
+
+func InternalNodeChild(nodeInstance []byte, childNum uint32) *uint32 {
+	numKeys := *InternalNodeNumKeys(nodeInstance)
+	if childNum > numKeys {
+		raiseCorrupt("Internal node has no child %d, it has %d keys. Corrupt file.", childNum, numKeys)
+	} else if childNum == numKeys {
+		return InternalNodeRightChild(nodeInstance)
+	}
+	return (*uint32)(unsafe.Pointer(&nodeInstance[constants.INTERNAL_NODE_HEADER_SIZE+uintptr(childNum)*constants.INTERNAL_NODE_CELL_SIZE]))
+}
+
+func InternalNodeKey(nodeInstance []byte, keyNum uint32) *uint32 {
+	offset := constants.INTERNAL_NODE_HEADER_SIZE + uintptr(keyNum)*constants.INTERNAL_NODE_CELL_SIZE + constants.INTERNAL_NODE_CHILD_SIZE
+	return (*uint32)(unsafe.Pointer(&nodeInstance[offset]))
+}
+
+// Returns the index of the child which should contain the given key
+func InternalNodeFindChild(nodeInstance []byte, key uint32) uint32 {
+	numKeys := *InternalNodeNumKeys(nodeInstance)
+
+	minIndex := uint32(0)
+	maxIndex := numKeys
+
+	for minIndex != maxIndex {
+		index := (minIndex + maxIndex) / 2
+		keyToRight := *InternalNodeKey(nodeInstance, index)
+		if keyToRight >= key {
+			maxIndex = index
+		} else {
+			minIndex = index + 1
+		}
+	}
+	return minIndex
+}
+
+func InternalNodeFind(tableInstance *Table, pageNum uint32, key uint32) *Cursor {
+	node := GetPage(tableInstance.Pager, pageNum)
+	childIndex := InternalNodeFindChild(node, key)
+
+	childNum := *InternalNodeChild(node, childIndex)
+	child := GetPage(tableInstance.Pager, childNum)
+
+	switch GetNodeType(child) {
+	case constants.NODE_LEAF:
+		return LeafNodeFind(tableInstance, childNum, key)
+	default: // constants.NODE_INTERNAL
+		return InternalNodeFind(tableInstance, childNum, key)
+	}
+}
+
+// Internal node keys only cover the children to the left of the right child,
+// so the max key of an internal node lives in its rightmost leaf
+func GetNodeMaxKey(pagerInstance *Pager, nodeInstance []byte) uint32 {
+	if GetNodeType(nodeInstance) == constants.NODE_LEAF {
+		return *LeafNodeKey(nodeInstance, *LeafNodeNumCells(nodeInstance)-1)
+	}
+	rightChild := GetPage(pagerInstance, *InternalNodeRightChild(nodeInstance))
+	return GetNodeMaxKey(pagerInstance, rightChild)
+}
+
+func IsNodeRoot(nodeInstance []byte) bool {
+	value := *(*uint8)(unsafe.Pointer(&nodeInstance[constants.IS_ROOT_OFFSET]))
+	return value == 1
+}
+
+func SetNodeRoot(nodeInstance []byte, isRoot bool) {
+	var value uint8
+	if isRoot {
+		value = 1
+	} else {
+		value = 0
+	}
+	*(*uint8)(unsafe.Pointer(&nodeInstance[constants.IS_ROOT_OFFSET])) = value
+}
+
+func NodeParent(nodeInstance []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&nodeInstance[constants.PARENT_POINTER_OFFSET]))
+}
+
+func SetNodeParent(pagerInstance *Pager, pageNum uint32, parentPageNum uint32) {
+	nodeInstance := GetPage(pagerInstance, pageNum)
+	MarkPageDirty(pagerInstance, pageNum)
+	*NodeParent(nodeInstance) = parentPageNum
+}
+
+func InitializeInternalNode(nodeInstance []byte) {
+	SetNodeType(nodeInstance, constants.NODE_INTERNAL)
+	SetNodeRoot(nodeInstance, false)
+	*InternalNodeNumKeys(nodeInstance) = 0
+}
+
+func UpdateInternalNodeKey(nodeInstance []byte, oldKey uint32, newKey uint32) {
+	oldChildIndex := InternalNodeFindChild(nodeInstance, oldKey)
+	// The right child has no key of its own, so there is nothing to update
+	if oldChildIndex < *InternalNodeNumKeys(nodeInstance) {
+		*InternalNodeKey(nodeInstance, oldChildIndex) = newKey
+	}
+}
+
+// Adds a new child/key pair to the parent that corresponds to the child
+func InternalNodeInsert(tableInstance *Table, parentPageNum uint32, childPageNum uint32) {
+	pagerInstance := tableInstance.Pager
+	parent := GetPage(pagerInstance, parentPageNum)
+	childMaxKey := GetNodeMaxKey(pagerInstance, GetPage(pagerInstance, childPageNum))
+	index := InternalNodeFindChild(parent, childMaxKey)
+
+	originalNumKeys := *InternalNodeNumKeys(parent)
+	if originalNumKeys >= uint32(constants.INTERNAL_NODE_MAX_KEYS) {
+		InternalNodeSplitAndInsert(tableInstance, parentPageNum, childPageNum)
+		return
+	}
+
+	rightChildPageNum := *InternalNodeRightChild(parent)
+	rightChild := GetPage(pagerInstance, rightChildPageNum)
+	rightChildMaxKey := GetNodeMaxKey(pagerInstance, rightChild)
+
+	SetNodeParent(pagerInstance, childPageNum, parentPageNum)
+	MarkPageDirty(pagerInstance, parentPageNum)
+	*InternalNodeNumKeys(parent) = originalNumKeys + 1
+
+	if childMaxKey > rightChildMaxKey {
+		// Replace right child
+		*InternalNodeChild(parent, originalNumKeys) = rightChildPageNum
+		*InternalNodeKey(parent, originalNumKeys) = rightChildMaxKey
+		*InternalNodeRightChild(parent) = childPageNum
+		return
+	}
+
+	// Make room for the new cell
+	for i := originalNumKeys; i > index; i-- {
+		copy(InternalNodeCell(parent, i), InternalNodeCell(parent, i-1))
+	}
+	*InternalNodeChild(parent, index) = childPageNum
+	*InternalNodeKey(parent, index) = childMaxKey
+}
+
+// Splits a full internal node in two while adding a new child to it. The old
+// page keeps the lower half of the children and the upper half moves to a new page
+func InternalNodeSplitAndInsert(tableInstance *Table, oldPageNum uint32, childPageNum uint32) {
+	pagerInstance := tableInstance.Pager
+	oldNode := GetPage(pagerInstance, oldPageNum)
+	oldMaxKey := GetNodeMaxKey(pagerInstance, oldNode)
+	numKeys := *InternalNodeNumKeys(oldNode)
+
+	// Gather every child with the key it is filed under, including the new one
+	children := make([]uint32, 0, numKeys+2)
+	keys := make([]uint32, 0, numKeys+2)
+	for i := uint32(0); i < numKeys; i++ {
+		children = append(children, *InternalNodeChild(oldNode, i))
+		keys = append(keys, *InternalNodeKey(oldNode, i))
+	}
+	children = append(children, *InternalNodeRightChild(oldNode))
+	keys = append(keys, oldMaxKey)
+
+	childMaxKey := GetNodeMaxKey(pagerInstance, GetPage(pagerInstance, childPageNum))
+	index := uint32(len(keys))
+	for i, key := range keys {
+		if key >= childMaxKey {
+			index = uint32(i)
+			break
+		}
+	}
+	children = append(children, 0)
+	keys = append(keys, 0)
+	copy(children[index+1:], children[index:])
+	copy(keys[index+1:], keys[index:])
+	children[index] = childPageNum
+	keys[index] = childMaxKey
+
+	newPageNum := GetUnusedPageNum(pagerInstance)
+	newNode := GetPage(pagerInstance, newPageNum)
+	MarkPageDirty(pagerInstance, newPageNum)
+	InitializeInternalNode(newNode)
+	oldNode = GetPage(pagerInstance, oldPageNum)
+	MarkPageDirty(pagerInstance, oldPageNum)
+	*NodeParent(newNode) = *NodeParent(oldNode)
+
+	leftCount := uint32(constants.INTERNAL_NODE_LEFT_SPLIT_COUNT)
+	writeInternalNodeCells(oldNode, children[:leftCount], keys[:leftCount])
+	writeInternalNodeCells(newNode, children[leftCount:], keys[leftCount:])
+	newLeftMaxKey := keys[leftCount-1]
+
+	if IsNodeRoot(oldNode) {
+		CreateNewRoot(tableInstance, newPageNum)
+	} else {
+		parentPageNum := *NodeParent(oldNode)
+		parent := GetPage(pagerInstance, parentPageNum)
+		MarkPageDirty(pagerInstance, parentPageNum)
+		UpdateInternalNodeKey(parent, oldMaxKey, newLeftMaxKey)
+		InternalNodeInsert(tableInstance, parentPageNum, newPageNum)
+	}
+
+	// Only re-point children after the parent is settled, since visiting
+	// every moved child can push the split nodes out of the page cache.
+	// CreateNewRoot already re-pointed the lower half if the root was split.
+	if index < leftCount && oldPageNum != tableInstance.RootPageNum {
+		SetNodeParent(pagerInstance, childPageNum, oldPageNum)
+	}
+	for _, child := range children[leftCount:] {
+		SetNodeParent(pagerInstance, child, newPageNum)
+	}
+}
+
+// Overwrites the cells of an internal node, using the last child as the right child
+func writeInternalNodeCells(nodeInstance []byte, children []uint32, keys []uint32) {
+	numKeys := uint32(len(children) - 1)
+	*InternalNodeNumKeys(nodeInstance) = numKeys
+	for i := uint32(0); i < numKeys; i++ {
+		*InternalNodeChild(nodeInstance, i) = children[i]
+		*InternalNodeKey(nodeInstance, i) = keys[i]
+	}
+	*InternalNodeRightChild(nodeInstance) = children[numKeys]
+}
+
+// Returns the position of a child page among the parent's children, where
+// the right child comes last
+func InternalNodeChildIndex(nodeInstance []byte, childPageNum uint32) uint32 {
+	numKeys := *InternalNodeNumKeys(nodeInstance)
+	for i := uint32(0); i < numKeys; i++ {
+		if *InternalNodeChild(nodeInstance, i) == childPageNum {
+			return i
+		}
+	}
+	if *InternalNodeRightChild(nodeInstance) != childPageNum {
+		raiseCorrupt("Page %d is not a child of its parent. Corrupt file.", childPageNum)
+	}
+	return numKeys
+}
+
+// Removes a child/key cell, leaving the right child in place
+func InternalNodeRemoveCell(nodeInstance []byte, cellNum uint32) {
+	numKeys := *InternalNodeNumKeys(nodeInstance)
+	for i := cellNum; i < numKeys-1; i++ {
+		copy(InternalNodeCell(nodeInstance, i), InternalNodeCell(nodeInstance, i+1))
+	}
+	*InternalNodeNumKeys(nodeInstance) = numKeys - 1
+}
+
+// Once the right node of a pair has been merged into the left one, the left
+// node takes over the right node's slot (and its key) in the parent
+func internalNodeMergeChildren(parent []byte, leftIndex uint32, leftPageNum uint32) {
+	*InternalNodeChild(parent, leftIndex+1) = leftPageNum
+	InternalNodeRemoveCell(parent, leftIndex)
+}
+
+// After the largest key under pageNum shrinks from oldMaxKey to newMaxKey, the
+// key filed for that subtree lives in the first ancestor where it isn't the right child
+func UpdateAncestorMaxKey(tableInstance *Table, pageNum uint32, oldMaxKey uint32, newMaxKey uint32) {
+	pagerInstance := tableInstance.Pager
+	for pageNum != tableInstance.RootPageNum {
+		parentPageNum := *NodeParent(GetPage(pagerInstance, pageNum))
+		parent := GetPage(pagerInstance, parentPageNum)
+		childIndex := InternalNodeChildIndex(parent, pageNum)
+		if childIndex < *InternalNodeNumKeys(parent) {
+			if *InternalNodeKey(parent, childIndex) == oldMaxKey {
+				MarkPageDirty(pagerInstance, parentPageNum)
+				*InternalNodeKey(parent, childIndex) = newMaxKey
+			}
+			return
+		}
+		pageNum = parentPageNum
+	}
+}
+
+// Fixes up a node that has dropped below its minimum size, either by merging
+// it with a sibling or by evening out the cells between the two
+func RebalanceNode(tableInstance *Table, pageNum uint32) {
+	pagerInstance := tableInstance.Pager
+	nodeInstance := GetPage(pagerInstance, pageNum)
+
+	if pageNum == tableInstance.RootPageNum {
+		if GetNodeType(nodeInstance) == constants.NODE_INTERNAL && *InternalNodeNumKeys(nodeInstance) == 0 {
+			CollapseRoot(tableInstance)
+		}
+		return
+	}
+
+	if GetNodeType(nodeInstance) == constants.NODE_LEAF {
+		if !LeafNodeUnderfull(nodeInstance) {
+			return
+		}
+	} else if *InternalNodeNumKeys(nodeInstance) >= uint32(constants.INTERNAL_NODE_MIN_KEYS) {
+		return
+	}
+
+	parentPageNum := *NodeParent(nodeInstance)
+	parent := GetPage(pagerInstance, parentPageNum)
+	childIndex := InternalNodeChildIndex(parent, pageNum)
+
+	// Prefer the left sibling, falling back to the right one for the first child
+	leftIndex := childIndex
+	if childIndex > 0 {
+		leftIndex = childIndex - 1
+	}
+	leftPageNum := *InternalNodeChild(parent, leftIndex)
+	rightPageNum := *InternalNodeChild(parent, leftIndex+1)
+
+	var merged bool
+	if GetNodeType(nodeInstance) == constants.NODE_LEAF {
+		merged = rebalanceLeafNodes(tableInstance, parentPageNum, leftIndex, leftPageNum, rightPageNum)
+	} else {
+		merged = rebalanceInternalNodes(tableInstance, parentPageNum, leftIndex, leftPageNum, rightPageNum)
+	}
+
+	if merged {
+		RebalanceNode(tableInstance, parentPageNum)
+	}
+}
+
+// Returns true if the right leaf was merged into the left one
+func rebalanceLeafNodes(tableInstance *Table, parentPageNum uint32, leftIndex uint32, leftPageNum uint32, rightPageNum uint32) bool {
+	pagerInstance := tableInstance.Pager
+	leftNode := GetPage(pagerInstance, leftPageNum)
+	rightNode := GetPage(pagerInstance, rightPageNum)
+	parent := GetPage(pagerInstance, parentPageNum)
+	MarkPageDirty(pagerInstance, leftPageNum)
+	MarkPageDirty(pagerInstance, rightPageNum)
+	MarkPageDirty(pagerInstance, parentPageNum)
+
+	cells := append(leafNodeCells(leftNode), leafNodeCells(rightNode)...)
+	totalSpace := uint32(0)
+	for _, cell := range cells {
+		totalSpace += leafNodeCellSpace(cell)
+	}
+
+	if totalSpace <= uint32(constants.LEAF_NODE_SPACE_FOR_CELLS) {
+		writeLeafNodeCells(leftNode, cells)
+		*LeafNodeNextLeaf(leftNode) = *LeafNodeNextLeaf(rightNode)
+		internalNodeMergeChildren(parent, leftIndex, leftPageNum)
+		FreePage(pagerInstance, rightPageNum)
+		return true
+	}
+
+	leftCount := leafNodeSplitIndex(cells)
+	writeLeafNodeCells(leftNode, cells[:leftCount])
+	writeLeafNodeCells(rightNode, cells[leftCount:])
+	*InternalNodeKey(parent, leftIndex) = *LeafNodeKey(leftNode, uint32(leftCount-1))
+	return false
+}
+
+// Returns true if the right internal node was merged into the left one
+func rebalanceInternalNodes(tableInstance *Table, parentPageNum uint32, leftIndex uint32, leftPageNum uint32, rightPageNum uint32) bool {
+	pagerInstance := tableInstance.Pager
+	leftNode := GetPage(pagerInstance, leftPageNum)
+	rightNode := GetPage(pagerInstance, rightPageNum)
+	parent := GetPage(pagerInstance, parentPageNum)
+	MarkPageDirty(pagerInstance, leftPageNum)
+	MarkPageDirty(pagerInstance, rightPageNum)
+	MarkPageDirty(pagerInstance, parentPageNum)
+
+	// The parent's key for the left node is the max key of the left node's right child
+	separatorKey := *InternalNodeKey(parent, leftIndex)
+	children, keys := internalNodeChildren(leftNode)
+	keys[len(keys)-1] = separatorKey
+	rightChildren, rightKeys := internalNodeChildren(rightNode)
+	children = append(children, rightChildren...)
+	keys = append(keys, rightKeys...)
+
+	if len(children)-1 <= int(constants.INTERNAL_NODE_MAX_KEYS) {
+		writeInternalNodeCells(leftNode, children, keys)
+		internalNodeMergeChildren(parent, leftIndex, leftPageNum)
+		for _, child := range rightChildren {
+			SetNodeParent(pagerInstance, child, leftPageNum)
+		}
+		FreePage(pagerInstance, rightPageNum)
+		return true
+	}
+
+	originalLeftCount := len(children) - len(rightChildren)
+	leftCount := len(children) / 2
+	writeInternalNodeCells(leftNode, children[:leftCount], keys[:leftCount])
+	writeInternalNodeCells(rightNode, children[leftCount:], keys[leftCount:])
+	*InternalNodeKey(parent, leftIndex) = keys[leftCount-1]
+
+	// Only the children that changed sides need a new parent
+	for i := leftCount; i < originalLeftCount; i++ {
+		SetNodeParent(pagerInstance, children[i], rightPageNum)
+	}
+	for i := originalLeftCount; i < leftCount; i++ {
+		SetNodeParent(pagerInstance, children[i], leftPageNum)
+	}
+	return false
+}
+
+// Returns every child of an internal node with its key. The right child's
+// key is left as 0 since it isn't stored in the node.
+func internalNodeChildren(nodeInstance []byte) ([]uint32, []uint32) {
+	numKeys := *InternalNodeNumKeys(nodeInstance)
+	children := make([]uint32, 0, numKeys+1)
+	keys := make([]uint32, 0, numKeys+1)
+	for i := uint32(0); i < numKeys; i++ {
+		children = append(children, *InternalNodeChild(nodeInstance, i))
+		keys = append(keys, *InternalNodeKey(nodeInstance, i))
+	}
+	children = append(children, *InternalNodeRightChild(nodeInstance))
+	keys = append(keys, 0)
+	return children, keys
+}
+
+// Replaces a root with a single child by the child itself
+func CollapseRoot(tableInstance *Table) {
+	root := GetPage(tableInstance.Pager, tableInstance.RootPageNum)
+	collapseRoot(tableInstance.Pager, tableInstance.RootPageNum, *InternalNodeRightChild(root))
+}
+
+// Copies the only child of a root, of a table or an index, into the root and
+// frees the child's page. The root keeps its page number.
+func collapseRoot(pagerInstance *Pager, rootPageNum uint32, childPageNum uint32) {
+	root := GetPage(pagerInstance, rootPageNum)
+	child := GetPage(pagerInstance, childPageNum)
+	MarkPageDirty(pagerInstance, rootPageNum)
+
+	copy(root, child)
+	SetNodeRoot(root, true)
+
+	for _, grandchild := range nodeChildren(root) {
+		SetNodeParent(pagerInstance, grandchild, rootPageNum)
+	}
+	FreePage(pagerInstance, childPageNum)
+}
+
+// Page numbers of the children of an internal node of a table or an index,
+// with the right child last. Leaves have none.
+func nodeChildren(nodeInstance []byte) []uint32 {
+	switch GetNodeType(nodeInstance) {
+	case constants.NODE_INTERNAL:
+		children, _ := internalNodeChildren(nodeInstance)
+		return children
+	case constants.NODE_INDEX_INTERNAL:
+		numCells := *IndexNodeNumCells(nodeInstance)
+		children := make([]uint32, 0, numCells+1)
+		for i := uint32(0); i < numCells; i++ {
+			children = append(children, IndexNodeChild(nodeInstance, i))
+		}
+		return append(children, *IndexNodeRightChild(nodeInstance))
+	}
+	return nil
+}
+
+// Leaf Node Code
+
+func LeafNodeNumCells(nodeInstance []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&nodeInstance[constants.LEAF_NODE_NUM_CELLS_OFFSET]))
+}
+
+// Page number of the next leaf to the right, 0 means this is the rightmost leaf
+func LeafNodeNextLeaf(nodeInstance []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&nodeInstance[constants.LEAF_NODE_NEXT_LEAF_OFFSET]))
+}
+
+// Offset of the cell within the page
+func LeafNodeCellPointer(nodeInstance []byte, cellNum uint32) *uint16 {
+	offset := uint32(constants.LEAF_NODE_HEADER_SIZE) + cellNum*uint32(constants.LEAF_NODE_CELL_POINTER_SIZE)
+	return (*uint16)(unsafe.Pointer(&nodeInstance[offset]))
+}
+
+func LeafNodeCellContent(nodeInstance []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&nodeInstance[constants.LEAF_NODE_CELL_CONTENT_OFFSET]))
+}
+
+func LeafNodeCell(nodeInstance []byte, cellNum uint32) []byte {
+	offset := uint32(*LeafNodeCellPointer(nodeInstance, cellNum))
+	return nodeInstance[offset : offset+leafCellSize(nodeInstance[offset:])]
+}
+
+func LeafNodeKey(nodeInstance []byte, cellNum uint32) *uint32 {
+	offset := uint32(*LeafNodeCellPointer(nodeInstance, cellNum))
+	return (*uint32)(unsafe.Pointer(&nodeInstance[offset+uint32(constants.LEAF_NODE_KEY_OFFSET)]))
+}
+
+// Bytes left between the cell pointers and the cell content area. Removing a
+// cell packs the remaining ones together again, so this is all the free space.
+func LeafNodeFreeSpace(nodeInstance []byte) uint32 {
+	pointersEnd := uint32(constants.LEAF_NODE_HEADER_SIZE) + *LeafNodeNumCells(nodeInstance)*uint32(constants.LEAF_NODE_CELL_POINTER_SIZE)
+	return *LeafNodeCellContent(nodeInstance) - pointersEnd
+}
+
+// Space a cell takes up in a leaf, including its pointer
+func leafNodeCellSpace(cell []byte) uint32 {
+	return uint32(len(cell)) + uint32(constants.LEAF_NODE_CELL_POINTER_SIZE)
+}
+
+// A leaf other than the root that has dropped below its minimum size
+func LeafNodeUnderfull(nodeInstance []byte) bool {
+	usedSpace := uint32(constants.LEAF_NODE_SPACE_FOR_CELLS) - LeafNodeFreeSpace(nodeInstance)
+	return usedSpace < uint32(constants.LEAF_NODE_MIN_USED_SPACE)
+}
+
+func InitializeLeafNode(nodeInstance []byte) {
+	SetNodeType(nodeInstance, constants.NODE_LEAF)
+	SetNodeRoot(nodeInstance, false)
+	*LeafNodeNumCells(nodeInstance) = 0
+	*LeafNodeNextLeaf(nodeInstance) = 0
+	*LeafNodeCellContent(nodeInstance) = constants.PAGE_SIZE
+}
+
+// Adds a cell at cellNum, the leaf must have room for it
+func leafNodeInsertCell(nodeInstance []byte, cellNum uint32, cell []byte) {
+	numCells := *LeafNodeNumCells(nodeInstance)
+	offset := *LeafNodeCellContent(nodeInstance) - uint32(len(cell))
+	copy(nodeInstance[offset:], cell)
+	*LeafNodeCellContent(nodeInstance) = offset
+
+	for i := numCells; i > cellNum; i-- {
+		*LeafNodeCellPointer(nodeInstance, i) = *LeafNodeCellPointer(nodeInstance, i-1)
+	}
+	*LeafNodeCellPointer(nodeInstance, cellNum) = uint16(offset)
+	*LeafNodeNumCells(nodeInstance) = numCells + 1
+}
+
+// Drops a cell and packs the rest together so there are no holes left behind
+func leafNodeRemoveCell(nodeInstance []byte, cellNum uint32) {
+	cells := leafNodeCells(nodeInstance)
+	writeLeafNodeCells(nodeInstance, append(cells[:cellNum], cells[cellNum+1:]...))
+}
+
+// Inserts a cell built by NewLeafCell
+func LeafNodeInsert(cursorInstance *Cursor, key uint32, cell []byte) {
+	nodeInstance := GetPage(cursorInstance.Table.Pager, cursorInstance.PageNum)
+	if LeafNodeFreeSpace(nodeInstance) < leafNodeCellSpace(cell) {
+		LeafNodeSplitAndInsert(cursorInstance, key, cell)
+		return
+	}
+	MarkPageDirty(cursorInstance.Table.Pager, cursorInstance.PageNum)
+	leafNodeInsertCell(nodeInstance, cursorInstance.CellNum, cell)
+}
+
+// Removes the cell under the cursor along with its overflow pages and
+// rebalances the tree if the leaf underflows
+func LeafNodeDelete(cursorInstance *Cursor) {
+	tableInstance := cursorInstance.Table
+	pagerInstance := tableInstance.Pager
+	FreeOverflowPages(pagerInstance, LeafNodeCell(GetPage(pagerInstance, cursorInstance.PageNum), cursorInstance.CellNum))
+
+	nodeInstance := GetPage(pagerInstance, cursorInstance.PageNum)
+	MarkPageDirty(pagerInstance, cursorInstance.PageNum)
+	numCells := *LeafNodeNumCells(nodeInstance)
+	oldMaxKey := *LeafNodeKey(nodeInstance, numCells-1)
+
+	leafNodeRemoveCell(nodeInstance, cursorInstance.CellNum)
+	numCells -= 1
+
+	if cursorInstance.CellNum == numCells && numCells > 0 {
+		UpdateAncestorMaxKey(tableInstance, cursorInstance.PageNum, oldMaxKey, *LeafNodeKey(nodeInstance, numCells-1))
+	}
+	RebalanceNode(tableInstance, cursorInstance.PageNum)
+}
+
+// Replaces the cell under the cursor with a new cell for the same key. The
+// cell is swapped in place if it fits, otherwise the row is moved.
+func LeafNodeUpdate(cursorInstance *Cursor, cell []byte) {
+	tableInstance := cursorInstance.Table
+	pagerInstance := tableInstance.Pager
+	nodeInstance := GetPage(pagerInstance, cursorInstance.PageNum)
+	oldCell := LeafNodeCell(nodeInstance, cursorInstance.CellNum)
+	if LeafNodeFreeSpace(nodeInstance)+uint32(len(oldCell)) < uint32(len(cell)) {
+		key := *LeafNodeKey(nodeInstance, cursorInstance.CellNum)
+		LeafNodeDelete(cursorInstance)
+		LeafNodeInsert(TableFind(tableInstance, key), key, cell)
+		return
+	}
+
+	FreeOverflowPages(pagerInstance, oldCell)
+	nodeInstance = GetPage(pagerInstance, cursorInstance.PageNum)
+	MarkPageDirty(pagerInstance, cursorInstance.PageNum)
+	leafNodeRemoveCell(nodeInstance, cursorInstance.CellNum)
+	leafNodeInsertCell(nodeInstance, cursorInstance.CellNum, cell)
+	RebalanceNode(tableInstance, cursorInstance.PageNum)
+}
+
+// Copies out every cell of a leaf node
+func leafNodeCells(nodeInstance []byte) [][]byte {
+	numCells := *LeafNodeNumCells(nodeInstance)
+	cells := make([][]byte, 0, numCells)
+	for i := uint32(0); i < numCells; i++ {
+		cells = append(cells, append([]byte{}, LeafNodeCell(nodeInstance, i)...))
+	}
+	return cells
+}
+
+// Lays the cells out from the end of the page, replacing whatever the leaf held
+func writeLeafNodeCells(nodeInstance []byte, cells [][]byte) {
+	*LeafNodeNumCells(nodeInstance) = 0
+	*LeafNodeCellContent(nodeInstance) = constants.PAGE_SIZE
+	for i, cell := range cells {
+		leafNodeInsertCell(nodeInstance, uint32(i), cell)
+	}
+	// Keep the unused space zeroed so stale rows don't linger in the file
+	pointersEnd := uint32(constants.LEAF_NODE_HEADER_SIZE) + uint32(len(cells))*uint32(constants.LEAF_NODE_CELL_POINTER_SIZE)
+	for i := pointersEnd; i < *LeafNodeCellContent(nodeInstance); i++ {
+		nodeInstance[i] = 0
+	}
+}
+
+// Index that splits cells into two runs taking up as close to the same space
+// as possible, with at least one cell on each side
+func leafNodeSplitIndex(cells [][]byte) int {
+	totalSpace := uint32(0)
+	for _, cell := range cells {
+		totalSpace += leafNodeCellSpace(cell)
+	}
+	leftSpace := uint32(0)
+	for i, cell := range cells[:len(cells)-1] {
+		leftSpace += leafNodeCellSpace(cell)
+		if 2*leftSpace >= totalSpace {
+			return i + 1
+		}
+	}
+	return len(cells) - 1
+}
+
+func LeafNodeFind(tableInstance *Table, pageNum uint32, key uint32) *Cursor {
+	node := GetPage(tableInstance.Pager, pageNum)
+	numCells := *LeafNodeNumCells(node)
+
+	cursorInstance := &Cursor{Table: tableInstance, PageNum: pageNum}
+
+	// Binary search
+	minIndex := uint32(0)
+	onePastMaxIndex := numCells
+	for onePastMaxIndex != minIndex {
+		index := (minIndex + onePastMaxIndex) / 2
+		keyAtIndex := *LeafNodeKey(node, index)
+		if key == keyAtIndex {
+			cursorInstance.CellNum = index
+			return cursorInstance
+		}
+		if key < keyAtIndex {
+			onePastMaxIndex = index
+		} else {
+			minIndex = index + 1
+		}
+	}
+	cursorInstance.CellNum = minIndex
+	return cursorInstance
+}
+
+func LeafNodeSplitAndInsert(cursorInstance *Cursor, key uint32, cell []byte) {
+	pagerInstance := cursorInstance.Table.Pager
+	oldNode := GetPage(pagerInstance, cursorInstance.PageNum)
+	oldMaxKey := GetNodeMaxKey(pagerInstance, oldNode)
+	newPageNum := GetUnusedPageNum(pagerInstance)
+	newNode := GetPage(pagerInstance, newPageNum)
+	oldNode = GetPage(pagerInstance, cursorInstance.PageNum)
+	MarkPageDirty(pagerInstance, cursorInstance.PageNum)
+	MarkPageDirty(pagerInstance, newPageNum)
+	InitializeLeafNode(newNode)
+	*NodeParent(newNode) = *NodeParent(oldNode)
+	*LeafNodeNextLeaf(newNode) = *LeafNodeNextLeaf(oldNode)
+	*LeafNodeNextLeaf(oldNode) = newPageNum
+
+	// All existing cells plus the new one are divided between the old (left)
+	// and new (right) nodes so both end up holding about as many bytes
+	cells := leafNodeCells(oldNode)
+	cells = append(cells[:cursorInstance.CellNum], append([][]byte{cell}, cells[cursorInstance.CellNum:]...)...)
+	leftCount := leafNodeSplitIndex(cells)
+	writeLeafNodeCells(oldNode, cells[:leftCount])
+	writeLeafNodeCells(newNode, cells[leftCount:])
+
+	if IsNodeRoot(oldNode) {
+		CreateNewRoot(cursorInstance.Table, newPageNum)
+		return
+	}
+
+	parentPageNum := *NodeParent(oldNode)
+	newMaxKey := GetNodeMaxKey(pagerInstance, oldNode)
+	parent := GetPage(pagerInstance, parentPageNum)
+	MarkPageDirty(pagerInstance, parentPageNum)
+	UpdateInternalNodeKey(parent, oldMaxKey, newMaxKey)
+	InternalNodeInsert(cursorInstance.Table, parentPageNum, newPageNum)
+}
+
+// Turns the root into an internal node over a new left child holding its old
+// contents and the given right child
+func CreateNewRoot(tableInstance *Table, rightChildPageNum uint32) {
+	pagerInstance := tableInstance.Pager
+	leftChildPageNum := moveRootToNewChild(pagerInstance, tableInstance.RootPageNum)
+	leftMaxKey := GetNodeMaxKey(pagerInstance, GetPage(pagerInstance, leftChildPageNum))
+	root := GetPage(pagerInstance, tableInstance.RootPageNum)
+	MarkPageDirty(pagerInstance, tableInstance.RootPageNum)
+
+	InitializeInternalNode(root)
+	SetNodeRoot(root, true)
+	*InternalNodeNumKeys(root) = 1
+	*InternalNodeChild(root, 0) = leftChildPageNum
+	*InternalNodeKey(root, 0) = leftMaxKey
+	*InternalNodeRightChild(root) = rightChildPageNum
+	SetNodeParent(pagerInstance, rightChildPageNum, tableInstance.RootPageNum)
+}
+
+// Moves the contents of a root, of a table or an index, into a new page and
+// returns its number, for the caller to turn the root into an internal node
+// over it. The root keeps its page number so a tree never has to track a
+// moving root.
+func moveRootToNewChild(pagerInstance *Pager, rootPageNum uint32) uint32 {
+	childPageNum := GetUnusedPageNum(pagerInstance)
+	child := GetPage(pagerInstance, childPageNum)
+	root := GetPage(pagerInstance, rootPageNum)
+	MarkPageDirty(pagerInstance, childPageNum)
+
+	copy(child, root)
+	SetNodeRoot(child, false)
+	*NodeParent(child) = rootPageNum
+
+	// The children that moved along with the old root need to know their new parent
+	for _, grandchild := range nodeChildren(child) {
+		SetNodeParent(pagerInstance, grandchild, childPageNum)
+	}
+	return childPageNum
+}
+
+func GetNodeType(nodeInstance []byte) constants.NodeType {
+	value := *(*uint8)(unsafe.Pointer(&nodeInstance[constants.NODE_TYPE_OFFSET]))
+	return constants.NodeType(value)
+}
+
+func SetNodeType(nodeInstance []byte, nodeType constants.NodeType) {
+	value := uint8(nodeType)
+	*(*uint8)(unsafe.Pointer(&nodeInstance[constants.NODE_TYPE_OFFSET])) = value
+}
+
+// Cursor Code
+
+// Positions a cursor on the first row of the leftmost leaf. Ids are always
+// positive, so seeking key 0 lands there.
+func TableStart(tableInstance *Table) *Cursor {
+	return TableSeek(tableInstance, 0)
+}
+
+// Positions a cursor on the first row with a key of at least key
+func TableSeek(tableInstance *Table, key uint32) *Cursor {
+	cursor := TableFind(tableInstance, key)
+
+	nodeInstance := GetPage(tableInstance.Pager, cursor.PageNum)
+	numCells := *LeafNodeNumCells(nodeInstance)
+	if numCells == 0 {
+		cursor.EndOfTable = true
+	} else if cursor.CellNum >= numCells {
+		// The key is past the end of its leaf, so the row is in the next leaf if anywhere
+		cursor.CellNum = numCells - 1
+		CursorAdvance(cursor)
+	}
+	return cursor
+}
+
+func TableFind(tableInstance *Table, key uint32) *Cursor {
+	rootPageNum := tableInstance.RootPageNum
+	rootNode := GetPage(tableInstance.Pager, rootPageNum)
+
+	if (GetNodeType(rootNode)) != constants.NODE_LEAF {
+		return InternalNodeFind(tableInstance, rootPageNum, key)
+	}
+	return LeafNodeFind(tableInstance, rootPageNum, key)
+}
+
+func CursorKey(cursor *Cursor) uint32 {
+	page := GetPage(cursor.Table.Pager, cursor.PageNum)
+	return *LeafNodeKey(page, cursor.CellNum)
+}
+
+// The record of the row under the cursor
+func CursorValue(cursor *Cursor) []byte {
+	pageNum := cursor.PageNum
+	page := GetPage(cursor.Table.Pager, pageNum)
+
+	return LeafCellRecord(cursor.Table.Pager, LeafNodeCell(page, cursor.CellNum))
+}
+
+// Reads the row under the cursor
+func CursorRow(cursor *Cursor, destination *Row) {
+	DeserializeRow(cursor.Table, CursorKey(cursor), CursorValue(cursor), destination)
+}
+
+func CursorAdvance(cursor *Cursor) {
+	pageNum := cursor.PageNum
+	nodeInstance := GetPage(cursor.Table.Pager, pageNum)
+
+	cursor.CellNum += 1
+	for cursor.CellNum >= *LeafNodeNumCells(nodeInstance) {
+		nextPageNum := *LeafNodeNextLeaf(nodeInstance)
+		if nextPageNum == 0 {
+			// This was the rightmost leaf
+			cursor.EndOfTable = true
+			return
+		}
+		cursor.PageNum = nextPageNum
+		cursor.CellNum = 0
+		nodeInstance = GetPage(cursor.Table.Pager, nextPageNum)
+	}
+}
+
+// Pager Code
+
+func PagerOpen(fileName string) *Pager {
+	fd, err := syscall.Open(fileName, constants.O_RDWR|constants.O_CREAT, constants.S_IWUSR|constants.S_IRUSR)
+	if err != nil {
+		raiseIOError(ErrIOOpen, "opening the database file", err)
+	}
+	pager := &Pager{
+		FileName:              fileName,
+		FileDescriptor:        fd,
+		Pages:                 make(map[uint32]*CachedPage),
+		CacheSize:             constants.DEFAULT_CACHE_SIZE,
+		RecentlyUsed:          list.New(),
+		PendingFileDescriptor: -1,
+	}
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			pagerCloseFiles(pager)
+			panic(recovered)
+		}
+	}()
+
+	// The file can only be read once a crashed writer's changes are undone
+	if !PagerLock(pager, constants.LOCK_SHARED) {
+		panic(newError(ErrBusy))
+	}
+
+	fileLength, err := syscall.Seek(fd, 0, os.SEEK_END)
+	if err != nil {
+		raiseIOError(ErrIOSeek, "getting the length of the database file", err)
+	}
+
+	pager.FileLength = uint32(fileLength)
+	pager.NumPages = uint32(fileLength / constants.PAGE_SIZE)
+
+	if fileLength%constants.PAGE_SIZE != 0 {
+		raiseCorrupt("Db file is not a whole number of pages. Corrupt file.")
+	}
+
+	// The journal mode is read straight from the file since the header page
+	// itself may have newer versions in the WAL
+	if fileLength >= constants.PAGE_SIZE {
+		header := make([]byte, constants.HEADER_SIZE)
+		if _, err := syscall.Pread(fd, header, 0); err != nil {
+			raiseIOError(ErrIORead, "reading the database file", err)
+		}
+		pager.ChangeCounter = *HeaderChangeCounter(header)
+		if *HeaderFormatVersion(header) == constants.FORMAT_VERSION_WAL {
+			// The shared lock is kept for as long as the database is open
+			WalOpen(pager)
+			return pager
+		}
+	}
+	PagerUnlock(pager, constants.LOCK_NONE)
+	return pager
+}
+
+// Closes whatever files of a pager are still open, ignoring any errors since
+// the failure that got here is what gets reported. A journal that is closed
+// without being deleted is rolled back by the next connection.
+func pagerCloseFiles(pager *Pager) {
+	if pager.Journal != nil {
+		syscall.Close(pager.Journal.FileDescriptor)
+		pager.Journal = nil
+	}
+	if pager.Wal != nil {
+		syscall.Close(pager.Wal.FileDescriptor)
+		pager.Wal = nil
+	}
+	if pager.PendingFileDescriptor >= 0 {
+		syscall.Unlink(PendingPath(pager.FileName))
+		syscall.Close(pager.PendingFileDescriptor)
+		pager.PendingFileDescriptor = -1
+	}
+	if pager.FileDescriptor >= 0 {
+		syscall.Close(pager.FileDescriptor)
+		pager.FileDescriptor = -1
+	}
+}
+
+// Writes a cached page back to the file and marks it clean
+func PagerFlush(pager *Pager, pageNum uint32) {
+	cachedPage := pager.Pages[pageNum]
+	if cachedPage == nil {
+		raiseInternal("Tried to flush null page.")
+	}
+
+	if pager.Wal != nil {
+		WalAppendFrame(pager, pageNum, cachedPage.Data, 0)
+		cachedPage.Dirty = false
+		return
+	}
+
+	if pager.Lock != constants.LOCK_EXCLUSIVE {
+		raiseInternal("Tried to write page %d without the exclusive lock.", pageNum)
+	}
+	// The original page has to be safe in the journal before it is overwritten
+	JournalSync(pager)
+
+	_, err := syscall.Seek(pager.FileDescriptor, int64(pageNum)*constants.PAGE_SIZE, os.SEEK_SET)
+	if err != nil {
+		raiseIOError(ErrIOSeek, "seeking in the database file", err)
+	}
+
+	bytesWritten, err := syscall.Write(pager.FileDescriptor, cachedPage.Data)
+	if bytesWritten == 0 || err != nil {
+		raiseIOError(ErrIOWrite, "writing the database file", err)
+	}
+
+	if endOfPage := (pageNum + 1) * constants.PAGE_SIZE; endOfPage > pager.FileLength {
+		pager.FileLength = endOfPage
+	}
+	cachedPage.Dirty = false
+}
+
+// Writes every dirty page back to the file, in page order
+func PagerFlushAll(pager *Pager) {
+	header := GetPage(pager, constants.HEADER_PAGE_NUM)
+	if *HeaderPageCount(header) != pager.NumPages {
+		MarkPageDirty(pager, constants.HEADER_PAGE_NUM)
+		*HeaderPageCount(header) = pager.NumPages
+	}
+
+	for _, pageNum := range dirtyPageNums(pager) {
+		PagerFlush(pager, pageNum)
+	}
+}
+
+func dirtyPageNums(pager *Pager) []uint32 {
+	pageNums := make([]uint32, 0)
+	for pageNum, cachedPage := range pager.Pages {
+		if cachedPage.Dirty {
+			pageNums = append(pageNums, pageNum)
+		}
+	}
+	sort.Slice(pageNums, func(i, j int) bool { return pageNums[i] < pageNums[j] })
+	return pageNums
+}
+
+// Makes every change since the last commit durable. Once the database file
+// is synced the journal is no longer needed, and deleting it is the commit point.
+// In WAL mode the synced commit frame is the commit point instead. In rollback
+// journal mode this also ends the read, and returns false without committing
+// anything if other connections are still reading.
+func PagerCommit(pager *Pager) bool {
+	if pager.Wal != nil {
+		if !pager.Wal.WriteLocked {
+			return true
+		}
+		WalCommit(pager)
+		if pager.Wal.MaxFrame >= constants.WAL_AUTOCHECKPOINT_FRAMES {
+			PagerCheckpoint(pager)
+		}
+		return true
+	}
+	journal := pager.Journal
+	if journal != nil && (len(journal.JournaledPages) > 0 || pager.NumPages != journal.OriginalNumPages) {
+		if !PagerLock(pager, constants.LOCK_EXCLUSIVE) {
+			return false
+		}
+		// Tells other connections the pages they have cached are out of date
+		header := GetPage(pager, constants.HEADER_PAGE_NUM)
+		MarkPageDirty(pager, constants.HEADER_PAGE_NUM)
+		*HeaderChangeCounter(header) += 1
+		pager.ChangeCounter = *HeaderChangeCounter(header)
+		PagerFlushAll(pager)
+		if err := syscall.Fsync(pager.FileDescriptor); err != nil {
+			raiseIOError(ErrIOFsync, "syncing the database file", err)
+		}
+	}
+	JournalFinish(pager)
+	PagerUnlock(pager, constants.LOCK_NONE)
+	return true
+}
+
+func GetPage(pagerInstance *Pager, pageNum uint32) []byte {
+	if cachedPage, ok := pagerInstance.Pages[pageNum]; ok {
+		pagerInstance.RecentlyUsed.MoveToFront(cachedPage.element)
+		return cachedPage.Data
+	}
+
+	for len(pagerInstance.Pages) >= pagerInstance.CacheSize {
+		if !PagerEvict(pagerInstance) {
+			break
+		}
+	}
+
+	page := make([]byte, constants.PAGE_SIZE)
+	numPages := pagerInstance.FileLength / constants.PAGE_SIZE
+
+	if pagerInstance.FileLength%constants.PAGE_SIZE != 0 {
+		numPages += 1
+	}
+
+	if pagerInstance.Wal != nil && WalReadPage(pagerInstance, pageNum, page) {
+		// The WAL holds a newer version than the database file
+	} else if pageNum < numPages {
+		_, errSeek := syscall.Seek(pagerInstance.FileDescriptor, int64(pageNum)*constants.PAGE_SIZE, os.SEEK_SET)
+		_, errRead := syscall.Read(pagerInstance.FileDescriptor, page)
+		if errSeek != nil {
+			raiseIOError(ErrIOSeek, "seeking in the database file", errSeek)
+		}
+		if errRead != nil {
+			raiseIOError(ErrIORead, "reading the database file", errRead)
+		}
+	}
+
+	cachedPage := &CachedPage{PageNum: pageNum, Data: page}
+	cachedPage.element = pagerInstance.RecentlyUsed.PushFront(cachedPage)
+	pagerInstance.Pages[pageNum] = cachedPage
+
+	if pageNum >= pagerInstance.NumPages {
+		// Pages past the end of the file only exist in the cache until they are flushed
+		pagerInstance.NumPages = pageNum + 1
+		MarkPageDirty(pagerInstance, pageNum)
+	}
+
+	return page
+}
+
+// Must be called before changing a page so it gets written back, and so its
+// original contents can be journaled while they are still intact
+func MarkPageDirty(pagerInstance *Pager, pageNum uint32) {
+	cachedPage, ok := pagerInstance.Pages[pageNum]
+	if !ok {
+		raiseInternal("Tried to mark uncached page %d dirty.", pageNum)
+	}
+	if pagerInstance.Wal != nil {
+		if !pagerInstance.Wal.WriteLocked {
+			raiseInternal("Tried to change page %d outside of a write.", pageNum)
+		}
+	} else if !cachedPage.Dirty {
+		JournalPage(pagerInstance, pageNum, cachedPage.Data)
+	}
+	cachedPage.Dirty = true
+}
+
+// Throws away every change since the last commit, ending the read as well in
+// rollback journal mode
+func PagerRollback(pagerInstance *Pager) {
+	if pagerInstance.Wal != nil {
+		if pagerInstance.Wal.WriteLocked {
+			WalRollback(pagerInstance)
+		}
+		return
+	}
+	defer PagerUnlock(pagerInstance, constants.LOCK_NONE)
+	if pagerInstance.Journal != nil {
+		JournalRollback(pagerInstance)
+	}
+}
+
+// Called before a statement reads the database. This picks up transactions
+// other connections committed since the last statement, unless an open
+// transaction has to keep reading the snapshot it started with. Returns false
+// if another connection is writing to the database file.
+func PagerBeginRead(pagerInstance *Pager) bool {
+	if pagerInstance.InTransaction {
+		return true
+	}
+	if pagerInstance.Wal == nil {
+		if !PagerLock(pagerInstance, constants.LOCK_SHARED) {
+			return false
+		}
+		if pagerInstance.Journal != nil {
+			return true
+		}
+		if changeCounter := pagerChangeCounter(pagerInstance); changeCounter != pagerInstance.ChangeCounter {
+			pagerReload(pagerInstance, changeCounter)
+			// Another connection may have switched the database to WAL mode,
+			// which keeps the shared lock from now on
+			if header := GetPage(pagerInstance, constants.HEADER_PAGE_NUM); *HeaderFormatVersion(header) == constants.FORMAT_VERSION_WAL {
+				WalOpen(pagerInstance)
+				PagerDropCache(pagerInstance)
+			}
+		}
+		return true
+	}
+	if pagerInstance.Wal.WriteLocked {
+		return true
+	}
+	if WalRefresh(pagerInstance) {
+		PagerDropCache(pagerInstance)
+		pagerInstance.NumPages = walSnapshotNumPages(pagerInstance)
+	}
+	return true
+}
+
+// Ends a read outside of a transaction, letting a writer at the database file
+// again in rollback journal mode. A write ends with its commit instead.
+func PagerEndRead(pagerInstance *Pager) {
+	if pagerInstance.Wal != nil || pagerInstance.InTransaction || pagerInstance.Journal != nil {
+		return
+	}
+	PagerUnlock(pagerInstance, constants.LOCK_NONE)
+}
+
+// Called before a statement changes the database. Returns false if another
+// connection is writing.
+func PagerBeginWrite(pagerInstance *Pager) bool {
+	if pagerInstance.Wal == nil {
+		return JournalBeginWrite(pagerInstance)
+	}
+	return WalBeginWrite(pagerInstance)
+}
+
+// Reads the change counter straight from the database file, where other
+// connections' commits show up. A file without a header yet counts as 0.
+func pagerChangeCounter(pagerInstance *Pager) uint32 {
+	header := make([]byte, constants.HEADER_SIZE)
+	bytesRead, err := syscall.Pread(pagerInstance.FileDescriptor, header, 0)
+	if err != nil {
+		raiseIOError(ErrIORead, "reading the database file", err)
+	}
+	if bytesRead < len(header) {
+		return 0
+	}
+	return *HeaderChangeCounter(header)
+}
+
+// Forgets the cached pages once another connection has committed, picking
+// up the new length of the database file
+func pagerReload(pagerInstance *Pager, changeCounter uint32) {
+	fileLength, err := syscall.Seek(pagerInstance.FileDescriptor, 0, os.SEEK_END)
+	if err != nil {
+		raiseIOError(ErrIOSeek, "getting the length of the database file", err)
+	}
+	PagerDropCache(pagerInstance)
+	pagerInstance.FileLength = uint32(fileLength)
+	pagerInstance.NumPages = uint32(fileLength / constants.PAGE_SIZE)
+	pagerInstance.ChangeCounter = changeCounter
+}
+
+// Forgets every cached page, there must be no uncommitted changes
+func PagerDropCache(pagerInstance *Pager) {
+	pagerInstance.Pages = make(map[uint32]*CachedPage)
+	pagerInstance.RecentlyUsed.Init()
+}
+
+// Checkpoints the WAL if no other connection has the database open. Returns
+// false if the checkpoint had to be skipped.
+func PagerCheckpoint(pagerInstance *Pager) bool {
+	if !PagerLockExclusive(pagerInstance) {
+		return false
+	}
+	WalCheckpoint(pagerInstance)
+	walLock(pagerInstance.FileDescriptor, syscall.LOCK_SH)
+	pagerInstance.Lock = constants.LOCK_SHARED
+	return true
+}
+
+// Upgrades this connection's database lock, failing if any other connection holds one
+func PagerLockExclusive(pagerInstance *Pager) bool {
+	err := syscall.Flock(pagerInstance.FileDescriptor, syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		// A failed upgrade can give up the shared lock, and without it another
+		// connection could checkpoint while this one still reads the WAL
+		walLock(pagerInstance.FileDescriptor, syscall.LOCK_SH)
+		return false
+	} else if err != nil {
+		raiseIOError(ErrIOLock, "locking the database file", err)
+	}
+	pagerInstance.Lock = constants.LOCK_EXCLUSIVE
+	return true
+}
+
+func JournalMode(pagerInstance *Pager) string {
+	if pagerInstance.Wal != nil {
+		return "wal"
+	}
+	return "delete"
+}
+
+// Switches between the rollback journal ("delete") and WAL mode, committing
+// any pending changes first
+func SetJournalMode(pagerInstance *Pager, mode string) error {
+	if mode != "wal" && mode != "delete" {
+		return errorf(ErrError, "Unknown journal mode '%s'.", mode)
+	}
+	if mode == JournalMode(pagerInstance) {
+		return nil
+	}
+	if pagerInstance.InTransaction {
+		return errorf(ErrMisuse, "Cannot change the journal mode inside a transaction.")
+	}
+	if !PagerBeginWrite(pagerInstance) {
+		return newError(ErrBusy)
+	}
+
+	switch mode {
+	case "wal":
+		header := GetPage(pagerInstance, constants.HEADER_PAGE_NUM)
+		MarkPageDirty(pagerInstance, constants.HEADER_PAGE_NUM)
+		*HeaderFormatVersion(header) = constants.FORMAT_VERSION_WAL
+		if !PagerCommit(pagerInstance) {
+			PagerRollback(pagerInstance)
+			return newError(ErrBusy)
+		}
+		// WAL mode keeps the shared lock for as long as the database is open
+		walLock(pagerInstance.FileDescriptor, syscall.LOCK_SH)
+		pagerInstance.Lock = constants.LOCK_SHARED
+		WalOpen(pagerInstance)
+	case "delete":
+		// Every frame has to be back in the database file before the WAL can go
+		if !PagerLockExclusive(pagerInstance) {
+			PagerRollback(pagerInstance)
+			return errorf(ErrBusy, "Cannot leave WAL mode while other connections have the database open.")
+		}
+		WalCheckpoint(pagerInstance)
+		WalClose(pagerInstance, true)
+		header := GetPage(pagerInstance, constants.HEADER_PAGE_NUM)
+		MarkPageDirty(pagerInstance, constants.HEADER_PAGE_NUM)
+		*HeaderFormatVersion(header) = constants.FORMAT_VERSION_ROLLBACK
+		// The exclusive lock is still held, so this can't be turned away
+		PagerCommit(pagerInstance)
+	}
+	return nil
+}
+
+// Drops the least recently used page from the cache, writing it back first if
+// it changed. In rollback journal mode a changed page can only be written once
+// no other connection is reading, until then the least recently used unchanged
+// page goes instead. Returns false if no page could be dropped, in which case
+// the cache grows past its size for now.
+func PagerEvict(pagerInstance *Pager) bool {
+	element := pagerInstance.RecentlyUsed.Back()
+	if element == nil {
+		return false
+	}
+	if element.Value.(*CachedPage).Dirty && pagerInstance.Wal == nil && !PagerLock(pagerInstance, constants.LOCK_EXCLUSIVE) {
+		for element != nil && element.Value.(*CachedPage).Dirty {
+			element = element.Prev()
+		}
+		if element == nil {
+			return false
+		}
+	}
+	cachedPage := element.Value.(*CachedPage)
+	if cachedPage.Dirty {
+		PagerFlush(pagerInstance, cachedPage.PageNum)
+	}
+	pagerInstance.RecentlyUsed.Remove(element)
+	delete(pagerInstance.Pages, cachedPage.PageNum)
+	return true
+}
+
+func SetCacheSize(pagerInstance *Pager, cacheSize int) {
+	if cacheSize < constants.MIN_CACHE_SIZE {
+		cacheSize = constants.MIN_CACHE_SIZE
+	}
+	pagerInstance.CacheSize = cacheSize
+	for len(pagerInstance.Pages) > pagerInstance.CacheSize {
+		if !PagerEvict(pagerInstance) {
+			break
+		}
+	}
+}
+
+// Hands out a page from the free list if there is one, otherwise a page past
+// the end of the file. Pages taken from the free list come back zeroed.
+func GetUnusedPageNum(pagerInstance *Pager) uint32 {
+	header := GetPage(pagerInstance, constants.HEADER_PAGE_NUM)
+	trunkPageNum := *FreeListHead(header)
+	if trunkPageNum == 0 {
+		return pagerInstance.NumPages
+	}
+
+	trunk := GetPage(pagerInstance, trunkPageNum)
+	MarkPageDirty(pagerInstance, constants.HEADER_PAGE_NUM)
+	MarkPageDirty(pagerInstance, trunkPageNum)
+	numLeaves := *FreeListTrunkNumLeaves(trunk)
+	pageNum := trunkPageNum
+	if numLeaves > 0 {
+		pageNum = *FreeListTrunkLeaf(trunk, numLeaves-1)
+		*FreeListTrunkNumLeaves(trunk) = numLeaves - 1
+	} else {
+		// The trunk has no leaves left, so the trunk page itself is reused
+		*FreeListHead(header) = *FreeListTrunkNext(trunk)
+	}
+	*FreePageCount(header) -= 1
+
+	page := GetPage(pagerInstance, pageNum)
+	MarkPageDirty(pagerInstance, pageNum)
+	for i := range page {
+		page[i] = 0
+	}
+	return pageNum
+}
+
+// Adds a page that is no longer part of any tree to the free list
+func FreePage(pagerInstance *Pager, pageNum uint32) {
+	header := GetPage(pagerInstance, constants.HEADER_PAGE_NUM)
+	MarkPageDirty(pagerInstance, constants.HEADER_PAGE_NUM)
+	trunkPageNum := *FreeListHead(header)
+	*FreePageCount(header) += 1
+
+	if trunkPageNum != 0 {
+		trunk := GetPage(pagerInstance, trunkPageNum)
+		numLeaves := *FreeListTrunkNumLeaves(trunk)
+		if numLeaves < uint32(constants.FREE_LIST_TRUNK_MAX_LEAVES) {
+			MarkPageDirty(pagerInstance, trunkPageNum)
+			*FreeListTrunkLeaf(trunk, numLeaves) = pageNum
+			*FreeListTrunkNumLeaves(trunk) = numLeaves + 1
+			return
+		}
+	}
+
+	// No room on the current trunk, so the freed page becomes the new head trunk
+	trunk := GetPage(pagerInstance, pageNum)
+	MarkPageDirty(pagerInstance, pageNum)
+	for i := range trunk {
+		trunk[i] = 0
+	}
+	*FreeListTrunkNext(trunk) = trunkPageNum
+	header = GetPage(pagerInstance, constants.HEADER_PAGE_NUM)
+	MarkPageDirty(pagerInstance, constants.HEADER_PAGE_NUM)
+	*FreeListHead(header) = pageNum
+}
+
+func HeaderFormatVersion(header []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&header[constants.HEADER_FORMAT_VERSION_OFFSET]))
+}
+
+func HeaderPageSize(header []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&header[constants.HEADER_PAGE_SIZE_OFFSET]))
+}
+
+func HeaderPageCount(header []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&header[constants.HEADER_PAGE_COUNT_OFFSET]))
+}
+
+// Bumped whenever the schema changes so cached schema information can be detected as stale
+func HeaderSchemaCookie(header []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&header[constants.HEADER_SCHEMA_COOKIE_OFFSET]))
+}
+
+// Bumped by every commit in rollback journal mode so other connections can
+// tell their cached pages are stale
+func HeaderChangeCounter(header []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&header[constants.HEADER_CHANGE_COUNTER_OFFSET]))
+}
+
+func InitializeHeader(header []byte) {
+	copy(header[constants.HEADER_MAGIC_OFFSET:], constants.HEADER_MAGIC)
+	*HeaderFormatVersion(header) = constants.FORMAT_VERSION_ROLLBACK
+	*HeaderPageSize(header) = constants.PAGE_SIZE
+	*HeaderPageCount(header) = 0
+	*FreeListHead(header) = 0
+	*FreePageCount(header) = 0
+	*HeaderSchemaCookie(header) = 0
+}
+
+// Checks that the header describes a database this build can read, given the
+// number of whole pages actually in the file
+func ValidateHeader(header []byte, numPages uint32) error {
+	magic := string(header[constants.HEADER_MAGIC_OFFSET : constants.HEADER_MAGIC_OFFSET+constants.HEADER_MAGIC_SIZE])
+	if magic != constants.HEADER_MAGIC {
+		return fmt.Errorf("File is not a goqlite database.")
+	}
+	if version := *HeaderFormatVersion(header); version > constants.HEADER_FORMAT_VERSION {
+		return fmt.Errorf("Database file format version %d is newer than the supported version %d.", version, constants.HEADER_FORMAT_VERSION)
+	} else if version == 0 {
+		return fmt.Errorf("Database file format version 0 is invalid. Corrupt file.")
+	}
+	if pageSize := *HeaderPageSize(header); pageSize != constants.PAGE_SIZE {
+		return fmt.Errorf("Database page size %d is not supported, expected %d.", pageSize, constants.PAGE_SIZE)
+	}
+	if pageCount := *HeaderPageCount(header); pageCount != numPages {
+		return fmt.Errorf("Database header records %d pages but the file holds %d. Corrupt file.", pageCount, numPages)
+	}
+	if *FreePageCount(header) >= numPages {
+		return fmt.Errorf("Database free list is larger than the file. Corrupt file.")
+	}
+	return nil
+}
+
+func FreeListHead(header []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&header[constants.FREE_LIST_HEAD_OFFSET]))
+}
+
+func FreePageCount(header []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&header[constants.FREE_PAGE_COUNT_OFFSET]))
+}
+
+func FreeListTrunkNext(trunk []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&trunk[constants.FREE_LIST_TRUNK_NEXT_OFFSET]))
+}
+
+func FreeListTrunkNumLeaves(trunk []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&trunk[constants.FREE_LIST_TRUNK_NUM_LEAVES_OFFSET]))
+}
+
+func FreeListTrunkLeaf(trunk []byte, leafNum uint32) *uint32 {
+	offset := constants.FREE_LIST_TRUNK_HEADER_SIZE + uintptr(leafNum)*constants.FREE_LIST_TRUNK_LEAF_SIZE
+	return (*uint32)(unsafe.Pointer(&trunk[offset]))
+}
+
+// Table Code
+
+// Largest key in the table, 0 if the table is empty
+func TableMaxKey(tableInstance *Table) uint32 {
+	root := GetPage(tableInstance.Pager, tableInstance.RootPageNum)
+	if GetNodeType(root) == constants.NODE_LEAF && *LeafNodeNumCells(root) == 0 {
+		return 0
+	}
+	return GetNodeMaxKey(tableInstance.Pager, root)
+}
+
+// Number of rows in the table, added up from the cell counts of its leaves
+// without reading any rows
+func TableCount(tableInstance *Table) int64 {
+	pageNum := tableInstance.RootPageNum
+	nodeInstance := GetPage(tableInstance.Pager, pageNum)
+	for GetNodeType(nodeInstance) != constants.NODE_LEAF {
+		pageNum = *InternalNodeChild(nodeInstance, 0)
+		nodeInstance = GetPage(tableInstance.Pager, pageNum)
+	}
+
+	count := int64(0)
+	for {
+		count += int64(*LeafNodeNumCells(nodeInstance))
+		pageNum = *LeafNodeNextLeaf(nodeInstance)
+		if pageNum == 0 {
+			return count
+		}
+		nodeInstance = GetPage(tableInstance.Pager, pageNum)
+	}
+}
+
+// Opens the database file, creating it if it doesn't exist. Raises an ErrIO
+// or ErrCorrupt *Error if it can't be read as a database, see RecoverError.
+func DBOpen(fileName string) *Database {
+	return dbOpen(fileName, false)
+}
+
+// Like DBOpen, creating a new database with the users table when usersTable is set
+func dbOpen(fileName string, usersTable bool) *Database {
+	pagerInstance := PagerOpen(fileName)
+	defer func() {
+		// Nothing is left open when the file turns out to be unusable
+		if recovered := recover(); recovered != nil {
+			pagerCloseFiles(pagerInstance)
+			panic(recovered)
+		}
+	}()
+	databaseInstance := &Database{Pager: pagerInstance}
+	if pagerInstance.FileLength == 0 {
+		// Another connection may be creating the file at the same time
+		if !PagerBeginWrite(pagerInstance) {
+			panic(newError(ErrBusy))
+		}
+	}
+	if pagerInstance.FileLength == 0 {
+		header := GetPage(pagerInstance, constants.HEADER_PAGE_NUM)
+		MarkPageDirty(pagerInstance, constants.HEADER_PAGE_NUM)
+		InitializeHeader(header)
+		catalogRoot := GetPage(pagerInstance, constants.CATALOG_ROOT_PAGE_NUM)
+		MarkPageDirty(pagerInstance, constants.CATALOG_ROOT_PAGE_NUM)
+		InitializeLeafNode(catalogRoot)
+		SetNodeRoot(catalogRoot, true)
+
+		// The table is part of the new file rather than a change to its schema
+		if usersTable {
+			catalog := CatalogTable(pagerInstance)
+			databaseInstance.Tables = map[string]*Table{constants.CATALOG_TABLE_NAME: catalog}
+			node, _ := Parse(constants.DEFAULT_TABLE_SQL)
+			tableInstance, _ := NewTable(node.(*CreateTableStmt), constants.DEFAULT_TABLE_SQL)
+			CreateTable(databaseInstance, tableInstance)
+		}
+	}
+	if !PagerCommit(pagerInstance) || !PagerBeginRead(pagerInstance) {
+		panic(newError(ErrBusy))
+	}
+	defer PagerEndRead(pagerInstance)
+
+	header := GetPage(pagerInstance, constants.HEADER_PAGE_NUM)
+	if err := ValidateHeader(header, pagerInstance.NumPages); err != nil {
+		raiseCorrupt("%v", err)
+	}
+	if err := LoadSchema(databaseInstance); err != nil {
+		panic(err)
+	}
+	return databaseInstance
+}
+
+func DBClose(databaseInstance *Database) {
+	pagerInstance := databaseInstance.Pager
+	// The files are closed whatever goes wrong on the way
+	defer pagerCloseFiles(pagerInstance)
+
+	// A transaction that was never committed is abandoned
+	if pagerInstance.InTransaction {
+		PagerRollback(pagerInstance)
+		pagerInstance.InTransaction = false
+	}
+	PagerCommit(pagerInstance)
+
+	// The last connection out folds the WAL back into the database file
+	if pagerInstance.Wal != nil {
+		if PagerLockExclusive(pagerInstance) {
+			WalCheckpoint(pagerInstance)
+			WalClose(pagerInstance, true)
+		} else {
+			WalClose(pagerInstance, false)
+		}
+	}
+
+	fd := pagerInstance.FileDescriptor
+	pagerInstance.FileDescriptor = -1
+	result := syscall.Close(fd)
+	if result != nil {
+		raiseIOError(ErrIOClose, "closing the database file", result)
+	}
+
+	pagerInstance.Pages = make(map[uint32]*CachedPage)
+	pagerInstance.RecentlyUsed.Init()
+}
+
+// Parse Command Code
+
+// Parses input and checks it against the schema, filling in statement for the executor
+func PrepareStatement(input string, statement *Statement, databaseInstance *Database) error {
+	node, err := Parse(input)
+	if err != nil {
+		return err
+	}
+	return PrepareNode(node, input, statement, databaseInstance)
+}
+
+// Checks a statement that has been parsed from input against the schema
+func PrepareNode(node StatementNode, input string, statement *Statement, databaseInstance *Database) (err error) {
+	if err := RefreshSchema(databaseInstance); err != nil {
+		return err
+	}
+	statement.SchemaCookie = databaseInstance.SchemaCookie
+
+	statement.Program, statement.Explain = nil, ""
+	if explain, ok := node.(*ExplainStmt); ok {
+		statement.Explain = constants.EXPLAIN_PROGRAM
+		if explain.QueryPlan {
+			statement.Explain = constants.EXPLAIN_QUERY_PLAN
+		}
+		node = explain.Statement
+	}
+
+	switch node := node.(type) {
+	case *InsertStmt:
+		err = prepareInsert(node, statement, databaseInstance)
+	case *SelectStmt:
+		err = prepareSelect(node, statement, databaseInstance)
+	case *UpdateStmt:
+		err = prepareUpdate(node, statement, databaseInstance)
+	case *DeleteStmt:
+		err = prepareDelete(node, statement, databaseInstance)
+	case *CreateTableStmt:
+		return schemaError(prepareCreateTable(node, input, statement, databaseInstance))
+	case *CreateIndexStmt:
+		return schemaError(prepareCreateIndex(node, input, statement, databaseInstance))
+	case *BeginStmt:
+		statement.Type = constants.STATEMENT_BEGIN
+	case *CommitStmt:
+		statement.Type = constants.STATEMENT_COMMIT
+	case *RollbackStmt:
+		statement.Type = constants.STATEMENT_ROLLBACK
+	}
+	if err != nil {
+		return schemaError(err)
+	}
+	statement.Program = CompileStatement(statement, statement.Table)
+	return nil
+}
+
+// Statements that don't fit the schema fail with plain errors built where the
+// problem is found, which are reported as ErrError
+func schemaError(err error) error {
+	var goqliteError *Error
+	if err == nil || errors.As(err, &goqliteError) {
+		return err
+	}
+	return &Error{Code: ErrError, Message: err.Error()}
+}
+
+// Finds a table that statements may change. The catalog only changes through
+// CREATE TABLE and CREATE INDEX.
+func writableTable(databaseInstance *Database, name string) (*Table, error) {
+	tableInstance, err := FindTable(databaseInstance, name)
+	if err == nil && tableInstance.Name == constants.CATALOG_TABLE_NAME {
+		return nil, fmt.Errorf("Table %s may not be modified.", tableInstance.Name)
+	}
+	return tableInstance, err
+}
+
+func prepareInsert(node *InsertStmt, statement *Statement, databaseInstance *Database) error {
+	tableInstance, err := writableTable(databaseInstance, node.Table)
+	if err != nil {
+		return err
+	}
+	if len(node.Rows) != 1 {
+		return fmt.Errorf("Only one row can be inserted at a time.")
+	}
+
+	// Columns the statement leaves out are NULL
+	positions := make([]int, 0, len(tableInstance.Columns))
+	if len(node.Columns) == 0 {
+		for i := range tableInstance.Columns {
+			positions = append(positions, i)
+		}
+	}
+	for _, name := range node.Columns {
+		position := ColumnIndex(tableInstance, name)
+		if position < 0 {
+			return fmt.Errorf("No such column: %s.", name)
+		}
+		positions = append(positions, position)
+	}
+	values := node.Rows[0]
+	if len(values) != len(positions) {
+		return fmt.Errorf("%d values for %d columns.", len(values), len(positions))
+	}
+
+	row := Row{Values: make([]interface{}, len(tableInstance.Columns))}
+	for i, position := range positions {
+		value, err := constantValue(values[i])
+		if err != nil {
+			return err
+		}
+		row.Values[position] = value
+	}
+	for i := range tableInstance.Columns {
+		if i == tableInstance.KeyColumn && row.Values[i] == nil {
+			// The executor picks a key
+			continue
+		}
+		value, err := ColumnValue(&tableInstance.Columns[i], row.Values[i])
+		if err != nil {
+			return err
+		}
+		row.Values[i] = value
+	}
+
+	if tableInstance.KeyColumn >= 0 && row.Values[tableInstance.KeyColumn] != nil {
+		key := row.Values[tableInstance.KeyColumn].(int64)
+		if key <= 0 {
+			return fmt.Errorf("ID must be positive.")
+		}
+		if key > math.MaxUint32 {
+			return fmt.Errorf("ID is too large.")
+		}
+		row.Key = uint32(key)
+	}
+
+	statement.Type = constants.STATEMENT_INSERT
+	statement.Table = tableInstance
+	statement.RowToInsert = row
+	return nil
+}
+
+func prepareSelect(node *SelectStmt, statement *Statement, databaseInstance *Database) error {
+	tableInstance, err := fromTable(node, databaseInstance)
+	if err != nil {
+		return err
+	}
+
+	resultColumns := make([]Expression, 0, len(node.Columns))
+	var columnNames []string
+	for _, column := range node.Columns {
+		if column.Expr == nil {
+			if tableInstance == nil {
+				return fmt.Errorf("SELECT * needs a FROM clause.")
+			}
+			var expanded []Expression
+			if tableInstance.Sources != nil {
+				expanded = joinedColumns(tableInstance)
+			} else {
+				for _, tableColumn := range tableInstance.Columns {
+					expanded = append(expanded, &ColumnExpr{Column: tableColumn.Name})
+				}
+			}
+			for _, expression := range expanded {
+				resultColumns = append(resultColumns, expression)
+				columnNames = append(columnNames, expression.(*ColumnExpr).Column)
+			}
+			continue
+		}
+		if err := CheckAggregateExpression(column.Expr, tableInstance); err != nil {
+			return err
+		}
+		resultColumns = append(resultColumns, column.Expr)
+		if column.Alias != "" {
+			columnNames = append(columnNames, column.Alias)
+		} else if columnExpression, ok := column.Expr.(*ColumnExpr); ok {
+			columnNames = append(columnNames, columnExpression.Column)
+		} else {
+			columnNames = append(columnNames, FormatExpression(column.Expr))
+		}
+	}
+
+	if node.Where != nil {
+		if err := CheckExpression(node.Where, tableInstance); err != nil {
+			return err
+		}
+	}
+
+	groupBy := make([]Expression, 0, len(node.GroupBy))
+	for i, term := range node.GroupBy {
+		expression, err := resultColumnTerm("GROUP BY", node, resultColumns, i, term, tableInstance)
+		if err != nil {
+			return err
+		}
+		if len(collectAggregates(expression, nil)) > 0 {
+			return fmt.Errorf("Aggregate functions are not allowed in the GROUP BY clause.")
+		}
+		groupBy = append(groupBy, expression)
+	}
+
+	if node.Having != nil {
+		if err := CheckAggregateExpression(node.Having, tableInstance); err != nil {
+			return err
+		}
+	}
+
+	orderBy := make([]OrderingTerm, 0, len(node.OrderBy))
+	for i, term := range node.OrderBy {
+		expression, err := resultColumnTerm("ORDER BY", node, resultColumns, i, term.Expr, tableInstance)
+		if err != nil {
+			return err
+		}
+		orderBy = append(orderBy, OrderingTerm{Expr: expression, Descending: term.Descending})
+	}
+
+	var aggregates []*FunctionExpr
+	expressions := append(append([]Expression{}, resultColumns...), node.Having)
+	for _, term := range orderBy {
+		expressions = append(expressions, term.Expr)
+	}
+	for _, expression := range expressions {
+		for _, call := range collectAggregates(expression, nil) {
+			// ORDER BY terms can be the very same expressions as result columns
+			if !containsAggregate(aggregates, call) {
+				aggregates = append(aggregates, call)
+			}
+		}
+	}
+	if node.Having != nil && len(groupBy) == 0 && len(aggregates) == 0 {
+		return fmt.Errorf("HAVING clause on a non-aggregate query.")
+	}
+
+	limit, offset := int64(-1), int64(0)
+	if node.Limit != nil {
+		var err error
+		if limit, err = integerClause("LIMIT", node.Limit); err != nil {
+			return err
+		}
+	}
+	if node.Offset != nil {
+		var err error
+		if offset, err = integerClause("OFFSET", node.Offset); err != nil {
+			return err
+		}
+	}
+
+	statement.Type = constants.STATEMENT_SELECT
+	statement.Table = tableInstance
+	if tableInstance != nil && tableInstance.Sources != nil {
+		planJoin(tableInstance, node.Where)
+	} else if tableInstance != nil {
+		planTable(statement, tableInstance, node.Where)
+	}
+	statement.ResultColumns = resultColumns
+	statement.ColumnNames = columnNames
+	statement.Where = node.Where
+	statement.GroupBy = groupBy
+	statement.Having = node.Having
+	statement.Aggregates = aggregates
+	statement.CountFromLeaves = tableInstance != nil && tableInstance.Sources == nil && node.Where == nil && len(groupBy) == 0 && countsOnly(aggregates, expressions)
+	statement.OrderBy = orderBy
+	statement.Limit = limit
+	statement.Offset = offset
+	return nil
+}
+
+// Resolves the ith term of a GROUP BY or ORDER BY clause. A number picks a
+// result column, counting from 1, and a bare name picks the result column
+// with that alias.
+func resultColumnTerm(clause string, node *SelectStmt, resultColumns []Expression, i int, expression Expression, tableInstance *Table) (Expression, error) {
+	if literal, ok := expression.(*LiteralExpr); ok {
+		if position, ok := literal.Value.(int64); ok {
+			if position < 1 || position > int64(len(resultColumns)) {
+				return nil, fmt.Errorf("%s term %d is out of range, it should be between 1 and %d.", clause, i+1, len(resultColumns))
+			}
+			return resultColumns[position-1], nil
+		}
+	}
+	if column, ok := expression.(*ColumnExpr); ok && column.Table == "" {
+		for _, resultColumn := range node.Columns {
+			if resultColumn.Alias != "" && strings.EqualFold(resultColumn.Alias, column.Column) {
+				return resultColumn.Expr, nil
+			}
+		}
+	}
+	if err := CheckAggregateExpression(expression, tableInstance); err != nil {
+		return nil, err
+	}
+	return expression, nil
+}
+
+func containsAggregate(aggregates []*FunctionExpr, call *FunctionExpr) bool {
+	for _, aggregate := range aggregates {
+		if aggregate == call {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a select's only aggregates are count(*) and nothing it outputs reads
+// a column, so the number of rows is all it needs to know
+func countsOnly(aggregates []*FunctionExpr, expressions []Expression) bool {
+	if len(aggregates) == 0 {
+		return false
+	}
+	for _, call := range aggregates {
+		if !isCountStar(call) {
+			return false
+		}
+	}
+	for _, expression := range expressions {
+		if expression == nil {
+			continue
+		}
+		readsColumn := false
+		walkExpression(expression, func(expression Expression) {
+			if _, ok := expression.(*ColumnExpr); ok {
+				readsColumn = true
+			}
+		})
+		if readsColumn {
+			return false
+		}
+	}
+	return true
+}
+
+// Evaluates the number given to LIMIT or OFFSET
+func integerClause(clause string, expression Expression) (int64, error) {
+	value, err := constantValue(expression)
+	if err != nil {
+		return 0, err
+	}
+	if integer, ok := convertValue(constants.COLUMN_TYPE_INTEGER, value); ok {
+		return integer.(int64), nil
+	}
+	return 0, fmt.Errorf("%s must be an integer.", clause)
+}
+
+func prepareUpdate(node *UpdateStmt, statement *Statement, databaseInstance *Database) error {
+	tableInstance, err := writableTable(databaseInstance, node.Table)
+	if err != nil {
+		return err
+	}
+
+	assignments := make(map[int]Expression)
+	for _, assignment := range node.Assignments {
+		position := ColumnIndex(tableInstance, assignment.Column)
+		if position < 0 {
+			return fmt.Errorf("No such column: %s.", assignment.Column)
+		} else if position == tableInstance.KeyColumn {
+			return fmt.Errorf("Cannot update column %s.", tableInstance.Columns[position].Name)
+		}
+		if err := CheckExpression(assignment.Value, tableInstance); err != nil {
+			return err
+		}
+		// Values computed from the row are checked as each row is rewritten
+		value := assignment.Value
+		if constant, err := constantValue(value); err == nil {
+			if constant, err = ColumnValue(&tableInstance.Columns[position], constant); err != nil {
+				return err
+			}
+			value = &LiteralExpr{Value: constant}
+		}
+		assignments[position] = value
+	}
+	if node.Where != nil {
+		if err := CheckExpression(node.Where, tableInstance); err != nil {
+			return err
+		}
+	}
+
+	statement.Type = constants.STATEMENT_UPDATE
+	statement.Table = tableInstance
+	planTable(statement, tableInstance, node.Where)
+	low, high, err := keyRange(tableInstance, node.Where)
+	statement.KeyRequired = node.Where != nil && err == nil && low == high
+	statement.Assignments = assignments
+	statement.Where = node.Where
+	return nil
+}
+
+func prepareDelete(node *DeleteStmt, statement *Statement, databaseInstance *Database) error {
+	tableInstance, err := writableTable(databaseInstance, node.Table)
+	if err != nil {
+		return err
+	}
+	if node.Where != nil {
+		if err := CheckExpression(node.Where, tableInstance); err != nil {
+			return err
+		}
+	}
+	statement.Type = constants.STATEMENT_DELETE
+	statement.Table = tableInstance
+	planTable(statement, tableInstance, node.Where)
+	statement.Where = node.Where
+	return nil
+}
+
+func prepareCreateTable(node *CreateTableStmt, input string, statement *Statement, databaseInstance *Database) error {
+	statement.Type = constants.STATEMENT_CREATE_TABLE
+	if _, err := FindTable(databaseInstance, node.Name); err == nil {
+		if node.IfNotExists {
+			return nil
+		}
+		return fmt.Errorf("Table %s already exists.", node.Name)
+	}
+	if _, err := FindIndex(databaseInstance, node.Name); err == nil {
+		return fmt.Errorf("There is already an index named %s.", node.Name)
+	}
+
+	if strings.HasPrefix(strings.ToLower(node.Name), constants.RESERVED_TABLE_PREFIX) {
+		return fmt.Errorf("Table name %s is reserved for internal use.", node.Name)
+	}
+
+	tableInstance, err := NewTable(node, statementSQL(input))
+	if err != nil {
+		return err
+	}
+	statement.Table = tableInstance
+	return nil
+}
+
+func prepareCreateIndex(node *CreateIndexStmt, input string, statement *Statement, databaseInstance *Database) error {
+	statement.Type = constants.STATEMENT_CREATE_INDEX
+	tableInstance, err := writableTable(databaseInstance, node.Table)
+	if err != nil {
+		return err
+	}
+
+	name := node.Name
+	if name == "" {
+		name = defaultIndexName(node)
+	}
+	if _, err := FindIndex(databaseInstance, name); err == nil {
+		if node.IfNotExists {
+			return nil
+		}
+		return fmt.Errorf("Index %s already exists.", name)
+	}
+	if _, err := FindTable(databaseInstance, name); err == nil {
+		return fmt.Errorf("There is already a table named %s.", name)
+	}
+	if strings.HasPrefix(strings.ToLower(name), constants.RESERVED_TABLE_PREFIX) {
+		return fmt.Errorf("Index name %s is reserved for internal use.", name)
+	}
+
+	indexInstance, err := NewIndex(node, name, tableInstance, statementSQL(input))
+	if err != nil {
+		return err
+	}
+	statement.Table = tableInstance
+	statement.Index = indexInstance
+	return nil
+}
+
+// The statement as it is kept in the catalog, without a trailing semicolon
+func statementSQL(input string) string {
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(input), ";"))
+}
+
+// Evaluates an expression that doesn't refer to any columns
+func constantValue(expression Expression) (interface{}, error) {
+	isConstant := true
+	walkExpression(expression, func(expression Expression) {
+		if _, ok := expression.(*ColumnExpr); ok {
+			isConstant = false
+		}
+	})
+	if !isConstant {
+		return nil, fmt.Errorf("Values must be constants.")
+	}
+	if err := CheckExpression(expression, nil); err != nil {
+		return nil, err
+	}
+	return Evaluate(expression, nil, nil), nil
+}
+
+// Name of the column holding a table's keys. Tables without an INTEGER PRIMARY
+// KEY can still refer to them as rowid.
+func keyColumnName(tableInstance *Table) string {
+	if tableInstance.KeyColumn >= 0 {
+		return tableInstance.Columns[tableInstance.KeyColumn].Name
+	}
+	return "rowid"
+}
+
+// Narrows the keys a WHERE clause can match down to [low, high]. Returns low > high
+// when nothing can match. Only comparisons of the key column with a number,
+// BETWEEN and AND of those are understood, anything else is an error.
+func keyRange(tableInstance *Table, where Expression) (uint32, uint32, error) {
+	return narrowedKeyRange(tableInstance, where, false)
+}
+
+// Narrows the keys a statement has to read, going by the conditions on the key
+// that are ANDed into its WHERE clause. Every row in the range still has to be
+// checked against the whole clause.
+func seekRange(tableInstance *Table, where Expression) (uint32, uint32) {
+	low, high, _ := narrowedKeyRange(tableInstance, where, true)
+	return low, high
+}
+
+func narrowedKeyRange(tableInstance *Table, where Expression, skipOthers bool) (uint32, uint32, error) {
+	// Keys are positive, so 1 is the lowest key there can be
+	low, high := int64(1), int64(math.MaxUint32)
+	if where != nil {
+		if err := narrowKeyRange(tableInstance, where, &low, &high, skipOthers); err != nil {
+			return 0, 0, err
+		}
+	}
+	if low > high {
+		return 1, 0, nil
+	}
+	return uint32(low), uint32(high), nil
+}
+
+// Conditions other than comparisons of the key are an error, unless
+// skipOthers is set and they are left for the caller to check
+func narrowKeyRange(tableInstance *Table, where Expression, low *int64, high *int64, skipOthers bool) error {
+	raiseLow := func(value int64) {
+		if value > *low {
+			*low = value
+		}
+	}
+	lowerHigh := func(value int64) {
+		if value < *high {
+			*high = value
+		}
+	}
+
+	switch expression := where.(type) {
+	case *BinaryExpr:
+		if expression.Operator == "AND" {
+			if err := narrowKeyRange(tableInstance, expression.Left, low, high, skipOthers); err != nil {
+				return err
+			}
+			return narrowKeyRange(tableInstance, expression.Right, low, high, skipOthers)
+		}
+		operator, key, ok := keyComparison(tableInstance, expression)
+		if !ok {
+			break
+		}
+		switch operator {
+		case "=", "==":
+			raiseLow(key)
+			lowerHigh(key)
+		case "<":
+			lowerHigh(key - 1)
+		case "<=":
+			lowerHigh(key)
+		case ">":
+			raiseLow(key + 1)
+		case ">=":
+			raiseLow(key)
+		}
+		return nil
+	case *BetweenExpr:
+		lowKey, lowOk := keyBound(expression.Low)
+		highKey, highOk := keyBound(expression.High)
+		if expression.Not || !isKeyColumn(tableInstance, expression.Operand) || !lowOk || !highOk {
+			break
+		}
+		raiseLow(lowKey)
+		lowerHigh(highKey)
+		return nil
+	}
+	if skipOthers {
+		return nil
+	}
+	return fmt.Errorf("Only WHERE conditions comparing %s with a number are supported.", keyColumnName(tableInstance))
+}
+
+// Recognizes "key OP number" and "number OP key", returning the operator as if the key came first
+func keyComparison(tableInstance *Table, expression *BinaryExpr) (string, int64, bool) {
+	flipped := map[string]string{"=": "=", "==": "==", "<": ">", "<=": ">=", ">": "<", ">=": "<="}
+	if _, ok := flipped[expression.Operator]; !ok {
+		return "", 0, false
+	}
+	if key, ok := keyBound(expression.Right); ok && isKeyColumn(tableInstance, expression.Left) {
+		return expression.Operator, key, true
+	}
+	if key, ok := keyBound(expression.Left); ok && isKeyColumn(tableInstance, expression.Right) {
+		return flipped[expression.Operator], key, true
+	}
+	return "", 0, false
+}
+
+// Reads an integer constant, clamped to just outside the range of valid keys so
+// comparisons with it keep their meaning without overflowing
+func keyBound(expression Expression) (int64, bool) {
+	value, err := constantValue(expression)
+	key, ok := numericAffinity(value).(int64)
+	if err != nil || !ok {
+		return 0, false
+	}
+	if key < 0 {
+		key = 0
+	} else if key > math.MaxUint32 {
+		key = math.MaxUint32 + 1
+	}
+	return key, true
+}
+
+func isKeyColumn(tableInstance *Table, expression Expression) bool {
+	column, ok := expression.(*ColumnExpr)
+	if !ok || (column.Table != "" && !strings.EqualFold(column.Table, tableInstance.Name)) {
+		return false
+	}
+	return strings.EqualFold(column.Column, keyColumnName(tableInstance)) || strings.EqualFold(column.Column, "rowid")
+}
+
+// Plans how a statement reads the rows of a single table: the keys its WHERE
+// clause narrows them down to, or else the index that narrows them the most
+func planTable(statement *Statement, tableInstance *Table, where Expression) {
+	statement.KeyLow, statement.KeyHigh = seekRange(tableInstance, where)
+	if statement.KeyLow == 1 && statement.KeyHigh == math.MaxUint32 {
+		// Nothing narrows the keys, but an index might narrow the rows
+		statement.Index, statement.IndexLow, statement.IndexHigh = chooseIndex(tableInstance, where)
+	}
+}
+
+// A comparison of a column with a constant, with the column on the left
+type columnCondition struct {
+	Position int
+	Operator string
+	Value    interface{}
+}
+
+// Picks the index that narrows down the rows a statement reads the most, going by
+// the conditions ANDed into its WHERE clause. Equality with the leading
+// indexed columns narrows the entries down to those starting with the given
+// values, and a range on the column after them narrows them further. Returns a
+// nil index if no index has a condition on its first column.
+func chooseIndex(tableInstance *Table, where Expression) (*Index, []interface{}, []interface{}) {
+	var conditions []columnCondition
+	collectColumnConditions(tableInstance, where, &conditions)
+
+	var best *Index
+	var bestLow, bestHigh []interface{}
+	for _, indexInstance := range tableInstance.Indexes {
+		low, high := indexBounds(indexInstance, conditions)
+		if len(low)+len(high) > len(bestLow)+len(bestHigh) {
+			best, bestLow, bestHigh = indexInstance, low, high
+		}
+	}
+	return best, bestLow, bestHigh
+}
+
+func collectColumnConditions(tableInstance *Table, where Expression, conditions *[]columnCondition) {
+	switch expression := where.(type) {
+	case *BinaryExpr:
+		if expression.Operator == "AND" {
+			collectColumnConditions(tableInstance, expression.Left, conditions)
+			collectColumnConditions(tableInstance, expression.Right, conditions)
+		} else if condition, ok := columnComparison(tableInstance, expression); ok {
+			*conditions = append(*conditions, condition)
+		}
+	case *BetweenExpr:
+		position := tableColumnPosition(tableInstance, expression.Operand)
+		low, lowErr := constantValue(expression.Low)
+		high, highErr := constantValue(expression.High)
+		if expression.Not || position < 0 || lowErr != nil || highErr != nil || low == nil || high == nil {
+			return
+		}
+		if hasNumericAffinity(&tableInstance.Columns[position]) {
+			low, high = numericAffinity(low), numericAffinity(high)
+		}
+		*conditions = append(*conditions, columnCondition{position, ">=", low}, columnCondition{position, "<=", high})
+	}
+}
+
+// Recognizes "column OP constant" and "constant OP column", like keyComparison
+// does for the key. Comparisons with NULL are left out since they never match.
+func columnComparison(tableInstance *Table, expression *BinaryExpr) (columnCondition, bool) {
+	flipped := map[string]string{"=": "=", "==": "=", "<": ">", "<=": ">=", ">": "<", ">=": "<="}
+	if _, ok := flipped[expression.Operator]; !ok {
+		return columnCondition{}, false
+	}
+	operator, column, constant := expression.Operator, expression.Left, expression.Right
+	if tableColumnPosition(tableInstance, column) < 0 {
+		operator, column, constant = flipped[expression.Operator], expression.Right, expression.Left
+	}
+	position := tableColumnPosition(tableInstance, column)
+	value, err := constantValue(constant)
+	if position < 0 || err != nil || value == nil {
+		return columnCondition{}, false
+	}
+	if hasNumericAffinity(&tableInstance.Columns[position]) {
+		// Compared as the number the text spells out, as the WHERE clause does
+		value = numericAffinity(value)
+	}
+	if operator == "==" {
+		operator = "="
+	}
+	return columnCondition{position, operator, value}, true
+}
+
+// Position of the column an expression refers to, -1 if it isn't a column of the table
+func tableColumnPosition(tableInstance *Table, expression Expression) int {
+	column, ok := expression.(*ColumnExpr)
+	if !ok || (column.Table != "" && !strings.EqualFold(column.Table, tableInstance.Name)) {
+		return -1
+	}
+	return ColumnIndex(tableInstance, column.Column)
+}
+
+// The first and last keys an index has to be read between to find every row
+// matching the conditions, each only as long as the conditions pin down
+func indexBounds(indexInstance *Index, conditions []columnCondition) ([]interface{}, []interface{}) {
+	var low, high []interface{}
+	for _, position := range indexInstance.Columns {
+		var equal, lower, upper interface{}
+		for _, condition := range conditions {
+			if condition.Position != position {
+				continue
+			}
+			switch condition.Operator {
+			case "=":
+				equal = condition.Value
+			case ">", ">=":
+				if lower == nil || CompareValues(condition.Value, lower) > 0 {
+					lower = condition.Value
+				}
+			case "<", "<=":
+				if upper == nil || CompareValues(condition.Value, upper) < 0 {
+					upper = condition.Value
+				}
+			}
+		}
+		if equal != nil {
+			low = append(low, equal)
+			high = append(high, equal)
+			continue
+		}
+		// Strict comparisons read the entries equal to the bound too, the
+		// WHERE clause drops those rows again
+		if lower != nil {
+			low = append(low, lower)
+		}
+		if upper != nil {
+			high = append(high, upper)
+		}
+		break
+	}
+	return low, high
+}
+
+// Runs the program PrepareStatement compiled on the machine, or compiles one
+// for the table when the statement was put together by hand
+func runStatement(statement *Statement, tableInstance *Table, vm *VM) error {
+	program := statement.Program
+	if program == nil {
+		program = CompileStatement(statement, tableInstance)
+	}
+	return vm.Run(program)
+}
+
+// Creates the table and bumps the schema cookie so other connections reload
+// the catalog
+func ExecuteCreateTable(statement *Statement, databaseInstance *Database) error {
+	tableInstance := statement.Table
+	if tableInstance == nil {
+		return nil
+	}
+	if err := CreateTable(databaseInstance, tableInstance); err != nil {
+		return err
+	}
+
+	pagerInstance := databaseInstance.Pager
+	header := GetPage(pagerInstance, constants.HEADER_PAGE_NUM)
+	MarkPageDirty(pagerInstance, constants.HEADER_PAGE_NUM)
+	*HeaderSchemaCookie(header) += 1
+	databaseInstance.SchemaCookie = *HeaderSchemaCookie(header)
+	return nil
+}
+
+// Creates the index and fills it with an entry for every row of its table.
+// The entries are collected and checked first, so a UNIQUE index over rows
+// that clash is turned down before anything is written.
+func ExecuteCreateIndex(statement *Statement, databaseInstance *Database) error {
+	indexInstance := statement.Index
+	if indexInstance == nil {
+		return nil
+	}
+
+	var keys [][]interface{}
+	var row Row
+	for cursor := TableStart(statement.Table); !cursor.EndOfTable; CursorAdvance(cursor) {
+		CursorRow(cursor, &row)
+		key := IndexKey(indexInstance, &row)
+		if len(encodeIndexKey(indexInstance, key)) > int(constants.INDEX_KEY_MAX_SIZE) {
+			return newError(ErrTooBigIndexKey)
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i int, j int) bool {
+		return compareIndexKeys(keys[i], keys[j]) < 0
+	})
+	if indexInstance.Unique {
+		for i := 1; i < len(keys); i++ {
+			values := keys[i][:len(keys[i])-1]
+			if compareIndexKeys(keys[i-1], values) == 0 && !hasNull(values) {
+				return newError(ErrConstraintUnique)
+			}
+		}
+	}
+
+	if err := CreateIndex(databaseInstance, indexInstance); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		IndexInsert(indexInstance, key)
+	}
+
+	pagerInstance := databaseInstance.Pager
+	header := GetPage(pagerInstance, constants.HEADER_PAGE_NUM)
+	MarkPageDirty(pagerInstance, constants.HEADER_PAGE_NUM)
+	*HeaderSchemaCookie(header) += 1
+	databaseInstance.SchemaCookie = *HeaderSchemaCookie(header)
+	return nil
+}
+
+func ExecuteBegin(statement *Statement, databaseInstance *Database) error {
+	pagerInstance := databaseInstance.Pager
+	if pagerInstance.InTransaction {
+		return errorf(ErrMisuse, "Cannot start a transaction within a transaction.")
+	}
+	// The transaction reads the snapshot that is current when it begins, and
+	// keeps other connections from committing until it ends
+	if !PagerBeginRead(pagerInstance) {
+		return newError(ErrBusy)
+	}
+	pagerInstance.InTransaction = true
+	return nil
+}
+
+func ExecuteCommit(statement *Statement, databaseInstance *Database) error {
+	pagerInstance := databaseInstance.Pager
+	if !pagerInstance.InTransaction {
+		return errorf(ErrMisuse, "No transaction is active.")
+	}
+	// The transaction stays open, to be committed again once the other
+	// connections finish reading
+	if !PagerCommit(pagerInstance) {
+		return newError(ErrBusy)
+	}
+	pagerInstance.InTransaction = false
+	return nil
+}
+
+func ExecuteRollback(statement *Statement, databaseInstance *Database) error {
+	pagerInstance := databaseInstance.Pager
+	if !pagerInstance.InTransaction {
+		return errorf(ErrMisuse, "No transaction is active.")
+	}
+	PagerRollback(pagerInstance)
+	pagerInstance.InTransaction = false
+	// Tables created by the transaction are gone again
+	if err := RefreshSchema(databaseInstance); err != nil {
+		panic(err)
+	}
+	return nil
+}
+
+// Runs a statement, committing it straight away unless a transaction is open.
+// Rows a select outputs are printed.
+func ExecuteStatement(statement *Statement, databaseInstance *Database) error {
+	return ExecuteStatementOn(statement, databaseInstance, &VM{Output: printValues})
+}
+
+// Like ExecuteStatement, running the program of an insert, select, update or
+// delete on the given machine, which is left holding what it changed
+func ExecuteStatementOn(statement *Statement, databaseInstance *Database, vm *VM) error {
+	if statement.Explain != "" {
+		// What the statement would do is output instead of doing it
+		if vm.Output != nil {
+			for _, values := range ExplainRows(statement) {
+				vm.Output(values)
+			}
+		}
+		return nil
+	}
+	switch statement.Type {
+	case (constants.STATEMENT_BEGIN):
+		return ExecuteBegin(statement, databaseInstance)
+	case (constants.STATEMENT_COMMIT):
+		return ExecuteCommit(statement, databaseInstance)
+	case (constants.STATEMENT_ROLLBACK):
+		return ExecuteRollback(statement, databaseInstance)
+	}
+
+	pagerInstance := databaseInstance.Pager
+	if statement.Type == constants.STATEMENT_SELECT {
+		if !PagerBeginRead(pagerInstance) {
+			return newError(ErrBusy)
+		}
+	} else if !PagerBeginWrite(pagerInstance) {
+		PagerEndRead(pagerInstance)
+		return newError(ErrBusy)
+	}
+
+	var err error
+	header := GetPage(pagerInstance, constants.HEADER_PAGE_NUM)
+	if *HeaderSchemaCookie(header) != statement.SchemaCookie {
+		// The tables the statement was checked against may no longer be there
+		err = newError(ErrSchema)
+	} else {
+		switch statement.Type {
+		case constants.STATEMENT_INSERT, constants.STATEMENT_SELECT, constants.STATEMENT_DELETE, constants.STATEMENT_UPDATE:
+			err = runStatement(statement, statement.Table, vm)
+		case (constants.STATEMENT_CREATE_TABLE):
+			err = ExecuteCreateTable(statement, databaseInstance)
+		case (constants.STATEMENT_CREATE_INDEX):
+			err = ExecuteCreateIndex(statement, databaseInstance)
+		default:
+			err = errorf(ErrInternal, "Unknown statement type %s.", statement.Type)
+		}
+	}
+
+	if !pagerInstance.InTransaction && !PagerCommit(pagerInstance) {
+		// Another connection is still reading what the statement changed
+		PagerRollback(pagerInstance)
+		return newError(ErrBusy)
+	}
+	return err
+}
+
+// Like ExecuteStatementOn, returning an error raised along the way like one
+// the statement returned. A statement that raised an error leaves nothing of
+// itself behind, and neither does the transaction it was part of.
+func ExecuteRecovered(statement *Statement, databaseInstance *Database, vm *VM) error {
+	result, raised := executeRecovered(statement, databaseInstance, vm)
+	if raised != nil {
+		abandonStatement(databaseInstance)
+		return raised
+	}
+	return result
+}
+
+// Runs a statement, keeping an error it returned, which leaves the database
+// as it was, apart from one raised along the way
+func executeRecovered(statement *Statement, databaseInstance *Database, vm *VM) (result error, raised error) {
+	defer RecoverError(&raised)
+	return ExecuteStatementOn(statement, databaseInstance, vm), nil
+}
+
+// Undoes whatever a statement that raised an error had changed, along with
+// the transaction it was part of. Errors doing so are dropped, the one the
+// statement raised is what gets reported.
+func abandonStatement(databaseInstance *Database) {
+	var err error
+	defer RecoverError(&err)
+	pagerInstance := databaseInstance.Pager
+	PagerRollback(pagerInstance)
+	pagerInstance.InTransaction = false
+	PagerDropCache(pagerInstance)
+	RefreshSchema(databaseInstance)
+}
+
+// The table column behind each result column of a statement, nil where the
+// result column is computed by an expression
+func ResultColumnTypes(statement *Statement) []*Column {
+	if statement.Explain != "" {
+		return make([]*Column, len(ExplainColumns(statement)))
+	}
+	columnTypes := make([]*Column, len(statement.ColumnNames))
+	for i, expression := range statement.ResultColumns {
+		columnTypes[i] = resultColumn(statement.Table, expression)
+	}
+	return columnTypes
+}
+
+// The column of the table an expression reads directly, or nil
+func resultColumn(tableInstance *Table, expression Expression) *Column {
+	column, ok := expression.(*ColumnExpr)
+	if !ok || tableInstance == nil {
+		return nil
+	}
+	position := -1
+	if tableInstance.Sources != nil {
+		// A joined table lists every rowid along with the columns
+		position, _ = joinColumnPosition(tableInstance, column)
+	} else {
+		position = ColumnIndex(tableInstance, column.Column)
+	}
+	if position < 0 {
+		return &Column{Name: "rowid", Type: constants.COLUMN_TYPE_INTEGER, PrimaryKey: true}
+	}
+	return &tableInstance.Columns[position]
+}
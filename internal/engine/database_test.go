@@ -0,0 +1,1804 @@
+// database_test.go
+package engine
+
+// TODO: Update tests for part 5
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/kris-gaudel/goqlite/constants"
+)
+
+func captureStdout(input string, f func()) string {
+	oldStdin := os.Stdin
+	oldStdout := os.Stdout
+
+	defer func() {
+		os.Stdin = oldStdin
+		os.Stdout = oldStdout
+	}()
+
+	// Feed stdin and drain stdout concurrently so large scripts can't fill the pipes
+	inRead, inWrite, _ := os.Pipe()
+	go func() {
+		inWrite.WriteString(input)
+		inWrite.Close()
+	}()
+	os.Stdin = inRead
+
+	outRead, outWrite, _ := os.Pipe()
+	os.Stdout = outWrite
+	outputChannel := make(chan []byte)
+	go func() {
+		outputBytes, _ := ioutil.ReadAll(outRead)
+		outputChannel <- outputBytes
+	}()
+
+	f()
+
+	outWrite.Close()
+	inRead.Close()
+	return string(<-outputChannel)
+}
+
+func tempDBFile(t *testing.T) string {
+	return filepath.Join(t.TempDir(), "test.db")
+}
+
+// Runs the REPL against the given database file
+func runScript(fileName string, input string) string {
+	return captureStdout(input, func() {
+		if err := RunShell(fileName); err != nil {
+			fmt.Println(err)
+		}
+	})
+}
+
+func expectOutput(t *testing.T, actualOutput string, expectedOutput string) {
+	t.Helper()
+	if actualOutput != expectedOutput {
+		actualLength := len(actualOutput)
+		expectedLength := len(expectedOutput)
+
+		t.Errorf("Actual Length: %d\nExepcted Length: %d\n", actualLength, expectedLength)
+		t.Errorf("Unexpected output:\nGot: %s\nExpected: %s", actualOutput, expectedOutput)
+	}
+}
+
+// Opens a database along with its users table, which a new database is given
+// like in the shell
+func openUsers(fileName string) (*Database, *Table) {
+	databaseInstance := dbOpen(fileName, true)
+	return databaseInstance, databaseInstance.Tables[constants.DEFAULT_TABLE_NAME]
+}
+
+// Long enough that only a handful of rows fit in a leaf, so trees grow deep quickly
+var longEmail = strings.Repeat("e", 200) + "@example.com"
+
+// Builds an insert of a users row that only has an id
+func insertStatement(table *Table, id uint32) *Statement {
+	row := Row{Key: id, Values: []interface{}{int64(id), nil, nil}}
+	return &Statement{Type: constants.STATEMENT_INSERT, Table: table, RowToInsert: row}
+}
+
+func TestBasic(t *testing.T) {
+	inputString := "insert 1 user1 person1@example.com\nselect\n.exit\n"
+	expectedOutput := "db > Executed.\ndb > (1, user1, person1@example.com)\nExecuted.\ndb > "
+	actualOutput := runScript(tempDBFile(t), inputString)
+
+	if actualOutput != expectedOutput {
+		actualLength := len(actualOutput)
+		expectedLength := len(expectedOutput)
+
+		t.Errorf("Actual Length: %d\nExepcted Length: %d\n", actualLength, expectedLength)
+		t.Errorf("Unexpected output:\nGot: %s\nExpected: %s", actualOutput, expectedOutput)
+	}
+}
+
+func TestMaxLength(t *testing.T) {
+	longName := strings.Repeat("a", 32)
+	longEmail := strings.Repeat("a", 255)
+
+	inputString := fmt.Sprintf("insert 1 %s %s\nselect\n.exit\n", longName, longEmail)
+	expectedOutput := fmt.Sprintf("db > Executed.\ndb > (1, %s, %s)\nExecuted.\ndb > ", longName, longEmail)
+	actualOutput := runScript(tempDBFile(t), inputString)
+
+	if actualOutput != expectedOutput {
+		actualLength := len(actualOutput)
+		expectedLength := len(expectedOutput)
+
+		t.Errorf("Actual Length: %d\nExepcted Length: %d\n", actualLength, expectedLength)
+		t.Errorf("Unexpected output:\nGot: %s\nExpected: %s", actualOutput, expectedOutput)
+	}
+}
+
+func TestOverMaxLength(t *testing.T) {
+	invalidLengthName := strings.Repeat("a", 33)
+	invalidLengthEmail := strings.Repeat("a", 256)
+
+	inputString := fmt.Sprintf("insert 1 %s %s\nselect\n.exit\n", invalidLengthName, invalidLengthEmail)
+	expectedOutput := fmt.Sprintf("db > String is too long.\ndb > Executed.\ndb > ")
+	actualOutput := runScript(tempDBFile(t), inputString)
+
+	if actualOutput != expectedOutput {
+		actualLength := len(actualOutput)
+		expectedLength := len(expectedOutput)
+
+		t.Errorf("Actual Length: %d\nExepcted Length: %d\n", actualLength, expectedLength)
+		t.Errorf("Unexpected output:\nGot: %s\nExpected: %s", actualOutput, expectedOutput)
+	}
+}
+
+func TestNegativeId(t *testing.T) {
+	inputString := "insert -1 user1 user1@test.com\n.exit\n"
+	expectedOutput := "db > ID must be positive.\ndb > "
+	actualOutput := runScript(tempDBFile(t), inputString)
+
+	if actualOutput != expectedOutput {
+		actualLength := len(actualOutput)
+		expectedLength := len(expectedOutput)
+
+		t.Errorf("Actual Length: %d\nExepcted Length: %d\n", actualLength, expectedLength)
+		t.Errorf("Unexpected output:\nGot: %s\nExpected: %s", actualOutput, expectedOutput)
+	}
+}
+
+func TestInsertSplitsLeavesAndInternalNodes(t *testing.T) {
+	fileName := tempDBFile(t)
+	databaseInstance, table := openUsers(fileName)
+	// Keep the cache tiny so pages constantly get evicted and read back
+	SetCacheSize(table.Pager, constants.MIN_CACHE_SIZE)
+	numRows := 20000
+	keys := rand.New(rand.NewSource(1)).Perm(numRows)
+
+	for _, key := range keys {
+		statement := insertStatement(table, uint32(key+1))
+		statement.RowToInsert.Values[1] = fmt.Sprintf("user%d", key+1)
+		statement.RowToInsert.Values[2] = longEmail
+		if err := runStatement(statement, table, &VM{}); err != nil {
+			t.Fatalf("Inserting %d: %v", key+1, err)
+		}
+	}
+	if len(table.Pager.Pages) > constants.MIN_CACHE_SIZE {
+		t.Errorf("Cache holds %d pages, limit is %d", len(table.Pager.Pages), constants.MIN_CACHE_SIZE)
+	}
+	DBClose(databaseInstance)
+
+	databaseInstance, table = openUsers(fileName)
+	root := GetPage(table.Pager, table.RootPageNum)
+	if GetNodeType(root) != constants.NODE_INTERNAL {
+		t.Fatalf("Expected the root to be an internal node")
+	}
+	if depth := checkSubtree(t, table.Pager, table.RootPageNum); depth < 3 {
+		t.Errorf("Expected internal nodes to have split, tree depth is %d", depth)
+	}
+
+	var row Row
+	for key := uint32(1); key <= uint32(numRows); key++ {
+		cursor := TableFind(table, key)
+		node := GetPage(table.Pager, cursor.PageNum)
+		if cursor.CellNum >= *LeafNodeNumCells(node) || *LeafNodeKey(node, cursor.CellNum) != key {
+			t.Fatalf("Key %d not found", key)
+		}
+		CursorRow(cursor, &row)
+		if username := row.Values[1]; username != fmt.Sprintf("user%d", key) {
+			t.Fatalf("Key %d has username %v", key, username)
+		}
+	}
+
+	numScanned := 0
+	previousId := uint32(0)
+	for cursor := TableStart(table); !cursor.EndOfTable; CursorAdvance(cursor) {
+		CursorRow(cursor, &row)
+		if row.Key <= previousId {
+			t.Fatalf("Scan returned %d after %d", row.Key, previousId)
+		}
+		previousId = row.Key
+		numScanned++
+	}
+	if numScanned != numRows {
+		t.Errorf("Scanned %d rows, expected %d", numScanned, numRows)
+	}
+
+	if err := runStatement(insertStatement(table, uint32(keys[0]+1)), table, &VM{}); !errors.Is(err, ErrConstraintPrimaryKey) {
+		t.Errorf("Expected duplicate key, got %v", err)
+	}
+	DBClose(databaseInstance)
+}
+
+// Verifies key ordering and parent pointers below pageNum and returns the subtree depth
+func checkSubtree(t *testing.T, pagerInstance *Pager, pageNum uint32) int {
+	t.Helper()
+	node := GetPage(pagerInstance, pageNum)
+	if GetNodeType(node) == constants.NODE_LEAF {
+		numCells := *LeafNodeNumCells(node)
+		if !IsNodeRoot(node) && LeafNodeUnderfull(node) {
+			t.Fatalf("Leaf %d only has %d bytes in use", pageNum, uint32(constants.LEAF_NODE_SPACE_FOR_CELLS)-LeafNodeFreeSpace(node))
+		}
+		for i := uint32(1); i < numCells; i++ {
+			if *LeafNodeKey(node, i-1) >= *LeafNodeKey(node, i) {
+				t.Fatalf("Leaf %d keys out of order at cell %d", pageNum, i)
+			}
+		}
+		return 1
+	}
+
+	numKeys := *InternalNodeNumKeys(node)
+	if !IsNodeRoot(node) && numKeys < uint32(constants.INTERNAL_NODE_MIN_KEYS) {
+		t.Fatalf("Internal node %d only has %d keys", pageNum, numKeys)
+	}
+	depth := 0
+	for i := uint32(0); i <= numKeys; i++ {
+		node = GetPage(pagerInstance, pageNum)
+		childPageNum := *InternalNodeChild(node, i)
+		child := GetPage(pagerInstance, childPageNum)
+		if *NodeParent(child) != pageNum {
+			t.Fatalf("Page %d has parent %d, expected %d", childPageNum, *NodeParent(child), pageNum)
+		}
+		maxKey := GetNodeMaxKey(pagerInstance, child)
+		node = GetPage(pagerInstance, pageNum)
+		if i < numKeys && *InternalNodeKey(node, i) != maxKey {
+			t.Fatalf("Page %d key %d is %d, child max is %d", pageNum, i, *InternalNodeKey(node, i), maxKey)
+		}
+		depth = checkSubtree(t, pagerInstance, childPageNum) + 1
+	}
+	return depth
+}
+
+func TestMultiLevelTreeStructure(t *testing.T) {
+	var script strings.Builder
+	var expectedOutput strings.Builder
+	for i := 1; i <= 40; i++ {
+		fmt.Fprintf(&script, "insert %d user%d %s\n", i, i, longEmail)
+		expectedOutput.WriteString("db > Executed.\n")
+	}
+	script.WriteString(".btree\n.exit\n")
+
+	expectedOutput.WriteString("db > Tree:\n- internal (size 3)\n")
+	// A full leaf holds 18 of these rows and splits evenly by size
+	leaves := [][2]int{{1, 10}, {11, 19}, {20, 28}, {29, 40}}
+	for i, leaf := range leaves {
+		fmt.Fprintf(&expectedOutput, "  - leaf (size %d)\n", leaf[1]-leaf[0]+1)
+		for key := leaf[0]; key <= leaf[1]; key++ {
+			fmt.Fprintf(&expectedOutput, "    - %d\n", key)
+		}
+		if i < len(leaves)-1 {
+			fmt.Fprintf(&expectedOutput, "  - key %d\n", leaf[1])
+		}
+	}
+	expectedOutput.WriteString("db > ")
+
+	expectOutput(t, runScript(tempDBFile(t), script.String()), expectedOutput.String())
+}
+
+func TestSelectScansAcrossLeaves(t *testing.T) {
+	var script strings.Builder
+	var expectedOutput strings.Builder
+	keys := rand.New(rand.NewSource(2)).Perm(50)
+	for _, key := range keys {
+		fmt.Fprintf(&script, "insert %d user%d person%d@example.com\n", key+1, key+1, key+1)
+		expectedOutput.WriteString("db > Executed.\n")
+	}
+	script.WriteString("select\n.exit\n")
+
+	expectedOutput.WriteString("db > ")
+	for i := 1; i <= 50; i++ {
+		fmt.Fprintf(&expectedOutput, "(%d, user%d, person%d@example.com)\n", i, i, i)
+	}
+	expectedOutput.WriteString("Executed.\ndb > ")
+
+	expectOutput(t, runScript(tempDBFile(t), script.String()), expectedOutput.String())
+}
+
+func TestSelectAfterReopen(t *testing.T) {
+	fileName := tempDBFile(t)
+	var script strings.Builder
+	for i := 1; i <= 20; i++ {
+		fmt.Fprintf(&script, "insert %d user%d person%d@example.com\n", i, i, i)
+	}
+	script.WriteString(".exit\n")
+	runScript(fileName, script.String())
+
+	var expectedOutput strings.Builder
+	expectedOutput.WriteString("db > ")
+	for i := 1; i <= 20; i++ {
+		fmt.Fprintf(&expectedOutput, "(%d, user%d, person%d@example.com)\n", i, i, i)
+	}
+	expectedOutput.WriteString("Executed.\ndb > ")
+	expectOutput(t, runScript(fileName, "select\n.exit\n"), expectedOutput.String())
+}
+
+func TestDelete(t *testing.T) {
+	var script strings.Builder
+	var expectedOutput strings.Builder
+	for i := 1; i <= 30; i++ {
+		fmt.Fprintf(&script, "insert %d user%d %s\n", i, i, longEmail)
+		expectedOutput.WriteString("db > Executed.\n")
+	}
+	script.WriteString("delete from users where id = 3\ndelete from users where id between 10 and 25\ndelete from users where id > 28\ndelete from users where 1 >= id\nselect\n")
+	script.WriteString("delete from users where id = 99\ndelete from users where username = 1\ndelete where id = 1\n.btree\n.exit\n")
+	expectedOutput.WriteString("db > Executed.\ndb > Executed.\ndb > Executed.\ndb > Executed.\ndb > ")
+	remaining := []int{2, 4, 5, 6, 7, 8, 9, 26, 27, 28}
+	for _, i := range remaining {
+		fmt.Fprintf(&expectedOutput, "(%d, user%d, %s)\n", i, i, longEmail)
+	}
+	expectedOutput.WriteString("Executed.\ndb > Executed.\ndb > Executed.\n")
+	expectedOutput.WriteString("db > Syntax error at line 1, column 8: expected FROM but found \"WHERE\".\n")
+	// The emptied middle leaves are merged back until the root is a single leaf
+	expectedOutput.WriteString("db > Tree:\n- leaf (size 10)\n")
+	for _, i := range remaining {
+		fmt.Fprintf(&expectedOutput, "  - %d\n", i)
+	}
+	expectedOutput.WriteString("db > ")
+
+	expectOutput(t, runScript(tempDBFile(t), script.String()), expectedOutput.String())
+}
+
+func TestDeleteRebalancesTree(t *testing.T) {
+	databaseInstance, table := openUsers(tempDBFile(t))
+	SetCacheSize(table.Pager, constants.MIN_CACHE_SIZE)
+	random := rand.New(rand.NewSource(3))
+
+	inserted := map[uint32]bool{}
+	for _, key := range random.Perm(12000) {
+		statement := insertStatement(table, uint32(key+1))
+		statement.RowToInsert.Values[2] = longEmail
+		if err := runStatement(statement, table, &VM{}); err != nil {
+			t.Fatalf("Inserting %d: %v", key+1, err)
+		}
+		inserted[uint32(key+1)] = true
+	}
+	if depth := checkSubtree(t, table.Pager, table.RootPageNum); depth < 3 {
+		t.Fatalf("Expected a tree with internal nodes below the root, depth is %d", depth)
+	}
+
+	ids := make([]uint32, 0, len(inserted))
+	for id := range inserted {
+		ids = append(ids, id)
+	}
+	random.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+
+	for i, id := range ids {
+		statement := Statement{Type: constants.STATEMENT_DELETE, Table: table, KeyLow: id, KeyHigh: id}
+		ExecuteStatement(&statement, databaseInstance)
+		delete(inserted, id)
+
+		if i%500 == 0 || len(inserted) < 30 {
+			checkSubtree(t, table.Pager, table.RootPageNum)
+			numScanned := 0
+			var row Row
+			for cursor := TableStart(table); !cursor.EndOfTable; CursorAdvance(cursor) {
+				CursorRow(cursor, &row)
+				if !inserted[row.Key] {
+					t.Fatalf("Scan returned deleted id %d", row.Key)
+				}
+				numScanned++
+			}
+			if numScanned != len(inserted) {
+				t.Fatalf("Scanned %d rows, expected %d", numScanned, len(inserted))
+			}
+		}
+	}
+
+	root := GetPage(table.Pager, table.RootPageNum)
+	if GetNodeType(root) != constants.NODE_LEAF || *LeafNodeNumCells(root) != 0 {
+		t.Errorf("Expected an empty root leaf after deleting everything")
+	}
+	DBClose(databaseInstance)
+}
+
+func TestUpdate(t *testing.T) {
+	inputString := "insert 1 user1 person1@example.com\ninsert 2 user2 person2@example.com\n" +
+		"update users set email = 'new@example.com' where id = 2\n" +
+		"UPDATE users SET username = 'renamed', email = 'other@example.com' WHERE id = 1;\n" +
+		"update users set email = 'missing@example.com' where id = 3\n" +
+		"update users set email = '" + strings.Repeat("a", 256) + "' where id = 1\n" +
+		"update users set id = 5 where id = 1\n" +
+		"update users set email = new@example.com where id = 1\n" +
+		"select\n.exit\n"
+	expectedOutput := "db > Executed.\ndb > Executed.\n" +
+		"db > Rows updated: 1\nExecuted.\n" +
+		"db > Rows updated: 1\nExecuted.\n" +
+		"db > Error: No row with that id.\n" +
+		"db > String is too long.\n" +
+		"db > Cannot update column id.\n" +
+		"db > Syntax error at line 1, column 29: unexpected character '@'.\n" +
+		"db > (1, renamed, other@example.com)\n(2, user2, new@example.com)\nExecuted.\ndb > "
+	expectOutput(t, runScript(tempDBFile(t), inputString), expectedOutput)
+}
+
+func TestFreedPagesAreReused(t *testing.T) {
+	fileName := tempDBFile(t)
+	databaseInstance, table := openUsers(fileName)
+	insertRange := func(low int, high int) {
+		for id := low; id <= high; id++ {
+			if err := runStatement(insertStatement(table, uint32(id)), table, &VM{}); err != nil {
+				t.Fatalf("Inserting %d: %v", id, err)
+			}
+		}
+	}
+
+	insertRange(1, 15000)
+	numPages := table.Pager.NumPages
+	runStatement(&Statement{Type: constants.STATEMENT_DELETE, KeyLow: 1, KeyHigh: 15000}, table, &VM{})
+
+	header := GetPage(table.Pager, constants.HEADER_PAGE_NUM)
+	// Everything but the header page, the catalog and the root is free again
+	if freePages := *FreePageCount(header); freePages != numPages-3 {
+		t.Fatalf("Expected %d free pages, got %d", numPages-3, freePages)
+	}
+	DBClose(databaseInstance)
+
+	// The free list survives a reopen and is drained before the file grows
+	databaseInstance, table = openUsers(fileName)
+	insertRange(20001, 35000)
+	if table.Pager.NumPages != numPages {
+		t.Errorf("File grew from %d to %d pages", numPages, table.Pager.NumPages)
+	}
+	checkSubtree(t, table.Pager, table.RootPageNum)
+	DBClose(databaseInstance)
+}
+
+func TestOnlyDirtyPagesAreWritten(t *testing.T) {
+	fileName := tempDBFile(t)
+	databaseInstance, table := openUsers(fileName)
+	for id := uint32(1); id <= 200; id++ {
+		runStatement(insertStatement(table, id), table, &VM{})
+	}
+	DBClose(databaseInstance)
+
+	databaseInstance, table = openUsers(fileName)
+	for cursor := TableStart(table); !cursor.EndOfTable; CursorAdvance(cursor) {
+	}
+	if dirtyPages := countDirtyPages(table.Pager); dirtyPages != 0 {
+		t.Errorf("Scanning left %d dirty pages", dirtyPages)
+	}
+
+	runStatement(&Statement{Type: constants.STATEMENT_UPDATE, Table: table, KeyLow: 150, KeyHigh: 150, Assignments: map[int]Expression{2: &LiteralExpr{Value: "x"}}}, table, &VM{})
+	if dirtyPages := countDirtyPages(table.Pager); dirtyPages != 1 {
+		t.Errorf("Updating one row left %d dirty pages", dirtyPages)
+	}
+	PagerCommit(table.Pager)
+	if dirtyPages := countDirtyPages(table.Pager); dirtyPages != 0 {
+		t.Errorf("Committing left %d dirty pages", dirtyPages)
+	}
+	DBClose(databaseInstance)
+}
+
+func countDirtyPages(pagerInstance *Pager) int {
+	dirtyPages := 0
+	for _, cachedPage := range pagerInstance.Pages {
+		if cachedPage.Dirty {
+			dirtyPages++
+		}
+	}
+	return dirtyPages
+}
+
+func TestCacheSizeCommand(t *testing.T) {
+	inputString := ".cache_size\n.cache_size 500\n.cache_size 1\n.cache_size lots\n.exit\n"
+	expectedOutput := fmt.Sprintf("db > Cache size: %d pages\ndb > Cache size: 500 pages\ndb > Cache size: %d pages\ndb > Usage: .cache_size [PAGES]\ndb > ",
+		constants.DEFAULT_CACHE_SIZE, constants.MIN_CACHE_SIZE)
+	expectOutput(t, runScript(tempDBFile(t), inputString), expectedOutput)
+}
+
+func TestDBInfo(t *testing.T) {
+	fileName := tempDBFile(t)
+	runScript(fileName, "insert 1 user1 person1@example.com\n.exit\n")
+
+	inputString := ".dbinfo\n.exit\n"
+	expectedOutput := "db > format version: 1\npage size: 4096\npage count: 3\nfree list head: 0\nfree pages: 0\nschema cookie: 0\ndb > "
+	expectOutput(t, runScript(fileName, inputString), expectedOutput)
+}
+
+func TestValidateHeader(t *testing.T) {
+	header := make([]byte, constants.PAGE_SIZE)
+	InitializeHeader(header)
+	*HeaderPageCount(header) = 5
+	if err := ValidateHeader(header, 5); err != nil {
+		t.Fatalf("Fresh header failed validation: %v", err)
+	}
+
+	cases := []struct {
+		name     string
+		modify   func(header []byte)
+		numPages uint32
+		expected string
+	}{
+		{"foreign", func(header []byte) { copy(header, "SQLite format 3\x00") }, 5, "File is not a goqlite database."},
+		{"future", func(header []byte) { *HeaderFormatVersion(header) = 3 }, 5, "Database file format version 3 is newer than the supported version 2."},
+		{"page size", func(header []byte) { *HeaderPageSize(header) = 1024 }, 5, "Database page size 1024 is not supported, expected 4096."},
+		{"truncated", func(header []byte) {}, 3, "Database header records 5 pages but the file holds 3. Corrupt file."},
+	}
+	for _, c := range cases {
+		modified := make([]byte, len(header))
+		copy(modified, header)
+		c.modify(modified)
+		err := ValidateHeader(modified, c.numPages)
+		if err == nil || err.Error() != c.expected {
+			t.Errorf("%s: expected %q, got %v", c.name, c.expected, err)
+		}
+	}
+}
+
+func TestOpenRejectsForeignFile(t *testing.T) {
+	fileName := tempDBFile(t)
+	garbage := make([]byte, 2*constants.PAGE_SIZE)
+	rand.New(rand.NewSource(4)).Read(garbage)
+	if err := os.WriteFile(fileName, garbage, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	open := func() (err error) {
+		defer RecoverError(&err)
+		DBOpen(fileName)
+		return nil
+	}
+	if err := open(); !errors.Is(err, ErrCorrupt) || err.Error() != "File is not a goqlite database." {
+		t.Fatalf("Expected a corrupt file error, got %v", err)
+	}
+	// The shell reports the same error instead of starting
+	expectOutput(t, runScript(fileName, ".exit\n"), "File is not a goqlite database.\n")
+}
+
+func TestHotJournalRollsBackCrashedTransaction(t *testing.T) {
+	fileName := tempDBFile(t)
+	databaseInstance, table := openUsers(fileName)
+	for id := uint32(1); id <= 2000; id++ {
+		runStatement(insertStatement(table, id), table, &VM{})
+	}
+	DBClose(databaseInstance)
+	if _, err := os.Stat(JournalPath(fileName)); !os.IsNotExist(err) {
+		t.Fatalf("Journal still exists after commit: %v", err)
+	}
+	committedInfo, _ := os.Stat(fileName)
+
+	// With a tiny cache the changes spill into the database file long before a commit
+	databaseInstance, table = openUsers(fileName)
+	SetCacheSize(table.Pager, constants.MIN_CACHE_SIZE)
+	for id := uint32(5000); id <= 25000; id++ {
+		runStatement(insertStatement(table, id), table, &VM{})
+	}
+	runStatement(&Statement{Type: constants.STATEMENT_DELETE, KeyLow: 1, KeyHigh: 1500}, table, &VM{})
+	if crashedInfo, _ := os.Stat(fileName); crashedInfo.Size() == committedInfo.Size() {
+		t.Fatalf("Expected uncommitted pages to have been written to the database file")
+	}
+
+	// Crash: drop the file descriptors without committing, leaving a torn record at the end of the journal
+	syscall.Close(table.Pager.FileDescriptor)
+	syscall.Write(table.Pager.Journal.FileDescriptor, make([]byte, 100))
+	syscall.Close(table.Pager.Journal.FileDescriptor)
+	syscall.Close(table.Pager.PendingFileDescriptor)
+
+	databaseInstance, table = openUsers(fileName)
+	if _, err := os.Stat(JournalPath(fileName)); !os.IsNotExist(err) {
+		t.Errorf("Hot journal was not removed: %v", err)
+	}
+	if recoveredInfo, _ := os.Stat(fileName); recoveredInfo.Size() != committedInfo.Size() {
+		t.Errorf("Database is %d bytes after recovery, expected %d", recoveredInfo.Size(), committedInfo.Size())
+	}
+	checkSubtree(t, table.Pager, table.RootPageNum)
+
+	var row Row
+	expectedId := uint32(1)
+	for cursor := TableStart(table); !cursor.EndOfTable; CursorAdvance(cursor) {
+		CursorRow(cursor, &row)
+		if row.Key != expectedId {
+			t.Fatalf("Expected id %d after recovery, got %d", expectedId, row.Key)
+		}
+		expectedId++
+	}
+	if expectedId != 2001 {
+		t.Errorf("Recovered %d rows, expected 2000", expectedId-1)
+	}
+	DBClose(databaseInstance)
+}
+
+func tableRowIds(table *Table) []uint32 {
+	PagerBeginRead(table.Pager)
+	ids := make([]uint32, 0)
+	for cursor := TableStart(table); !cursor.EndOfTable; CursorAdvance(cursor) {
+		ids = append(ids, CursorKey(cursor))
+	}
+	PagerEndRead(table.Pager)
+	return ids
+}
+
+func TestJournalModeCommand(t *testing.T) {
+	fileName := tempDBFile(t)
+	inputString := ".journal_mode\n.journal_mode wal\ninsert 1 user1 person1@example.com\nselect\n.checkpoint\n.journal_mode memory\n.exit\n"
+	expectedOutput := "db > Journal mode: delete\ndb > Journal mode: wal\ndb > Executed.\ndb > (1, user1, person1@example.com)\nExecuted.\ndb > Checkpoint complete.\ndb > Usage: .journal_mode [delete|wal]\ndb > "
+	expectOutput(t, runScript(fileName, inputString), expectedOutput)
+
+	if _, err := os.Stat(WalPath(fileName)); !os.IsNotExist(err) {
+		t.Errorf("WAL still exists after the last connection closed: %v", err)
+	}
+
+	inputString = ".journal_mode\n.dbinfo\n.journal_mode delete\nselect\n.exit\n"
+	expectedOutput = "db > Journal mode: wal\ndb > format version: 2\npage size: 4096\npage count: 3\nfree list head: 0\nfree pages: 0\nschema cookie: 0\ndb > Journal mode: delete\ndb > (1, user1, person1@example.com)\nExecuted.\ndb > "
+	expectOutput(t, runScript(fileName, inputString), expectedOutput)
+}
+
+func TestWalReadersSeeCommittedSnapshots(t *testing.T) {
+	fileName := tempDBFile(t)
+	writer, writerTable := openUsers(fileName)
+	if err := SetJournalMode(writer.Pager, "wal"); err != nil {
+		t.Fatal(err)
+	}
+	insert := func(databaseInstance *Database, id uint32) error {
+		return ExecuteStatement(insertStatement(databaseInstance.Tables[constants.DEFAULT_TABLE_NAME], id), databaseInstance)
+	}
+	for id := uint32(1); id <= 50; id++ {
+		insert(writer, id)
+	}
+	dbInfo, _ := os.Stat(fileName)
+	ExecuteStatement(&Statement{Type: constants.STATEMENT_BEGIN}, writer)
+	for id := uint32(51); id <= 100; id++ {
+		insert(writer, id)
+	}
+
+	reader, readerTable := openUsers(fileName)
+	if reader.Pager.Wal == nil {
+		t.Fatalf("Expected the second connection to open in WAL mode")
+	}
+	if ids := tableRowIds(readerTable); len(ids) != 50 {
+		t.Errorf("Reader saw %d rows while the writer was active, expected 50", len(ids))
+	}
+	if err := insert(reader, 500); !errors.Is(err, ErrBusy) {
+		t.Errorf("Expected a second writer to be refused, got %v", err)
+	}
+
+	// A transaction keeps reading the snapshot it started with
+	ExecuteStatement(&Statement{Type: constants.STATEMENT_BEGIN}, reader)
+	ExecuteStatement(&Statement{Type: constants.STATEMENT_COMMIT}, writer)
+	if ids := tableRowIds(readerTable); len(ids) != 50 {
+		t.Errorf("Reader saw %d rows inside its transaction, expected 50", len(ids))
+	}
+	if err := insert(reader, 500); !errors.Is(err, ErrBusy) {
+		t.Errorf("Expected a write from a stale snapshot to be refused, got %v", err)
+	}
+	ExecuteStatement(&Statement{Type: constants.STATEMENT_COMMIT}, reader)
+
+	if ids := tableRowIds(readerTable); len(ids) != 100 {
+		t.Errorf("Reader saw %d rows after the commit, expected 100", len(ids))
+	}
+	if err := insert(reader, 500); err != nil {
+		t.Errorf("Expected the reader to write once the writer committed, got %v", err)
+	}
+	if ids := tableRowIds(writerTable); len(ids) != 101 {
+		t.Errorf("Writer saw %d rows after the reader's commit, expected 101", len(ids))
+	}
+
+	// Commits only append to the WAL, the database file is untouched until a checkpoint
+	if info, _ := os.Stat(fileName); info.Size() != dbInfo.Size() || info.ModTime() != dbInfo.ModTime() {
+		t.Errorf("Database file changed before a checkpoint")
+	}
+	if PagerCheckpoint(writer.Pager) {
+		t.Errorf("Checkpoint ran while another connection had the database open")
+	}
+
+	DBClose(writer)
+	if _, err := os.Stat(WalPath(fileName)); err != nil {
+		t.Errorf("WAL was removed while a reader still needed it: %v", err)
+	}
+	DBClose(reader)
+	if _, err := os.Stat(WalPath(fileName)); !os.IsNotExist(err) {
+		t.Errorf("WAL still exists after the last connection closed: %v", err)
+	}
+
+	databaseInstance, table := openUsers(fileName)
+	if table.Pager.Wal == nil {
+		t.Errorf("Journal mode was not kept across reopening")
+	}
+	if ids := tableRowIds(table); len(ids) != 101 || ids[100] != 500 {
+		t.Errorf("Checkpointed database has rows %v", ids)
+	}
+	checkSubtree(t, table.Pager, table.RootPageNum)
+	DBClose(databaseInstance)
+}
+
+func TestWalAutocheckpointWithTwoConnections(t *testing.T) {
+	fileName := tempDBFile(t)
+	first, firstTable := openUsers(fileName)
+	if err := SetJournalMode(first.Pager, "wal"); err != nil {
+		t.Fatal(err)
+	}
+	second, secondTable := openUsers(fileName)
+
+	// Both connections commit well past the autocheckpoint threshold. The
+	// first one's checkpoint can't run while the second has the database
+	// open, the second one's can once the first lets it.
+	for id := uint32(1); id <= 600; id++ {
+		if err := ExecuteStatement(insertStatement(firstTable, id), first); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id := uint32(601); id <= 1300; id++ {
+		if err := ExecuteStatement(insertStatement(secondTable, id), second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ids := tableRowIds(firstTable); len(ids) != 1300 {
+		t.Errorf("First connection saw %d rows, expected 1300", len(ids))
+	}
+	if err := ExecuteStatement(insertStatement(firstTable, 1301), first); err != nil {
+		t.Fatal(err)
+	}
+	if ids := tableRowIds(secondTable); len(ids) != 1301 {
+		t.Errorf("Second connection saw %d rows, expected 1301", len(ids))
+	}
+	DBClose(first)
+	DBClose(second)
+
+	databaseInstance, table := openUsers(fileName)
+	checkSubtree(t, table.Pager, table.RootPageNum)
+	if ids := tableRowIds(table); len(ids) != 1301 {
+		t.Errorf("Reopened database has %d rows, expected 1301", len(ids))
+	}
+	DBClose(databaseInstance)
+}
+
+func TestWalIgnoresUncommittedFrames(t *testing.T) {
+	fileName := tempDBFile(t)
+	databaseInstance, table := openUsers(fileName)
+	SetJournalMode(table.Pager, "wal")
+	for id := uint32(1); id <= 2000; id++ {
+		ExecuteStatement(insertStatement(table, id), databaseInstance)
+	}
+
+	// With a tiny cache the open transaction spills frames into the WAL long before it commits
+	SetCacheSize(table.Pager, constants.MIN_CACHE_SIZE)
+	ExecuteStatement(&Statement{Type: constants.STATEMENT_BEGIN}, databaseInstance)
+	for id := uint32(5000); id <= 15000; id++ {
+		ExecuteStatement(insertStatement(table, id), databaseInstance)
+	}
+	if table.Pager.Wal.NumFrames <= table.Pager.Wal.MaxFrame {
+		t.Fatalf("Expected uncommitted frames to have been written to the WAL")
+	}
+
+	// Crash: drop the file descriptors without committing or checkpointing
+	syscall.Close(table.Pager.FileDescriptor)
+	syscall.Close(table.Pager.Wal.FileDescriptor)
+
+	databaseInstance, table = openUsers(fileName)
+	checkSubtree(t, table.Pager, table.RootPageNum)
+	if ids := tableRowIds(table); len(ids) != 2000 || ids[1999] != 2000 {
+		t.Errorf("Recovered %d rows, expected 2000", len(ids))
+	}
+	DBClose(databaseInstance)
+}
+
+func TestTransactions(t *testing.T) {
+	fileName := tempDBFile(t)
+	inputString := "begin\ninsert 1 user1 person1@example.com\ninsert 2 user2 person2@example.com\nrollback\nselect\n" +
+		"begin transaction\ninsert 3 user3 person3@example.com\nbegin\ncommit\ncommit\nrollback\n" +
+		"begin\ninsert 4 user4 person4@example.com\n.exit\n"
+	expectedOutput := "db > Executed.\ndb > Executed.\ndb > Executed.\ndb > Executed.\ndb > Executed.\n" +
+		"db > Executed.\ndb > Executed.\ndb > Error: Cannot start a transaction within a transaction.\ndb > Executed.\n" +
+		"db > Error: No transaction is active.\ndb > Error: No transaction is active.\n" +
+		"db > Executed.\ndb > Executed.\ndb > "
+	expectOutput(t, runScript(fileName, inputString), expectedOutput)
+
+	// The transaction left open at exit is rolled back
+	expectOutput(t, runScript(fileName, "select\n.exit\n"), "db > (3, user3, person3@example.com)\nExecuted.\ndb > ")
+}
+
+func TestRollbackRestoresSpilledPages(t *testing.T) {
+	for _, mode := range []string{"delete", "wal"} {
+		fileName := tempDBFile(t)
+		databaseInstance, table := openUsers(fileName)
+		SetJournalMode(table.Pager, mode)
+		ExecuteStatement(&Statement{Type: constants.STATEMENT_BEGIN}, databaseInstance)
+		for id := uint32(1); id <= 2000; id++ {
+			ExecuteStatement(insertStatement(table, id), databaseInstance)
+		}
+		ExecuteStatement(&Statement{Type: constants.STATEMENT_COMMIT}, databaseInstance)
+		numPages := table.Pager.NumPages
+
+		// With a tiny cache the transaction's changes spill out of the cache before the rollback
+		SetCacheSize(table.Pager, constants.MIN_CACHE_SIZE)
+		ExecuteStatement(&Statement{Type: constants.STATEMENT_BEGIN}, databaseInstance)
+		for id := uint32(5000); id <= 15000; id++ {
+			ExecuteStatement(insertStatement(table, id), databaseInstance)
+		}
+		ExecuteStatement(&Statement{Type: constants.STATEMENT_DELETE, Table: table, KeyLow: 1, KeyHigh: 1500}, databaseInstance)
+		ExecuteStatement(&Statement{Type: constants.STATEMENT_ROLLBACK}, databaseInstance)
+
+		if table.Pager.NumPages != numPages {
+			t.Errorf("%s: database has %d pages after rollback, expected %d", mode, table.Pager.NumPages, numPages)
+		}
+		checkSubtree(t, table.Pager, table.RootPageNum)
+		if ids := tableRowIds(table); len(ids) != 2000 || ids[0] != 1 || ids[1999] != 2000 {
+			t.Errorf("%s: %d rows after rollback, expected 2000", mode, len(ids))
+		}
+		DBClose(databaseInstance)
+
+		databaseInstance, table = openUsers(fileName)
+		if ids := tableRowIds(table); len(ids) != 2000 {
+			t.Errorf("%s: %d rows after reopening, expected 2000", mode, len(ids))
+		}
+		DBClose(databaseInstance)
+	}
+}
+
+func TestLexer(t *testing.T) {
+	input := "SeLeCt \"odd \"\"name\"\"\", x'0aFF' -- trailing comment\n/* block\ncomment */ 'it''s' 12 3.5e2 .5 0x1F <= <> ||;"
+	expected := []Token{
+		{constants.TOKEN_KEYWORD, "SELECT", 1, 1},
+		{constants.TOKEN_IDENTIFIER, "odd \"name\"", 1, 8},
+		{constants.TOKEN_OPERATOR, ",", 1, 22},
+		{constants.TOKEN_BLOB, "0aFF", 1, 24},
+		{constants.TOKEN_STRING, "it's", 3, 12},
+		{constants.TOKEN_INTEGER, "12", 3, 20},
+		{constants.TOKEN_FLOAT, "3.5e2", 3, 23},
+		{constants.TOKEN_FLOAT, ".5", 3, 29},
+		{constants.TOKEN_INTEGER, "0x1F", 3, 32},
+		{constants.TOKEN_OPERATOR, "<=", 3, 37},
+		{constants.TOKEN_OPERATOR, "<>", 3, 40},
+		{constants.TOKEN_OPERATOR, "||", 3, 43},
+		{constants.TOKEN_OPERATOR, ";", 3, 45},
+		{constants.TOKEN_EOF, "", 3, 46},
+	}
+
+	lexer := NewLexer(input)
+	for i, expectedToken := range expected {
+		token, err := lexer.Next()
+		if err != nil {
+			t.Fatalf("Token %d: %v", i, err)
+		}
+		if token != expectedToken {
+			t.Errorf("Token %d: expected %+v, got %+v", i, expectedToken, token)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	statement, err := Parse("select id, email as address from users where not id between 1 and 2 * 3 and email like '%@corp.com' or id in (7, -8) order by email desc, id limit 5 offset 10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedSelect := &SelectStmt{
+		Columns: []ResultColumn{{Expr: &ColumnExpr{Column: "id"}}, {Expr: &ColumnExpr{Column: "email"}, Alias: "address"}},
+		From:    "users",
+		Where: &BinaryExpr{
+			Operator: "OR",
+			Left: &BinaryExpr{
+				Operator: "AND",
+				Left: &UnaryExpr{Operator: "NOT", Operand: &BetweenExpr{
+					Operand: &ColumnExpr{Column: "id"},
+					Low:     &LiteralExpr{Value: int64(1)},
+					High:    &BinaryExpr{Operator: "*", Left: &LiteralExpr{Value: int64(2)}, Right: &LiteralExpr{Value: int64(3)}},
+				}},
+				Right: &BinaryExpr{Operator: "LIKE", Left: &ColumnExpr{Column: "email"}, Right: &LiteralExpr{Value: "%@corp.com"}},
+			},
+			Right: &InExpr{Operand: &ColumnExpr{Column: "id"}, Values: []Expression{
+				&LiteralExpr{Value: int64(7)},
+				&UnaryExpr{Operator: "-", Operand: &LiteralExpr{Value: int64(8)}},
+			}},
+		},
+		OrderBy: []OrderingTerm{{Expr: &ColumnExpr{Column: "email"}, Descending: true}, {Expr: &ColumnExpr{Column: "id"}}},
+		Limit:   &LiteralExpr{Value: int64(5)},
+		Offset:  &LiteralExpr{Value: int64(10)},
+	}
+	if !reflect.DeepEqual(statement, expectedSelect) {
+		t.Errorf("Unexpected select syntax tree: %#v", statement)
+	}
+
+	statement, err = Parse("insert into users (id, username) values (1, 'a'), (2, NULL);")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedInsert := &InsertStmt{Table: "users", Columns: []string{"id", "username"}, Rows: [][]Expression{
+		{&LiteralExpr{Value: int64(1)}, &LiteralExpr{Value: "a"}},
+		{&LiteralExpr{Value: int64(2)}, &LiteralExpr{Value: nil}},
+	}}
+	if !reflect.DeepEqual(statement, expectedInsert) {
+		t.Errorf("Unexpected insert syntax tree: %#v", statement)
+	}
+
+	statement, err = Parse("create table if not exists people (id integer primary key, name varchar(20) not null)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedCreate := &CreateTableStmt{Name: "people", IfNotExists: true, Columns: []ColumnDefinition{
+		{Name: "id", Type: "integer", PrimaryKey: true},
+		{Name: "name", Type: "varchar", Length: 20, NotNull: true},
+	}}
+	if !reflect.DeepEqual(statement, expectedCreate) {
+		t.Errorf("Unexpected create table syntax tree: %#v", statement)
+	}
+
+	statement, err = Parse("create unique index if not exists by_name on people (name, id)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedIndex := &CreateIndexStmt{Name: "by_name", Unique: true, IfNotExists: true, Table: "people", Columns: []string{"name", "id"}}
+	if !reflect.DeepEqual(statement, expectedIndex) {
+		t.Errorf("Unexpected create index syntax tree: %#v", statement)
+	}
+
+	statement, err = Parse("select a.id from users a left outer join docs as d on d.owner = a.id, notes join tags using (id, name) group by 1 having count(*) > 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedJoin := &SelectStmt{
+		Columns:   []ResultColumn{{Expr: &ColumnExpr{Table: "a", Column: "id"}}},
+		From:      "users",
+		FromAlias: "a",
+		Joins: []JoinClause{
+			{Kind: "LEFT", Table: "docs", Alias: "d", On: &BinaryExpr{Operator: "=", Left: &ColumnExpr{Table: "d", Column: "owner"}, Right: &ColumnExpr{Table: "a", Column: "id"}}},
+			{Kind: "CROSS", Table: "notes"},
+			{Kind: "INNER", Table: "tags", Using: []string{"id", "name"}},
+		},
+		GroupBy: []Expression{&LiteralExpr{Value: int64(1)}},
+		Having:  &BinaryExpr{Operator: ">", Left: &FunctionExpr{Name: "count", Star: true}, Right: &LiteralExpr{Value: int64(1)}},
+	}
+	if !reflect.DeepEqual(statement, expectedJoin) {
+		t.Errorf("Unexpected join syntax tree: %#v", statement)
+	}
+
+	statement, err = Parse("explain query plan delete from users where id = 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedExplain := &ExplainStmt{QueryPlan: true, Statement: &DeleteStmt{
+		Table: "users",
+		Where: &BinaryExpr{Operator: "=", Left: &ColumnExpr{Column: "id"}, Right: &LiteralExpr{Value: int64(1)}},
+	}}
+	if !reflect.DeepEqual(statement, expectedExplain) {
+		t.Errorf("Unexpected explain syntax tree: %#v", statement)
+	}
+
+	errorCases := []struct {
+		input    string
+		expected string
+	}{
+		{"", "Syntax error at line 1, column 1: expected a statement but found end of input."},
+		{"drop table users", "Syntax error at line 1, column 1: unrecognized statement starting with \"drop\"."},
+		{"select *\nfrom users\nwhere id = 'open", "Syntax error at line 3, column 12: unterminated string."},
+		{"select * from users where (id = 1", "Syntax error at line 1, column 34: expected \")\" but found end of input."},
+		{"select * from users limit 1 2", "Syntax error at line 1, column 29: unexpected \"2\" after the end of the statement."},
+		{"update users set email 'x'", "Syntax error at line 1, column 24: expected \"=\" but found 'x'."},
+		{"select 12abc", "Syntax error at line 1, column 8: malformed number."},
+		{"insert 1 user1", "Syntax error at line 1, column 15: expected an email but found end of input."},
+		{"create table t (a text(0))", "Syntax error at line 1, column 24: expected a length but found \"0\"."},
+		{"create index on users ()", "Syntax error at line 1, column 24: expected a column name but found \")\"."},
+		{"select * from users left docs", "Syntax error at line 1, column 26: expected JOIN but found \"docs\"."},
+		{"explain query select 1", "Syntax error at line 1, column 15: expected PLAN but found \"SELECT\"."},
+		{"explain explain select 1", "Syntax error at line 1, column 9: EXPLAIN cannot be nested."},
+	}
+	for _, c := range errorCases {
+		if _, err := Parse(c.input); err == nil || err.Error() != c.expected {
+			t.Errorf("%q: expected %q, got %v", c.input, c.expected, err)
+		}
+	}
+}
+
+func TestInsertSQL(t *testing.T) {
+	inputString := "INSERT INTO users (email, username, id) VALUES ('a@b.c', 'it''s', 7)\n" +
+		"insert into users values (3, 'user3', 'person3@example.com');\n" +
+		"insert into people values (4, 'a', 'b')\n" +
+		"insert into users (id, name) values (5, 'x')\n" +
+		"insert into users values (6, 'x')\n" +
+		"select * from users\n.exit\n"
+	expectedOutput := "db > Executed.\ndb > Executed.\n" +
+		"db > No such table: people.\n" +
+		"db > No such column: name.\n" +
+		"db > 2 values for 3 columns.\n" +
+		"db > (3, user3, person3@example.com)\n(7, it's, a@b.c)\nExecuted.\ndb > "
+	expectOutput(t, runScript(tempDBFile(t), inputString), expectedOutput)
+}
+
+func TestCreateTable(t *testing.T) {
+	fileName := tempDBFile(t)
+	inputString := "create table items (name TEXT NOT NULL, price REAL, qty INTEGER, data BLOB)\n" +
+		"insert into items values ('apple', 1.5, 3, x'6869')\n" +
+		"insert into items (name, qty) values ('pear', '7')\n" +
+		"insert into items (price) values (2)\n" +
+		"insert into items values ('plum', 'cheap', 1, NULL)\n" +
+		"select * from items\n" +
+		"create table items (a int)\n" +
+		"create table if not exists items (a int)\n" +
+		"create table t (a number)\n" +
+		"create table t (a text primary key)\n" +
+		"create table t (a int, A text)\n" +
+		"create table notes (body text)\n" +
+		"insert into notes values ('" + strings.Repeat("a", 400) + "')\n" +
+		"begin\ncreate table scratch (a int)\ninsert into scratch values (1)\nrollback\nselect * from scratch\n" +
+		"select\n.exit\n"
+	expectedOutput := "db > Executed.\ndb > Executed.\ndb > Executed.\n" +
+		"db > Column name cannot be NULL.\n" +
+		"db > Cannot store TEXT in REAL column price.\n" +
+		"db > (apple, 1.5, 3, hi)\n(pear, NULL, 7, NULL)\nExecuted.\n" +
+		"db > Table items already exists.\n" +
+		"db > Executed.\n" +
+		"db > Unknown column type number.\n" +
+		"db > Only an INTEGER column can be the primary key.\n" +
+		"db > Duplicate column name: A.\n" +
+		"db > Executed.\n" +
+		"db > Executed.\n" +
+		"db > Executed.\ndb > Executed.\ndb > Executed.\ndb > Executed.\n" +
+		"db > No such table: scratch.\n" +
+		"db > Executed.\ndb > "
+	expectOutput(t, runScript(fileName, inputString), expectedOutput)
+
+	// The tables and their rows survive reopening, and rows without a key are
+	// numbered after the last one
+	inputString = "insert into items values ('fig', 2, NULL, NULL)\nselect * from items\n.btree items\n.dbinfo\n.exit\n"
+	expectedOutput = "db > Executed.\n" +
+		"db > (apple, 1.5, 3, hi)\n(pear, NULL, 7, NULL)\n(fig, 2.0, NULL, NULL)\nExecuted.\n" +
+		"db > Tree:\n- leaf (size 3)\n  - 1\n  - 2\n  - 3\n" +
+		"db > format version: 1\npage size: 4096\npage count: 5\nfree list head: 0\nfree pages: 0\nschema cookie: 2\ndb > "
+	expectOutput(t, runScript(fileName, inputString), expectedOutput)
+}
+
+func TestCatalog(t *testing.T) {
+	fileName := tempDBFile(t)
+	inputString := "create table items (name text, qty int)\n" +
+		"create table Archive (id integer primary key, body blob)\n" +
+		"insert into items values ('apple', 3)\n" +
+		"insert into archive values (5, 'old')\n" +
+		".tables\n" +
+		".schema archive\n" +
+		".schema missing\n" +
+		"select * from goqlite_master\n" +
+		"insert into goqlite_master values ('table', 'x', 'x', 9, 'create table x (a)')\n" +
+		"delete from goqlite_master\n" +
+		"create table goqlite_stats (a int)\n" +
+		".exit\n"
+	expectedOutput := "db > Executed.\ndb > Executed.\ndb > Executed.\ndb > Executed.\n" +
+		"db > Archive\nitems\nusers\n" +
+		"db > create table Archive (id integer primary key, body blob);\n" +
+		"db > No such table: missing.\n" +
+		"db > (table, users, users, 2, " + constants.DEFAULT_TABLE_SQL + ")\n" +
+		"(table, items, items, 3, create table items (name text, qty int))\n" +
+		"(table, Archive, Archive, 4, create table Archive (id integer primary key, body blob))\n" +
+		"Executed.\n" +
+		"db > Table goqlite_master may not be modified.\n" +
+		"db > Table goqlite_master may not be modified.\n" +
+		"db > Table name goqlite_stats is reserved for internal use.\n" +
+		"db > "
+	expectOutput(t, runScript(fileName, inputString), expectedOutput)
+
+	// Each table keeps its own B-tree, found again through the catalog
+	inputString = ".schema\nselect * from items\nselect * from archive\n.exit\n"
+	expectedOutput = "db > " + constants.DEFAULT_TABLE_SQL + ";\n" +
+		"create table items (name text, qty int);\n" +
+		"create table Archive (id integer primary key, body blob);\n" +
+		"db > (apple, 3)\nExecuted.\n" +
+		"db > (5, old)\nExecuted.\ndb > "
+	expectOutput(t, runScript(fileName, inputString), expectedOutput)
+}
+
+func TestOverflowPages(t *testing.T) {
+	fileName := tempDBFile(t)
+	// Spills onto a few overflow pages
+	big := strings.Repeat("abcdefghij", 2000)
+	// Needs a longer chain than the row it replaces
+	bigger := strings.Repeat("z", int(constants.LEAF_NODE_MAX_LOCAL)+3*int(constants.OVERFLOW_PAGE_DATA_SIZE))
+	inputString := "create table docs (id integer primary key, body text, data blob)\n" +
+		"insert into docs values (1, 'short', NULL)\n" +
+		"insert into docs values (2, '" + big + "', x'00ff')\n" +
+		"insert into docs values (3, 'middle', NULL)\n" +
+		"select * from docs\n" +
+		"update docs set body = '" + bigger + "' where id = 2\n" +
+		".exit\n"
+	expectedOutput := "db > Executed.\ndb > Executed.\ndb > Executed.\ndb > Executed.\n" +
+		"db > (1, short, NULL)\n(2, " + big + ", \x00\xff)\n(3, middle, NULL)\nExecuted.\n" +
+		"db > Rows updated: 1\nExecuted.\ndb > "
+	expectOutput(t, runScript(fileName, inputString), expectedOutput)
+
+	databaseInstance := DBOpen(fileName)
+	table := databaseInstance.Tables["docs"]
+	var row Row
+	CursorRow(TableFind(table, 2), &row)
+	if row.Values[1] != bigger || !reflect.DeepEqual(row.Values[2], []byte{0x00, 0xff}) {
+		t.Errorf("Row 2 did not read back whole, body is %d bytes", len(FormatValue(row.Values[1])))
+	}
+
+	// Shrinking the row and then deleting it hands every overflow page back
+	statement := Statement{Type: constants.STATEMENT_UPDATE, Table: table, KeyLow: 2, KeyHigh: 2, Assignments: map[int]Expression{1: &LiteralExpr{Value: "tiny"}}}
+	captureStdout("", func() { runStatement(&statement, table, &VM{}) })
+	CursorRow(TableFind(table, 2), &row)
+	if row.Values[1] != "tiny" {
+		t.Errorf("Expected the updated body, got %v", row.Values[1])
+	}
+	runStatement(&Statement{Type: constants.STATEMENT_DELETE, KeyLow: 1, KeyHigh: 3}, table, &VM{})
+	header := GetPage(table.Pager, constants.HEADER_PAGE_NUM)
+	// Only the header and the three roots are still in use
+	if freePages := *FreePageCount(header); freePages != table.Pager.NumPages-4 {
+		t.Errorf("Expected %d free pages, got %d", table.Pager.NumPages-4, freePages)
+	}
+	DBClose(databaseInstance)
+}
+
+func TestLeafCellLocalSize(t *testing.T) {
+	maxLocal := uint32(constants.LEAF_NODE_MAX_LOCAL)
+	minLocal := uint32(constants.LEAF_NODE_MIN_LOCAL)
+	dataSize := uint32(constants.OVERFLOW_PAGE_DATA_SIZE)
+	cases := []struct {
+		recordSize uint32
+		localSize  uint32
+	}{
+		{10, 10},
+		{maxLocal, maxLocal},
+		// The last overflow page is filled and the remainder stays local
+		{minLocal + dataSize + 100, minLocal + 100},
+		// Unless the remainder is too large for the leaf
+		{maxLocal + 1, minLocal},
+	}
+	for _, c := range cases {
+		if localSize := leafCellLocalSize(c.recordSize); localSize != c.localSize {
+			t.Errorf("Record of %d bytes keeps %d bytes local, expected %d", c.recordSize, localSize, c.localSize)
+		}
+	}
+}
+
+func TestSelectClauses(t *testing.T) {
+	var script strings.Builder
+	var expectedOutput strings.Builder
+	for i := 1; i <= 8; i++ {
+		domain := "corp.com"
+		if i%2 == 0 {
+			domain = "example.com"
+		}
+		fmt.Fprintf(&script, "insert %d user%d person%d@%s\n", i, 9-i, i, domain)
+		expectedOutput.WriteString("db > Executed.\n")
+	}
+	script.WriteString("select username, email from users where id > 2 and email like '%@CORP.com' order by username limit 2 offset 1\n" +
+		"select id * 10 as big, upper(username) from users where id in (2, 4, NULL) or username is null order by big desc\n" +
+		"select id, id % 3, -id / 2.0 from users where id between 7 and 100 order by 2, 1 desc\n" +
+		"select 1 + 2, 'a' || NULL, 7 / 0, typeof(1.5), length('héllo'), coalesce(NULL, 3), 9223372036854775807 + 1\n" +
+		"select rowid from users where not id >= 2 limit 5\n" +
+		"select * from users order by email desc, id limit 3\n" +
+		"select * from users limit 0\n" +
+		"select name from users\n" +
+		"select id from users order by 3\n" +
+		"select nothing(id) from users\n" +
+		"select id from users limit 'many'\n" +
+		"select *\n" +
+		".exit\n")
+	expectedOutput.WriteString("db > (user4, person5@corp.com)\n(user6, person3@corp.com)\nExecuted.\n" +
+		"db > (40, USER5)\n(20, USER7)\nExecuted.\n" +
+		"db > (7, 1, -3.5)\n(8, 2, -4.0)\nExecuted.\n" +
+		"db > (3, NULL, NULL, real, 5, 3, 9.223372036854776e+18)\nExecuted.\n" +
+		"db > (1)\nExecuted.\n" +
+		"db > (8, user1, person8@example.com)\n(7, user2, person7@corp.com)\n(6, user3, person6@example.com)\nExecuted.\n" +
+		"db > Executed.\n" +
+		"db > No such column: name.\n" +
+		"db > ORDER BY term 1 is out of range, it should be between 1 and 1.\n" +
+		"db > Unknown function nothing.\n" +
+		"db > LIMIT must be an integer.\n" +
+		"db > SELECT * needs a FROM clause.\n" +
+		"db > ")
+	expectOutput(t, runScript(tempDBFile(t), script.String()), expectedOutput.String())
+}
+
+func TestLikeMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		text    string
+		match   bool
+	}{
+		{"abc", "ABC", true},
+		{"a_c", "abc", true},
+		{"a_c", "ac", false},
+		{"%", "", true},
+		{"%b%", "abc", true},
+		{"a%%c", "abbbc", true},
+		{"a%c", "abcd", false},
+		{"%@corp.com", "x@corp.com.au", false},
+	}
+	for _, c := range cases {
+		if match := likeMatch([]rune(c.pattern), []rune(c.text)); match != c.match {
+			t.Errorf("%q LIKE %q is %v, expected %v", c.text, c.pattern, match, c.match)
+		}
+	}
+}
+
+func TestSelectSeeksByKey(t *testing.T) {
+	fileName := tempDBFile(t)
+	databaseInstance, table := openUsers(fileName)
+	for id := uint32(1); id <= 3000; id++ {
+		statement := insertStatement(table, id)
+		statement.RowToInsert.Values[2] = longEmail
+		if err := runStatement(statement, table, &VM{}); err != nil {
+			t.Fatalf("Inserting %d: %v", id, err)
+		}
+	}
+	DBClose(databaseInstance)
+
+	queries := []struct {
+		sql    string
+		output string
+	}{
+		{"select id from users where id = 1234", "(1234)\n"},
+		{"select id from users where id between 2998 and 5000 and username is null", "(2998)\n(2999)\n(3000)\n"},
+		{"select id from users where 3 > rowid", "(1)\n(2)\n"},
+		{"select id from users where id >= 3000 and id < 3000", ""},
+		{"select id from users where id > 4000", ""},
+		{"select id from users where id > 2999 order by id desc", "(3000)\n"},
+	}
+	for _, query := range queries {
+		// Start every query with an empty cache to see which pages it reads
+		databaseInstance = DBOpen(fileName)
+		var statement Statement
+		output := captureStdout("", func() {
+			if err := PrepareStatement(query.sql, &statement, databaseInstance); err != nil {
+				fmt.Println(err)
+				return
+			}
+			ExecuteStatement(&statement, databaseInstance)
+		})
+		expectOutput(t, output, query.output)
+		// The header, the catalog and one path down the tree, rather than every leaf
+		if numPages := len(databaseInstance.Pager.Pages); numPages > 6 {
+			t.Errorf("%s read %d pages", query.sql, numPages)
+		}
+		DBClose(databaseInstance)
+	}
+}
+
+func TestCreateIndex(t *testing.T) {
+	fileName := tempDBFile(t)
+	inputString := "insert 1 bob b@x.com\ninsert 2 al a@x.com\ninsert 3 cy c@x.com\n" +
+		"create unique index on users(email)\n" +
+		"create index names on users (username, email)\n" +
+		"select * from users where email = 'b@x.com'\n" +
+		"insert 4 dup b@x.com\n" +
+		"update users set email = 'c@x.com' where id = 1\n" +
+		"update users set email = 'z@x.com' where id = 1\n" +
+		"delete from users where id = 3\n" +
+		".btree idx_users_email\n" +
+		"create unique index on users(username)\n" +
+		"create index users on users(id)\n" +
+		"create index names on users(id)\n" +
+		"create index if not exists names on users(id)\n" +
+		"create index q on users(nope)\n" +
+		"create table names (a int)\n" +
+		".exit\n"
+	expectedOutput := "db > Executed.\ndb > Executed.\ndb > Executed.\ndb > Executed.\ndb > Executed.\n" +
+		"db > (1, bob, b@x.com)\nExecuted.\n" +
+		"db > Error: UNIQUE constraint failed.\n" +
+		"db > Error: UNIQUE constraint failed.\n" +
+		"db > Rows updated: 1\nExecuted.\n" +
+		"db > Executed.\n" +
+		"db > Tree:\n- leaf (size 2)\n  - (a@x.com, 2)\n  - (z@x.com, 1)\n" +
+		"db > Executed.\n" +
+		"db > There is already a table named users.\n" +
+		"db > Index names already exists.\n" +
+		"db > Executed.\n" +
+		"db > No such column: nope.\n" +
+		"db > There is already an index named names.\n" +
+		"db > "
+	expectOutput(t, runScript(fileName, inputString), expectedOutput)
+
+	// The indexes are listed with their table and still used after reopening
+	inputString = ".schema users\n" +
+		"select id from users where email between 'a' and 'b'\n" +
+		"select id from users where username = 'bob' and email > 'c'\n" +
+		"insert 5 al e@x.com\n" +
+		".exit\n"
+	expectedOutput = "db > " + constants.DEFAULT_TABLE_SQL + ";\n" +
+		"create unique index on users(email);\n" +
+		"create index names on users (username, email);\n" +
+		"create unique index on users(username);\n" +
+		"db > (2)\nExecuted.\n" +
+		"db > (1)\nExecuted.\n" +
+		"db > Error: UNIQUE constraint failed.\n" +
+		"db > "
+	expectOutput(t, runScript(fileName, inputString), expectedOutput)
+}
+
+// Checks that every key under pageNum is above low and at most high, and that
+// every node points back at its parent
+func checkIndexSubtree(t *testing.T, indexInstance *Index, pageNum uint32, low []interface{}, high []interface{}) {
+	t.Helper()
+	pagerInstance := indexInstance.Table.Pager
+	node := GetPage(pagerInstance, pageNum)
+	inRange := func(key []interface{}) bool {
+		return (low == nil || compareIndexKeys(key, low) > 0) && (high == nil || compareIndexKeys(key, high) <= 0)
+	}
+	if GetNodeType(node) == constants.NODE_INDEX_LEAF {
+		for i := uint32(0); i < *IndexNodeNumCells(node); i++ {
+			if key := decodeIndexKey(indexInstance, IndexNodeKey(node, i)); !inRange(key) {
+				t.Errorf("Page %d holds %v outside its range", pageNum, key)
+			}
+		}
+		return
+	}
+
+	cells := indexNodeCells(node)
+	rightChild := *IndexNodeRightChild(node)
+	childLow := low
+	for _, cell := range cells {
+		key := decodeIndexKey(indexInstance, indexCellKey(constants.NODE_INDEX_INTERNAL, cell))
+		if !inRange(key) {
+			t.Errorf("Page %d has key %v outside its range", pageNum, key)
+		}
+		child := indexCellChild(cell)
+		if parent := *NodeParent(GetPage(pagerInstance, child)); parent != pageNum {
+			t.Errorf("Page %d has parent %d, expected %d", child, parent, pageNum)
+		}
+		checkIndexSubtree(t, indexInstance, child, childLow, key)
+		childLow = key
+	}
+	if parent := *NodeParent(GetPage(pagerInstance, rightChild)); parent != pageNum {
+		t.Errorf("Page %d has parent %d, expected %d", rightChild, parent, pageNum)
+	}
+	checkIndexSubtree(t, indexInstance, rightChild, childLow, high)
+}
+
+// Checks that the index holds exactly one entry for every row, in order
+func checkIndex(t *testing.T, indexInstance *Index) {
+	t.Helper()
+	checkIndexSubtree(t, indexInstance, indexInstance.RootPageNum, nil, nil)
+
+	var expected [][]interface{}
+	var row Row
+	for cursor := TableStart(indexInstance.Table); !cursor.EndOfTable; CursorAdvance(cursor) {
+		CursorRow(cursor, &row)
+		expected = append(expected, IndexKey(indexInstance, &row))
+	}
+	sort.Slice(expected, func(i int, j int) bool {
+		return compareIndexKeys(expected[i], expected[j]) < 0
+	})
+
+	var actual [][]interface{}
+	for cursor := IndexSeek(indexInstance, nil); !cursor.EndOfIndex; IndexCursorAdvance(cursor) {
+		actual = append(actual, IndexCursorKey(cursor))
+	}
+	if len(actual) != len(expected) {
+		t.Fatalf("Index has %d entries for %d rows", len(actual), len(expected))
+	}
+	for i := range actual {
+		if compareIndexKeys(actual[i], expected[i]) != 0 {
+			t.Fatalf("Entry %d is %v, expected %v", i, actual[i], expected[i])
+		}
+	}
+}
+
+func TestIndexMaintenance(t *testing.T) {
+	fileName := tempDBFile(t)
+	databaseInstance, table := openUsers(fileName)
+	var statement Statement
+	if err := PrepareStatement("create index by_email on users (email)", &statement, databaseInstance); err != nil {
+		t.Fatal(err)
+	}
+	ExecuteStatement(&statement, databaseInstance)
+	indexInstance := table.Indexes[0]
+
+	// Long emails inserted out of order grow the index several levels deep, and
+	// every email is shared by a few rows
+	email := func(id uint32, version int) string {
+		return fmt.Sprintf("%s%03d-%d", strings.Repeat("e", 300), id*31%500, version)
+	}
+	for i := uint32(0); i < 2000; i++ {
+		id := i*7919%2000 + 1
+		statement := insertStatement(table, id)
+		statement.RowToInsert.Values[2] = email(id, 0)
+		if err := runStatement(statement, table, &VM{}); err != nil {
+			t.Fatalf("Inserting %d: %v", id, err)
+		}
+	}
+	checkIndex(t, indexInstance)
+
+	captureStdout("", func() {
+		for id := uint32(1); id <= 2000; id += 3 {
+			update := Statement{Type: constants.STATEMENT_UPDATE, Table: table, KeyLow: id, KeyHigh: id, Assignments: map[int]Expression{2: &LiteralExpr{Value: email(id, 1)}}}
+			runStatement(&update, table, &VM{})
+		}
+	})
+	for id := uint32(2); id <= 2000; id += 3 {
+		runStatement(&Statement{Type: constants.STATEMENT_DELETE, Table: table, KeyLow: id, KeyHigh: id}, table, &VM{})
+	}
+	checkIndex(t, indexInstance)
+	DBClose(databaseInstance)
+
+	// A lookup by email reads one path down the index and the matching rows,
+	// rather than every leaf
+	databaseInstance = DBOpen(fileName)
+	sql := fmt.Sprintf("select id from users where email = '%s'", email(1, 1))
+	output := captureStdout("", func() {
+		if err := PrepareStatement(sql, &statement, databaseInstance); err != nil {
+			fmt.Println(err)
+			return
+		}
+		ExecuteStatement(&statement, databaseInstance)
+	})
+	expectOutput(t, output, "(1)\n(1501)\n")
+	if numPages := len(databaseInstance.Pager.Pages); numPages > 12 {
+		t.Errorf("Lookup read %d pages", numPages)
+	}
+	DBClose(databaseInstance)
+
+	// Emptied index nodes are merged away and their pages freed along with the table's
+	databaseInstance, table = openUsers(fileName)
+	indexInstance = table.Indexes[0]
+	runStatement(&Statement{Type: constants.STATEMENT_DELETE, Table: table, KeyLow: 1, KeyHigh: 2000}, table, &VM{})
+	checkIndex(t, indexInstance)
+	root := GetPage(table.Pager, indexInstance.RootPageNum)
+	if GetNodeType(root) != constants.NODE_INDEX_LEAF || *IndexNodeNumCells(root) != 0 {
+		t.Errorf("Expected the index root to be an empty leaf")
+	}
+	// Everything but the header page, the catalog and the two roots is free again
+	header := GetPage(table.Pager, constants.HEADER_PAGE_NUM)
+	if freePages := *FreePageCount(header); freePages != table.Pager.NumPages-4 {
+		t.Errorf("Expected %d free pages, got %d", table.Pager.NumPages-4, freePages)
+	}
+	DBClose(databaseInstance)
+}
+
+func TestAggregates(t *testing.T) {
+	fileName := tempDBFile(t)
+	inputString := "select count(*), sum(id), avg(id), min(email), group_concat(username) from users\n" +
+		"create table sales (id integer primary key, region text, amount real, qty int)\n" +
+		"insert into sales values (1, 'east', 10.5, 2)\n" +
+		"insert into sales values (2, 'west', 3, NULL)\n" +
+		"insert into sales values (3, 'east', 4, 5)\n" +
+		"insert into sales values (4, NULL, 1, 1)\n" +
+		"insert into sales values (5, 'west', 7.25, 3)\n" +
+		"select count(*), count(qty), sum(qty), sum(amount), avg(qty), min(amount), max(region) from sales\n" +
+		"select region, count(*), sum(qty), group_concat(id, '-') from sales group by region\n" +
+		"select region, sum(amount) as total from sales group by 1 having count(*) > 1 order by total desc\n" +
+		"select region, count(*) from sales where qty > 1 group by region order by 2 desc, region limit 1\n" +
+		"select count(*) + 1 from sales\n" +
+		"select sum(qty) from sales where id > 100\n" +
+		"select count(*)\n" +
+		"select id from sales where count(*) > 1\n" +
+		"select region from sales group by count(*)\n" +
+		"select id from sales having id > 1\n" +
+		"select sum(max(id)) from sales\n" +
+		"select sum(*) from sales\n" +
+		"select region from sales group by 3\n" +
+		"select avg(qty) from sales where qty = 2\n" +
+		".exit\n"
+	expectedOutput := "db > (0, NULL, NULL, NULL, NULL)\nExecuted.\n" +
+		"db > Executed.\ndb > Executed.\ndb > Executed.\ndb > Executed.\ndb > Executed.\ndb > Executed.\n" +
+		"db > (5, 4, 11, 25.75, 2.75, 1.0, west)\nExecuted.\n" +
+		"db > (NULL, 1, 1, 4)\n(east, 2, 7, 1-3)\n(west, 2, 3, 2-5)\nExecuted.\n" +
+		"db > (east, 14.5)\n(west, 10.25)\nExecuted.\n" +
+		"db > (east, 2)\nExecuted.\n" +
+		"db > (6)\nExecuted.\n" +
+		"db > (NULL)\nExecuted.\n" +
+		"db > (1)\nExecuted.\n" +
+		"db > Misuse of aggregate function count().\n" +
+		"db > Aggregate functions are not allowed in the GROUP BY clause.\n" +
+		"db > HAVING clause on a non-aggregate query.\n" +
+		"db > Misuse of aggregate function max().\n" +
+		"db > Wrong number of arguments to function sum.\n" +
+		"db > GROUP BY term 1 is out of range, it should be between 1 and 1.\n" +
+		"db > (2.0)\nExecuted.\n" +
+		"db > "
+	expectOutput(t, runScript(fileName, inputString), expectedOutput)
+}
+
+func TestComparisonAffinity(t *testing.T) {
+	fileName := tempDBFile(t)
+	// Text that spells out a number matches it in an INTEGER or REAL column,
+	// whether the rows are scanned, sought by key or found through an index
+	inputString := "create table items (id integer primary key, qty int, price real, label text)\n" +
+		"insert into items values (1, 2, 1.5, '2')\n" +
+		"insert into items values (2, 3, 2, 'x')\n" +
+		"insert into items values (3, 10, 2.5, '9')\n" +
+		"select id from items where id = '2'\n" +
+		"select id from items where '2' < rowid\n" +
+		"select id from items where price = ' 2.5 '\n" +
+		"select id from items where qty = label\n" +
+		"select id from items where qty = 'two'\n" +
+		"create index items_qty on items (qty)\n" +
+		"select id from items where qty = '3'\n" +
+		"select id from items where qty between '2' and '3'\n" +
+		"select id from items where label > '2'\n" +
+		".exit\n"
+	expectedOutput := "db > Executed.\ndb > Executed.\ndb > Executed.\ndb > Executed.\n" +
+		"db > (2)\nExecuted.\n" +
+		"db > (3)\nExecuted.\n" +
+		"db > (3)\nExecuted.\n" +
+		"db > (1)\nExecuted.\n" +
+		"db > Executed.\n" +
+		"db > Executed.\n" +
+		"db > (2)\nExecuted.\n" +
+		"db > (1)\n(2)\nExecuted.\n" +
+		// Comparing two TEXT values stays a text comparison
+		"db > (2)\n(3)\nExecuted.\n" +
+		"db > "
+	expectOutput(t, runScript(fileName, inputString), expectedOutput)
+}
+
+func TestCountFromLeaves(t *testing.T) {
+	fileName := tempDBFile(t)
+	body := strings.Repeat("abcdefghij", 1000)
+	inputString := "create table docs (id integer primary key, body text)\n"
+	for id := 1; id <= 40; id++ {
+		inputString += fmt.Sprintf("insert into docs values (%d, '%s')\n", id, body)
+	}
+	inputString += ".exit\n"
+	runScript(fileName, inputString)
+
+	// Every row spills onto overflow pages, which counting the cells of the
+	// leaves never has to read
+	databaseInstance := DBOpen(fileName)
+	var statement Statement
+	output := captureStdout("", func() {
+		if err := PrepareStatement("select count(*) from docs", &statement, databaseInstance); err != nil {
+			fmt.Println(err)
+			return
+		}
+		ExecuteStatement(&statement, databaseInstance)
+	})
+	expectOutput(t, output, "(40)\n")
+	if !statement.CountFromLeaves {
+		t.Error("count(*) read the rows")
+	}
+	if numPages := len(databaseInstance.Pager.Pages); numPages > 8 {
+		t.Errorf("Counting read %d pages", numPages)
+	}
+	DBClose(databaseInstance)
+
+	// Counting a column has to look at every row and agrees
+	inputString = "select count(body), count(*) from docs\n.exit\n"
+	expectOutput(t, runScript(fileName, inputString), "db > (40, 40)\nExecuted.\ndb > ")
+}
+
+func TestJoins(t *testing.T) {
+	fileName := tempDBFile(t)
+	inputString := "create table authors (id integer primary key, name text, country text)\n" +
+		"create table books (id integer primary key, author_id int, title text, country text)\n" +
+		"create index on books (author_id)\n" +
+		"insert into authors values (1, 'ann', 'ca')\n" +
+		"insert into authors values (2, 'bo', 'us')\n" +
+		"insert into authors values (3, 'cy', 'ca')\n" +
+		"insert into books values (10, 1, 'alpha', 'ca')\n" +
+		"insert into books values (11, 1, 'beta', 'us')\n" +
+		"insert into books values (12, 2, 'gamma', 'us')\n" +
+		"insert into books values (13, NULL, 'delta', NULL)\n" +
+		"select a.name, b.title from authors a join books b on b.author_id = a.id order by b.id\n" +
+		"select name, title from authors left join books on books.author_id = authors.id where title is null or title > 'b'\n" +
+		"select * from authors join books using (country) order by authors.id, books.id\n" +
+		"select count(*) from authors, books\n" +
+		"select a.name, count(b.id) from authors a left outer join books b on a.id = b.author_id group by a.id\n" +
+		"select title from books b cross join authors a where a.country = b.country and a.id = 3\n" +
+		"select a.name, b.name from authors a join authors b on a.country = b.country and a.id < b.id\n" +
+		"select u.rowid, name from authors u where u.id = 2\n" +
+		"select id from authors join books on 1\n" +
+		"select name from authors a join books b on b.author_id = c.id\n" +
+		"select name from authors join authors\n" +
+		"select * from authors join books using (title)\n" +
+		"select authors.name from authors a\n" +
+		".exit\n"
+	expectedOutput := "db > Executed.\ndb > Executed.\ndb > Executed.\n" +
+		"db > Executed.\ndb > Executed.\ndb > Executed.\n" +
+		"db > Executed.\ndb > Executed.\ndb > Executed.\ndb > Executed.\n" +
+		"db > (ann, alpha)\n(ann, beta)\n(bo, gamma)\nExecuted.\n" +
+		"db > (ann, beta)\n(bo, gamma)\n(cy, NULL)\nExecuted.\n" +
+		"db > (1, ann, ca, 10, 1, alpha)\n(2, bo, us, 11, 1, beta)\n(2, bo, us, 12, 2, gamma)\n(3, cy, ca, 10, 1, alpha)\nExecuted.\n" +
+		"db > (12)\nExecuted.\n" +
+		"db > (ann, 2)\n(bo, 1)\n(cy, 0)\nExecuted.\n" +
+		"db > (alpha)\nExecuted.\n" +
+		"db > (ann, cy)\nExecuted.\n" +
+		"db > (2, bo)\nExecuted.\n" +
+		"db > Ambiguous column name: id.\n" +
+		"db > No such column: c.id.\n" +
+		"db > Table name authors is used more than once.\n" +
+		"db > Cannot join using column title, it is not in both tables.\n" +
+		"db > No such column: authors.name.\n" +
+		"db > "
+	expectOutput(t, runScript(fileName, inputString), expectedOutput)
+}
+
+func TestJoinAccess(t *testing.T) {
+	fileName := tempDBFile(t)
+	inputString := "create table owners (id integer primary key, code int, tag int)\n" +
+		"create table pets (id integer primary key, owner int, code int)\n" +
+		"create index on pets (owner)\n"
+	for id := 1; id <= 60; id++ {
+		inputString += fmt.Sprintf("insert into owners values (%d, %d, %d)\n", id, id%7, id%5)
+		inputString += fmt.Sprintf("insert into pets values (%d, %d, %d)\n", id, id*13%70, id%7)
+	}
+	inputString += ".exit\n"
+	runScript(fileName, inputString)
+
+	databaseInstance := DBOpen(fileName)
+	defer DBClose(databaseInstance)
+	run := func(sql string) (string, []string) {
+		var statement Statement
+		output := captureStdout("", func() {
+			if err := PrepareStatement(sql, &statement, databaseInstance); err != nil {
+				fmt.Println(err)
+				return
+			}
+			ExecuteStatement(&statement, databaseInstance)
+		})
+		var access []string
+		if statement.Table != nil {
+			for _, source := range statement.Table.Sources {
+				access = append(access, source.Access)
+			}
+		}
+		return output, access
+	}
+
+	// Each way of reading the inner table gives the rows a plain scan does
+	cases := []struct {
+		sql    string
+		access []string
+	}{
+		{"select o.id, p.id from owners o join pets p on p.owner = o.id order by 1, 2", []string{constants.JOIN_ACCESS_SCAN, constants.JOIN_ACCESS_INDEX}},
+		{"select o.id, p.id from pets p join owners o on p.owner = o.id order by 1, 2", []string{constants.JOIN_ACCESS_SCAN, constants.JOIN_ACCESS_ROWID}},
+		{"select o.id, p.id from owners o join pets p on p.code = o.code and p.owner = o.tag order by 1, 2", []string{constants.JOIN_ACCESS_SCAN, constants.JOIN_ACCESS_INDEX}},
+		{"select o.id, p.id from owners o join pets p on p.code = o.code order by 1, 2", []string{constants.JOIN_ACCESS_SCAN, constants.JOIN_ACCESS_HASH}},
+		{"select o.id, p.id from owners o, pets p where p.code = o.code order by 1, 2", []string{constants.JOIN_ACCESS_SCAN, constants.JOIN_ACCESS_HASH}},
+		{"select o.id, p.id from owners o join pets p on p.code + 0 = o.code order by 1, 2", []string{constants.JOIN_ACCESS_SCAN, constants.JOIN_ACCESS_SCAN}},
+		{"select o.id, p.id from owners o join pets p on p.id = 5 where o.id = 3", []string{constants.JOIN_ACCESS_ROWID, constants.JOIN_ACCESS_ROWID}},
+	}
+	for _, c := range cases {
+		output, access := run(c.sql)
+		if !reflect.DeepEqual(access, c.access) {
+			t.Errorf("%s: read the tables by %v, expected %v", c.sql, access, c.access)
+		}
+		scan := strings.Replace(c.sql, "p.code =", "p.code + 0 =", 1)
+		scan = strings.Replace(scan, "p.owner =", "p.owner + 0 =", 1)
+		scan = strings.Replace(scan, "p.id =", "p.id + 0 =", 1)
+		if expected, _ := run(scan); output != expected || output == "" {
+			t.Errorf("%s: got %q, a scan gives %q", c.sql, output, expected)
+		}
+	}
+
+	// A LEFT join only looks up rows by its ON clause, so WHERE still sees the
+	// owners without pets
+	output, access := run("select o.id from owners o left join pets p on p.owner = o.id where p.id is null and o.id < 20")
+	expectOutput(t, output, "(5)\n(18)\n")
+	if !reflect.DeepEqual(access, []string{constants.JOIN_ACCESS_SCAN, constants.JOIN_ACCESS_INDEX}) {
+		t.Errorf("LEFT join read the tables by %v", access)
+	}
+}
+
+func TestRunProgram(t *testing.T) {
+	// Counts down from 3, printing each value
+	program := &Program{
+		Instructions: []Instruction{
+			{Opcode: constants.OP_INTEGER, P1: 3, P2: 0},
+			{Opcode: constants.OP_RESULT_ROW, P1: 0, P2: 1},
+			{Opcode: constants.OP_DECR_JUMP_ZERO, P1: 0, P2: 4},
+			{Opcode: constants.OP_GOTO, P2: 1},
+			{Opcode: constants.OP_HALT, P4: ErrFullTable},
+		},
+		NumRegisters: 1,
+	}
+	var err error
+	output := captureStdout("", func() {
+		err = RunProgram(program)
+	})
+	expectOutput(t, output, "(3)\n(2)\n(1)\n")
+	if !errors.Is(err, ErrFullTable) || err.Error() != "Table is full." {
+		t.Errorf("Program halted with %v", err)
+	}
+}
+
+func TestCompileStatement(t *testing.T) {
+	fileName := tempDBFile(t)
+	inputString := "create table people (id integer primary key, name text)\n" +
+		"insert into people values (1, 'ann')\n" +
+		"insert into people values (2, 'bo')\n" +
+		"insert into people values (3, 'cy')\n" +
+		".exit\n"
+	runScript(fileName, inputString)
+
+	databaseInstance := DBOpen(fileName)
+	defer DBClose(databaseInstance)
+	var statement Statement
+	if err := PrepareStatement("select name from people where id > 1 order by name desc limit 1", &statement, databaseInstance); err != nil {
+		t.Fatal(err)
+	}
+	program := statement.Program
+	if program == nil {
+		t.Fatal("Select wasn't compiled")
+	}
+	opcodes := make(map[string]bool)
+	for _, instruction := range program.Instructions {
+		opcodes[instruction.Opcode] = true
+	}
+	for _, opcode := range []string{constants.OP_SEEK_GE, constants.OP_SORTER_INSERT, constants.OP_SORTER_SORT, constants.OP_RESULT_ROW} {
+		if !opcodes[opcode] {
+			t.Errorf("Program has no %s", opcode)
+		}
+	}
+	if last := program.Instructions[len(program.Instructions)-1]; last.Opcode != constants.OP_HALT {
+		t.Errorf("Program ends with %s", last.Opcode)
+	}
+	// The same program can run more than once
+	for i := 0; i < 2; i++ {
+		output := captureStdout("", func() {
+			ExecuteStatement(&statement, databaseInstance)
+		})
+		expectOutput(t, output, "(cy)\n")
+	}
+
+	if err := PrepareStatement("begin", &statement, databaseInstance); err != nil {
+		t.Fatal(err)
+	}
+	if statement.Program != nil {
+		t.Error("BEGIN was compiled")
+	}
+}
+
+func TestExplain(t *testing.T) {
+	fileName := tempDBFile(t)
+	inputString := "create table authors (id integer primary key, name text)\n" +
+		"create table books (id integer primary key, author_id int, title text)\n" +
+		"create index by_author on books (author_id, title)\n" +
+		"insert into authors values (1, 'ann')\n" +
+		"explain query plan select * from authors\n" +
+		"explain query plan select * from authors where id between 2 and 5\n" +
+		"explain query plan select * from books where author_id = 1 and title > 'a' order by title\n" +
+		"explain query plan select name, count(*) from authors a left join books b on b.author_id = a.id group by name\n" +
+		"explain query plan select count(*) from books\n" +
+		"explain query plan update authors set name = 'bo' where id = 1\n" +
+		"explain query plan update books set title = 'x' where author_id = 1\n" +
+		"explain query plan delete from books where author_id between 2 and 3\n" +
+		"explain insert into authors values (2, 'bo')\n" +
+		"select * from authors\n" +
+		".exit\n"
+	expected := "db > Executed.\n" +
+		"db > Executed.\n" +
+		"db > Executed.\n" +
+		"db > Executed.\n" +
+		"db > QUERY PLAN\n`--SCAN authors\nExecuted.\n" +
+		"db > QUERY PLAN\n`--SEARCH authors USING INTEGER PRIMARY KEY (rowid>? AND rowid<?)\nExecuted.\n" +
+		"db > QUERY PLAN\n|--SEARCH books USING INDEX by_author (author_id=? AND title>?)\n`--USE TEMP B-TREE FOR ORDER BY\nExecuted.\n" +
+		"db > QUERY PLAN\n|--SCAN a\n|--SEARCH b USING INDEX by_author (author_id=?) LEFT-JOIN\n`--USE TEMP B-TREE FOR GROUP BY\nExecuted.\n" +
+		"db > QUERY PLAN\n`--SCAN books USING LEAF CELL COUNTS\nExecuted.\n" +
+		"db > QUERY PLAN\n`--SEARCH authors USING INTEGER PRIMARY KEY (rowid=?)\nExecuted.\n" +
+		"db > QUERY PLAN\n`--SEARCH books USING INDEX by_author (author_id=?)\nExecuted.\n" +
+		"db > QUERY PLAN\n`--SEARCH books USING INDEX by_author (author_id>? AND author_id<?)\nExecuted.\n"
+	output := runScript(fileName, inputString)
+	if !strings.HasPrefix(output, expected) {
+		t.Fatalf("Unexpected output:\n%s", output)
+	}
+
+	// EXPLAIN lists the program without running it, so the insert never happens
+	program := strings.TrimPrefix(output, expected)
+	for _, opcode := range []string{constants.OP_OPEN_WRITE, constants.OP_MAKE_RECORD, constants.OP_INSERT} {
+		if !strings.Contains(program, opcode) {
+			t.Errorf("Program has no %s:\n%s", opcode, program)
+		}
+	}
+	if !strings.HasPrefix(program, "db > addr  opcode") || !strings.HasSuffix(program, "db > (1, ann)\nExecuted.\ndb > ") {
+		t.Errorf("Unexpected output:\n%s", program)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	// Extended codes match themselves and their primary code, nothing else
+	err := error(newError(ErrConstraintUnique))
+	if !errors.Is(err, ErrConstraintUnique) || !errors.Is(err, ErrConstraint) || errors.Is(err, ErrConstraintPrimaryKey) || errors.Is(err, ErrBusy) {
+		t.Errorf("Unexpected matches for %v", err)
+	}
+	if ErrIOFsync.Primary() != ErrIO || ErrIOFsync.Error() != "Disk I/O error." || ErrorCodeOf(err) != ErrConstraintUnique || ErrorCodeOf(errors.New("plain")) != ErrError {
+		t.Errorf("Unexpected codes")
+	}
+
+	// Raised I/O errors keep the system call error behind them
+	raise := func(code ErrorCode, cause error) (err error) {
+		defer RecoverError(&err)
+		raiseIOError(code, "writing the database file", cause)
+		return nil
+	}
+	err = raise(ErrIOWrite, syscall.EIO)
+	if !errors.Is(err, ErrIOWrite) || !errors.Is(err, syscall.EIO) || err.Error() != "Error writing the database file: input/output error." {
+		t.Errorf("Unexpected I/O error %v", err)
+	}
+	if err := raise(ErrIOWrite, syscall.ENOSPC); !errors.Is(err, ErrFullDisk) || errors.Is(err, ErrIO) || !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("Expected running out of space to be reported as a full disk, got %v", err)
+	}
+}
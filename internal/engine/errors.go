@@ -0,0 +1,194 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"syscall"
+)
+
+// Error Code
+//
+// Every error goqlite reports is an *Error carrying an ErrorCode. The low
+// byte of a code is its primary code, which says what kind of failure it is,
+// and the extended codes add detail in the bits above, like SQLite's. An
+// ErrorCode is an error itself, so errors.Is(err, ErrConstraint) matches any
+// constraint failure and errors.Is(err, ErrConstraintUnique) only a UNIQUE one.
+//
+// Failures deep in the pager and the B-trees can't be handed back through
+// every caller in between, so they are raised by panicking with an *Error,
+// the way the parser raises a syntax error. The entry points of goqlite
+// recover them and return them as errors, which leaves the process running
+// when a database file turns out to be unreadable or corrupt.
+
+type ErrorCode int
+
+// Primary codes
+const (
+	// The statement doesn't fit the schema, like a missing table or column
+	ErrError ErrorCode = iota + 1
+	// The engine was asked to do something it never should, like change a
+	// page outside of a write
+	ErrInternal
+	ErrSyntax
+	ErrConstraint
+	// An UPDATE found no row with the key it was given
+	ErrNotFound
+	// Another connection is writing
+	ErrBusy
+	// Another connection changed the schema after the statement was prepared
+	ErrSchema
+	ErrTooBig
+	ErrFull
+	// A read, write or sync of the database file, its journal or its WAL failed
+	ErrIO
+	// The database file doesn't hold what a database should
+	ErrCorrupt
+	// The API was used the wrong way, like committing without a transaction
+	ErrMisuse
+)
+
+// Extended codes
+const (
+	ErrConstraintPrimaryKey = ErrConstraint | 1<<8
+	ErrConstraintUnique     = ErrConstraint | 2<<8
+
+	ErrTooBigRow      = ErrTooBig | 1<<8
+	ErrTooBigIndexKey = ErrTooBig | 2<<8
+
+	// Every key up to the largest has been used
+	ErrFullTable = ErrFull | 1<<8
+	// The file system ran out of space
+	ErrFullDisk = ErrFull | 2<<8
+
+	ErrIORead     = ErrIO | 1<<8
+	ErrIOWrite    = ErrIO | 2<<8
+	ErrIOFsync    = ErrIO | 3<<8
+	ErrIOOpen     = ErrIO | 4<<8
+	ErrIOClose    = ErrIO | 5<<8
+	ErrIOSeek     = ErrIO | 6<<8
+	ErrIOTruncate = ErrIO | 7<<8
+	ErrIODelete   = ErrIO | 8<<8
+	ErrIOLock     = ErrIO | 9<<8
+)
+
+// What each code means when nothing more specific is said, extended codes
+// without an entry fall back on their primary code's
+var errorMessages = map[ErrorCode]string{
+	ErrError:                "SQL error.",
+	ErrInternal:             "Internal error.",
+	ErrSyntax:               "Syntax error.",
+	ErrConstraint:           "Constraint failed.",
+	ErrConstraintPrimaryKey: "Duplicate key.",
+	ErrConstraintUnique:     "UNIQUE constraint failed.",
+	ErrNotFound:             "No row with that id.",
+	ErrBusy:                 "Database is locked.",
+	ErrSchema:               "The schema changed, run the statement again.",
+	ErrTooBig:               "Value is too large.",
+	ErrTooBigRow:            "Row is too large.",
+	ErrTooBigIndexKey:       "Index key is too large.",
+	ErrFull:                 "Database is full.",
+	ErrFullTable:            "Table is full.",
+	ErrFullDisk:             "Disk is full.",
+	ErrIO:                   "Disk I/O error.",
+	ErrCorrupt:              "Database file is corrupt.",
+	ErrMisuse:               "Library used incorrectly.",
+}
+
+// The primary code an extended code adds detail to
+func (code ErrorCode) Primary() ErrorCode {
+	return code & 0xff
+}
+
+func (code ErrorCode) Error() string {
+	if message, ok := errorMessages[code]; ok {
+		return message
+	}
+	return errorMessages[code.Primary()]
+}
+
+type Error struct {
+	// A primary code, or an extended code when there's more to say
+	Code    ErrorCode
+	Message string
+	// Where a syntax error is in the statement, both counted from 1. Zero for
+	// errors that aren't about one spot in the text.
+	Line   int
+	Column int
+	// The system call error behind an I/O error, nil otherwise
+	Err error
+}
+
+func (err *Error) Error() string {
+	if err.Line > 0 {
+		return fmt.Sprintf("Syntax error at line %d, column %d: %s.", err.Line, err.Column, err.Message)
+	}
+	return err.Message
+}
+
+func (err *Error) Unwrap() error {
+	return err.Err
+}
+
+// Matches the error's code, or the primary code it extends
+func (err *Error) Is(target error) bool {
+	code, ok := target.(ErrorCode)
+	return ok && (err.Code == code || err.Code.Primary() == code)
+}
+
+// The error's code, or ErrError for an error that didn't come from goqlite
+func ErrorCodeOf(err error) ErrorCode {
+	var goqliteError *Error
+	if errors.As(err, &goqliteError) {
+		return goqliteError.Code
+	}
+	return ErrError
+}
+
+// An error with the code's own message
+func newError(code ErrorCode) *Error {
+	return &Error{Code: code, Message: code.Error()}
+}
+
+func errorf(code ErrorCode, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// Raises an I/O error for a failed system call. Running out of space is
+// reported as ErrFullDisk rather than as an I/O error.
+func raiseIOError(code ErrorCode, action string, err error) {
+	if err == nil {
+		// A write that wrote nothing and a read that came up short
+		err = io.ErrUnexpectedEOF
+	}
+	if errors.Is(err, syscall.ENOSPC) {
+		code = ErrFullDisk
+	}
+	panic(&Error{Code: code, Message: fmt.Sprintf("Error %s: %v.", action, err), Err: err})
+}
+
+func raiseCorrupt(format string, args ...interface{}) {
+	panic(errorf(ErrCorrupt, format, args...))
+}
+
+func raiseInternal(format string, args ...interface{}) {
+	panic(errorf(ErrInternal, format, args...))
+}
+
+// Deferred by the entry points of goqlite to return an error raised
+// further down as their own. Pages are used as they are read from the file,
+// so a corrupt one shows up as an index or slice out of range, which is
+// returned as ErrCorrupt. Anything else that panicked keeps going.
+func RecoverError(err *error) {
+	if recovered := recover(); recovered != nil {
+		switch raised := recovered.(type) {
+		case *Error:
+			*err = raised
+		case runtime.Error:
+			*err = &Error{Code: ErrCorrupt, Message: fmt.Sprintf("Database file is corrupt: %v.", raised), Err: raised}
+		default:
+			panic(recovered)
+		}
+	}
+}
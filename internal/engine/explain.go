@@ -0,0 +1,192 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/kris-gaudel/goqlite/constants"
+)
+
+// Explain Code
+//
+// EXPLAIN outputs the program a statement compiles to, one row per
+// instruction, and EXPLAIN QUERY PLAN outputs how it reads each table: a SCAN
+// walks the whole B-tree, a SEARCH seeks to the rows its key or an index
+// narrows it down to. Joined tables are listed in the order their loops are
+// nested. Neither runs the statement. The shell prints the rows as a table.
+
+// Column names of the rows ExplainRows returns
+func ExplainColumns(statement *Statement) []string {
+	if statement.Explain == constants.EXPLAIN_QUERY_PLAN {
+		return []string{"detail"}
+	}
+	return []string{"addr", "opcode", "p1", "p2", "p3", "p4", "p5"}
+}
+
+// What the statement was prepared to explain, as the rows it outputs
+func ExplainRows(statement *Statement) [][]interface{} {
+	var rows [][]interface{}
+	if statement.Explain == constants.EXPLAIN_QUERY_PLAN {
+		for _, line := range QueryPlan(statement) {
+			rows = append(rows, []interface{}{line})
+		}
+	} else if statement.Program != nil {
+		for address, instruction := range statement.Program.Instructions {
+			rows = append(rows, []interface{}{int64(address), instruction.Opcode, int64(instruction.P1), int64(instruction.P2),
+				int64(instruction.P3), formatOperand(instruction.P4), int64(instruction.P5)})
+		}
+	}
+	return rows
+}
+
+// Spells out the P4 of an instruction, naming the table, index or functions
+// it points to
+func formatOperand(operand interface{}) string {
+	switch operand := operand.(type) {
+	case nil:
+		return ""
+	case *Table:
+		return operand.Name
+	case *Index:
+		return operand.Name
+	case *JoinSource:
+		return operand.Table.Name
+	case ErrorCode:
+		return operand.Error()
+	case []*FunctionExpr:
+		names := make([]string, len(operand))
+		for i, call := range operand {
+			names[i] = call.Name
+		}
+		return strings.Join(names, ",")
+	case []bool:
+		// Sort order of each ORDER BY term
+		orders := make([]string, len(operand))
+		for i, descending := range operand {
+			orders[i] = "ASC"
+			if descending {
+				orders[i] = "DESC"
+			}
+		}
+		return strings.Join(orders, ",")
+	}
+	return FormatValue(operand)
+}
+
+// One line for each table the statement reads, in the order it reads them,
+// followed by the sorting it does. Inserts and statements that aren't
+// compiled have no plan.
+func QueryPlan(statement *Statement) []string {
+	tableInstance := statement.Table
+	var plan []string
+	switch statement.Type {
+	case constants.STATEMENT_SELECT:
+		switch {
+		case tableInstance == nil:
+			plan = append(plan, "SCAN CONSTANT ROW")
+		case statement.CountFromLeaves:
+			plan = append(plan, fmt.Sprintf("SCAN %s USING LEAF CELL COUNTS", tableInstance.Name))
+		case tableInstance.Sources != nil:
+			for _, source := range tableInstance.Sources {
+				plan = append(plan, joinSourcePlan(source))
+			}
+		default:
+			plan = append(plan, tablePlan(statement))
+		}
+		if len(statement.GroupBy) > 0 {
+			plan = append(plan, "USE TEMP B-TREE FOR GROUP BY")
+		}
+		if len(statement.OrderBy) > 0 {
+			plan = append(plan, "USE TEMP B-TREE FOR ORDER BY")
+		}
+	case constants.STATEMENT_UPDATE, constants.STATEMENT_DELETE:
+		plan = append(plan, tablePlan(statement))
+	}
+	return plan
+}
+
+// How a statement planned by planTable reads its table
+func tablePlan(statement *Statement) string {
+	if statement.Index != nil {
+		return indexPlan(statement.Table, statement.Index, statement.IndexLow, statement.IndexHigh)
+	}
+	return keyRangePlan(statement.Table, statement.KeyLow, statement.KeyHigh)
+}
+
+// A whole table, or the rows between two keys
+func keyRangePlan(tableInstance *Table, low uint32, high uint32) string {
+	var constraints []string
+	if low == high {
+		constraints = append(constraints, "rowid=?")
+	} else {
+		if low > 1 {
+			constraints = append(constraints, "rowid>?")
+		}
+		if high < math.MaxUint32 {
+			constraints = append(constraints, "rowid<?")
+		}
+	}
+	if len(constraints) == 0 {
+		return "SCAN " + tableInstance.Name
+	}
+	return fmt.Sprintf("SEARCH %s USING INTEGER PRIMARY KEY (%s)", tableInstance.Name, strings.Join(constraints, " AND "))
+}
+
+// The entries of an index between the bounds chooseIndex picked. The leading
+// columns both bounds agree on are pinned down, the column after them can
+// have a range.
+func indexPlan(tableInstance *Table, indexInstance *Index, low []interface{}, high []interface{}) string {
+	var constraints []string
+	pinned := 0
+	for pinned < len(low) && pinned < len(high) && CompareValues(low[pinned], high[pinned]) == 0 {
+		constraints = append(constraints, indexColumnName(indexInstance, pinned)+"=?")
+		pinned++
+	}
+	if len(low) > pinned {
+		constraints = append(constraints, indexColumnName(indexInstance, pinned)+">?")
+	}
+	if len(high) > pinned {
+		constraints = append(constraints, indexColumnName(indexInstance, pinned)+"<?")
+	}
+	if len(constraints) == 0 {
+		return fmt.Sprintf("SCAN %s USING INDEX %s", tableInstance.Name, indexInstance.Name)
+	}
+	return fmt.Sprintf("SEARCH %s USING INDEX %s (%s)", tableInstance.Name, indexInstance.Name, strings.Join(constraints, " AND "))
+}
+
+func indexColumnName(indexInstance *Index, i int) string {
+	return indexInstance.Table.Columns[indexInstance.Columns[i]].Name
+}
+
+// How a join reads a table for each combination of rows before it
+func joinSourcePlan(source *JoinSource) string {
+	name := source.Table.Name
+	var line string
+	switch source.Access {
+	case constants.JOIN_ACCESS_ROWID:
+		line = fmt.Sprintf("SEARCH %s USING INTEGER PRIMARY KEY (rowid=?)", name)
+	case constants.JOIN_ACCESS_INDEX:
+		constraints := make([]string, len(source.LookupValues))
+		for i := range constraints {
+			constraints[i] = indexColumnName(source.Index, i) + "=?"
+		}
+		line = fmt.Sprintf("SEARCH %s USING INDEX %s (%s)", name, source.Index.Name, strings.Join(constraints, " AND "))
+	case constants.JOIN_ACCESS_HASH:
+		constraints := make([]string, len(source.HashColumns))
+		for i, column := range source.HashColumns {
+			if column == len(source.Table.Columns) {
+				constraints[i] = "rowid=?"
+			} else {
+				constraints[i] = source.Table.Columns[column].Name + "=?"
+			}
+		}
+		line = fmt.Sprintf("SEARCH %s USING HASH TABLE (%s)", name, strings.Join(constraints, " AND "))
+	default:
+		line = "SCAN " + name
+	}
+	if source.Kind == "LEFT" {
+		line += " LEFT-JOIN"
+	}
+	return line
+}
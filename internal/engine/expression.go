@@ -0,0 +1,609 @@
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/kris-gaudel/goqlite/constants"
+)
+
+// Expression Code
+//
+// Expressions are evaluated against one row of a table following SQLite's
+// rules: NULL makes most operators NULL, AND and OR use three-valued logic,
+// numbers sort before text which sorts before blobs, and integer arithmetic
+// that overflows carries on with reals. Truth values are the integers 1 and 0.
+
+type scalarFunction struct {
+	MinArgs int
+	// -1 for functions that take any number of arguments
+	MaxArgs int
+	Call    func(args []interface{}) interface{}
+}
+
+var scalarFunctions = map[string]scalarFunction{
+	"abs":      {1, 1, functionAbs},
+	"coalesce": {2, -1, functionCoalesce},
+	"ifnull":   {2, 2, functionCoalesce},
+	"length":   {1, 1, functionLength},
+	"lower":    {1, 1, func(args []interface{}) interface{} { return mapText(args[0], strings.ToLower) }},
+	"upper":    {1, 1, func(args []interface{}) interface{} { return mapText(args[0], strings.ToUpper) }},
+	"typeof":   {1, 1, functionTypeof},
+}
+
+// Calls visit for an expression and every expression inside it
+func walkExpression(expression Expression, visit func(Expression)) {
+	visit(expression)
+	switch expression := expression.(type) {
+	case *UnaryExpr:
+		walkExpression(expression.Operand, visit)
+	case *BinaryExpr:
+		walkExpression(expression.Left, visit)
+		walkExpression(expression.Right, visit)
+	case *BetweenExpr:
+		walkExpression(expression.Operand, visit)
+		walkExpression(expression.Low, visit)
+		walkExpression(expression.High, visit)
+	case *InExpr:
+		walkExpression(expression.Operand, visit)
+		for _, value := range expression.Values {
+			walkExpression(value, visit)
+		}
+	case *IsNullExpr:
+		walkExpression(expression.Operand, visit)
+	case *FunctionExpr:
+		for _, arg := range expression.Args {
+			walkExpression(arg, visit)
+		}
+	}
+}
+
+// Checks that the columns and functions an expression uses exist, so
+// evaluating it can't fail. The table is nil when there are no columns to refer to.
+func CheckExpression(expression Expression, tableInstance *Table) error {
+	return checkExpression(expression, tableInstance, false)
+}
+
+// Like CheckExpression, but also allows aggregate calls, for the parts of a
+// select that are evaluated once per group
+func CheckAggregateExpression(expression Expression, tableInstance *Table) error {
+	return checkExpression(expression, tableInstance, true)
+}
+
+func checkExpression(expression Expression, tableInstance *Table, allowAggregates bool) error {
+	var err error
+	walkExpression(expression, func(expression Expression) {
+		if err != nil {
+			return
+		}
+		switch expression := expression.(type) {
+		case *ColumnExpr:
+			if tableInstance != nil && tableInstance.Sources != nil {
+				_, err = joinColumnPosition(tableInstance, expression)
+			} else if tableInstance == nil || !hasColumn(tableInstance, expression) {
+				err = fmt.Errorf("No such column: %s.", columnExprName(expression))
+			}
+		case *FunctionExpr:
+			if aggregate, ok := aggregateFunctions[expression.Name]; ok {
+				if !allowAggregates {
+					err = fmt.Errorf("Misuse of aggregate function %s().", expression.Name)
+				} else if (expression.Star && expression.Name != "count") || len(expression.Args) < aggregate.MinArgs || len(expression.Args) > aggregate.MaxArgs {
+					err = fmt.Errorf("Wrong number of arguments to function %s.", expression.Name)
+				} else {
+					// Aggregates can't be nested
+					for _, arg := range expression.Args {
+						if err = checkExpression(arg, tableInstance, false); err != nil {
+							return
+						}
+					}
+				}
+				return
+			}
+			function, ok := scalarFunctions[expression.Name]
+			if !ok || expression.Star {
+				err = fmt.Errorf("Unknown function %s.", expression.Name)
+			} else if len(expression.Args) < function.MinArgs || (function.MaxArgs >= 0 && len(expression.Args) > function.MaxArgs) {
+				err = fmt.Errorf("Wrong number of arguments to function %s.", expression.Name)
+			}
+		}
+	})
+	return err
+}
+
+func columnExprName(expression *ColumnExpr) string {
+	if expression.Table != "" {
+		return expression.Table + "." + expression.Column
+	}
+	return expression.Column
+}
+
+func hasColumn(tableInstance *Table, expression *ColumnExpr) bool {
+	if expression.Table != "" && !strings.EqualFold(expression.Table, tableInstance.Name) {
+		return false
+	}
+	return ColumnIndex(tableInstance, expression.Column) >= 0 || strings.EqualFold(expression.Column, "rowid")
+}
+
+// Value of a column in the row. A table's own columns win over rowid, so a
+// column that happens to be named rowid can still be read.
+func rowColumnValue(tableInstance *Table, row *Row, expression *ColumnExpr) interface{} {
+	if tableInstance.Sources != nil {
+		position, _ := joinColumnPosition(tableInstance, expression)
+		return row.Values[position]
+	}
+	if position := ColumnIndex(tableInstance, expression.Column); position >= 0 {
+		return row.Values[position]
+	}
+	return int64(row.Key)
+}
+
+// Evaluates an expression that has passed CheckExpression against a row of
+// the table. Both are nil for expressions that don't refer to columns.
+func Evaluate(expression Expression, tableInstance *Table, row *Row) interface{} {
+	switch expression := expression.(type) {
+	case *LiteralExpr:
+		return expression.Value
+	case *ParameterExpr:
+		return expression.Value
+	case *ColumnExpr:
+		return rowColumnValue(tableInstance, row, expression)
+	case *UnaryExpr:
+		operand := Evaluate(expression.Operand, tableInstance, row)
+		switch expression.Operator {
+		case "NOT":
+			return logicalNot(operand)
+		case "-":
+			return negate(operand)
+		}
+		return operand
+	case *BinaryExpr:
+		return evaluateBinary(expression, tableInstance, row)
+	case *BetweenExpr:
+		operand := Evaluate(expression.Operand, tableInstance, row)
+		lowValue, highValue := Evaluate(expression.Low, tableInstance, row), Evaluate(expression.High, tableInstance, row)
+		if betweenNumerically(tableInstance, expression) {
+			operand, lowValue, highValue = numericAffinity(operand), numericAffinity(lowValue), numericAffinity(highValue)
+		}
+		low := comparison(">=", operand, lowValue)
+		high := comparison("<=", operand, highValue)
+		if expression.Not {
+			return logicalNot(logicalAnd(low, high))
+		}
+		return logicalAnd(low, high)
+	case *InExpr:
+		operand := Evaluate(expression.Operand, tableInstance, row)
+		values := make([]interface{}, len(expression.Values))
+		for i, value := range expression.Values {
+			values[i] = Evaluate(value, tableInstance, row)
+		}
+		return inValue(operand, values, expression.Not)
+	case *IsNullExpr:
+		return booleanValue((Evaluate(expression.Operand, tableInstance, row) == nil) != expression.Not)
+	case *FunctionExpr:
+		args := make([]interface{}, len(expression.Args))
+		for i, arg := range expression.Args {
+			args[i] = Evaluate(arg, tableInstance, row)
+		}
+		return scalarFunctions[expression.Name].Call(args)
+	}
+	return nil
+}
+
+func evaluateBinary(expression *BinaryExpr, tableInstance *Table, row *Row) interface{} {
+	left := Evaluate(expression.Left, tableInstance, row)
+	// AND and OR can settle the result from the left side alone
+	switch expression.Operator {
+	case "AND":
+		if truth, known := truthValue(left); known && !truth {
+			return booleanValue(false)
+		}
+		return logicalAnd(left, Evaluate(expression.Right, tableInstance, row))
+	case "OR":
+		if truth, known := truthValue(left); known && truth {
+			return booleanValue(true)
+		}
+		return logicalOr(left, Evaluate(expression.Right, tableInstance, row))
+	}
+
+	right := Evaluate(expression.Right, tableInstance, row)
+	if comparesNumerically(tableInstance, expression.Operator, expression.Left, expression.Right) {
+		left, right = numericAffinity(left), numericAffinity(right)
+	}
+	return binaryValue(expression.Operator, left, right)
+}
+
+// Whether the operator compares its operands and one of them is an INTEGER or
+// REAL column, which makes text on either side that spells out a number
+// compare as that number, like SQLite's numeric affinity
+func comparesNumerically(tableInstance *Table, operator string, left Expression, right Expression) bool {
+	switch operator {
+	case "=", "==", "!=", "<>", "<", "<=", ">", ">=":
+		return hasNumericAffinity(resultColumn(tableInstance, left)) || hasNumericAffinity(resultColumn(tableInstance, right))
+	}
+	return false
+}
+
+func betweenNumerically(tableInstance *Table, expression *BetweenExpr) bool {
+	return comparesNumerically(tableInstance, ">=", expression.Operand, expression.Low) || comparesNumerically(tableInstance, "<=", expression.Operand, expression.High)
+}
+
+func hasNumericAffinity(column *Column) bool {
+	return column != nil && (column.Type == constants.COLUMN_TYPE_INTEGER || column.Type == constants.COLUMN_TYPE_REAL)
+}
+
+// The number text spells out, or the value unchanged if it isn't such text
+func numericAffinity(value interface{}) interface{} {
+	text, ok := value.(string)
+	if !ok {
+		return value
+	}
+	text = strings.TrimSpace(text)
+	if integer, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return integer
+	}
+	if real, err := strconv.ParseFloat(text, 64); err == nil && !math.IsInf(real, 0) && !math.IsNaN(real) {
+		return real
+	}
+	return value
+}
+
+// Applies an operator other than AND and OR to its operands
+func binaryValue(operator string, left interface{}, right interface{}) interface{} {
+	switch operator {
+	case "=", "==", "!=", "<>", "<", "<=", ">", ">=":
+		return comparison(operator, left, right)
+	case "LIKE":
+		if left == nil || right == nil {
+			return nil
+		}
+		return booleanValue(likeMatch([]rune(textValue(right)), []rune(textValue(left))))
+	case "||":
+		if left == nil || right == nil {
+			return nil
+		}
+		return textValue(left) + textValue(right)
+	}
+	return arithmetic(operator, left, right)
+}
+
+// Whether the operand is among the values, or isn't for NOT IN
+func inValue(operand interface{}, values []interface{}, not bool) interface{} {
+	if operand == nil {
+		return nil
+	}
+	sawNull := false
+	for _, value := range values {
+		if value == nil {
+			sawNull = true
+		} else if CompareValues(operand, value) == 0 {
+			return booleanValue(!not)
+		}
+	}
+	// Not finding the value among NULLs doesn't prove it isn't there
+	if sawNull {
+		return nil
+	}
+	return booleanValue(not)
+}
+
+// True if the value counts as true in a WHERE clause. NULL is neither true
+// nor false, so known is false for it.
+func truthValue(value interface{}) (truth bool, known bool) {
+	switch number := numericValue(value).(type) {
+	case int64:
+		return number != 0, true
+	case float64:
+		return number != 0, true
+	}
+	return false, false
+}
+
+// True only for values that are known to be true
+func IsTrue(value interface{}) bool {
+	truth, known := truthValue(value)
+	return known && truth
+}
+
+func booleanValue(truth bool) interface{} {
+	if truth {
+		return int64(1)
+	}
+	return int64(0)
+}
+
+func logicalNot(value interface{}) interface{} {
+	truth, known := truthValue(value)
+	if !known {
+		return nil
+	}
+	return booleanValue(!truth)
+}
+
+func logicalAnd(left interface{}, right interface{}) interface{} {
+	leftTruth, leftKnown := truthValue(left)
+	rightTruth, rightKnown := truthValue(right)
+	if (leftKnown && !leftTruth) || (rightKnown && !rightTruth) {
+		return booleanValue(false)
+	}
+	if !leftKnown || !rightKnown {
+		return nil
+	}
+	return booleanValue(true)
+}
+
+func logicalOr(left interface{}, right interface{}) interface{} {
+	leftTruth, leftKnown := truthValue(left)
+	rightTruth, rightKnown := truthValue(right)
+	if (leftKnown && leftTruth) || (rightKnown && rightTruth) {
+		return booleanValue(true)
+	}
+	if !leftKnown || !rightKnown {
+		return nil
+	}
+	return booleanValue(false)
+}
+
+func comparison(operator string, left interface{}, right interface{}) interface{} {
+	if left == nil || right == nil {
+		return nil
+	}
+	order := CompareValues(left, right)
+	switch operator {
+	case "=", "==":
+		return booleanValue(order == 0)
+	case "!=", "<>":
+		return booleanValue(order != 0)
+	case "<":
+		return booleanValue(order < 0)
+	case "<=":
+		return booleanValue(order <= 0)
+	case ">":
+		return booleanValue(order > 0)
+	}
+	return booleanValue(order >= 0)
+}
+
+// Orders NULL first, then numbers, then text, then blobs. Text compares byte
+// by byte, like SQLite's BINARY collation.
+func CompareValues(left interface{}, right interface{}) int {
+	leftClass, rightClass := valueClass(left), valueClass(right)
+	if leftClass != rightClass {
+		if leftClass < rightClass {
+			return -1
+		}
+		return 1
+	}
+
+	switch left := left.(type) {
+	case int64:
+		if right, ok := right.(int64); ok {
+			switch {
+			case left < right:
+				return -1
+			case left > right:
+				return 1
+			}
+			return 0
+		}
+		return compareReals(float64(left), realValue(right))
+	case float64:
+		return compareReals(left, realValue(right))
+	case string:
+		return strings.Compare(left, right.(string))
+	case []byte:
+		return bytes.Compare(left, right.([]byte))
+	}
+	return 0
+}
+
+func valueClass(value interface{}) int {
+	switch value.(type) {
+	case nil:
+		return 0
+	case int64, float64:
+		return 1
+	case string:
+		return 2
+	}
+	return 3
+}
+
+func compareReals(left float64, right float64) int {
+	switch {
+	case left < right:
+		return -1
+	case left > right:
+		return 1
+	}
+	return 0
+}
+
+func realValue(value interface{}) float64 {
+	switch number := numericValue(value).(type) {
+	case int64:
+		return float64(number)
+	case float64:
+		return number
+	}
+	return 0
+}
+
+// Converts a value to a number for arithmetic. Text that doesn't spell out a
+// number counts as 0, NULL stays NULL.
+func numericValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case int64, float64, nil:
+		return value
+	case string:
+		text := strings.TrimSpace(value)
+		if integer, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return integer
+		}
+		if real, err := strconv.ParseFloat(text, 64); err == nil {
+			return real
+		}
+		return int64(0)
+	case []byte:
+		return numericValue(string(value))
+	}
+	return int64(0)
+}
+
+func textValue(value interface{}) string {
+	return FormatValue(value)
+}
+
+func negate(value interface{}) interface{} {
+	switch number := numericValue(value).(type) {
+	case int64:
+		if number == math.MinInt64 {
+			return -float64(number)
+		}
+		return -number
+	case float64:
+		return -number
+	}
+	return nil
+}
+
+func arithmetic(operator string, left interface{}, right interface{}) interface{} {
+	left, right = numericValue(left), numericValue(right)
+	if left == nil || right == nil {
+		return nil
+	}
+
+	leftInteger, leftOk := left.(int64)
+	rightInteger, rightOk := right.(int64)
+	if operator == "%" {
+		// Like SQLite, the remainder is taken of the operands cut down to integers
+		leftInteger, rightInteger = int64(realValue(left)), int64(realValue(right))
+		if rightInteger == 0 {
+			return nil
+		}
+		if !leftOk || !rightOk {
+			return float64(leftInteger % rightInteger)
+		}
+		return leftInteger % rightInteger
+	}
+
+	if leftOk && rightOk {
+		switch operator {
+		case "+":
+			if sum := leftInteger + rightInteger; (sum > leftInteger) == (rightInteger > 0) {
+				return sum
+			}
+		case "-":
+			if difference := leftInteger - rightInteger; (difference < leftInteger) == (rightInteger > 0) {
+				return difference
+			}
+		case "*":
+			product := leftInteger * rightInteger
+			if leftInteger == 0 || (product/leftInteger == rightInteger && !(leftInteger == -1 && rightInteger == math.MinInt64)) {
+				return product
+			}
+		case "/":
+			if rightInteger == 0 {
+				return nil
+			}
+			if !(leftInteger == math.MinInt64 && rightInteger == -1) {
+				return leftInteger / rightInteger
+			}
+		}
+		// The integer result overflowed, work it out with reals instead
+	}
+
+	leftReal, rightReal := realValue(left), realValue(right)
+	switch operator {
+	case "+":
+		return leftReal + rightReal
+	case "-":
+		return leftReal - rightReal
+	case "*":
+		return leftReal * rightReal
+	}
+	if rightReal == 0 {
+		return nil
+	}
+	return leftReal / rightReal
+}
+
+// Matches text against a LIKE pattern, where % matches any run of characters
+// and _ any single character. Letters match regardless of case.
+func likeMatch(pattern []rune, text []rune) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '%':
+			for len(pattern) > 0 && pattern[0] == '%' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for start := 0; start <= len(text); start++ {
+				if likeMatch(pattern, text[start:]) {
+					return true
+				}
+			}
+			return false
+		case '_':
+			if len(text) == 0 {
+				return false
+			}
+		default:
+			if len(text) == 0 || unicode.ToLower(pattern[0]) != unicode.ToLower(text[0]) {
+				return false
+			}
+		}
+		pattern, text = pattern[1:], text[1:]
+	}
+	return len(text) == 0
+}
+
+func functionAbs(args []interface{}) interface{} {
+	switch number := numericValue(args[0]).(type) {
+	case int64:
+		if number < 0 {
+			return negate(number)
+		}
+		return number
+	case float64:
+		return math.Abs(number)
+	}
+	return nil
+}
+
+func functionCoalesce(args []interface{}) interface{} {
+	for _, arg := range args {
+		if arg != nil {
+			return arg
+		}
+	}
+	return nil
+}
+
+// Characters in text, bytes in a blob
+func functionLength(args []interface{}) interface{} {
+	switch value := args[0].(type) {
+	case nil:
+		return nil
+	case []byte:
+		return int64(len(value))
+	}
+	return int64(utf8.RuneCountInString(textValue(args[0])))
+}
+
+func functionTypeof(args []interface{}) interface{} {
+	return strings.ToLower(valueTypeName(args[0]))
+}
+
+func mapText(value interface{}, mapping func(string) string) interface{} {
+	if value == nil {
+		return nil
+	}
+	return mapping(textValue(value))
+}
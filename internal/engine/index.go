@@ -0,0 +1,543 @@
+package engine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"unsafe"
+
+	"github.com/kris-gaudel/goqlite/constants"
+)
+
+// Index Code
+//
+// An index is a B+tree of its own, ordered by the indexed columns of each row
+// followed by the row's rowid, which keeps every key distinct and leads back
+// to the row in its table. Keys are stored as records laid out by the index's
+// key table. As in the table B-trees, every entry lives in a leaf, leaves are
+// linked left to right and an internal cell holds the largest key under its
+// child.
+//
+// A node that drops below a quarter full when an entry is removed is merged
+// with a sibling if the two fit in one node, and the emptied page goes back on
+// the free list. Nodes that don't fit together are left as they are rather
+// than evened out, since keys vary in size and a new separator for the parent
+// might not fit where the old one was. Cursors skip over leaves that are
+// still empty.
+
+func IndexNodeNumCells(nodeInstance []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&nodeInstance[constants.INDEX_NODE_NUM_CELLS_OFFSET]))
+}
+
+func IndexNodeCellContent(nodeInstance []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&nodeInstance[constants.INDEX_NODE_CELL_CONTENT_OFFSET]))
+}
+
+// Page number of the next leaf to the right, 0 means this is the rightmost leaf
+func IndexNodeNextLeaf(nodeInstance []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&nodeInstance[constants.INDEX_NODE_NEXT_LEAF_OFFSET]))
+}
+
+// Child holding the keys above every key in an internal node
+func IndexNodeRightChild(nodeInstance []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&nodeInstance[constants.INDEX_NODE_RIGHT_CHILD_OFFSET]))
+}
+
+// Offset of the cell within the page
+func IndexNodeCellPointer(nodeInstance []byte, cellNum uint32) *uint16 {
+	offset := uint32(constants.INDEX_NODE_HEADER_SIZE) + cellNum*uint32(constants.INDEX_NODE_CELL_POINTER_SIZE)
+	return (*uint16)(unsafe.Pointer(&nodeInstance[offset]))
+}
+
+func IndexNodeCell(nodeInstance []byte, cellNum uint32) []byte {
+	offset := uint32(*IndexNodeCellPointer(nodeInstance, cellNum))
+	keyOffset := indexCellKeyOffset(GetNodeType(nodeInstance))
+	keySize := uint32(binary.LittleEndian.Uint16(nodeInstance[offset+keyOffset-uint32(constants.INDEX_NODE_KEY_SIZE_SIZE):]))
+	return nodeInstance[offset : offset+keyOffset+keySize]
+}
+
+// The encoded key of a cell
+func IndexNodeKey(nodeInstance []byte, cellNum uint32) []byte {
+	return indexCellKey(GetNodeType(nodeInstance), IndexNodeCell(nodeInstance, cellNum))
+}
+
+// Child page of an internal node's cell
+func IndexNodeChild(nodeInstance []byte, cellNum uint32) uint32 {
+	return indexCellChild(IndexNodeCell(nodeInstance, cellNum))
+}
+
+func InitializeIndexNode(nodeInstance []byte, nodeType constants.NodeType) {
+	SetNodeType(nodeInstance, nodeType)
+	SetNodeRoot(nodeInstance, false)
+	*IndexNodeNumCells(nodeInstance) = 0
+	*IndexNodeCellContent(nodeInstance) = constants.PAGE_SIZE
+	*IndexNodeNextLeaf(nodeInstance) = 0
+	*IndexNodeRightChild(nodeInstance) = 0
+}
+
+// Where the key starts in a cell, after the child page of an internal cell and the key size
+func indexCellKeyOffset(nodeType constants.NodeType) uint32 {
+	offset := uint32(constants.INDEX_NODE_KEY_SIZE_SIZE)
+	if nodeType == constants.NODE_INDEX_INTERNAL {
+		offset += uint32(constants.INDEX_NODE_CHILD_SIZE)
+	}
+	return offset
+}
+
+func indexCellKey(nodeType constants.NodeType, cell []byte) []byte {
+	return cell[indexCellKeyOffset(nodeType):]
+}
+
+func indexCellChild(cell []byte) uint32 {
+	return binary.LittleEndian.Uint32(cell)
+}
+
+func newIndexLeafCell(key []byte) []byte {
+	cell := binary.LittleEndian.AppendUint16(nil, uint16(len(key)))
+	return append(cell, key...)
+}
+
+func newIndexInternalCell(child uint32, key []byte) []byte {
+	cell := binary.LittleEndian.AppendUint32(nil, child)
+	cell = binary.LittleEndian.AppendUint16(cell, uint16(len(key)))
+	return append(cell, key...)
+}
+
+// Bytes left between the cell pointers and the cell content area
+func IndexNodeFreeSpace(nodeInstance []byte) uint32 {
+	pointersEnd := uint32(constants.INDEX_NODE_HEADER_SIZE) + *IndexNodeNumCells(nodeInstance)*uint32(constants.INDEX_NODE_CELL_POINTER_SIZE)
+	return *IndexNodeCellContent(nodeInstance) - pointersEnd
+}
+
+// Copies out every cell of an index node
+func indexNodeCells(nodeInstance []byte) [][]byte {
+	numCells := *IndexNodeNumCells(nodeInstance)
+	cells := make([][]byte, 0, numCells)
+	for i := uint32(0); i < numCells; i++ {
+		cells = append(cells, append([]byte{}, IndexNodeCell(nodeInstance, i)...))
+	}
+	return cells
+}
+
+// Lays the cells out from the end of the page, replacing whatever the node held
+func writeIndexNodeCells(nodeInstance []byte, cells [][]byte) {
+	offset := uint32(constants.PAGE_SIZE)
+	for i, cell := range cells {
+		offset -= uint32(len(cell))
+		copy(nodeInstance[offset:], cell)
+		*IndexNodeCellPointer(nodeInstance, uint32(i)) = uint16(offset)
+	}
+	*IndexNodeNumCells(nodeInstance) = uint32(len(cells))
+	*IndexNodeCellContent(nodeInstance) = offset
+	// Keep the unused space zeroed so stale keys don't linger in the file
+	pointersEnd := uint32(constants.INDEX_NODE_HEADER_SIZE) + uint32(len(cells))*uint32(constants.INDEX_NODE_CELL_POINTER_SIZE)
+	for i := pointersEnd; i < offset; i++ {
+		nodeInstance[i] = 0
+	}
+}
+
+// Whether cells fit in a single node
+func indexCellsFit(cells [][]byte) bool {
+	space := uint32(0)
+	for _, cell := range cells {
+		space += uint32(len(cell)) + uint32(constants.INDEX_NODE_CELL_POINTER_SIZE)
+	}
+	return space <= uint32(constants.INDEX_NODE_SPACE_FOR_CELLS)
+}
+
+// The key of a row in an index: the row's values in the indexed columns
+// followed by its rowid
+func IndexKey(indexInstance *Index, row *Row) []interface{} {
+	key := make([]interface{}, 0, len(indexInstance.Columns)+1)
+	for _, position := range indexInstance.Columns {
+		if position == indexInstance.Table.KeyColumn {
+			key = append(key, int64(row.Key))
+		} else {
+			key = append(key, row.Values[position])
+		}
+	}
+	return append(key, int64(row.Key))
+}
+
+func encodeIndexKey(indexInstance *Index, key []interface{}) []byte {
+	return SerializeRow(indexInstance.KeyTable, &Row{Values: key})
+}
+
+func decodeIndexKey(indexInstance *Index, encoded []byte) []interface{} {
+	var row Row
+	DeserializeRow(indexInstance.KeyTable, 0, encoded, &row)
+	return row.Values
+}
+
+// Compares two keys value by value. A key with fewer values compares equal to
+// every key it is the start of.
+func compareIndexKeys(left []interface{}, right []interface{}) int {
+	for i := 0; i < len(left) && i < len(right); i++ {
+		if order := CompareValues(left[i], right[i]); order != 0 {
+			return order
+		}
+	}
+	return 0
+}
+
+// Position of the first cell whose key is at least key, the number of cells if there is none
+func indexNodeFindCell(indexInstance *Index, nodeInstance []byte, key []interface{}) uint32 {
+	minIndex, maxIndex := uint32(0), *IndexNodeNumCells(nodeInstance)
+	for minIndex != maxIndex {
+		index := (minIndex + maxIndex) / 2
+		if compareIndexKeys(decodeIndexKey(indexInstance, IndexNodeKey(nodeInstance, index)), key) >= 0 {
+			maxIndex = index
+		} else {
+			minIndex = index + 1
+		}
+	}
+	return minIndex
+}
+
+// Descends to the leftmost leaf that can hold keys of at least key
+func indexFindLeaf(indexInstance *Index, key []interface{}) uint32 {
+	pagerInstance := indexInstance.Table.Pager
+	pageNum := indexInstance.RootPageNum
+	for {
+		nodeInstance := GetPage(pagerInstance, pageNum)
+		if GetNodeType(nodeInstance) == constants.NODE_INDEX_LEAF {
+			return pageNum
+		}
+		cellNum := indexNodeFindCell(indexInstance, nodeInstance, key)
+		if cellNum == *IndexNodeNumCells(nodeInstance) {
+			pageNum = *IndexNodeRightChild(nodeInstance)
+		} else {
+			pageNum = IndexNodeChild(nodeInstance, cellNum)
+		}
+	}
+}
+
+// Adds a key to the index, splitting nodes on the way up as they fill
+func IndexInsert(indexInstance *Index, key []interface{}) {
+	pagerInstance := indexInstance.Table.Pager
+	pageNum := indexFindLeaf(indexInstance, key)
+	nodeInstance := GetPage(pagerInstance, pageNum)
+	cellNum := indexNodeFindCell(indexInstance, nodeInstance, key)
+
+	cells := indexNodeCells(nodeInstance)
+	cells = append(cells, nil)
+	copy(cells[cellNum+1:], cells[cellNum:])
+	cells[cellNum] = newIndexLeafCell(encodeIndexKey(indexInstance, key))
+
+	MarkPageDirty(pagerInstance, pageNum)
+	if indexCellsFit(cells) {
+		writeIndexNodeCells(nodeInstance, cells)
+		return
+	}
+	indexNodeSplit(indexInstance, pageNum, cells)
+}
+
+// Removes a key from the index, if it is there
+func IndexDelete(indexInstance *Index, key []interface{}) {
+	cursor := IndexSeek(indexInstance, key)
+	if cursor.EndOfIndex || compareIndexKeys(IndexCursorKey(cursor), key) != 0 {
+		return
+	}
+	pagerInstance := indexInstance.Table.Pager
+	nodeInstance := GetPage(pagerInstance, cursor.PageNum)
+	MarkPageDirty(pagerInstance, cursor.PageNum)
+	cells := indexNodeCells(nodeInstance)
+	writeIndexNodeCells(nodeInstance, append(cells[:cursor.CellNum], cells[cursor.CellNum+1:]...))
+	indexRebalanceNode(indexInstance, cursor.PageNum)
+}
+
+// Merges a node that has dropped below its minimum size with a sibling when
+// the two fit in one node, then checks the parent that lost a child
+func indexRebalanceNode(indexInstance *Index, pageNum uint32) {
+	pagerInstance := indexInstance.Table.Pager
+	nodeInstance := GetPage(pagerInstance, pageNum)
+	if pageNum == indexInstance.RootPageNum {
+		if GetNodeType(nodeInstance) == constants.NODE_INDEX_INTERNAL && *IndexNodeNumCells(nodeInstance) == 0 {
+			collapseRoot(pagerInstance, pageNum, *IndexNodeRightChild(nodeInstance))
+		}
+		return
+	}
+	usedSpace := uint32(constants.INDEX_NODE_SPACE_FOR_CELLS) - IndexNodeFreeSpace(nodeInstance)
+	if usedSpace >= uint32(constants.INDEX_NODE_MIN_USED_SPACE) {
+		return
+	}
+
+	parentPageNum := *NodeParent(nodeInstance)
+	children := nodeChildren(GetPage(pagerInstance, parentPageNum))
+	if len(children) < 2 {
+		return
+	}
+	childIndex := 0
+	for i, child := range children {
+		if child == pageNum {
+			childIndex = i
+		}
+	}
+	// Prefer the left sibling, falling back to the right one for the first child
+	leftIndex := childIndex
+	if childIndex > 0 {
+		leftIndex = childIndex - 1
+	}
+	if indexMergeNodes(indexInstance, parentPageNum, leftIndex, children[leftIndex], children[leftIndex+1]) {
+		indexRebalanceNode(indexInstance, parentPageNum)
+	}
+}
+
+// Moves the cells of the right node into the left one if they fit, the left
+// node taking over the right node's slot in the parent. Returns whether the
+// nodes were merged.
+func indexMergeNodes(indexInstance *Index, parentPageNum uint32, leftIndex int, leftPageNum uint32, rightPageNum uint32) bool {
+	pagerInstance := indexInstance.Table.Pager
+	leftNode := GetPage(pagerInstance, leftPageNum)
+	rightNode := GetPage(pagerInstance, rightPageNum)
+	parent := GetPage(pagerInstance, parentPageNum)
+	parentCells := indexNodeCells(parent)
+
+	nodeType := GetNodeType(leftNode)
+	cells := indexNodeCells(leftNode)
+	var movedChildren []uint32
+	if nodeType == constants.NODE_INDEX_INTERNAL {
+		// The parent's key for the left node comes down to file its right child
+		separator := indexCellKey(constants.NODE_INDEX_INTERNAL, parentCells[leftIndex])
+		cells = append(cells, newIndexInternalCell(*IndexNodeRightChild(leftNode), separator))
+		movedChildren = nodeChildren(rightNode)
+	}
+	cells = append(cells, indexNodeCells(rightNode)...)
+	if !indexCellsFit(cells) {
+		return false
+	}
+
+	MarkPageDirty(pagerInstance, leftPageNum)
+	MarkPageDirty(pagerInstance, parentPageNum)
+	writeIndexNodeCells(leftNode, cells)
+	if nodeType == constants.NODE_INDEX_LEAF {
+		*IndexNodeNextLeaf(leftNode) = *IndexNodeNextLeaf(rightNode)
+	} else {
+		*IndexNodeRightChild(leftNode) = *IndexNodeRightChild(rightNode)
+	}
+	// The right node's key in the parent still bounds everything in the left one
+	if leftIndex+1 == len(parentCells) {
+		*IndexNodeRightChild(parent) = leftPageNum
+	} else {
+		binary.LittleEndian.PutUint32(parentCells[leftIndex+1], leftPageNum)
+	}
+	writeIndexNodeCells(parent, append(parentCells[:leftIndex], parentCells[leftIndex+1:]...))
+
+	for _, child := range movedChildren {
+		SetNodeParent(pagerInstance, child, leftPageNum)
+	}
+	FreePage(pagerInstance, rightPageNum)
+	return true
+}
+
+// Shares the cells of an overfull node out between it and a new node to its
+// right, then files the new node with the parent
+func indexNodeSplit(indexInstance *Index, pageNum uint32, cells [][]byte) {
+	pagerInstance := indexInstance.Table.Pager
+	newPageNum := GetUnusedPageNum(pagerInstance)
+	newNode := GetPage(pagerInstance, newPageNum)
+	oldNode := GetPage(pagerInstance, pageNum)
+	MarkPageDirty(pagerInstance, newPageNum)
+	MarkPageDirty(pagerInstance, pageNum)
+
+	nodeType := GetNodeType(oldNode)
+	InitializeIndexNode(newNode, nodeType)
+	*NodeParent(newNode) = *NodeParent(oldNode)
+	splitIndex := leafNodeSplitIndex(cells)
+
+	// The largest key left in the old node, which the parent files it under
+	var separator []byte
+	var movedChildren []uint32
+	if nodeType == constants.NODE_INDEX_LEAF {
+		writeIndexNodeCells(oldNode, cells[:splitIndex])
+		writeIndexNodeCells(newNode, cells[splitIndex:])
+		*IndexNodeNextLeaf(newNode) = *IndexNodeNextLeaf(oldNode)
+		*IndexNodeNextLeaf(oldNode) = newPageNum
+		separator = indexCellKey(nodeType, cells[splitIndex-1])
+	} else {
+		// The middle cell's child becomes the old node's right child and its
+		// key moves up to the parent
+		if splitIndex == len(cells)-1 {
+			splitIndex--
+		}
+		middle := cells[splitIndex]
+		writeIndexNodeCells(oldNode, cells[:splitIndex])
+		writeIndexNodeCells(newNode, cells[splitIndex+1:])
+		*IndexNodeRightChild(newNode) = *IndexNodeRightChild(oldNode)
+		*IndexNodeRightChild(oldNode) = indexCellChild(middle)
+		separator = indexCellKey(nodeType, middle)
+		for _, cell := range cells[splitIndex+1:] {
+			movedChildren = append(movedChildren, indexCellChild(cell))
+		}
+		movedChildren = append(movedChildren, *IndexNodeRightChild(newNode))
+	}
+	isRoot := IsNodeRoot(oldNode)
+	parentPageNum := *NodeParent(oldNode)
+
+	for _, child := range movedChildren {
+		SetNodeParent(pagerInstance, child, newPageNum)
+	}
+	if isRoot {
+		indexCreateNewRoot(indexInstance, separator, newPageNum)
+		return
+	}
+	indexInternalNodeInsert(indexInstance, parentPageNum, pageNum, separator, newPageNum)
+}
+
+// Files newPageNum with the parent as the node right after childPageNum, which
+// has just given up its upper keys to it and now tops out at childMaxKey
+func indexInternalNodeInsert(indexInstance *Index, parentPageNum uint32, childPageNum uint32, childMaxKey []byte, newPageNum uint32) {
+	pagerInstance := indexInstance.Table.Pager
+	parent := GetPage(pagerInstance, parentPageNum)
+	MarkPageDirty(pagerInstance, parentPageNum)
+
+	cells := indexNodeCells(parent)
+	childCell := len(cells)
+	for i, cell := range cells {
+		if indexCellChild(cell) == childPageNum {
+			childCell = i
+			break
+		}
+	}
+	if childCell == len(cells) {
+		// The child was the right child, so the new node takes its place
+		cells = append(cells, newIndexInternalCell(childPageNum, childMaxKey))
+		*IndexNodeRightChild(parent) = newPageNum
+	} else {
+		// The new node takes over the child's old key, which still bounds it
+		oldMaxKey := indexCellKey(constants.NODE_INDEX_INTERNAL, cells[childCell])
+		cells = append(cells, nil)
+		copy(cells[childCell+2:], cells[childCell+1:])
+		cells[childCell] = newIndexInternalCell(childPageNum, childMaxKey)
+		cells[childCell+1] = newIndexInternalCell(newPageNum, oldMaxKey)
+	}
+
+	if indexCellsFit(cells) {
+		writeIndexNodeCells(parent, cells)
+		return
+	}
+	indexNodeSplit(indexInstance, parentPageNum, cells)
+}
+
+// Turns the root into an internal node over a new left child holding its old
+// contents, filed under leftMaxKey, and the given right child
+func indexCreateNewRoot(indexInstance *Index, leftMaxKey []byte, rightChildPageNum uint32) {
+	pagerInstance := indexInstance.Table.Pager
+	rootPageNum := indexInstance.RootPageNum
+	leftChildPageNum := moveRootToNewChild(pagerInstance, rootPageNum)
+	root := GetPage(pagerInstance, rootPageNum)
+	MarkPageDirty(pagerInstance, rootPageNum)
+
+	InitializeIndexNode(root, constants.NODE_INDEX_INTERNAL)
+	SetNodeRoot(root, true)
+	writeIndexNodeCells(root, [][]byte{newIndexInternalCell(leftChildPageNum, leftMaxKey)})
+	*IndexNodeRightChild(root) = rightChildPageNum
+	SetNodeParent(pagerInstance, rightChildPageNum, rootPageNum)
+}
+
+// Positions a cursor on the first entry with a key of at least key. A key
+// with fewer values than the index lands on the first entry that starts with
+// values at least as large.
+func IndexSeek(indexInstance *Index, key []interface{}) *IndexCursor {
+	pageNum := indexFindLeaf(indexInstance, key)
+	nodeInstance := GetPage(indexInstance.Table.Pager, pageNum)
+	cursor := &IndexCursor{Index: indexInstance, PageNum: pageNum, CellNum: indexNodeFindCell(indexInstance, nodeInstance, key)}
+	indexCursorSkipEmpty(cursor)
+	return cursor
+}
+
+func IndexCursorKey(cursor *IndexCursor) []interface{} {
+	nodeInstance := GetPage(cursor.Index.Table.Pager, cursor.PageNum)
+	return decodeIndexKey(cursor.Index, IndexNodeKey(nodeInstance, cursor.CellNum))
+}
+
+// Rowid of the row the entry under the cursor points at
+func IndexCursorRowid(cursor *IndexCursor) uint32 {
+	key := IndexCursorKey(cursor)
+	return uint32(key[len(key)-1].(int64))
+}
+
+func IndexCursorAdvance(cursor *IndexCursor) {
+	cursor.CellNum += 1
+	indexCursorSkipEmpty(cursor)
+}
+
+// Moves a cursor that has run off the end of its leaf on to the next entry,
+// passing over leaves that have emptied out
+func indexCursorSkipEmpty(cursor *IndexCursor) {
+	for {
+		nodeInstance := GetPage(cursor.Index.Table.Pager, cursor.PageNum)
+		if cursor.CellNum < *IndexNodeNumCells(nodeInstance) {
+			return
+		}
+		nextPageNum := *IndexNodeNextLeaf(nodeInstance)
+		if nextPageNum == 0 {
+			cursor.EndOfIndex = true
+			return
+		}
+		cursor.PageNum = nextPageNum
+		cursor.CellNum = 0
+	}
+}
+
+// Whether another row already has the same values as key in the columns of a
+// UNIQUE index. Like SQLite, rows with NULL in an indexed column never clash.
+func indexHasConflict(indexInstance *Index, key []interface{}) bool {
+	values := key[:len(key)-1]
+	if hasNull(values) {
+		return false
+	}
+	for cursor := IndexSeek(indexInstance, values); !cursor.EndOfIndex; IndexCursorAdvance(cursor) {
+		entry := IndexCursorKey(cursor)
+		if compareIndexKeys(entry, values) != 0 {
+			return false
+		}
+		if CompareValues(entry[len(entry)-1], key[len(key)-1]) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func hasNull(values []interface{}) bool {
+	for _, value := range values {
+		if value == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func PrintIndexTree(indexInstance *Index, pageNum uint32, indentationLevel uint32) {
+	nodeInstance := GetPage(indexInstance.Table.Pager, pageNum)
+	numCells := *IndexNodeNumCells(nodeInstance)
+
+	switch GetNodeType(nodeInstance) {
+	case constants.NODE_INDEX_LEAF:
+		Indent(indentationLevel)
+		fmt.Printf("- leaf (size %d)\n", numCells)
+		for i := uint32(0); i < numCells; i++ {
+			Indent(indentationLevel + 1)
+			fmt.Printf("- %s\n", formatIndexKey(decodeIndexKey(indexInstance, IndexNodeKey(nodeInstance, i))))
+		}
+	case constants.NODE_INDEX_INTERNAL:
+		Indent(indentationLevel)
+		fmt.Printf("- internal (size %d)\n", numCells)
+		for i := uint32(0); i < numCells; i++ {
+			PrintIndexTree(indexInstance, IndexNodeChild(nodeInstance, i), indentationLevel+1)
+			// Printing the child can evict this node from the cache
+			nodeInstance = GetPage(indexInstance.Table.Pager, pageNum)
+			Indent(indentationLevel + 1)
+			fmt.Printf("- key %s\n", formatIndexKey(decodeIndexKey(indexInstance, IndexNodeKey(nodeInstance, i))))
+		}
+		PrintIndexTree(indexInstance, *IndexNodeRightChild(nodeInstance), indentationLevel+1)
+	}
+}
+
+func formatIndexKey(key []interface{}) string {
+	values := make([]string, len(key))
+	for i, value := range key {
+		values[i] = FormatValue(value)
+	}
+	return fmt.Sprintf("(%s)", strings.Join(values, ", "))
+}
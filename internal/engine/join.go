@@ -0,0 +1,321 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/kris-gaudel/goqlite/constants"
+)
+
+// Join Code
+//
+// A select that joins tables evaluates its expressions against a pseudo table
+// whose columns are those of every joined table in FROM order, each table's
+// followed by its rowid. Rows are combined by nested loops, which the compiled
+// program runs: for every combination of rows from the tables before it, a
+// table's rows are read by rowid or through an index when an equality in the
+// ON or WHERE clause pins down its key or its leading indexed columns, from a
+// hash table built once when an equality with the tables before it has no
+// index to use, and by a full scan otherwise.
+
+// One table of a join
+type JoinSource struct {
+	// The table, renamed to its alias if it has one
+	Table *Table
+	// "INNER", "LEFT" or "CROSS", empty for the first table
+	Kind string
+	// Position of the table's first column in a joined row. Its columns are
+	// followed by its rowid, all of them NULL when a LEFT join found no row.
+	Offset int
+	// Condition a row has to meet to be joined onto the rows before it, with
+	// USING turned into equalities, nil to join every row
+	On Expression
+	// Columns named by USING, which the table shares with the ones before it
+	Using []string
+	// One of the JOIN_ACCESS_* constants
+	Access string
+	// Index read by an INDEX access
+	Index *Index
+	// Values the rowid, the leading indexed columns or the HashColumns have to
+	// equal, evaluated against the rows before the table
+	LookupValues []Expression
+	// Columns of the table a HASH access matches LookupValues against
+	HashColumns []int
+}
+
+// The table a select reads, which is a pseudo table joining several tables
+// when the FROM clause has joins, and nil when there is no FROM clause
+func fromTable(node *SelectStmt, databaseInstance *Database) (*Table, error) {
+	if node.From == "" {
+		return nil, nil
+	}
+	tableInstance, err := FindTable(databaseInstance, node.From)
+	if err != nil {
+		return nil, err
+	}
+	tableInstance = aliasedTable(tableInstance, node.FromAlias)
+	if len(node.Joins) == 0 {
+		return tableInstance, nil
+	}
+
+	sources := []*JoinSource{{Table: tableInstance, Access: constants.JOIN_ACCESS_SCAN}}
+	for _, join := range node.Joins {
+		joinedInstance, err := FindTable(databaseInstance, join.Table)
+		if err != nil {
+			return nil, err
+		}
+		joinedInstance = aliasedTable(joinedInstance, join.Alias)
+		for _, source := range sources {
+			if strings.EqualFold(source.Table.Name, joinedInstance.Name) {
+				return nil, fmt.Errorf("Table name %s is used more than once.", joinedInstance.Name)
+			}
+		}
+		left := joinedTable(sources)
+		source := &JoinSource{Table: joinedInstance, Kind: join.Kind, Offset: len(left.Columns), Using: join.Using, Access: constants.JOIN_ACCESS_SCAN}
+		sources = append(sources, source)
+
+		// The condition can refer to this table and the ones before it
+		if join.On != nil {
+			if err := CheckExpression(join.On, joinedTable(sources)); err != nil {
+				return nil, err
+			}
+			source.On = join.On
+		}
+		for _, name := range join.Using {
+			position, err := joinColumnPosition(left, &ColumnExpr{Column: name})
+			if err != nil || ColumnIndex(joinedInstance, name) < 0 {
+				return nil, fmt.Errorf("Cannot join using column %s, it is not in both tables.", name)
+			}
+			leftName := left.Sources[sourceAt(left, position)].Table.Name
+			equality := &BinaryExpr{Operator: "=", Left: &ColumnExpr{Table: leftName, Column: name}, Right: &ColumnExpr{Table: joinedInstance.Name, Column: name}}
+			if source.On == nil {
+				source.On = equality
+			} else {
+				source.On = &BinaryExpr{Operator: "AND", Left: source.On, Right: equality}
+			}
+		}
+	}
+	return joinedTable(sources), nil
+}
+
+// A copy of the table that statements refer to by its alias
+func aliasedTable(tableInstance *Table, alias string) *Table {
+	if alias == "" {
+		return tableInstance
+	}
+	aliased := *tableInstance
+	aliased.Name = alias
+	return &aliased
+}
+
+func joinedTable(sources []*JoinSource) *Table {
+	joined := &Table{KeyColumn: -1, Sources: sources}
+	for _, source := range sources {
+		joined.Columns = append(joined.Columns, source.Table.Columns...)
+		joined.Columns = append(joined.Columns, Column{Name: "rowid", Type: constants.COLUMN_TYPE_INTEGER})
+	}
+	return joined
+}
+
+// What * stands for in a join: every column of every table, except that a
+// column named by USING is only listed for the tables before the join
+func joinedColumns(tableInstance *Table) []Expression {
+	var columns []Expression
+	for _, source := range tableInstance.Sources {
+		for _, column := range source.Table.Columns {
+			if !usesColumn(source, column.Name) {
+				columns = append(columns, &ColumnExpr{Table: source.Table.Name, Column: column.Name})
+			}
+		}
+	}
+	return columns
+}
+
+func usesColumn(source *JoinSource, name string) bool {
+	for _, column := range source.Using {
+		if strings.EqualFold(column, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Position of a column within a table's part of a joined row, where the
+// position after the table's own columns holds its rowid. -1 if the table
+// has no such column.
+func sourceColumn(source *JoinSource, name string) int {
+	if position := ColumnIndex(source.Table, name); position >= 0 {
+		return position
+	}
+	if strings.EqualFold(name, "rowid") {
+		return len(source.Table.Columns)
+	}
+	return -1
+}
+
+// Position in a joined row of the column an expression refers to. A bare
+// name has to belong to only one table, apart from columns named by USING,
+// which stand for the column of the tables before the join.
+func joinColumnPosition(tableInstance *Table, expression *ColumnExpr) (int, error) {
+	position := -1
+	for _, source := range tableInstance.Sources {
+		if expression.Table != "" && !strings.EqualFold(expression.Table, source.Table.Name) {
+			continue
+		}
+		column := sourceColumn(source, expression.Column)
+		if column < 0 || (expression.Table == "" && usesColumn(source, expression.Column)) {
+			continue
+		}
+		if position >= 0 {
+			return -1, fmt.Errorf("Ambiguous column name: %s.", columnExprName(expression))
+		}
+		position = source.Offset + column
+	}
+	if position < 0 {
+		return -1, fmt.Errorf("No such column: %s.", columnExprName(expression))
+	}
+	return position, nil
+}
+
+// Index of the table a position in a joined row belongs to
+func sourceAt(tableInstance *Table, position int) int {
+	i := len(tableInstance.Sources) - 1
+	for tableInstance.Sources[i].Offset > position {
+		i--
+	}
+	return i
+}
+
+// Whether every column an expression refers to belongs to a table before the ith
+func refersBefore(tableInstance *Table, expression Expression, i int) bool {
+	before := true
+	walkExpression(expression, func(expression Expression) {
+		if column, ok := expression.(*ColumnExpr); ok {
+			position, err := joinColumnPosition(tableInstance, column)
+			if err != nil || sourceAt(tableInstance, position) >= i {
+				before = false
+			}
+		}
+	})
+	return before
+}
+
+// The conditions ANDed together in an expression
+func conjuncts(expression Expression, terms []Expression) []Expression {
+	if binary, ok := expression.(*BinaryExpr); ok && binary.Operator == "AND" {
+		return conjuncts(binary.Right, conjuncts(binary.Left, terms))
+	}
+	if expression == nil {
+		return terms
+	}
+	return append(terms, expression)
+}
+
+// Picks how each table of a join is read, going by the equalities in its ON
+// clause and in the WHERE clause. WHERE is left out for the right side of a
+// LEFT join, whose rows are joined as NULLs before WHERE is checked.
+func planJoin(tableInstance *Table, where Expression) {
+	for i, source := range tableInstance.Sources {
+		terms := conjuncts(source.On, nil)
+		if source.Kind != "LEFT" {
+			terms = conjuncts(where, terms)
+		}
+
+		// Equalities of the table's columns with values known before reading it
+		var columns []int
+		var values []Expression
+		for _, term := range terms {
+			binary, ok := term.(*BinaryExpr)
+			if !ok || (binary.Operator != "=" && binary.Operator != "==") {
+				continue
+			}
+			for _, sides := range [][2]Expression{{binary.Left, binary.Right}, {binary.Right, binary.Left}} {
+				column, ok := sides[0].(*ColumnExpr)
+				if !ok {
+					continue
+				}
+				position, err := joinColumnPosition(tableInstance, column)
+				if err == nil && sourceAt(tableInstance, position) == i && refersBefore(tableInstance, sides[1], i) {
+					columns = append(columns, position-source.Offset)
+					values = append(values, sides[1])
+					break
+				}
+			}
+		}
+		valueOf := func(column int) Expression {
+			for j, equal := range columns {
+				if equal == column {
+					return values[j]
+				}
+			}
+			return nil
+		}
+
+		rowid := valueOf(len(source.Table.Columns))
+		if rowid == nil && source.Table.KeyColumn >= 0 {
+			rowid = valueOf(source.Table.KeyColumn)
+		}
+		if rowid != nil {
+			source.Access, source.LookupValues = constants.JOIN_ACCESS_ROWID, []Expression{rowid}
+			continue
+		}
+		for _, indexInstance := range source.Table.Indexes {
+			var lookup []Expression
+			for _, column := range indexInstance.Columns {
+				value := valueOf(column)
+				if value == nil {
+					break
+				}
+				lookup = append(lookup, value)
+			}
+			if len(lookup) > len(source.LookupValues) {
+				source.Access, source.Index, source.LookupValues = constants.JOIN_ACCESS_INDEX, indexInstance, lookup
+			}
+		}
+		// Hashing only pays off when there are rows before the table to match
+		if source.Access == constants.JOIN_ACCESS_SCAN && i > 0 && len(columns) > 0 {
+			source.Access, source.HashColumns, source.LookupValues = constants.JOIN_ACCESS_HASH, columns, values
+		}
+	}
+}
+
+// Reads every row of the table once, keyed by its values of the HashColumns.
+// Rows with a NULL among them are left out since they can't be equal to anything.
+func buildJoinHash(source *JoinSource) map[string][]Row {
+	hash := make(map[string][]Row)
+	var row Row
+	for cursor := TableStart(source.Table); !cursor.EndOfTable; CursorAdvance(cursor) {
+		CursorRow(cursor, &row)
+		keys := make([]interface{}, len(source.HashColumns))
+		for i, column := range source.HashColumns {
+			if column == len(source.Table.Columns) {
+				keys[i] = int64(row.Key)
+			} else {
+				keys[i] = row.Values[column]
+			}
+		}
+		if !hasNull(keys) {
+			key := groupKey(keys)
+			hash[key] = append(hash[key], row)
+		}
+	}
+	return hash
+}
+
+// The key of the row a rowid lookup is after, false if no row can have it
+func lookupKey(value interface{}) (uint32, bool) {
+	var key float64
+	switch value := value.(type) {
+	case int64:
+		key = float64(value)
+	case float64:
+		key = value
+	default:
+		return 0, false
+	}
+	if key != math.Trunc(key) || key < 1 || key > math.MaxUint32 {
+		return 0, false
+	}
+	return uint32(key), true
+}
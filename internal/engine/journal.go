@@ -0,0 +1,312 @@
+package engine
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/kris-gaudel/goqlite/constants"
+)
+
+// Rollback Journal Code
+//
+// Before a page of the database file is changed for the first time, its
+// original contents are appended to the journal. The journal is synced before
+// any page is written back to the database, and deleting it is what commits
+// the changes. A writer holds an exclusive lock on the journal from before it
+// writes the header until after the file is deleted, which is its RESERVED
+// lock, see the Lock Code. A journal nobody holds the lock on was left behind
+// by a crash and is "hot": its original pages are played back into the
+// database by the next connection to read it.
+
+type Journal struct {
+	FileDescriptor int
+	// Random value mixed into every record checksum so records from an older
+	// journal that happen to be left in the file are never mistaken for valid ones
+	Nonce uint32
+	// Number of pages the database had when the journal was started
+	OriginalNumPages uint32
+	// Pages whose original contents are already in the journal
+	JournaledPages map[uint32]bool
+	// False while there are records that haven't reached the disk yet
+	Synced bool
+}
+
+func JournalPath(fileName string) string {
+	return fileName + "-journal"
+}
+
+// Takes the write lock and starts a journal before a statement changes the
+// database. Returns false if another connection is writing, or if it
+// committed after the open transaction read pages that are now out of date.
+// Whatever an earlier journal in the file holds is thrown away: the shared
+// lock means no writer has touched the database since it was checked for a
+// hot journal.
+func JournalBeginWrite(pager *Pager) bool {
+	if pager.Journal != nil {
+		return true
+	}
+	if !PagerLock(pager, constants.LOCK_SHARED) {
+		return false
+	}
+	fd := journalLock(pager.FileName)
+	if fd < 0 {
+		return false
+	}
+
+	// Changes have to build on the last commit, not on whatever this connection last read
+	if changeCounter := pagerChangeCounter(pager); changeCounter != pager.ChangeCounter {
+		if pager.InTransaction {
+			syscall.Close(fd)
+			return false
+		}
+		pagerReload(pager, changeCounter)
+	}
+	JournalOpen(pager, fd)
+	return true
+}
+
+// Starts a journal for the pager's current transaction in the locked file fd
+func JournalOpen(pager *Pager, fd int) {
+	journal := &Journal{
+		FileDescriptor:   fd,
+		Nonce:            uint32(time.Now().UnixNano()),
+		OriginalNumPages: pager.FileLength / constants.PAGE_SIZE,
+		JournaledPages:   make(map[uint32]bool),
+	}
+	pager.Journal = journal
+	if pager.Lock < constants.LOCK_RESERVED {
+		pager.Lock = constants.LOCK_RESERVED
+	}
+
+	if err := syscall.Ftruncate(fd, 0); err != nil {
+		raiseIOError(ErrIOTruncate, "starting the journal", err)
+	}
+	header := make([]byte, constants.JOURNAL_HEADER_SIZE)
+	copy(header[constants.JOURNAL_MAGIC_OFFSET:], constants.JOURNAL_MAGIC)
+	binary.LittleEndian.PutUint32(header[constants.JOURNAL_NONCE_OFFSET:], journal.Nonce)
+	binary.LittleEndian.PutUint32(header[constants.JOURNAL_PAGE_COUNT_OFFSET:], journal.OriginalNumPages)
+	writeFully(fd, header, "journal")
+
+	// The journal only protects the database once its directory entry is durable
+	syncDirectory(filepath.Dir(pager.FileName))
+}
+
+// Opens the journal, creating it if needed, and takes the write lock on it.
+// Returns -1 if another connection holds the lock.
+func journalLock(fileName string) int {
+	return lockFile(JournalPath(fileName), "the journal")
+}
+
+// Appends the original contents of a page unless it has already been saved.
+// Pages past the original end of the file need no record since rolling back
+// truncates the file.
+func JournalPage(pager *Pager, pageNum uint32, data []byte) {
+	if pager.Journal == nil {
+		// Statements take the lock in PagerBeginWrite, this only happens for
+		// changes made outside of one
+		if !PagerLock(pager, constants.LOCK_SHARED) {
+			panic(newError(ErrBusy))
+		}
+		fd := journalLock(pager.FileName)
+		if fd < 0 {
+			panic(newError(ErrBusy))
+		}
+		JournalOpen(pager, fd)
+	}
+	journal := pager.Journal
+	if journal.JournaledPages[pageNum] || pageNum >= journal.OriginalNumPages {
+		return
+	}
+
+	record := make([]byte, constants.JOURNAL_RECORD_SIZE)
+	binary.LittleEndian.PutUint32(record[constants.JOURNAL_RECORD_PAGE_NUM_OFFSET:], pageNum)
+	copy(record[constants.JOURNAL_RECORD_DATA_OFFSET:], data)
+	checksum := journalRecordChecksum(journal.Nonce, record)
+	binary.LittleEndian.PutUint32(record[constants.JOURNAL_RECORD_CHECKSUM_OFFSET:], checksum)
+	writeFully(journal.FileDescriptor, record, "journal")
+
+	journal.JournaledPages[pageNum] = true
+	journal.Synced = false
+}
+
+// Makes sure every journal record is on disk. Must happen before the database file is written.
+func JournalSync(pager *Pager) {
+	journal := pager.Journal
+	if journal == nil || journal.Synced {
+		return
+	}
+	if err := syscall.Fsync(journal.FileDescriptor); err != nil {
+		raiseIOError(ErrIOFsync, "syncing the journal", err)
+	}
+	journal.Synced = true
+}
+
+// Deletes the journal once the database file holds the committed pages
+func JournalFinish(pager *Pager) {
+	journal := pager.Journal
+	if journal == nil {
+		return
+	}
+	pager.Journal = nil
+
+	// The lock is only let go of once the journal is gone, so no other
+	// connection can take it for a hot one
+	deleteErr := syscall.Unlink(JournalPath(pager.FileName))
+	closeErr := syscall.Close(journal.FileDescriptor)
+	if deleteErr != nil {
+		raiseIOError(ErrIODelete, "deleting the journal", deleteErr)
+	}
+	if closeErr != nil {
+		raiseIOError(ErrIOClose, "closing the journal", closeErr)
+	}
+	syncDirectory(filepath.Dir(pager.FileName))
+}
+
+// Puts back the original contents of every page the open transaction changed.
+// Pages only reach the database file under the exclusive lock, so without it
+// there is nothing to put back.
+func JournalRollback(pager *Pager) {
+	journal := pager.Journal
+	pager.Journal = nil
+	closed := false
+	defer func() {
+		if !closed {
+			syscall.Close(journal.FileDescriptor)
+		}
+	}()
+
+	// The pages that reached the database file are undone exactly like after a
+	// crash, while the lock keeps other connections from seeing them
+	if pager.Lock == constants.LOCK_EXCLUSIVE {
+		journalPlayBack(journal.FileDescriptor, pager.FileDescriptor)
+	}
+	PagerDropCache(pager)
+	pager.FileLength = journal.OriginalNumPages * constants.PAGE_SIZE
+	pager.NumPages = journal.OriginalNumPages
+	if err := syscall.Unlink(JournalPath(pager.FileName)); err != nil {
+		raiseIOError(ErrIODelete, "deleting the journal", err)
+	}
+	syncDirectory(filepath.Dir(pager.FileName))
+
+	closed = true
+	if err := syscall.Close(journal.FileDescriptor); err != nil {
+		raiseIOError(ErrIOClose, "closing the journal", err)
+	}
+}
+
+// Rolls the database file back using a journal left behind by a crash, if
+// there is one, once the connection has its shared lock. A journal another
+// connection holds the lock on belongs to a transaction that is still going,
+// and is left alone. Returns false if other connections are reading, since
+// putting the pages back needs the exclusive lock.
+func RecoverHotJournal(pager *Pager) bool {
+	journalPath := JournalPath(pager.FileName)
+	journalFd, err := syscall.Open(journalPath, constants.O_RDWR, 0)
+	if err == syscall.ENOENT {
+		return true
+	} else if err != nil {
+		raiseIOError(ErrIOOpen, "opening the journal", err)
+	}
+	defer syscall.Close(journalFd)
+
+	if !flockNonBlocking(journalFd, syscall.LOCK_EX, "locking the journal") || !fileIsCurrent(journalFd, journalPath) {
+		return true
+	}
+	if !PagerLock(pager, constants.LOCK_EXCLUSIVE) {
+		PagerUnlock(pager, constants.LOCK_SHARED)
+		return false
+	}
+	journalPlayBack(journalFd, pager.FileDescriptor)
+	if err := syscall.Unlink(journalPath); err != nil {
+		raiseIOError(ErrIODelete, "deleting the journal", err)
+	}
+	syncDirectory(filepath.Dir(pager.FileName))
+	PagerUnlock(pager, constants.LOCK_SHARED)
+	pagerReload(pager, pagerChangeCounter(pager))
+	return true
+}
+
+// Writes the original pages saved in the locked journal journalFd back into
+// the database file and empties the journal. Returns false if there was
+// nothing to play back: a journal without a complete header was never synced,
+// so the database can't have been touched yet.
+func journalPlayBack(journalFd int, fd int) bool {
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(journalFd, &stat); err != nil {
+		raiseIOError(ErrIORead, "reading the journal", err)
+	}
+	contents := make([]byte, stat.Size)
+	for bytesRead := 0; bytesRead < len(contents); {
+		n, err := syscall.Pread(journalFd, contents[bytesRead:], int64(bytesRead))
+		if err != nil {
+			raiseIOError(ErrIORead, "reading the journal", err)
+		} else if n == 0 {
+			contents = contents[:bytesRead]
+		}
+		bytesRead += n
+	}
+
+	if len(contents) < int(constants.JOURNAL_HEADER_SIZE) ||
+		string(contents[constants.JOURNAL_MAGIC_OFFSET:constants.JOURNAL_MAGIC_OFFSET+len(constants.JOURNAL_MAGIC)]) != constants.JOURNAL_MAGIC {
+		return false
+	}
+	nonce := binary.LittleEndian.Uint32(contents[constants.JOURNAL_NONCE_OFFSET:])
+	originalNumPages := binary.LittleEndian.Uint32(contents[constants.JOURNAL_PAGE_COUNT_OFFSET:])
+
+	// Records after the last sync may be torn, but the pages they cover
+	// were never written to the database, so stopping there is safe
+	for offset := int(constants.JOURNAL_HEADER_SIZE); offset+int(constants.JOURNAL_RECORD_SIZE) <= len(contents); offset += int(constants.JOURNAL_RECORD_SIZE) {
+		record := contents[offset : offset+int(constants.JOURNAL_RECORD_SIZE)]
+		checksum := binary.LittleEndian.Uint32(record[constants.JOURNAL_RECORD_CHECKSUM_OFFSET:])
+		if checksum != journalRecordChecksum(nonce, record) {
+			break
+		}
+		pageNum := binary.LittleEndian.Uint32(record[constants.JOURNAL_RECORD_PAGE_NUM_OFFSET:])
+		data := record[constants.JOURNAL_RECORD_DATA_OFFSET : constants.JOURNAL_RECORD_DATA_OFFSET+constants.PAGE_SIZE]
+		if _, err := syscall.Pwrite(fd, data, int64(pageNum)*constants.PAGE_SIZE); err != nil {
+			raiseIOError(ErrIOWrite, "rolling back the journal", err)
+		}
+	}
+
+	if err := syscall.Ftruncate(fd, int64(originalNumPages)*constants.PAGE_SIZE); err != nil {
+		raiseIOError(ErrIOTruncate, "rolling back the journal", err)
+	}
+	if err := syscall.Fsync(fd); err != nil {
+		raiseIOError(ErrIOFsync, "syncing the database file", err)
+	}
+	// The journal is only reused once nothing in it can be played back again
+	if err := syscall.Ftruncate(journalFd, 0); err != nil {
+		raiseIOError(ErrIOTruncate, "rolling back the journal", err)
+	}
+	return true
+}
+
+func journalRecordChecksum(nonce uint32, record []byte) uint32 {
+	nonceBytes := make([]byte, 4)
+	binary.LittleEndian.PutUint32(nonceBytes, nonce)
+	checksum := crc32.ChecksumIEEE(nonceBytes)
+	return crc32.Update(checksum, crc32.IEEETable, record[:constants.JOURNAL_RECORD_CHECKSUM_OFFSET])
+}
+
+func writeFully(fd int, data []byte, description string) {
+	for len(data) > 0 {
+		bytesWritten, err := syscall.Write(fd, data)
+		if err != nil || bytesWritten == 0 {
+			raiseIOError(ErrIOWrite, "writing "+description, err)
+		}
+		data = data[bytesWritten:]
+	}
+}
+
+func syncDirectory(directory string) {
+	fd, err := syscall.Open(directory, syscall.O_RDONLY, 0)
+	if err != nil {
+		raiseIOError(ErrIOOpen, "opening the database directory", err)
+	}
+	// Not every filesystem supports syncing a directory, which is fine
+	syscall.Fsync(fd)
+	syscall.Close(fd)
+}
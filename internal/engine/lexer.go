@@ -0,0 +1,287 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/kris-gaudel/goqlite/constants"
+)
+
+// Lexer Code
+
+type Token struct {
+	Type constants.TokenType
+	// Keywords are upper-cased, quoted strings and identifiers have their quotes
+	// and escapes removed, everything else is the source text
+	Text string
+	// Position of the token's first character, both counted from 1
+	Line   int
+	Column int
+}
+
+type Lexer struct {
+	input    []rune
+	position int
+	line     int
+	column   int
+}
+
+var keywords = map[string]bool{
+	"AND": true, "AS": true, "ASC": true, "BEGIN": true, "BETWEEN": true, "BY": true,
+	"COMMIT": true, "CREATE": true, "CROSS": true, "DELETE": true, "DESC": true, "END": true,
+	"EXISTS": true, "EXPLAIN": true, "FALSE": true, "FROM": true, "GROUP": true, "HAVING": true,
+	"IF": true, "IN": true, "INDEX": true, "INNER": true, "INSERT": true, "INTO": true, "IS": true,
+	"JOIN": true, "KEY": true, "LEFT": true, "LIKE": true,
+	"LIMIT": true, "NOT": true, "NULL": true, "OFFSET": true, "ON": true, "OR": true,
+	"ORDER": true, "OUTER": true, "PLAN": true, "PRIMARY": true, "QUERY": true, "ROLLBACK": true, "SELECT": true, "SET": true,
+	"TABLE": true, "TRANSACTION": true, "TRUE": true, "UNIQUE": true, "UPDATE": true,
+	"USING": true, "VALUES": true, "WHERE": true,
+}
+
+// Longest operators first so "<=" isn't read as "<" followed by "="
+var operators = []string{"<=", ">=", "==", "!=", "<>", "||", "(", ")", ",", ";", ".", "*", "+", "-", "/", "%", "=", "<", ">"}
+
+func NewLexer(input string) *Lexer {
+	return &Lexer{input: []rune(input), line: 1, column: 1}
+}
+
+func (lexer *Lexer) peek(offset int) rune {
+	if lexer.position+offset >= len(lexer.input) {
+		return 0
+	}
+	return lexer.input[lexer.position+offset]
+}
+
+func (lexer *Lexer) advance() rune {
+	character := lexer.input[lexer.position]
+	lexer.position++
+	if character == '\n' {
+		lexer.line++
+		lexer.column = 1
+	} else {
+		lexer.column++
+	}
+	return character
+}
+
+func (lexer *Lexer) atEnd() bool {
+	return lexer.position >= len(lexer.input)
+}
+
+func (lexer *Lexer) errorAt(line int, column int, format string, args ...interface{}) *Error {
+	return &Error{Code: ErrSyntax, Line: line, Column: column, Message: fmt.Sprintf(format, args...)}
+}
+
+// Skips whitespace and both kinds of comments
+func (lexer *Lexer) skipIgnored() error {
+	for !lexer.atEnd() {
+		character := lexer.peek(0)
+		switch {
+		case unicode.IsSpace(character):
+			lexer.advance()
+		case character == '-' && lexer.peek(1) == '-':
+			for !lexer.atEnd() && lexer.peek(0) != '\n' {
+				lexer.advance()
+			}
+		case character == '/' && lexer.peek(1) == '*':
+			line, column := lexer.line, lexer.column
+			lexer.advance()
+			lexer.advance()
+			for !(lexer.peek(0) == '*' && lexer.peek(1) == '/') {
+				if lexer.atEnd() {
+					return lexer.errorAt(line, column, "unterminated comment")
+				}
+				lexer.advance()
+			}
+			lexer.advance()
+			lexer.advance()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// Returns the next token, or a TOKEN_EOF token once the input is used up
+func (lexer *Lexer) Next() (Token, error) {
+	if err := lexer.skipIgnored(); err != nil {
+		return Token{}, err
+	}
+	token := Token{Type: constants.TOKEN_EOF, Line: lexer.line, Column: lexer.column}
+	if lexer.atEnd() {
+		return token, nil
+	}
+
+	character := lexer.peek(0)
+	switch {
+	case (character == 'x' || character == 'X') && lexer.peek(1) == '\'':
+		lexer.advance()
+		text, err := lexer.readQuoted('\'', '\'')
+		if err != nil {
+			return token, err
+		}
+		if len(text)%2 != 0 || strings.Trim(strings.ToLower(text), "0123456789abcdef") != "" {
+			return token, lexer.errorAt(token.Line, token.Column, "malformed blob literal")
+		}
+		token.Type, token.Text = constants.TOKEN_BLOB, text
+	case isIdentifierStart(character):
+		start := lexer.position
+		for !lexer.atEnd() && isIdentifierPart(lexer.peek(0)) {
+			lexer.advance()
+		}
+		token.Type, token.Text = constants.TOKEN_IDENTIFIER, string(lexer.input[start:lexer.position])
+		if upper := strings.ToUpper(token.Text); keywords[upper] {
+			token.Type, token.Text = constants.TOKEN_KEYWORD, upper
+		}
+	case unicode.IsDigit(character) || (character == '.' && unicode.IsDigit(lexer.peek(1))):
+		return lexer.readNumber(token)
+	case character == '\'':
+		text, err := lexer.readQuoted('\'', '\'')
+		if err != nil {
+			return token, err
+		}
+		token.Type, token.Text = constants.TOKEN_STRING, text
+	case character == '"' || character == '`':
+		text, err := lexer.readQuoted(character, character)
+		if err != nil {
+			return token, err
+		}
+		token.Type, token.Text = constants.TOKEN_IDENTIFIER, text
+	case character == '?' || (character == ':' && isIdentifierStart(lexer.peek(1))):
+		start := lexer.position
+		lexer.advance()
+		for !lexer.atEnd() && ((character == '?' && unicode.IsDigit(lexer.peek(0))) || (character == ':' && isIdentifierPart(lexer.peek(0)))) {
+			lexer.advance()
+		}
+		token.Type, token.Text = constants.TOKEN_PARAMETER, string(lexer.input[start:lexer.position])
+	case character == '[':
+		text, err := lexer.readQuoted('[', ']')
+		if err != nil {
+			return token, err
+		}
+		token.Type, token.Text = constants.TOKEN_IDENTIFIER, text
+	default:
+		for _, operator := range operators {
+			if lexer.hasPrefix(operator) {
+				for range operator {
+					lexer.advance()
+				}
+				token.Type, token.Text = constants.TOKEN_OPERATOR, operator
+				return token, nil
+			}
+		}
+		return token, lexer.errorAt(token.Line, token.Column, "unexpected character %q", character)
+	}
+	return token, nil
+}
+
+// Reads a run of non-space characters as a string. Used by the shorthand
+// insert, whose values are bare words like person1@example.com.
+func (lexer *Lexer) NextWord() (Token, error) {
+	if err := lexer.skipIgnored(); err != nil {
+		return Token{}, err
+	}
+	token := Token{Type: constants.TOKEN_EOF, Line: lexer.line, Column: lexer.column}
+	start := lexer.position
+	for !lexer.atEnd() && !unicode.IsSpace(lexer.peek(0)) {
+		lexer.advance()
+	}
+	if lexer.position > start {
+		token.Type, token.Text = constants.TOKEN_STRING, string(lexer.input[start:lexer.position])
+	}
+	return token, nil
+}
+
+func (lexer *Lexer) hasPrefix(prefix string) bool {
+	for offset, character := range []rune(prefix) {
+		if lexer.peek(offset) != character {
+			return false
+		}
+	}
+	return true
+}
+
+// Reads a quoted string or identifier. A doubled closing quote stands for
+// one quote character inside the text.
+func (lexer *Lexer) readQuoted(open rune, close rune) (string, error) {
+	line, column := lexer.line, lexer.column
+	lexer.advance()
+	var text strings.Builder
+	for {
+		if lexer.atEnd() {
+			if open == '\'' {
+				return "", lexer.errorAt(line, column, "unterminated string")
+			}
+			return "", lexer.errorAt(line, column, "unterminated quoted identifier")
+		}
+		character := lexer.advance()
+		if character == close {
+			if close != ']' && lexer.peek(0) == close {
+				lexer.advance()
+			} else {
+				return text.String(), nil
+			}
+		}
+		text.WriteRune(character)
+	}
+}
+
+func (lexer *Lexer) readNumber(token Token) (Token, error) {
+	start := lexer.position
+	token.Type = constants.TOKEN_INTEGER
+
+	if lexer.peek(0) == '0' && (lexer.peek(1) == 'x' || lexer.peek(1) == 'X') {
+		lexer.advance()
+		lexer.advance()
+		for isHexDigit(lexer.peek(0)) {
+			lexer.advance()
+		}
+		if lexer.position-start == 2 {
+			return token, lexer.errorAt(token.Line, token.Column, "malformed hexadecimal number")
+		}
+	} else {
+		for unicode.IsDigit(lexer.peek(0)) {
+			lexer.advance()
+		}
+		if lexer.peek(0) == '.' {
+			token.Type = constants.TOKEN_FLOAT
+			lexer.advance()
+			for unicode.IsDigit(lexer.peek(0)) {
+				lexer.advance()
+			}
+		}
+		if next := lexer.peek(0); next == 'e' || next == 'E' {
+			token.Type = constants.TOKEN_FLOAT
+			lexer.advance()
+			if sign := lexer.peek(0); sign == '+' || sign == '-' {
+				lexer.advance()
+			}
+			if !unicode.IsDigit(lexer.peek(0)) {
+				return token, lexer.errorAt(token.Line, token.Column, "malformed number")
+			}
+			for unicode.IsDigit(lexer.peek(0)) {
+				lexer.advance()
+			}
+		}
+	}
+
+	// "12abc" is a mistake rather than a number followed by an identifier
+	if isIdentifierPart(lexer.peek(0)) {
+		return token, lexer.errorAt(token.Line, token.Column, "malformed number")
+	}
+	token.Text = string(lexer.input[start:lexer.position])
+	return token, nil
+}
+
+func isIdentifierStart(character rune) bool {
+	return character == '_' || unicode.IsLetter(character)
+}
+
+func isIdentifierPart(character rune) bool {
+	return isIdentifierStart(character) || unicode.IsDigit(character) || character == '$'
+}
+
+func isHexDigit(character rune) bool {
+	return unicode.IsDigit(character) || strings.ContainsRune("abcdefABCDEF", character)
+}
@@ -0,0 +1,148 @@
+package engine
+
+import (
+	"syscall"
+
+	"github.com/kris-gaudel/goqlite/constants"
+)
+
+// Lock Code
+//
+// In rollback journal mode connections lock the database like SQLite does,
+// going up through these levels with advisory flocks:
+//   - SHARED: a shared lock on the database file, held while reading, for a
+//     statement or for a whole transaction
+//   - RESERVED: the lock on the journal, held by the one connection that is
+//     writing from the first change until it commits or rolls back
+//   - PENDING: an exclusive lock on the pending file, which keeps new readers
+//     out while the writer waits for the ones already reading to finish
+//   - EXCLUSIVE: an exclusive lock on the database file, without which nothing
+//     is written to it, whether a commit or pages spilled out of the cache
+//
+// A failed attempt is reported rather than waited on, see BUSY_RETRY_INTERVAL.
+// In WAL mode every connection keeps its shared lock for as long as it has the
+// database open instead, see the WAL code.
+
+func PendingPath(fileName string) string {
+	return fileName + "-pending"
+}
+
+// Raises this connection's lock to level, one of the LOCK_* constants. Returns
+// false if another connection's lock is in the way. RESERVED comes with the
+// journal, so JournalBeginWrite takes it.
+func PagerLock(pager *Pager, level int) bool {
+	if pager.Lock >= level {
+		return true
+	}
+	switch level {
+	case constants.LOCK_SHARED:
+		// A writer waiting for readers to finish lets no new ones in
+		if pendingLocked(pager.FileName) {
+			return false
+		}
+		if !flockNonBlocking(pager.FileDescriptor, syscall.LOCK_SH, "locking the database file") {
+			return false
+		}
+		pager.Lock = constants.LOCK_SHARED
+		if !RecoverHotJournal(pager) {
+			PagerUnlock(pager, constants.LOCK_NONE)
+			return false
+		}
+	case constants.LOCK_EXCLUSIVE:
+		if pager.PendingFileDescriptor < 0 {
+			fd := lockFile(PendingPath(pager.FileName), "the pending lock")
+			if fd < 0 {
+				return false
+			}
+			pager.PendingFileDescriptor = fd
+			pager.Lock = constants.LOCK_PENDING
+		}
+		if !flockNonBlocking(pager.FileDescriptor, syscall.LOCK_EX, "locking the database file") {
+			// A failed upgrade can give up the shared lock along with it
+			walLock(pager.FileDescriptor, syscall.LOCK_SH)
+			return false
+		}
+		pager.Lock = constants.LOCK_EXCLUSIVE
+	default:
+		raiseInternal("Cannot take lock level %d.", level)
+	}
+	return true
+}
+
+// Lowers this connection's lock to LOCK_SHARED or LOCK_NONE. The journal has
+// to be closed first when giving up RESERVED.
+func PagerUnlock(pager *Pager, level int) {
+	if pager.Lock <= level {
+		return
+	}
+	if pager.Lock == constants.LOCK_EXCLUSIVE || level == constants.LOCK_NONE {
+		how := syscall.LOCK_SH
+		if level == constants.LOCK_NONE {
+			how = syscall.LOCK_UN
+		}
+		walLock(pager.FileDescriptor, how)
+	}
+	// Like the journal, the pending file is only let go of once it's gone
+	if fd := pager.PendingFileDescriptor; fd >= 0 {
+		pager.PendingFileDescriptor = -1
+		syscall.Unlink(PendingPath(pager.FileName))
+		syscall.Close(fd)
+	}
+	pager.Lock = level
+}
+
+// Whether a writer holds the pending lock
+func pendingLocked(fileName string) bool {
+	fd, err := syscall.Open(PendingPath(fileName), constants.O_RDWR, 0)
+	if err == syscall.ENOENT {
+		return false
+	} else if err != nil {
+		raiseIOError(ErrIOOpen, "opening the pending lock", err)
+	}
+	defer syscall.Close(fd)
+	return !flockNonBlocking(fd, syscall.LOCK_SH, "locking the pending lock")
+}
+
+// Opens the file at path, creating it if needed, and takes an exclusive lock
+// on it. Returns -1 if another connection holds a lock on it.
+func lockFile(path string, description string) int {
+	for {
+		fd, err := syscall.Open(path, constants.O_RDWR|constants.O_CREAT, constants.S_IWUSR|constants.S_IRUSR)
+		if err != nil {
+			raiseIOError(ErrIOOpen, "opening "+description, err)
+		}
+		if !flockNonBlocking(fd, syscall.LOCK_EX, "locking "+description) {
+			syscall.Close(fd)
+			return -1
+		}
+		// The connection that held the lock may have deleted the file while
+		// this one waited, leaving it locking a file nobody else can see
+		if fileIsCurrent(fd, path) {
+			return fd
+		}
+		syscall.Close(fd)
+	}
+}
+
+// Whether fd is the file at path rather than one that has been deleted
+func fileIsCurrent(fd int, path string) bool {
+	var opened, current syscall.Stat_t
+	if err := syscall.Fstat(fd, &opened); err != nil {
+		raiseIOError(ErrIORead, "reading "+path, err)
+	}
+	if err := syscall.Stat(path, &current); err != nil {
+		return false
+	}
+	return opened.Dev == current.Dev && opened.Ino == current.Ino
+}
+
+// Takes a flock without waiting, returning false if another one is in the way
+func flockNonBlocking(fd int, how int, action string) bool {
+	err := syscall.Flock(fd, how|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false
+	} else if err != nil {
+		raiseIOError(ErrIOLock, action, err)
+	}
+	return true
+}
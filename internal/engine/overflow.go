@@ -0,0 +1,124 @@
+package engine
+
+import (
+	"unsafe"
+
+	"github.com/kris-gaudel/goqlite/constants"
+)
+
+// Overflow Page Code
+//
+// A record too large to keep whole in its leaf is split up: the first part
+// stays in the leaf cell and the rest goes to a chain of overflow pages. The
+// chain belongs to the cell, so it moves along with the cell when leaves split
+// or merge and is freed once the row is deleted or rewritten.
+
+func OverflowPageNext(page []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&page[constants.OVERFLOW_PAGE_NEXT_OFFSET]))
+}
+
+func LeafCellRecordSize(cell []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&cell[constants.LEAF_NODE_RECORD_SIZE_OFFSET]))
+}
+
+// Number of bytes of a record that are kept in its leaf cell. Like SQLite,
+// the part left in the leaf is sized so the last overflow page is filled.
+func leafCellLocalSize(recordSize uint32) uint32 {
+	if recordSize <= uint32(constants.LEAF_NODE_MAX_LOCAL) {
+		return recordSize
+	}
+	localSize := uint32(constants.LEAF_NODE_MIN_LOCAL) + (recordSize-uint32(constants.LEAF_NODE_MIN_LOCAL))%uint32(constants.OVERFLOW_PAGE_DATA_SIZE)
+	if localSize > uint32(constants.LEAF_NODE_MAX_LOCAL) {
+		localSize = uint32(constants.LEAF_NODE_MIN_LOCAL)
+	}
+	return localSize
+}
+
+// Size of the cell at the start of cell, which may run on past it
+func leafCellSize(cell []byte) uint32 {
+	recordSize := *LeafCellRecordSize(cell)
+	localSize := leafCellLocalSize(recordSize)
+	size := uint32(constants.LEAF_NODE_CELL_HEADER_SIZE) + localSize
+	if localSize < recordSize {
+		size += uint32(constants.LEAF_NODE_OVERFLOW_POINTER_SIZE)
+	}
+	return size
+}
+
+// First overflow page of a cell whose record doesn't fit in the leaf
+func leafCellOverflowPage(cell []byte) *uint32 {
+	offset := uint32(constants.LEAF_NODE_CELL_HEADER_SIZE) + leafCellLocalSize(*LeafCellRecordSize(cell))
+	return (*uint32)(unsafe.Pointer(&cell[offset]))
+}
+
+// Builds the cell for a row, writing whatever doesn't fit in the leaf to a new
+// overflow chain
+func NewLeafCell(pagerInstance *Pager, key uint32, record []byte) []byte {
+	recordSize := uint32(len(record))
+	localSize := leafCellLocalSize(recordSize)
+	cell := make([]byte, uintptr(localSize)+constants.LEAF_NODE_CELL_HEADER_SIZE)
+	*(*uint32)(unsafe.Pointer(&cell[constants.LEAF_NODE_KEY_OFFSET])) = key
+	*LeafCellRecordSize(cell) = recordSize
+	copy(cell[constants.LEAF_NODE_CELL_HEADER_SIZE:], record[:localSize])
+	if localSize == recordSize {
+		return cell
+	}
+
+	// The chain is written from the back so each page can point at the next one
+	overflow := record[localSize:]
+	dataSize := int(constants.OVERFLOW_PAGE_DATA_SIZE)
+	nextPageNum := uint32(0)
+	for start := (len(overflow) - 1) / dataSize * dataSize; start >= 0; start -= dataSize {
+		end := start + dataSize
+		if end > len(overflow) {
+			end = len(overflow)
+		}
+		pageNum := GetUnusedPageNum(pagerInstance)
+		page := GetPage(pagerInstance, pageNum)
+		MarkPageDirty(pagerInstance, pageNum)
+		*OverflowPageNext(page) = nextPageNum
+		copy(page[constants.OVERFLOW_PAGE_DATA_OFFSET:], overflow[start:end])
+		nextPageNum = pageNum
+	}
+	return append(cell, uint32ToBytes(nextPageNum)...)
+}
+
+// Reads a cell's whole record, following its overflow chain
+func LeafCellRecord(pagerInstance *Pager, cell []byte) []byte {
+	recordSize := *LeafCellRecordSize(cell)
+	localSize := leafCellLocalSize(recordSize)
+	record := make([]byte, 0, recordSize)
+	record = append(record, cell[constants.LEAF_NODE_CELL_HEADER_SIZE:uintptr(localSize)+constants.LEAF_NODE_CELL_HEADER_SIZE]...)
+	if localSize == recordSize {
+		return record
+	}
+
+	pageNum := *leafCellOverflowPage(cell)
+	for uint32(len(record)) < recordSize {
+		if pageNum == 0 || pageNum >= pagerInstance.NumPages {
+			raiseCorrupt("Overflow chain ends before its record does. Corrupt file.")
+		}
+		page := GetPage(pagerInstance, pageNum)
+		size := recordSize - uint32(len(record))
+		if size > uint32(constants.OVERFLOW_PAGE_DATA_SIZE) {
+			size = uint32(constants.OVERFLOW_PAGE_DATA_SIZE)
+		}
+		record = append(record, page[constants.OVERFLOW_PAGE_DATA_OFFSET:constants.OVERFLOW_PAGE_DATA_OFFSET+uintptr(size)]...)
+		pageNum = *OverflowPageNext(page)
+	}
+	return record
+}
+
+// Hands a cell's overflow pages back to the free list
+func FreeOverflowPages(pagerInstance *Pager, cell []byte) {
+	recordSize := *LeafCellRecordSize(cell)
+	if leafCellLocalSize(recordSize) == recordSize {
+		return
+	}
+	pageNum := *leafCellOverflowPage(cell)
+	for pageNum != 0 {
+		nextPageNum := *OverflowPageNext(GetPage(pagerInstance, pageNum))
+		FreePage(pagerInstance, pageNum)
+		pageNum = nextPageNum
+	}
+}
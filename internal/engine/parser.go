@@ -0,0 +1,689 @@
+package engine
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/kris-gaudel/goqlite/constants"
+)
+
+// Parser Code
+//
+// A recursive-descent parser with one token of lookahead. Errors are raised by
+// panicking with an ErrSyntax *Error, which Parse recovers and returns.
+
+type Parser struct {
+	lexer   *Lexer
+	current Token
+	// Placeholders in the order they appear
+	parameters []*ParameterExpr
+}
+
+// Parses a single statement, optionally followed by a semicolon
+func Parse(input string) (StatementNode, error) {
+	statement, _, err := ParseParameters(input)
+	return statement, err
+}
+
+// Like Parse, also returning the statement's parameters in the order they appear
+func ParseParameters(input string) (statement StatementNode, parameters []*ParameterExpr, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			syntaxError, ok := recovered.(*Error)
+			if !ok {
+				panic(recovered)
+			}
+			statement, parameters, err = nil, nil, syntaxError
+		}
+	}()
+
+	parser := &Parser{lexer: NewLexer(input)}
+	parser.advance()
+	statement = parser.parseStatement()
+	parser.acceptOperator(";")
+	if parser.current.Type != constants.TOKEN_EOF {
+		parser.fail("unexpected %s after the end of the statement", describeToken(parser.current))
+	}
+	return statement, parser.parameters, nil
+}
+
+func (parser *Parser) advance() {
+	token, err := parser.lexer.Next()
+	if err != nil {
+		panic(err)
+	}
+	parser.current = token
+}
+
+func (parser *Parser) fail(format string, args ...interface{}) {
+	panic(&Error{Code: ErrSyntax, Line: parser.current.Line, Column: parser.current.Column, Message: fmt.Sprintf(format, args...)})
+}
+
+func describeToken(token Token) string {
+	switch token.Type {
+	case constants.TOKEN_EOF:
+		return "end of input"
+	case constants.TOKEN_STRING:
+		return "'" + strings.ReplaceAll(token.Text, "'", "''") + "'"
+	}
+	return strconv.Quote(token.Text)
+}
+
+func (parser *Parser) isKeyword(keyword string) bool {
+	return parser.current.Type == constants.TOKEN_KEYWORD && parser.current.Text == keyword
+}
+
+func (parser *Parser) acceptKeyword(keyword string) bool {
+	if parser.isKeyword(keyword) {
+		parser.advance()
+		return true
+	}
+	return false
+}
+
+func (parser *Parser) expectKeyword(keyword string) {
+	if !parser.acceptKeyword(keyword) {
+		parser.fail("expected %s but found %s", keyword, describeToken(parser.current))
+	}
+}
+
+func (parser *Parser) isOperator(operator string) bool {
+	return parser.current.Type == constants.TOKEN_OPERATOR && parser.current.Text == operator
+}
+
+func (parser *Parser) acceptOperator(operator string) bool {
+	if parser.isOperator(operator) {
+		parser.advance()
+		return true
+	}
+	return false
+}
+
+func (parser *Parser) expectOperator(operator string) {
+	if !parser.acceptOperator(operator) {
+		parser.fail("expected \"%s\" but found %s", operator, describeToken(parser.current))
+	}
+}
+
+func (parser *Parser) expectIdentifier(description string) string {
+	if parser.current.Type != constants.TOKEN_IDENTIFIER {
+		parser.fail("expected %s but found %s", description, describeToken(parser.current))
+	}
+	name := parser.current.Text
+	parser.advance()
+	return name
+}
+
+func (parser *Parser) parseStatement() StatementNode {
+	switch {
+	case parser.isKeyword("SELECT"):
+		return parser.parseSelect()
+	case parser.isKeyword("INSERT"):
+		return parser.parseInsert()
+	case parser.isKeyword("UPDATE"):
+		return parser.parseUpdate()
+	case parser.isKeyword("DELETE"):
+		return parser.parseDelete()
+	case parser.isKeyword("CREATE"):
+		return parser.parseCreate()
+	case parser.isKeyword("EXPLAIN"):
+		return parser.parseExplain()
+	case parser.acceptKeyword("BEGIN"):
+		parser.acceptKeyword("TRANSACTION")
+		return &BeginStmt{}
+	case parser.acceptKeyword("COMMIT"), parser.acceptKeyword("END"):
+		parser.acceptKeyword("TRANSACTION")
+		return &CommitStmt{}
+	case parser.acceptKeyword("ROLLBACK"):
+		parser.acceptKeyword("TRANSACTION")
+		return &RollbackStmt{}
+	case parser.current.Type == constants.TOKEN_EOF:
+		parser.fail("expected a statement but found end of input")
+	}
+	parser.fail("unrecognized statement starting with %s", describeToken(parser.current))
+	return nil
+}
+
+func (parser *Parser) parseExplain() *ExplainStmt {
+	parser.expectKeyword("EXPLAIN")
+	explain := &ExplainStmt{}
+	if parser.acceptKeyword("QUERY") {
+		parser.expectKeyword("PLAN")
+		explain.QueryPlan = true
+	}
+	if parser.isKeyword("EXPLAIN") {
+		parser.fail("EXPLAIN cannot be nested")
+	}
+	explain.Statement = parser.parseStatement()
+	return explain
+}
+
+func (parser *Parser) parseSelect() *SelectStmt {
+	parser.expectKeyword("SELECT")
+	statement := &SelectStmt{}
+
+	// A bare "select" is shorthand for reading every row of the default table
+	if parser.current.Type == constants.TOKEN_EOF || parser.isOperator(";") {
+		statement.Columns = []ResultColumn{{}}
+		statement.From = constants.DEFAULT_TABLE_NAME
+		return statement
+	}
+
+	for {
+		if parser.acceptOperator("*") {
+			statement.Columns = append(statement.Columns, ResultColumn{})
+		} else {
+			column := ResultColumn{Expr: parser.parseExpression()}
+			if parser.acceptKeyword("AS") {
+				column.Alias = parser.expectIdentifier("a column alias")
+			} else if parser.current.Type == constants.TOKEN_IDENTIFIER {
+				column.Alias = parser.expectIdentifier("a column alias")
+			}
+			statement.Columns = append(statement.Columns, column)
+		}
+		if !parser.acceptOperator(",") {
+			break
+		}
+	}
+
+	if parser.acceptKeyword("FROM") {
+		statement.From = parser.expectIdentifier("a table name")
+		statement.FromAlias = parser.parseTableAlias()
+		for {
+			join, ok := parser.parseJoinOperator()
+			if !ok {
+				break
+			}
+			join.Table = parser.expectIdentifier("a table name")
+			join.Alias = parser.parseTableAlias()
+			if parser.acceptKeyword("ON") {
+				join.On = parser.parseExpression()
+			} else if parser.acceptKeyword("USING") {
+				parser.expectOperator("(")
+				for {
+					join.Using = append(join.Using, parser.expectIdentifier("a column name"))
+					if !parser.acceptOperator(",") {
+						break
+					}
+				}
+				parser.expectOperator(")")
+			}
+			statement.Joins = append(statement.Joins, join)
+		}
+	}
+	if parser.acceptKeyword("WHERE") {
+		statement.Where = parser.parseExpression()
+	}
+	if parser.acceptKeyword("GROUP") {
+		parser.expectKeyword("BY")
+		statement.GroupBy = parser.parseExpressionList()
+	}
+	if parser.acceptKeyword("HAVING") {
+		statement.Having = parser.parseExpression()
+	}
+	if parser.acceptKeyword("ORDER") {
+		parser.expectKeyword("BY")
+		for {
+			term := OrderingTerm{Expr: parser.parseExpression()}
+			if parser.acceptKeyword("DESC") {
+				term.Descending = true
+			} else {
+				parser.acceptKeyword("ASC")
+			}
+			statement.OrderBy = append(statement.OrderBy, term)
+			if !parser.acceptOperator(",") {
+				break
+			}
+		}
+	}
+	if parser.acceptKeyword("LIMIT") {
+		statement.Limit = parser.parseExpression()
+		if parser.acceptKeyword("OFFSET") {
+			statement.Offset = parser.parseExpression()
+		} else if parser.acceptOperator(",") {
+			// "LIMIT offset, count" lists the two the other way around
+			statement.Offset = statement.Limit
+			statement.Limit = parser.parseExpression()
+		}
+	}
+	return statement
+}
+
+// Parses the optional "[AS] alias" after a table name in a FROM clause
+func (parser *Parser) parseTableAlias() string {
+	if parser.acceptKeyword("AS") || parser.current.Type == constants.TOKEN_IDENTIFIER {
+		return parser.expectIdentifier("a table alias")
+	}
+	return ""
+}
+
+// Parses what joins two tables: a comma, JOIN, INNER JOIN, LEFT [OUTER] JOIN
+// or CROSS JOIN. Returns false when the FROM clause has no more tables.
+func (parser *Parser) parseJoinOperator() (JoinClause, bool) {
+	switch {
+	case parser.acceptOperator(","):
+		return JoinClause{Kind: "CROSS"}, true
+	case parser.acceptKeyword("JOIN"):
+		return JoinClause{Kind: "INNER"}, true
+	case parser.acceptKeyword("INNER"):
+		parser.expectKeyword("JOIN")
+		return JoinClause{Kind: "INNER"}, true
+	case parser.acceptKeyword("LEFT"):
+		parser.acceptKeyword("OUTER")
+		parser.expectKeyword("JOIN")
+		return JoinClause{Kind: "LEFT"}, true
+	case parser.acceptKeyword("CROSS"):
+		parser.expectKeyword("JOIN")
+		return JoinClause{Kind: "CROSS"}, true
+	}
+	return JoinClause{}, false
+}
+
+func (parser *Parser) parseInsert() *InsertStmt {
+	parser.expectKeyword("INSERT")
+	if !parser.acceptKeyword("INTO") {
+		return parser.parseShorthandInsert()
+	}
+
+	statement := &InsertStmt{Table: parser.expectIdentifier("a table name")}
+	if parser.acceptOperator("(") {
+		for {
+			statement.Columns = append(statement.Columns, parser.expectIdentifier("a column name"))
+			if !parser.acceptOperator(",") {
+				break
+			}
+		}
+		parser.expectOperator(")")
+	}
+
+	parser.expectKeyword("VALUES")
+	for {
+		parser.expectOperator("(")
+		statement.Rows = append(statement.Rows, parser.parseExpressionList())
+		parser.expectOperator(")")
+		if !parser.acceptOperator(",") {
+			break
+		}
+	}
+	return statement
+}
+
+// Parses "insert ID USERNAME EMAIL", where the two strings are bare words
+// that can hold characters like @ that SQL would not allow unquoted
+func (parser *Parser) parseShorthandInsert() *InsertStmt {
+	negative := parser.acceptOperator("-")
+	if parser.current.Type != constants.TOKEN_INTEGER {
+		parser.fail("expected INTO or an id but found %s", describeToken(parser.current))
+	}
+	var id Expression = &LiteralExpr{Value: parser.integerValue(parser.current)}
+	if negative {
+		id = &UnaryExpr{Operator: "-", Operand: id}
+	}
+
+	// The lexer has only read up to the end of the id, so it can switch to words here
+	values := []Expression{id}
+	for _, description := range []string{"a username", "an email"} {
+		word, err := parser.lexer.NextWord()
+		if err != nil {
+			panic(err)
+		}
+		if word.Type == constants.TOKEN_EOF {
+			parser.current = word
+			parser.fail("expected %s but found end of input", description)
+		}
+		values = append(values, &LiteralExpr{Value: word.Text})
+	}
+	parser.advance()
+
+	return &InsertStmt{Table: constants.DEFAULT_TABLE_NAME, Rows: [][]Expression{values}}
+}
+
+func (parser *Parser) parseUpdate() *UpdateStmt {
+	parser.expectKeyword("UPDATE")
+	statement := &UpdateStmt{Table: parser.expectIdentifier("a table name")}
+	parser.expectKeyword("SET")
+	for {
+		assignment := Assignment{Column: parser.expectIdentifier("a column name")}
+		parser.expectOperator("=")
+		assignment.Value = parser.parseExpression()
+		statement.Assignments = append(statement.Assignments, assignment)
+		if !parser.acceptOperator(",") {
+			break
+		}
+	}
+	if parser.acceptKeyword("WHERE") {
+		statement.Where = parser.parseExpression()
+	}
+	return statement
+}
+
+func (parser *Parser) parseDelete() *DeleteStmt {
+	parser.expectKeyword("DELETE")
+	parser.expectKeyword("FROM")
+	statement := &DeleteStmt{Table: parser.expectIdentifier("a table name")}
+	if parser.acceptKeyword("WHERE") {
+		statement.Where = parser.parseExpression()
+	}
+	return statement
+}
+
+func (parser *Parser) parseCreate() StatementNode {
+	parser.expectKeyword("CREATE")
+	if parser.isKeyword("UNIQUE") || parser.isKeyword("INDEX") {
+		return parser.parseCreateIndex()
+	}
+	return parser.parseCreateTable()
+}
+
+// Parses an optional IF NOT EXISTS
+func (parser *Parser) parseIfNotExists() bool {
+	if !parser.acceptKeyword("IF") {
+		return false
+	}
+	parser.expectKeyword("NOT")
+	parser.expectKeyword("EXISTS")
+	return true
+}
+
+func (parser *Parser) parseCreateTable() *CreateTableStmt {
+	parser.expectKeyword("TABLE")
+	statement := &CreateTableStmt{IfNotExists: parser.parseIfNotExists()}
+	statement.Name = parser.expectIdentifier("a table name")
+
+	parser.expectOperator("(")
+	for {
+		statement.Columns = append(statement.Columns, parser.parseColumnDefinition())
+		if !parser.acceptOperator(",") {
+			break
+		}
+	}
+	parser.expectOperator(")")
+	return statement
+}
+
+// Parses "[UNIQUE] INDEX [IF NOT EXISTS] [name] ON table (column, ...)"
+func (parser *Parser) parseCreateIndex() *CreateIndexStmt {
+	statement := &CreateIndexStmt{Unique: parser.acceptKeyword("UNIQUE")}
+	parser.expectKeyword("INDEX")
+	statement.IfNotExists = parser.parseIfNotExists()
+	if !parser.isKeyword("ON") {
+		statement.Name = parser.expectIdentifier("an index name")
+	}
+	parser.expectKeyword("ON")
+	statement.Table = parser.expectIdentifier("a table name")
+
+	parser.expectOperator("(")
+	for {
+		statement.Columns = append(statement.Columns, parser.expectIdentifier("a column name"))
+		if !parser.acceptOperator(",") {
+			break
+		}
+	}
+	parser.expectOperator(")")
+	return statement
+}
+
+// Parses "name type[(length)]" followed by any PRIMARY KEY and NOT NULL constraints
+func (parser *Parser) parseColumnDefinition() ColumnDefinition {
+	column := ColumnDefinition{Name: parser.expectIdentifier("a column name")}
+	column.Type = parser.expectIdentifier("a column type")
+	if parser.acceptOperator("(") {
+		length, err := strconv.Atoi(parser.current.Text)
+		if parser.current.Type != constants.TOKEN_INTEGER || err != nil || length <= 0 {
+			parser.fail("expected a length but found %s", describeToken(parser.current))
+		}
+		column.Length = length
+		parser.advance()
+		parser.expectOperator(")")
+	}
+
+	for {
+		switch {
+		case parser.acceptKeyword("PRIMARY"):
+			parser.expectKeyword("KEY")
+			column.PrimaryKey = true
+		case parser.acceptKeyword("NOT"):
+			parser.expectKeyword("NULL")
+			column.NotNull = true
+		default:
+			return column
+		}
+	}
+}
+
+func (parser *Parser) parseExpressionList() []Expression {
+	expressions := []Expression{parser.parseExpression()}
+	for parser.acceptOperator(",") {
+		expressions = append(expressions, parser.parseExpression())
+	}
+	return expressions
+}
+
+// Expressions from the loosest binding operator to the tightest:
+// OR, AND, NOT, equality and IS/IN/LIKE/BETWEEN, comparisons, + -, * / %, ||, unary - +
+func (parser *Parser) parseExpression() Expression {
+	left := parser.parseAnd()
+	for parser.acceptKeyword("OR") {
+		left = &BinaryExpr{Operator: "OR", Left: left, Right: parser.parseAnd()}
+	}
+	return left
+}
+
+func (parser *Parser) parseAnd() Expression {
+	left := parser.parseNot()
+	for parser.acceptKeyword("AND") {
+		left = &BinaryExpr{Operator: "AND", Left: left, Right: parser.parseNot()}
+	}
+	return left
+}
+
+func (parser *Parser) parseNot() Expression {
+	if parser.acceptKeyword("NOT") {
+		return &UnaryExpr{Operator: "NOT", Operand: parser.parseNot()}
+	}
+	return parser.parseEquality()
+}
+
+func (parser *Parser) parseEquality() Expression {
+	left := parser.parseComparison()
+	for {
+		switch {
+		case parser.isOperator("=") || parser.isOperator("==") || parser.isOperator("!=") || parser.isOperator("<>"):
+			operator := parser.current.Text
+			parser.advance()
+			left = &BinaryExpr{Operator: operator, Left: left, Right: parser.parseComparison()}
+		case parser.acceptKeyword("IS"):
+			not := parser.acceptKeyword("NOT")
+			parser.expectKeyword("NULL")
+			left = &IsNullExpr{Operand: left, Not: not}
+		case parser.isKeyword("NOT") || parser.isKeyword("IN") || parser.isKeyword("LIKE") || parser.isKeyword("BETWEEN"):
+			not := parser.acceptKeyword("NOT")
+			left = parser.parseMembership(left, not)
+		default:
+			return left
+		}
+	}
+}
+
+// Parses the IN, LIKE or BETWEEN that follows left, after an optional NOT
+func (parser *Parser) parseMembership(left Expression, not bool) Expression {
+	switch {
+	case parser.acceptKeyword("IN"):
+		parser.expectOperator("(")
+		expression := &InExpr{Operand: left, Values: parser.parseExpressionList(), Not: not}
+		parser.expectOperator(")")
+		return expression
+	case parser.acceptKeyword("LIKE"):
+		var expression Expression = &BinaryExpr{Operator: "LIKE", Left: left, Right: parser.parseComparison()}
+		if not {
+			expression = &UnaryExpr{Operator: "NOT", Operand: expression}
+		}
+		return expression
+	case parser.acceptKeyword("BETWEEN"):
+		// The bounds are parsed above AND so the AND between them isn't taken as a conjunction
+		low := parser.parseComparison()
+		parser.expectKeyword("AND")
+		return &BetweenExpr{Operand: left, Low: low, High: parser.parseComparison(), Not: not}
+	}
+	parser.fail("expected IN, LIKE or BETWEEN but found %s", describeToken(parser.current))
+	return nil
+}
+
+func (parser *Parser) parseComparison() Expression {
+	left := parser.parseAdditive()
+	for parser.isOperator("<") || parser.isOperator("<=") || parser.isOperator(">") || parser.isOperator(">=") {
+		operator := parser.current.Text
+		parser.advance()
+		left = &BinaryExpr{Operator: operator, Left: left, Right: parser.parseAdditive()}
+	}
+	return left
+}
+
+func (parser *Parser) parseAdditive() Expression {
+	left := parser.parseMultiplicative()
+	for parser.isOperator("+") || parser.isOperator("-") {
+		operator := parser.current.Text
+		parser.advance()
+		left = &BinaryExpr{Operator: operator, Left: left, Right: parser.parseMultiplicative()}
+	}
+	return left
+}
+
+func (parser *Parser) parseMultiplicative() Expression {
+	left := parser.parseConcatenation()
+	for parser.isOperator("*") || parser.isOperator("/") || parser.isOperator("%") {
+		operator := parser.current.Text
+		parser.advance()
+		left = &BinaryExpr{Operator: operator, Left: left, Right: parser.parseConcatenation()}
+	}
+	return left
+}
+
+func (parser *Parser) parseConcatenation() Expression {
+	left := parser.parseUnary()
+	for parser.acceptOperator("||") {
+		left = &BinaryExpr{Operator: "||", Left: left, Right: parser.parseUnary()}
+	}
+	return left
+}
+
+func (parser *Parser) parseUnary() Expression {
+	if parser.isOperator("-") || parser.isOperator("+") {
+		operator := parser.current.Text
+		parser.advance()
+		return &UnaryExpr{Operator: operator, Operand: parser.parseUnary()}
+	}
+	return parser.parsePrimary()
+}
+
+func (parser *Parser) parsePrimary() Expression {
+	token := parser.current
+	switch token.Type {
+	case constants.TOKEN_INTEGER:
+		parser.advance()
+		return &LiteralExpr{Value: parser.integerValue(token)}
+	case constants.TOKEN_FLOAT:
+		value, err := strconv.ParseFloat(token.Text, 64)
+		if err != nil {
+			parser.fail("malformed number %s", token.Text)
+		}
+		parser.advance()
+		return &LiteralExpr{Value: value}
+	case constants.TOKEN_STRING:
+		parser.advance()
+		return &LiteralExpr{Value: token.Text}
+	case constants.TOKEN_BLOB:
+		value, _ := hex.DecodeString(token.Text)
+		parser.advance()
+		return &LiteralExpr{Value: value}
+	case constants.TOKEN_PARAMETER:
+		parameter := parser.parameter(token)
+		parser.advance()
+		return parameter
+	case constants.TOKEN_IDENTIFIER:
+		parser.advance()
+		if parser.acceptOperator("(") {
+			return parser.parseFunctionCall(token.Text)
+		}
+		if parser.acceptOperator(".") {
+			return &ColumnExpr{Table: token.Text, Column: parser.expectIdentifier("a column name")}
+		}
+		return &ColumnExpr{Column: token.Text}
+	}
+
+	switch {
+	case parser.acceptKeyword("NULL"):
+		return &LiteralExpr{Value: nil}
+	case parser.acceptKeyword("TRUE"):
+		return &LiteralExpr{Value: int64(1)}
+	case parser.acceptKeyword("FALSE"):
+		return &LiteralExpr{Value: int64(0)}
+	case parser.acceptOperator("("):
+		expression := parser.parseExpression()
+		parser.expectOperator(")")
+		return expression
+	}
+	parser.fail("expected an expression but found %s", describeToken(token))
+	return nil
+}
+
+// Numbers a placeholder the way SQLite does: ? takes the number after the
+// highest one so far, ?NNN has its own number and :name gets the number it
+// was given where the name first appeared
+func (parser *Parser) parameter(token Token) *ParameterExpr {
+	highest := 0
+	for _, parameter := range parser.parameters {
+		if parameter.Index > highest {
+			highest = parameter.Index
+		}
+	}
+
+	index := highest + 1
+	if token.Text != "?" && token.Text[0] == '?' {
+		number, err := strconv.Atoi(token.Text[1:])
+		if err != nil || number < 1 || number > constants.MAX_PARAMETER_NUMBER {
+			parser.fail("parameter %s should be between ?1 and ?%d", token.Text, constants.MAX_PARAMETER_NUMBER)
+		}
+		index = number
+	} else if token.Text[0] == ':' {
+		for _, parameter := range parser.parameters {
+			if parameter.Name == token.Text {
+				index = parameter.Index
+				break
+			}
+		}
+	}
+	parameter := &ParameterExpr{Index: index, Name: token.Text}
+	parser.parameters = append(parser.parameters, parameter)
+	return parameter
+}
+
+// Parses the arguments of a call whose opening parenthesis was just read
+func (parser *Parser) parseFunctionCall(name string) Expression {
+	call := &FunctionExpr{Name: strings.ToLower(name)}
+	if parser.acceptOperator("*") {
+		call.Star = true
+	} else if !parser.isOperator(")") {
+		call.Args = parser.parseExpressionList()
+	}
+	parser.expectOperator(")")
+	return call
+}
+
+// Integers too large for 64 bits become reals, like they do in SQLite
+func (parser *Parser) integerValue(token Token) interface{} {
+	if strings.HasPrefix(token.Text, "0x") || strings.HasPrefix(token.Text, "0X") {
+		value, err := strconv.ParseUint(token.Text[2:], 16, 64)
+		if err != nil {
+			parser.fail("hexadecimal number %s is too large", token.Text)
+		}
+		return int64(value)
+	}
+	if value, err := strconv.ParseInt(token.Text, 10, 64); err == nil {
+		return value
+	}
+	value, _ := strconv.ParseFloat(token.Text, 64)
+	return value
+}
@@ -0,0 +1,196 @@
+package engine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/kris-gaudel/goqlite/constants"
+)
+
+// Record Code
+//
+// A row is stored as a record laid out by its table's columns: a bitmap with
+// one bit per column, set for NULLs, followed by every other value in column
+// order. INTEGER and REAL values take 8 bytes, TEXT and BLOB values are a
+// varint length followed by their bytes. The INTEGER PRIMARY KEY column is the
+// row's key in the B-tree, so its value isn't repeated in the record.
+
+func SerializeRow(tableInstance *Table, source *Row) []byte {
+	record := make([]byte, recordBitmapSize(tableInstance))
+	for i, column := range tableInstance.Columns {
+		value := source.Values[i]
+		if i == tableInstance.KeyColumn {
+			continue
+		}
+		if value == nil {
+			record[i/8] |= 1 << (i % 8)
+			continue
+		}
+
+		switch column.Type {
+		case constants.COLUMN_TYPE_INTEGER:
+			record = binary.LittleEndian.AppendUint64(record, uint64(value.(int64)))
+		case constants.COLUMN_TYPE_REAL:
+			record = binary.LittleEndian.AppendUint64(record, math.Float64bits(value.(float64)))
+		case constants.COLUMN_TYPE_TEXT:
+			record = binary.AppendUvarint(record, uint64(len(value.(string))))
+			record = append(record, value.(string)...)
+		case constants.COLUMN_TYPE_BLOB:
+			record = binary.AppendUvarint(record, uint64(len(value.([]byte))))
+			record = append(record, value.([]byte)...)
+		}
+	}
+	return record
+}
+
+func DeserializeRow(tableInstance *Table, key uint32, source []byte, destination *Row) {
+	values := make([]interface{}, len(tableInstance.Columns))
+	offset := recordBitmapSize(tableInstance)
+	for i, column := range tableInstance.Columns {
+		if i == tableInstance.KeyColumn {
+			values[i] = int64(key)
+			continue
+		}
+		if source[i/8]&(1<<(i%8)) != 0 {
+			continue
+		}
+
+		switch column.Type {
+		case constants.COLUMN_TYPE_INTEGER:
+			values[i] = int64(binary.LittleEndian.Uint64(source[offset:]))
+			offset += 8
+		case constants.COLUMN_TYPE_REAL:
+			values[i] = math.Float64frombits(binary.LittleEndian.Uint64(source[offset:]))
+			offset += 8
+		case constants.COLUMN_TYPE_TEXT, constants.COLUMN_TYPE_BLOB:
+			length, lengthSize := binary.Uvarint(source[offset:])
+			offset += lengthSize
+			data := source[offset : offset+int(length)]
+			offset += int(length)
+			if column.Type == constants.COLUMN_TYPE_TEXT {
+				values[i] = string(data)
+			} else {
+				values[i] = append([]byte{}, data...)
+			}
+		}
+	}
+	*destination = Row{Key: key, Values: values}
+}
+
+func recordBitmapSize(tableInstance *Table) int {
+	return (len(tableInstance.Columns) + 7) / 8
+}
+
+// Converts a value to the column's declared type and checks it against the
+// column's length and NOT NULL constraint
+func ColumnValue(column *Column, value interface{}) (interface{}, error) {
+	if value == nil {
+		if column.NotNull {
+			return nil, fmt.Errorf("Column %s cannot be NULL.", column.Name)
+		}
+		return nil, nil
+	}
+
+	converted, ok := convertValue(column.Type, value)
+	if !ok {
+		return nil, fmt.Errorf("Cannot store %s in %s column %s.", valueTypeName(value), column.Type, column.Name)
+	}
+	switch converted := converted.(type) {
+	case string:
+		if column.MaxLength > 0 && len(converted) > column.MaxLength {
+			return nil, fmt.Errorf("String is too long.")
+		}
+	case []byte:
+		if column.MaxLength > 0 && len(converted) > column.MaxLength {
+			return nil, fmt.Errorf("Blob is too long.")
+		}
+	}
+	return converted, nil
+}
+
+// Text that spells out a number is accepted by numeric columns, and numbers are
+// accepted by TEXT columns, much like SQLite's type affinity
+func convertValue(columnType string, value interface{}) (interface{}, bool) {
+	switch columnType {
+	case constants.COLUMN_TYPE_INTEGER:
+		switch value := value.(type) {
+		case int64:
+			return value, true
+		case float64:
+			if value == math.Trunc(value) && value >= math.MinInt64 && value < math.MaxInt64 {
+				return int64(value), true
+			}
+		case string:
+			if integer, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64); err == nil {
+				return integer, true
+			}
+		}
+	case constants.COLUMN_TYPE_REAL:
+		switch value := value.(type) {
+		case int64:
+			return float64(value), true
+		case float64:
+			return value, true
+		case string:
+			if real, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				return real, true
+			}
+		}
+	case constants.COLUMN_TYPE_TEXT:
+		switch value := value.(type) {
+		case int64, float64:
+			return FormatValue(value), true
+		case string:
+			return value, true
+		case []byte:
+			return string(value), true
+		}
+	case constants.COLUMN_TYPE_BLOB:
+		switch value := value.(type) {
+		case string:
+			return []byte(value), true
+		case []byte:
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+func valueTypeName(value interface{}) string {
+	switch value.(type) {
+	case int64:
+		return constants.COLUMN_TYPE_INTEGER
+	case float64:
+		return constants.COLUMN_TYPE_REAL
+	case string:
+		return constants.COLUMN_TYPE_TEXT
+	case []byte:
+		return constants.COLUMN_TYPE_BLOB
+	}
+	return "NULL"
+}
+
+// Formats a value the way the REPL prints it. Reals always show a decimal
+// point so they can be told apart from integers.
+func FormatValue(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "NULL"
+	case int64:
+		return strconv.FormatInt(value, 10)
+	case float64:
+		text := strconv.FormatFloat(value, 'g', -1, 64)
+		if !strings.ContainsAny(text, ".eIN") {
+			text += ".0"
+		}
+		return text
+	case string:
+		return value
+	case []byte:
+		return string(value)
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,240 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kris-gaudel/goqlite/constants"
+)
+
+// Schema Code
+//
+// Every table and index is listed in the catalog, itself a table whose root
+// is page 1. Opening a database reads the catalog and parses each CREATE
+// statement back into a table or index. The schema cookie in the header is bumped whenever the
+// catalog changes so other connections know to read it again.
+
+// The catalog's own table, which is never listed in itself
+func CatalogTable(pagerInstance *Pager) *Table {
+	node, _ := Parse(constants.CATALOG_TABLE_SQL)
+	tableInstance, _ := NewTable(node.(*CreateTableStmt), constants.CATALOG_TABLE_SQL)
+	tableInstance.RootPageNum = constants.CATALOG_ROOT_PAGE_NUM
+	tableInstance.Pager = pagerInstance
+	return tableInstance
+}
+
+// The catalog row describing a table or index: its type, name, the table it
+// belongs to (a table belongs to itself), root page and CREATE statement
+func catalogRow(kind string, name string, tableName string, rootPageNum uint32, sql string) Row {
+	return Row{Values: []interface{}{kind, name, tableName, int64(rootPageNum), sql}}
+}
+
+// Builds a table from its CREATE TABLE statement. The table has no root page
+// until it is created or loaded.
+func NewTable(node *CreateTableStmt, sql string) (*Table, error) {
+	tableInstance := &Table{Name: node.Name, KeyColumn: -1, SQL: sql}
+	for i, definition := range node.Columns {
+		if ColumnIndex(tableInstance, definition.Name) >= 0 {
+			return nil, fmt.Errorf("Duplicate column name: %s.", definition.Name)
+		}
+		columnType, err := columnTypeOf(definition.Type)
+		if err != nil {
+			return nil, err
+		}
+
+		column := Column{Name: definition.Name, Type: columnType, PrimaryKey: definition.PrimaryKey, NotNull: definition.NotNull}
+		if columnType == constants.COLUMN_TYPE_TEXT || columnType == constants.COLUMN_TYPE_BLOB {
+			column.MaxLength = definition.Length
+		}
+		if definition.PrimaryKey {
+			if tableInstance.KeyColumn >= 0 {
+				return nil, fmt.Errorf("Table %s has more than one primary key.", node.Name)
+			}
+			if columnType != constants.COLUMN_TYPE_INTEGER {
+				return nil, fmt.Errorf("Only an INTEGER column can be the primary key.")
+			}
+			tableInstance.KeyColumn = i
+		}
+		tableInstance.Columns = append(tableInstance.Columns, column)
+	}
+	return tableInstance, nil
+}
+
+// Builds an index on tableInstance from its CREATE INDEX statement. The index
+// has no root page until it is created or loaded.
+func NewIndex(node *CreateIndexStmt, name string, tableInstance *Table, sql string) (*Index, error) {
+	indexInstance := &Index{Name: name, Table: tableInstance, Unique: node.Unique, SQL: sql}
+	keyTable := &Table{Name: name, KeyColumn: -1}
+	for _, columnName := range node.Columns {
+		position := ColumnIndex(tableInstance, columnName)
+		if position < 0 {
+			return nil, fmt.Errorf("No such column: %s.", columnName)
+		}
+		indexInstance.Columns = append(indexInstance.Columns, position)
+		column := tableInstance.Columns[position]
+		keyTable.Columns = append(keyTable.Columns, Column{Name: column.Name, Type: column.Type})
+	}
+	keyTable.Columns = append(keyTable.Columns, Column{Name: "rowid", Type: constants.COLUMN_TYPE_INTEGER})
+	indexInstance.KeyTable = keyTable
+	return indexInstance, nil
+}
+
+// Name given to an index whose CREATE INDEX leaves it out
+func defaultIndexName(node *CreateIndexStmt) string {
+	return fmt.Sprintf("idx_%s_%s", node.Table, strings.Join(node.Columns, "_"))
+}
+
+// Maps a declared type onto one of the four column types, going by the same
+// substrings SQLite uses so names like VARCHAR or BIGINT work
+func columnTypeOf(declared string) (string, error) {
+	upper := strings.ToUpper(declared)
+	switch {
+	case strings.Contains(upper, "INT"):
+		return constants.COLUMN_TYPE_INTEGER, nil
+	case strings.Contains(upper, "CHAR"), strings.Contains(upper, "CLOB"), strings.Contains(upper, "TEXT"):
+		return constants.COLUMN_TYPE_TEXT, nil
+	case strings.Contains(upper, "BLOB"):
+		return constants.COLUMN_TYPE_BLOB, nil
+	case strings.Contains(upper, "REAL"), strings.Contains(upper, "FLOA"), strings.Contains(upper, "DOUB"):
+		return constants.COLUMN_TYPE_REAL, nil
+	}
+	return "", fmt.Errorf("Unknown column type %s.", declared)
+}
+
+// Returns the position of the named column, or -1 if the table has no such column
+func ColumnIndex(tableInstance *Table, name string) int {
+	for i, column := range tableInstance.Columns {
+		if strings.EqualFold(column.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Reads every table and index listed in the catalog. An index is always
+// listed after its table since it can only be created once the table exists.
+// A catalog that can't be read is reported as ErrCorrupt.
+func LoadSchema(databaseInstance *Database) error {
+	catalog := CatalogTable(databaseInstance.Pager)
+	tables := map[string]*Table{constants.CATALOG_TABLE_NAME: catalog}
+
+	var row Row
+	for cursor := TableStart(catalog); !cursor.EndOfTable; CursorAdvance(cursor) {
+		CursorRow(cursor, &row)
+		name, nameOk := row.Values[1].(string)
+		tableName, tableNameOk := row.Values[2].(string)
+		rootPageNum, rootOk := row.Values[3].(int64)
+		sql, sqlOk := row.Values[4].(string)
+		node, err := Parse(sql)
+		if !nameOk || !tableNameOk || !rootOk || !sqlOk || err != nil {
+			return errorf(ErrCorrupt, "Catalog row %d is unreadable. Corrupt file.", row.Key)
+		}
+
+		switch node := node.(type) {
+		case *CreateTableStmt:
+			tableInstance, err := NewTable(node, sql)
+			if err != nil {
+				return errorf(ErrCorrupt, "Catalog row %d is unreadable: %v Corrupt file.", row.Key, err)
+			}
+			tableInstance.RootPageNum = uint32(rootPageNum)
+			tableInstance.Pager = databaseInstance.Pager
+			tables[strings.ToLower(tableInstance.Name)] = tableInstance
+		case *CreateIndexStmt:
+			tableInstance, ok := tables[strings.ToLower(tableName)]
+			if !ok {
+				return errorf(ErrCorrupt, "Index %s is on a missing table %s. Corrupt file.", name, tableName)
+			}
+			indexInstance, err := NewIndex(node, name, tableInstance, sql)
+			if err != nil {
+				return errorf(ErrCorrupt, "Catalog row %d is unreadable: %v Corrupt file.", row.Key, err)
+			}
+			indexInstance.RootPageNum = uint32(rootPageNum)
+			tableInstance.Indexes = append(tableInstance.Indexes, indexInstance)
+		default:
+			return errorf(ErrCorrupt, "Catalog row %d does not describe a table or index. Corrupt file.", row.Key)
+		}
+	}
+
+	header := GetPage(databaseInstance.Pager, constants.HEADER_PAGE_NUM)
+	databaseInstance.Tables = tables
+	databaseInstance.SchemaCookie = *HeaderSchemaCookie(header)
+	return nil
+}
+
+// Gives a new table an empty root leaf and lists it in the catalog, which can
+// only fail if the catalog row is too large
+func CreateTable(databaseInstance *Database, tableInstance *Table) error {
+	pagerInstance := databaseInstance.Pager
+	rootPageNum := GetUnusedPageNum(pagerInstance)
+	rootNode := GetPage(pagerInstance, rootPageNum)
+	MarkPageDirty(pagerInstance, rootPageNum)
+	InitializeLeafNode(rootNode)
+	SetNodeRoot(rootNode, true)
+	tableInstance.RootPageNum = rootPageNum
+	tableInstance.Pager = pagerInstance
+
+	row := catalogRow("table", tableInstance.Name, tableInstance.Name, rootPageNum, tableInstance.SQL)
+	if err := insertCatalogRow(databaseInstance, row); err != nil {
+		return err
+	}
+	databaseInstance.Tables[strings.ToLower(tableInstance.Name)] = tableInstance
+	return nil
+}
+
+// Gives a new index an empty root leaf and lists it in the catalog. The index
+// starts out empty, filling it is up to the caller.
+func CreateIndex(databaseInstance *Database, indexInstance *Index) error {
+	pagerInstance := databaseInstance.Pager
+	rootPageNum := GetUnusedPageNum(pagerInstance)
+	rootNode := GetPage(pagerInstance, rootPageNum)
+	MarkPageDirty(pagerInstance, rootPageNum)
+	InitializeIndexNode(rootNode, constants.NODE_INDEX_LEAF)
+	SetNodeRoot(rootNode, true)
+	indexInstance.RootPageNum = rootPageNum
+
+	tableInstance := indexInstance.Table
+	row := catalogRow("index", indexInstance.Name, tableInstance.Name, rootPageNum, indexInstance.SQL)
+	if err := insertCatalogRow(databaseInstance, row); err != nil {
+		return err
+	}
+	tableInstance.Indexes = append(tableInstance.Indexes, indexInstance)
+	return nil
+}
+
+func insertCatalogRow(databaseInstance *Database, row Row) error {
+	catalog := databaseInstance.Tables[constants.CATALOG_TABLE_NAME]
+	insert := Statement{Type: constants.STATEMENT_INSERT, Table: catalog, RowToInsert: row}
+	return runStatement(&insert, catalog, &VM{})
+}
+
+// Loads the schema again if it changed since it was last read, either because
+// another connection created a table or index or because a rollback undid one
+func RefreshSchema(databaseInstance *Database) error {
+	if !PagerBeginRead(databaseInstance.Pager) {
+		return newError(ErrBusy)
+	}
+	header := GetPage(databaseInstance.Pager, constants.HEADER_PAGE_NUM)
+	if databaseInstance.Tables != nil && *HeaderSchemaCookie(header) == databaseInstance.SchemaCookie {
+		return nil
+	}
+	return LoadSchema(databaseInstance)
+}
+
+func FindTable(databaseInstance *Database, name string) (*Table, error) {
+	tableInstance, ok := databaseInstance.Tables[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("No such table: %s.", name)
+	}
+	return tableInstance, nil
+}
+
+func FindIndex(databaseInstance *Database, name string) (*Index, error) {
+	for _, tableInstance := range databaseInstance.Tables {
+		for _, indexInstance := range tableInstance.Indexes {
+			if strings.EqualFold(indexInstance.Name, name) {
+				return indexInstance, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("No such index: %s.", name)
+}
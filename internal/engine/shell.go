@@ -0,0 +1,243 @@
+package engine
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kris-gaudel/goqlite/constants"
+)
+
+// Shell Code
+//
+// The interactive shell cmd/main runs: it reads a statement or a dot command
+// from each line of standard input and prints what comes of it.
+
+// Runs the shell on the database file until .exit or the end of input. Returns
+// the error that stopped it if the database failed underneath it.
+func RunShell(fileName string) (err error) {
+	defer RecoverError(&err)
+	// A database the shell creates starts out with the users table
+	databaseInstance := dbOpen(fileName, true)
+
+	reader := bufio.NewReader(os.Stdin)
+	exitFlag := false
+	for {
+		// Other connections can write while the shell waits for input
+		PagerEndRead(databaseInstance.Pager)
+		fmt.Print("db > ") // Prompt
+
+		// REPL logic
+		input, err := reader.ReadString('\n')
+		trimmedInput := strings.TrimSpace(input)
+
+		if err != nil {
+			fmt.Print("Error reading input: ", err)
+			break
+		}
+
+		if trimmedInput == "" {
+			continue
+		}
+
+		if trimmedInput[0] == '.' {
+			switch DoMetaCommand(trimmedInput, databaseInstance) {
+			case (constants.META_COMMAND_SUCCESS):
+				continue
+			case (constants.META_COMMAND_FAIL):
+				continue
+			case (constants.META_COMMAND_UNRECOGNIZED_COMMAND):
+				fmt.Println("Unrecognized command: ", trimmedInput)
+				continue
+			case (constants.META_COMMAND_EXIT):
+				exitFlag = true
+				break
+			}
+		}
+
+		if exitFlag {
+			return nil
+		}
+
+		var statement Statement
+		if err := PrepareStatement(trimmedInput, &statement, databaseInstance); err != nil {
+			fmt.Println(err)
+			continue
+		}
+
+		if statement.Explain != "" {
+			printExplain(&statement)
+			fmt.Println("Executed.")
+			continue
+		}
+
+		vm := &VM{Output: printValues}
+		if err := ExecuteStatementOn(&statement, databaseInstance, vm); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			continue
+		}
+		if statement.Type == constants.STATEMENT_UPDATE {
+			fmt.Printf("Rows updated: %d\n", vm.Changes)
+		}
+		fmt.Println("Executed.")
+	}
+	return nil
+}
+
+func DoMetaCommand(input string, databaseInstance *Database) string {
+	pagerInstance := databaseInstance.Pager
+	if input == ".exit" {
+		DBClose(databaseInstance)
+		return constants.META_COMMAND_EXIT
+	} else if input == ".constants" {
+		fmt.Println("Constants:")
+		PrintConstants()
+		return constants.META_COMMAND_SUCCESS
+	} else if input == ".btree" || strings.HasPrefix(input, ".btree ") {
+		name := strings.TrimSpace(strings.TrimPrefix(input, ".btree"))
+		if name == "" {
+			name = constants.DEFAULT_TABLE_NAME
+		}
+		if err := RefreshSchema(databaseInstance); err != nil {
+			fmt.Println(err)
+			return constants.META_COMMAND_FAIL
+		}
+		if indexInstance, err := FindIndex(databaseInstance, name); err == nil {
+			fmt.Println("Tree:")
+			PrintIndexTree(indexInstance, indexInstance.RootPageNum, 0)
+			return constants.META_COMMAND_SUCCESS
+		}
+		tableInstance, err := FindTable(databaseInstance, name)
+		if err != nil {
+			fmt.Println(err)
+			return constants.META_COMMAND_FAIL
+		}
+		fmt.Println("Tree:")
+		PrintTree(pagerInstance, tableInstance.RootPageNum, 0)
+		return constants.META_COMMAND_SUCCESS
+	} else if input == ".tables" {
+		if err := RefreshSchema(databaseInstance); err != nil {
+			fmt.Println(err)
+			return constants.META_COMMAND_FAIL
+		}
+		names := make([]string, 0, len(databaseInstance.Tables))
+		for _, tableInstance := range databaseInstance.Tables {
+			if tableInstance.Name != constants.CATALOG_TABLE_NAME {
+				names = append(names, tableInstance.Name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return constants.META_COMMAND_SUCCESS
+	} else if input == ".schema" || strings.HasPrefix(input, ".schema ") {
+		name := strings.TrimSpace(strings.TrimPrefix(input, ".schema"))
+		if err := RefreshSchema(databaseInstance); err != nil {
+			fmt.Println(err)
+			return constants.META_COMMAND_FAIL
+		}
+		if name != "" {
+			tableInstance, err := FindTable(databaseInstance, name)
+			if err != nil {
+				fmt.Println(err)
+				return constants.META_COMMAND_FAIL
+			}
+			// A table's indexes are listed along with it
+			fmt.Printf("%s;\n", tableInstance.SQL)
+			for _, indexInstance := range tableInstance.Indexes {
+				fmt.Printf("%s;\n", indexInstance.SQL)
+			}
+			return constants.META_COMMAND_SUCCESS
+		}
+		// Tables and indexes are listed in the order they were created
+		var row Row
+		for cursor := TableStart(databaseInstance.Tables[constants.CATALOG_TABLE_NAME]); !cursor.EndOfTable; CursorAdvance(cursor) {
+			CursorRow(cursor, &row)
+			fmt.Printf("%s;\n", FormatValue(row.Values[4]))
+		}
+		return constants.META_COMMAND_SUCCESS
+	} else if input == ".dbinfo" {
+		if !PagerBeginRead(pagerInstance) {
+			fmt.Println(newError(ErrBusy))
+			return constants.META_COMMAND_FAIL
+		}
+		PrintHeader(GetPage(pagerInstance, constants.HEADER_PAGE_NUM))
+		return constants.META_COMMAND_SUCCESS
+	} else if input == ".cache_size" {
+		fmt.Printf("Cache size: %d pages\n", pagerInstance.CacheSize)
+		return constants.META_COMMAND_SUCCESS
+	} else if strings.HasPrefix(input, ".cache_size ") {
+		cacheSize, err := strconv.Atoi(strings.TrimSpace(input[len(".cache_size "):]))
+		if err != nil || cacheSize <= 0 {
+			fmt.Println("Usage: .cache_size [PAGES]")
+			return constants.META_COMMAND_FAIL
+		}
+		SetCacheSize(pagerInstance, cacheSize)
+		fmt.Printf("Cache size: %d pages\n", pagerInstance.CacheSize)
+		return constants.META_COMMAND_SUCCESS
+	} else if input == ".journal_mode" {
+		fmt.Printf("Journal mode: %s\n", JournalMode(pagerInstance))
+		return constants.META_COMMAND_SUCCESS
+	} else if strings.HasPrefix(input, ".journal_mode ") {
+		mode := strings.ToLower(strings.TrimSpace(input[len(".journal_mode "):]))
+		if mode != "wal" && mode != "delete" {
+			fmt.Println("Usage: .journal_mode [delete|wal]")
+			return constants.META_COMMAND_FAIL
+		}
+		if err := SetJournalMode(pagerInstance, mode); err != nil {
+			fmt.Println(err)
+			return constants.META_COMMAND_FAIL
+		}
+		fmt.Printf("Journal mode: %s\n", JournalMode(pagerInstance))
+		return constants.META_COMMAND_SUCCESS
+	} else if input == ".checkpoint" {
+		if pagerInstance.Wal == nil {
+			fmt.Println("Database is not in WAL mode.")
+			return constants.META_COMMAND_FAIL
+		}
+		if pagerInstance.InTransaction {
+			fmt.Println("Cannot checkpoint inside a transaction.")
+			return constants.META_COMMAND_FAIL
+		}
+		if !PagerCheckpoint(pagerInstance) {
+			fmt.Println("Checkpoint skipped: other connections have the database open.")
+			return constants.META_COMMAND_FAIL
+		}
+		fmt.Println("Checkpoint complete.")
+		return constants.META_COMMAND_SUCCESS
+	}
+	return constants.META_COMMAND_UNRECOGNIZED_COMMAND
+}
+
+// Prints what a statement was prepared to explain instead of running it: the
+// program as a table, or the query plan as a tree
+func printExplain(statement *Statement) {
+	rows := ExplainRows(statement)
+	if statement.Explain == constants.EXPLAIN_QUERY_PLAN {
+		if len(rows) == 0 {
+			return
+		}
+		fmt.Println("QUERY PLAN")
+		for i, row := range rows {
+			if i == len(rows)-1 {
+				fmt.Printf("`--%s\n", row[0])
+			} else {
+				fmt.Printf("|--%s\n", row[0])
+			}
+		}
+		return
+	}
+	if statement.Program == nil {
+		return
+	}
+	format := "%-4v  %-13v  %-4v  %-4v  %-4v  %-13v  %v\n"
+	fmt.Printf(format, "addr", "opcode", "p1", "p2", "p3", "p4", "p5")
+	fmt.Printf(format, "----", "-------------", "----", "----", "----", "-------------", "--")
+	for _, row := range rows {
+		fmt.Printf(format, row...)
+	}
+}
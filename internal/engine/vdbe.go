@@ -0,0 +1,460 @@
+package engine
+
+import (
+	"math"
+	"sort"
+
+	"github.com/kris-gaudel/goqlite/constants"
+)
+
+// Virtual Machine Code
+//
+// Statements are compiled into programs for a register machine, much like
+// SQLite's VDBE. A program works on numbered registers holding values and
+// numbered cursors reading or writing a table, an index or a hash table built
+// from a table. Each instruction is an opcode with up to five operands, where
+// P2 is the address to jump to for instructions that jump. The machine runs
+// instructions in order from the first until one halts or it runs off the end.
+
+type Instruction struct {
+	// One of the OP_* constants
+	Opcode string
+	P1     int
+	P2     int
+	P3     int
+	P4     interface{}
+	P5     int
+}
+
+type Program struct {
+	Instructions []Instruction
+	NumRegisters int
+	NumCursors   int
+}
+
+type vmCursor struct {
+	Table       *Table
+	Index       *Index
+	Cursor      *Cursor
+	IndexCursor *IndexCursor
+	// Rows of a hash cursor by their hashed values, and the rows it is stepping through
+	Hash         map[string][]Row
+	HashRows     []Row
+	HashPosition int
+	// Set once the cursor has gone past its last row
+	EndOfRows bool
+	// Set by NullRow, every column reads as NULL until the cursor moves
+	NullRow bool
+	// The row under the cursor once a column of it has been read
+	Row *Row
+}
+
+type VM struct {
+	// Called with each row a program outputs, the values are only valid until
+	// it returns. Rows are dropped when this is nil.
+	Output func(values []interface{})
+	// Rows the last program inserted, updated or deleted, and the key of the
+	// last row it inserted
+	Changes         int64
+	LastInsertRowid int64
+
+	Program   *Program
+	Registers []interface{}
+	Cursors   []*vmCursor
+	// Groups of a grouped select, keyed by their GROUP BY values
+	Groups     map[string]*rowGroup
+	GroupList  []*rowGroup
+	Group      *rowGroup
+	GroupIndex int
+	// Rows collected for ORDER BY
+	Sorter         []sortedRow
+	SorterPosition int
+	// Rowids collected by an update or delete, and how many have been read back
+	RowSet         []int64
+	RowSetPosition int
+}
+
+type sortedRow struct {
+	values []interface{}
+	keys   []interface{}
+}
+
+// Runs a program, printing the rows it outputs, and returns the error it
+// halted with, if any
+func RunProgram(program *Program) error {
+	vm := &VM{Output: printValues}
+	return vm.Run(program)
+}
+
+func printValues(values []interface{}) {
+	PrintRow(&Row{Values: values})
+}
+
+// Runs a program from the start and returns the error it halted with, if any
+func (vm *VM) Run(program *Program) error {
+	*vm = VM{
+		Output:    vm.Output,
+		Program:   program,
+		Registers: make([]interface{}, program.NumRegisters),
+		Cursors:   make([]*vmCursor, program.NumCursors),
+		Groups:    make(map[string]*rowGroup),
+	}
+	registers := vm.Registers
+	instructions := program.Instructions
+	for pc := 0; pc < len(instructions); {
+		instruction := &instructions[pc]
+		pc++
+		p1, p2, p3 := instruction.P1, instruction.P2, instruction.P3
+		switch instruction.Opcode {
+		case constants.OP_GOTO:
+			pc = p2
+		case constants.OP_HALT:
+			// P4 is the ErrorCode of a program that failed
+			if instruction.P4 != nil {
+				return newError(instruction.P4.(ErrorCode))
+			}
+			return nil
+		case constants.OP_IF:
+			if IsTrue(registers[p1]) {
+				pc = p2
+			}
+		case constants.OP_IF_NOT:
+			if !IsTrue(registers[p1]) {
+				pc = p2
+			}
+		case constants.OP_IS_NULL:
+			if registers[p1] == nil {
+				pc = p2
+			}
+		case constants.OP_IF_POS:
+			// Counts down an OFFSET, jumping past each row it skips
+			if registers[p1].(int64) > 0 {
+				registers[p1] = registers[p1].(int64) - 1
+				pc = p2
+			}
+		case constants.OP_DECR_JUMP_ZERO:
+			registers[p1] = registers[p1].(int64) - 1
+			if registers[p1].(int64) == 0 {
+				pc = p2
+			}
+		case constants.OP_EQ:
+			if registers[p1] != nil && registers[p3] != nil && CompareValues(registers[p1], registers[p3]) == 0 {
+				pc = p2
+			}
+		case constants.OP_GT:
+			if registers[p1] != nil && registers[p3] != nil && CompareValues(registers[p1], registers[p3]) > 0 {
+				pc = p2
+			}
+		case constants.OP_SAME_KEYS:
+			if compareIndexKeys(registers[p1:p1+instruction.P5], registers[p3:p3+instruction.P5]) == 0 {
+				pc = p2
+			}
+
+		case constants.OP_INTEGER:
+			registers[p2] = int64(p1)
+		case constants.OP_VALUE:
+			registers[p2] = instruction.P4
+		case constants.OP_COPY:
+			copy(registers[p2:p2+p3], registers[p1:p1+p3])
+		case constants.OP_ADD_IMM:
+			registers[p1] = registers[p1].(int64) + int64(p2)
+		case constants.OP_BINARY:
+			left, right := registers[p1], registers[p2]
+			if instruction.P5 != 0 {
+				// A comparison with a numeric column
+				left, right = numericAffinity(left), numericAffinity(right)
+			}
+			registers[p3] = binaryValue(instruction.P4.(string), left, right)
+		case constants.OP_AND:
+			registers[p3] = logicalAnd(registers[p1], registers[p2])
+		case constants.OP_OR:
+			registers[p3] = logicalOr(registers[p1], registers[p2])
+		case constants.OP_NOT:
+			registers[p2] = logicalNot(registers[p1])
+		case constants.OP_NEGATIVE:
+			registers[p2] = negate(registers[p1])
+		case constants.OP_TEST_NULL:
+			registers[p2] = booleanValue((registers[p1] == nil) != (instruction.P5 != 0))
+		case constants.OP_IN:
+			registers[p2] = inValue(registers[p1], registers[p1+1:p1+1+p3], instruction.P5 != 0)
+		case constants.OP_FUNCTION:
+			args := append([]interface{}(nil), registers[p1:p1+p2]...)
+			registers[p3] = scalarFunctions[instruction.P4.(string)].Call(args)
+
+		case constants.OP_OPEN_READ, constants.OP_OPEN_WRITE:
+			switch target := instruction.P4.(type) {
+			case *Table:
+				vm.Cursors[p1] = &vmCursor{Table: target}
+			case *Index:
+				vm.Cursors[p1] = &vmCursor{Table: target.Table, Index: target}
+			}
+		case constants.OP_REWIND:
+			cursor := vm.Cursors[p1]
+			cursor.moved()
+			if cursor.Index != nil {
+				cursor.IndexCursor = IndexSeek(cursor.Index, nil)
+				cursor.EndOfRows = cursor.IndexCursor.EndOfIndex
+			} else {
+				cursor.Cursor = TableStart(cursor.Table)
+				cursor.EndOfRows = cursor.Cursor.EndOfTable
+			}
+			if cursor.EndOfRows {
+				pc = p2
+			}
+		case constants.OP_NEXT:
+			// Loops back to P2 while there are rows left
+			cursor := vm.Cursors[p1]
+			if cursor.NullRow || cursor.EndOfRows {
+				break
+			}
+			cursor.moved()
+			switch {
+			case cursor.Hash != nil:
+				cursor.HashPosition++
+				cursor.EndOfRows = cursor.HashPosition >= len(cursor.HashRows)
+			case cursor.Index != nil:
+				IndexCursorAdvance(cursor.IndexCursor)
+				cursor.EndOfRows = cursor.IndexCursor.EndOfIndex
+			default:
+				CursorAdvance(cursor.Cursor)
+				cursor.EndOfRows = cursor.Cursor.EndOfTable
+			}
+			if !cursor.EndOfRows {
+				pc = p2
+			}
+		case constants.OP_SEEK_GE:
+			// Jumps to P2 if no row or entry is at or above the key in P3 onwards
+			cursor := vm.Cursors[p1]
+			cursor.moved()
+			if cursor.Index != nil {
+				cursor.IndexCursor = IndexSeek(cursor.Index, append([]interface{}(nil), registers[p3:p3+instruction.P5]...))
+				cursor.EndOfRows = cursor.IndexCursor.EndOfIndex
+			} else {
+				cursor.Cursor = TableSeek(cursor.Table, uint32(registers[p3].(int64)))
+				cursor.EndOfRows = cursor.Cursor.EndOfTable
+			}
+			if cursor.EndOfRows {
+				pc = p2
+			}
+		case constants.OP_SEEK_ROWID:
+			// Jumps to P2 unless a row has the key in P3
+			cursor := vm.Cursors[p1]
+			cursor.moved()
+			key, ok := lookupKey(registers[p3])
+			if ok {
+				cursor.Cursor = TableSeek(cursor.Table, key)
+				ok = !cursor.Cursor.EndOfTable && CursorKey(cursor.Cursor) == key
+			}
+			cursor.EndOfRows = !ok
+			if !ok {
+				pc = p2
+			}
+		case constants.OP_IDX_GT:
+			// Jumps to P2 once the entry under the cursor is past the key in P3 onwards
+			cursor := vm.Cursors[p1]
+			if compareIndexKeys(IndexCursorKey(cursor.IndexCursor), registers[p3:p3+instruction.P5]) > 0 {
+				pc = p2
+			}
+		case constants.OP_IDX_ROWID:
+			registers[p2] = int64(IndexCursorRowid(vm.Cursors[p1].IndexCursor))
+		case constants.OP_COLUMN:
+			registers[p3] = nil
+			if row := vm.Cursors[p1].row(); row != nil {
+				registers[p3] = row.Values[p2]
+			}
+		case constants.OP_ROWID:
+			registers[p2] = nil
+			if row := vm.Cursors[p1].row(); row != nil {
+				registers[p2] = int64(row.Key)
+			}
+		case constants.OP_NULL_ROW:
+			vm.Cursors[p1].NullRow = true
+		case constants.OP_IF_NULL_ROW:
+			if vm.Cursors[p1].NullRow {
+				pc = p2
+			}
+		case constants.OP_COUNT:
+			registers[p2] = TableCount(vm.Cursors[p1].Table)
+		case constants.OP_HASH_BUILD:
+			source := instruction.P4.(*JoinSource)
+			vm.Cursors[p1] = &vmCursor{Table: source.Table, Hash: buildJoinHash(source)}
+		case constants.OP_HASH_PROBE:
+			// Jumps to P2 unless some row has the values in P3 onwards
+			cursor := vm.Cursors[p1]
+			cursor.moved()
+			values := registers[p3 : p3+instruction.P5]
+			cursor.HashRows, cursor.HashPosition = nil, 0
+			if !hasNull(values) {
+				cursor.HashRows = cursor.Hash[groupKey(values)]
+			}
+			cursor.EndOfRows = len(cursor.HashRows) == 0
+			if cursor.EndOfRows {
+				pc = p2
+			}
+
+		case constants.OP_GROUP_FIND:
+			keys := append([]interface{}(nil), registers[p1:p1+p2]...)
+			group, ok := vm.Groups[groupKey(keys)]
+			if !ok {
+				group = newRowGroup(instruction.P4.([]*FunctionExpr), keys)
+				vm.Groups[groupKey(keys)] = group
+				vm.GroupList = append(vm.GroupList, group)
+			}
+			vm.Group = group
+		case constants.OP_AGG_STEP:
+			vm.Group.aggregators[p1].Step(append([]interface{}(nil), registers[p2:p2+p3]...))
+		case constants.OP_GROUP_SAVE:
+			vm.Group.values = append(vm.Group.values[:0], registers[p1:p1+p2]...)
+		case constants.OP_GROUP_SORT:
+			if len(vm.GroupList) == 0 && p1 != 0 {
+				// Aggregates over no rows still give one row, with NULL for every column
+				group := newRowGroup(instruction.P4.([]*FunctionExpr), nil)
+				group.values = make([]interface{}, p2)
+				vm.GroupList = append(vm.GroupList, group)
+			}
+			sort.SliceStable(vm.GroupList, func(i int, j int) bool {
+				return compareIndexKeys(vm.GroupList[i].keys, vm.GroupList[j].keys) < 0
+			})
+		case constants.OP_GROUP_NEXT:
+			// Loads the next group's saved values into P1 onwards and its
+			// aggregates into P3 onwards, jumping to P2 once there are none left
+			if vm.GroupIndex >= len(vm.GroupList) {
+				pc = p2
+				break
+			}
+			group := vm.GroupList[vm.GroupIndex]
+			vm.GroupIndex++
+			copy(registers[p1:], group.values)
+			for i, aggregator := range group.aggregators {
+				registers[p3+i] = aggregator.Final()
+			}
+		case constants.OP_SORTER_INSERT:
+			vm.Sorter = append(vm.Sorter, sortedRow{
+				values: append([]interface{}(nil), registers[p1:p1+p2]...),
+				keys:   append([]interface{}(nil), registers[p3:p3+len(instruction.P4.([]bool))]...),
+			})
+		case constants.OP_SORTER_SORT:
+			descending := instruction.P4.([]bool)
+			sort.SliceStable(vm.Sorter, func(i int, j int) bool {
+				for k := range descending {
+					order := CompareValues(vm.Sorter[i].keys[k], vm.Sorter[j].keys[k])
+					if descending[k] {
+						order = -order
+					}
+					if order != 0 {
+						return order < 0
+					}
+				}
+				return false
+			})
+		case constants.OP_SORTER_NEXT:
+			if vm.SorterPosition >= len(vm.Sorter) {
+				pc = p2
+				break
+			}
+			copy(registers[p1:], vm.Sorter[vm.SorterPosition].values)
+			vm.SorterPosition++
+		case constants.OP_ROWSET_ADD:
+			vm.RowSet = append(vm.RowSet, registers[p1].(int64))
+		case constants.OP_ROWSET_READ:
+			// Loads the next rowid into P3, jumping to P2 once there are none left
+			if vm.RowSetPosition >= len(vm.RowSet) {
+				pc = p2
+				break
+			}
+			registers[p3] = vm.RowSet[vm.RowSetPosition]
+			vm.RowSetPosition++
+
+		case constants.OP_RESULT_ROW:
+			if vm.Output != nil {
+				vm.Output(registers[p1 : p1+p2])
+			}
+		case constants.OP_NEW_ROWID:
+			// Without a key the row goes after the last one, like a rowid in SQLite
+			maxKey := TableMaxKey(vm.Cursors[p1].Table)
+			if maxKey == math.MaxUint32 {
+				return newError(ErrFullTable)
+			}
+			registers[p2] = int64(maxKey) + 1
+		case constants.OP_TYPE_CHECK:
+			// Converts the value in P1 to the type of column P2 of the table
+			// in P4, for values that were only computed while running
+			column := &instruction.P4.(*Table).Columns[p2]
+			value, err := ColumnValue(column, registers[p1])
+			if err != nil {
+				return errorf(ErrError, "%v", err)
+			}
+			registers[p1] = value
+		case constants.OP_MAKE_RECORD:
+			record := SerializeRow(instruction.P4.(*Table), &Row{Values: registers[p1 : p1+p2]})
+			if len(record) > int(constants.RECORD_MAX_SIZE) {
+				return newError(ErrTooBigRow)
+			}
+			registers[p3] = record
+		case constants.OP_INSERT:
+			// Writes the record in P2 as the row with the key in P3, replacing
+			// the row already there if there is one. P5 is set for inserts,
+			// which make the key the last one inserted.
+			cursor := vm.Cursors[p1]
+			cursor.moved()
+			key := uint32(registers[p3].(int64))
+			tableCursor := TableFind(cursor.Table, key)
+			cell := NewLeafCell(cursor.Table.Pager, key, registers[p2].([]byte))
+			node := GetPage(cursor.Table.Pager, tableCursor.PageNum)
+			if tableCursor.CellNum < *LeafNodeNumCells(node) && *LeafNodeKey(node, tableCursor.CellNum) == key {
+				LeafNodeUpdate(tableCursor, cell)
+			} else {
+				LeafNodeInsert(tableCursor, key, cell)
+			}
+			if instruction.P5 != 0 {
+				vm.LastInsertRowid = int64(key)
+			}
+			vm.Changes++
+		case constants.OP_DELETE:
+			cursor := vm.Cursors[p1]
+			cursor.moved()
+			LeafNodeDelete(cursor.Cursor)
+			vm.Changes++
+		case constants.OP_IDX_CHECK:
+			// Checks that a key fits in the index and, for a UNIQUE index,
+			// doesn't clash with another row's
+			indexInstance := vm.Cursors[p1].Index
+			key := registers[p2 : p2+p3]
+			if len(encodeIndexKey(indexInstance, key)) > int(constants.INDEX_KEY_MAX_SIZE) {
+				return newError(ErrTooBigIndexKey)
+			}
+			if indexInstance.Unique && indexHasConflict(indexInstance, key) {
+				return newError(ErrConstraintUnique)
+			}
+		case constants.OP_IDX_INSERT:
+			IndexInsert(vm.Cursors[p1].Index, append([]interface{}(nil), registers[p2:p2+p3]...))
+		case constants.OP_IDX_DELETE:
+			IndexDelete(vm.Cursors[p1].Index, append([]interface{}(nil), registers[p2:p2+p3]...))
+		default:
+			return errorf(ErrInternal, "Unknown opcode %s.", instruction.Opcode)
+		}
+	}
+	return nil
+}
+
+// Forgets the row read under a cursor that is about to move
+func (cursor *vmCursor) moved() {
+	cursor.NullRow = false
+	cursor.Row = nil
+}
+
+// The row under the cursor, nil after NullRow
+func (cursor *vmCursor) row() *Row {
+	if cursor.NullRow {
+		return nil
+	}
+	if cursor.Row == nil {
+		if cursor.Hash != nil {
+			cursor.Row = &cursor.HashRows[cursor.HashPosition]
+		} else {
+			cursor.Row = &Row{}
+			CursorRow(cursor.Cursor, cursor.Row)
+		}
+	}
+	return cursor.Row
+}
@@ -0,0 +1,442 @@
+package engine
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/kris-gaudel/goqlite/constants"
+)
+
+// Write-Ahead Log Code
+//
+// In WAL mode the database file is only written by checkpoints. A transaction
+// appends the new images of the pages it changed to the WAL instead, and the
+// frame holding the header page carries the commit marker. Every frame's
+// checksum chains from the one before it, so a torn or stale frame ends the
+// log. Readers keep an index of the newest committed frame for each page and
+// only pick up frames committed after their snapshot when a statement starts.
+//
+// Locks are advisory flocks:
+//   - every connection holds a shared lock on the database file
+//   - a writer holds an exclusive lock on the WAL file until it commits
+//   - a checkpoint needs an exclusive lock on the database file, so it only
+//     runs once no other connection could be reading frames it is about to drop
+//
+// A checkpoint starts the WAL over with a new salt. A connection that finds a
+// salt other than its own in the header forgets its index and reads the new
+// WAL from the start.
+
+type Wal struct {
+	FileDescriptor int
+	// Regenerated whenever the WAL restarts so frames from before a checkpoint are never read back
+	Salt               uint32
+	CheckpointSequence uint32
+	HeaderChecksum     uint32
+	// Frames up to MaxFrame belong to committed transactions, frames are numbered from 1
+	MaxFrame         uint32
+	MaxFrameChecksum uint32
+	// Size of the database in pages as of the last commit
+	NumPages uint32
+	// Newest committed frame for each page
+	Index map[uint32]uint32
+	// Frames appended by this connection's open transaction
+	NumFrames    uint32
+	LastChecksum uint32
+	Uncommitted  map[uint32]uint32
+	// Set while this connection holds the write lock
+	WriteLocked bool
+}
+
+func WalPath(fileName string) string {
+	return fileName + "-wal"
+}
+
+// Opens the WAL next to the database, creating it if needed, and reads every
+// transaction committed to it so far
+func WalOpen(pager *Pager) {
+	fd, err := syscall.Open(WalPath(pager.FileName), constants.O_RDWR|constants.O_CREAT, constants.S_IWUSR|constants.S_IRUSR)
+	if err != nil {
+		raiseIOError(ErrIOOpen, "opening the WAL", err)
+	}
+
+	wal := &Wal{
+		FileDescriptor: fd,
+		Index:          make(map[uint32]uint32),
+		Uncommitted:    make(map[uint32]uint32),
+	}
+	pager.Wal = wal
+
+	if !walReadHeader(wal) {
+		// Nobody can have committed to a WAL without a valid header, but another
+		// connection may be writing one right now
+		walLock(fd, syscall.LOCK_EX)
+		if !walReadHeader(wal) {
+			walWriteHeader(wal, uint32(time.Now().UnixNano()), 0)
+			syncDirectory(filepath.Dir(pager.FileName))
+		}
+		walLock(fd, syscall.LOCK_UN)
+	}
+	wal.MaxFrameChecksum = wal.HeaderChecksum
+
+	WalRefresh(pager)
+	pager.NumPages = walSnapshotNumPages(pager)
+}
+
+// Reads the WAL header, returning false if the file doesn't start with a valid one
+func walReadHeader(wal *Wal) bool {
+	header := make([]byte, constants.WAL_HEADER_SIZE)
+	bytesRead, err := syscall.Pread(wal.FileDescriptor, header, 0)
+	if err != nil {
+		raiseIOError(ErrIORead, "reading the WAL", err)
+	}
+	if bytesRead < len(header) ||
+		string(header[constants.WAL_MAGIC_OFFSET:constants.WAL_MAGIC_OFFSET+len(constants.WAL_MAGIC)]) != constants.WAL_MAGIC ||
+		binary.LittleEndian.Uint32(header[constants.WAL_VERSION_OFFSET:]) != constants.WAL_FORMAT_VERSION ||
+		binary.LittleEndian.Uint32(header[constants.WAL_PAGE_SIZE_OFFSET:]) != constants.PAGE_SIZE {
+		return false
+	}
+	checksum := crc32.ChecksumIEEE(header[:constants.WAL_CHECKSUM_OFFSET])
+	if checksum != binary.LittleEndian.Uint32(header[constants.WAL_CHECKSUM_OFFSET:]) {
+		return false
+	}
+
+	wal.Salt = binary.LittleEndian.Uint32(header[constants.WAL_SALT_OFFSET:])
+	wal.CheckpointSequence = binary.LittleEndian.Uint32(header[constants.WAL_CHECKPOINT_SEQUENCE_OFFSET:])
+	wal.HeaderChecksum = checksum
+	return true
+}
+
+// Empties the WAL and starts it over with a new header
+func walWriteHeader(wal *Wal, salt uint32, checkpointSequence uint32) {
+	header := make([]byte, constants.WAL_HEADER_SIZE)
+	copy(header[constants.WAL_MAGIC_OFFSET:], constants.WAL_MAGIC)
+	binary.LittleEndian.PutUint32(header[constants.WAL_VERSION_OFFSET:], constants.WAL_FORMAT_VERSION)
+	binary.LittleEndian.PutUint32(header[constants.WAL_PAGE_SIZE_OFFSET:], constants.PAGE_SIZE)
+	binary.LittleEndian.PutUint32(header[constants.WAL_CHECKPOINT_SEQUENCE_OFFSET:], checkpointSequence)
+	binary.LittleEndian.PutUint32(header[constants.WAL_SALT_OFFSET:], salt)
+	checksum := crc32.ChecksumIEEE(header[:constants.WAL_CHECKSUM_OFFSET])
+	binary.LittleEndian.PutUint32(header[constants.WAL_CHECKSUM_OFFSET:], checksum)
+
+	if err := syscall.Ftruncate(wal.FileDescriptor, 0); err != nil {
+		raiseIOError(ErrIOTruncate, "truncating the WAL", err)
+	}
+	if _, err := syscall.Pwrite(wal.FileDescriptor, header, 0); err != nil {
+		raiseIOError(ErrIOWrite, "writing the WAL", err)
+	}
+	if err := syscall.Fsync(wal.FileDescriptor); err != nil {
+		raiseIOError(ErrIOFsync, "syncing the WAL", err)
+	}
+
+	wal.Salt = salt
+	wal.CheckpointSequence = checkpointSequence
+	wal.HeaderChecksum = checksum
+}
+
+// Adds transactions committed since the last refresh to the index. Returns
+// true if any were found or the WAL was started over, in which case cached
+// pages may be out of date.
+func WalRefresh(pager *Pager) bool {
+	wal := pager.Wal
+	restarted := walRestarted(wal)
+	if restarted {
+		walRestart(pager)
+	}
+	frames, maxFrame, maxFrameChecksum, numPages := walScan(wal)
+	if maxFrame == wal.MaxFrame {
+		return restarted
+	}
+	for pageNum, frameNum := range frames {
+		wal.Index[pageNum] = frameNum
+	}
+	wal.MaxFrame = maxFrame
+	wal.MaxFrameChecksum = maxFrameChecksum
+	wal.NumPages = numPages
+	return true
+}
+
+// Whether another connection checkpointed and started the WAL over since this
+// connection last read its header
+func walRestarted(wal *Wal) bool {
+	header := make([]byte, constants.WAL_HEADER_SIZE)
+	bytesRead, err := syscall.Pread(wal.FileDescriptor, header, 0)
+	if err != nil {
+		raiseIOError(ErrIORead, "reading the WAL", err)
+	}
+	return bytesRead == len(header) && binary.LittleEndian.Uint32(header[constants.WAL_SALT_OFFSET:]) != wal.Salt
+}
+
+// Forgets every frame of the WAL this connection had indexed and reads the
+// new header. The database file already holds the pages they had.
+func walRestart(pager *Pager) {
+	wal := pager.Wal
+	if !walReadHeader(wal) {
+		raiseCorrupt("WAL header is invalid. Corrupt file.")
+	}
+	wal.Index = make(map[uint32]uint32)
+	wal.MaxFrame = 0
+	wal.MaxFrameChecksum = wal.HeaderChecksum
+	PagerDropCache(pager)
+
+	fileLength, err := syscall.Seek(pager.FileDescriptor, 0, os.SEEK_END)
+	if err != nil {
+		raiseIOError(ErrIOSeek, "getting the length of the database file", err)
+	}
+	pager.FileLength = uint32(fileLength)
+	pager.NumPages = walSnapshotNumPages(pager)
+}
+
+// Reads the frames of transactions committed past this connection's snapshot
+// without changing it. Returns the newest frame of each page they touched and
+// the state of the WAL after the last of them.
+func walScan(wal *Wal) (map[uint32]uint32, uint32, uint32, uint32) {
+	frame := make([]byte, constants.WAL_FRAME_SIZE)
+	frames := make(map[uint32]uint32)
+	pending := make(map[uint32]uint32)
+	checksum := wal.MaxFrameChecksum
+	maxFrame, maxFrameChecksum, numPages := wal.MaxFrame, wal.MaxFrameChecksum, wal.NumPages
+
+	for frameNum := wal.MaxFrame + 1; ; frameNum++ {
+		bytesRead, err := syscall.Pread(wal.FileDescriptor, frame, walFrameOffset(frameNum))
+		if err != nil {
+			raiseIOError(ErrIORead, "reading the WAL", err)
+		}
+		if bytesRead < len(frame) || binary.LittleEndian.Uint32(frame[constants.WAL_FRAME_SALT_OFFSET:]) != wal.Salt {
+			break
+		}
+		checksum = walFrameChecksum(checksum, frame)
+		if checksum != binary.LittleEndian.Uint32(frame[constants.WAL_FRAME_CHECKSUM_OFFSET:]) {
+			break
+		}
+
+		pending[binary.LittleEndian.Uint32(frame[constants.WAL_FRAME_PAGE_NUM_OFFSET:])] = frameNum
+		if commitSize := binary.LittleEndian.Uint32(frame[constants.WAL_FRAME_COMMIT_SIZE_OFFSET:]); commitSize != 0 {
+			for pageNum, pendingFrameNum := range pending {
+				frames[pageNum] = pendingFrameNum
+			}
+			pending = make(map[uint32]uint32)
+			maxFrame, maxFrameChecksum, numPages = frameNum, checksum, commitSize
+		}
+	}
+	return frames, maxFrame, maxFrameChecksum, numPages
+}
+
+// Takes the write lock and moves this connection to the newest snapshot.
+// Returns false if another connection is in the middle of a write.
+func WalBeginWrite(pager *Pager) bool {
+	wal := pager.Wal
+	if wal.WriteLocked {
+		return true
+	}
+	if err := syscall.Flock(wal.FileDescriptor, syscall.LOCK_EX|syscall.LOCK_NB); err == syscall.EWOULDBLOCK {
+		return false
+	} else if err != nil {
+		raiseIOError(ErrIOLock, "locking the WAL", err)
+	}
+
+	// Changes have to build on the last commit, not on whatever this connection
+	// last read. A transaction that already read an older snapshot can't move
+	// to the new one without its earlier reads going stale.
+	if pager.InTransaction {
+		if walRestarted(wal) {
+			walLock(wal.FileDescriptor, syscall.LOCK_UN)
+			return false
+		}
+		if _, maxFrame, _, _ := walScan(wal); maxFrame != wal.MaxFrame {
+			walLock(wal.FileDescriptor, syscall.LOCK_UN)
+			return false
+		}
+	} else if WalRefresh(pager) {
+		PagerDropCache(pager)
+	}
+	pager.NumPages = walSnapshotNumPages(pager)
+
+	// Frames past MaxFrame were left by a writer that never committed and get overwritten
+	wal.NumFrames = wal.MaxFrame
+	wal.LastChecksum = wal.MaxFrameChecksum
+	wal.Uncommitted = make(map[uint32]uint32)
+	wal.WriteLocked = true
+	return true
+}
+
+// Appends a page image to the WAL as part of the open transaction
+func WalAppendFrame(pager *Pager, pageNum uint32, data []byte, commitSize uint32) {
+	wal := pager.Wal
+	if !wal.WriteLocked {
+		raiseInternal("Tried to write to the WAL without the write lock.")
+	}
+
+	frame := make([]byte, constants.WAL_FRAME_SIZE)
+	binary.LittleEndian.PutUint32(frame[constants.WAL_FRAME_PAGE_NUM_OFFSET:], pageNum)
+	binary.LittleEndian.PutUint32(frame[constants.WAL_FRAME_COMMIT_SIZE_OFFSET:], commitSize)
+	binary.LittleEndian.PutUint32(frame[constants.WAL_FRAME_SALT_OFFSET:], wal.Salt)
+	copy(frame[constants.WAL_FRAME_DATA_OFFSET:], data)
+	checksum := walFrameChecksum(wal.LastChecksum, frame)
+	binary.LittleEndian.PutUint32(frame[constants.WAL_FRAME_CHECKSUM_OFFSET:], checksum)
+
+	frameNum := wal.NumFrames + 1
+	if _, err := syscall.Pwrite(wal.FileDescriptor, frame, walFrameOffset(frameNum)); err != nil {
+		raiseIOError(ErrIOWrite, "writing the WAL", err)
+	}
+	wal.NumFrames = frameNum
+	wal.LastChecksum = checksum
+	wal.Uncommitted[pageNum] = frameNum
+}
+
+// Fills page with the newest version of the page visible to this connection.
+// Returns false if the WAL has no copy, meaning the database file's is current.
+// A frame from before a checkpoint means the snapshot is gone, so the index is
+// rebuilt from the new WAL and the statement is turned away with ErrBusy.
+func WalReadPage(pager *Pager, pageNum uint32, page []byte) bool {
+	wal := pager.Wal
+	frameNum, ok := wal.Uncommitted[pageNum]
+	if !ok {
+		frameNum, ok = wal.Index[pageNum]
+	}
+	if !ok {
+		return false
+	}
+	frame := make([]byte, constants.WAL_FRAME_SIZE)
+	bytesRead, err := syscall.Pread(wal.FileDescriptor, frame, walFrameOffset(frameNum))
+	if err != nil {
+		raiseIOError(ErrIORead, "reading the WAL", err)
+	}
+	if bytesRead != len(frame) || binary.LittleEndian.Uint32(frame[constants.WAL_FRAME_SALT_OFFSET:]) != wal.Salt {
+		if walRestarted(wal) {
+			walRestart(pager)
+			WalRefresh(pager)
+			panic(errorf(ErrBusy, "Another connection checkpointed the WAL during the statement."))
+		}
+		raiseIOError(ErrIORead, "reading the WAL", nil)
+	}
+	copy(page, frame[constants.WAL_FRAME_DATA_OFFSET:])
+	return true
+}
+
+// Writes the open transaction's remaining dirty pages to the WAL, ending with
+// the header page as the commit frame, then releases the write lock
+func WalCommit(pager *Pager) {
+	wal := pager.Wal
+	header := GetPage(pager, constants.HEADER_PAGE_NUM)
+	MarkPageDirty(pager, constants.HEADER_PAGE_NUM)
+	*HeaderPageCount(header) = pager.NumPages
+
+	for _, pageNum := range dirtyPageNums(pager) {
+		if pageNum != constants.HEADER_PAGE_NUM {
+			PagerFlush(pager, pageNum)
+		}
+	}
+	WalAppendFrame(pager, constants.HEADER_PAGE_NUM, header, pager.NumPages)
+	pager.Pages[constants.HEADER_PAGE_NUM].Dirty = false
+
+	if err := syscall.Fsync(wal.FileDescriptor); err != nil {
+		raiseIOError(ErrIOFsync, "syncing the WAL", err)
+	}
+
+	for pageNum, frameNum := range wal.Uncommitted {
+		wal.Index[pageNum] = frameNum
+	}
+	wal.Uncommitted = make(map[uint32]uint32)
+	wal.MaxFrame = wal.NumFrames
+	wal.MaxFrameChecksum = wal.LastChecksum
+	wal.NumPages = pager.NumPages
+
+	walLock(wal.FileDescriptor, syscall.LOCK_UN)
+	wal.WriteLocked = false
+}
+
+// Throws away the frames of the open transaction and releases the write lock
+func WalRollback(pager *Pager) {
+	wal := pager.Wal
+	if err := syscall.Ftruncate(wal.FileDescriptor, walFrameOffset(wal.MaxFrame+1)); err != nil {
+		raiseIOError(ErrIOTruncate, "truncating the WAL", err)
+	}
+	wal.Uncommitted = make(map[uint32]uint32)
+	wal.NumFrames = wal.MaxFrame
+	wal.LastChecksum = wal.MaxFrameChecksum
+
+	PagerDropCache(pager)
+	pager.NumPages = walSnapshotNumPages(pager)
+
+	walLock(wal.FileDescriptor, syscall.LOCK_UN)
+	wal.WriteLocked = false
+}
+
+// Copies the newest committed version of every page in the WAL into the
+// database file and starts the WAL over. The caller must hold the exclusive
+// database lock and have no transaction open.
+func WalCheckpoint(pager *Pager) {
+	// Connections that closed since the last refresh may have committed
+	// frames this one hasn't indexed yet
+	if WalRefresh(pager) {
+		PagerDropCache(pager)
+	}
+	wal := pager.Wal
+	if wal.MaxFrame == 0 {
+		return
+	}
+
+	page := make([]byte, constants.PAGE_SIZE)
+	for pageNum := range wal.Index {
+		WalReadPage(pager, pageNum, page)
+		if _, err := syscall.Pwrite(pager.FileDescriptor, page, int64(pageNum)*constants.PAGE_SIZE); err != nil {
+			raiseIOError(ErrIOWrite, "checkpointing the WAL", err)
+		}
+	}
+	fileLength := wal.NumPages * constants.PAGE_SIZE
+	if err := syscall.Ftruncate(pager.FileDescriptor, int64(fileLength)); err != nil {
+		raiseIOError(ErrIOTruncate, "checkpointing the WAL", err)
+	}
+	if err := syscall.Fsync(pager.FileDescriptor); err != nil {
+		raiseIOError(ErrIOFsync, "syncing the database file", err)
+	}
+	pager.FileLength = fileLength
+
+	// Only once the database file is durable can the frames be thrown away
+	walWriteHeader(wal, wal.Salt+1, wal.CheckpointSequence+1)
+	wal.Index = make(map[uint32]uint32)
+	wal.MaxFrame = 0
+	wal.MaxFrameChecksum = wal.HeaderChecksum
+}
+
+// Closes the WAL, deleting it when this connection has just checkpointed it
+// and still holds the exclusive database lock
+func WalClose(pager *Pager, deleteFile bool) {
+	wal := pager.Wal
+	if err := syscall.Close(wal.FileDescriptor); err != nil {
+		raiseIOError(ErrIOClose, "closing the WAL", err)
+	}
+	if deleteFile {
+		if err := syscall.Unlink(WalPath(pager.FileName)); err != nil {
+			raiseIOError(ErrIODelete, "deleting the WAL", err)
+		}
+		syncDirectory(filepath.Dir(pager.FileName))
+	}
+	pager.Wal = nil
+}
+
+// Number of pages in the database as of this connection's snapshot
+func walSnapshotNumPages(pager *Pager) uint32 {
+	if pager.Wal.MaxFrame > 0 {
+		return pager.Wal.NumPages
+	}
+	return pager.FileLength / constants.PAGE_SIZE
+}
+
+func walFrameOffset(frameNum uint32) int64 {
+	return int64(constants.WAL_HEADER_SIZE) + int64(frameNum-1)*int64(constants.WAL_FRAME_SIZE)
+}
+
+func walFrameChecksum(previousChecksum uint32, frame []byte) uint32 {
+	checksum := crc32.Update(previousChecksum, crc32.IEEETable, frame[:constants.WAL_FRAME_CHECKSUM_OFFSET])
+	return crc32.Update(checksum, crc32.IEEETable, frame[constants.WAL_FRAME_DATA_OFFSET:])
+}
+
+func walLock(fd int, how int) {
+	if err := syscall.Flock(fd, how); err != nil {
+		raiseIOError(ErrIOLock, "locking the database file", err)
+	}
+}
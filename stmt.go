@@ -0,0 +1,334 @@
+package goqlite
+
+import (
+	"container/list"
+	"errors"
+	"time"
+
+	"github.com/kris-gaudel/goqlite/constants"
+	"github.com/kris-gaudel/goqlite/internal/engine"
+)
+
+// Prepared Statement Code
+//
+// A Stmt is parsed once and run as many times as needed, with values bound to
+// its ?, ?NNN and :name parameters in between. Bound values never go through
+// the lexer, they sit in the statement's ParameterExpr nodes and read like
+// literals when the statement is checked against the schema. That check is
+// redone when the bindings or the schema change, since which rows a statement
+// seeks to depends on the values. Closing a Stmt hands it back to its
+// connection, which keeps the most recently closed ones by their SQL text so
+// preparing the same SQL again skips parsing.
+
+// A prepared statement. It may only be used by one goroutine at a time.
+type Stmt struct {
+	db  *DB
+	sql string
+	// The statement as parsed, with the bound values in its parameters
+	node       engine.StatementNode
+	parameters []*engine.ParameterExpr
+	// Highest parameter number, which is how many values the statement takes
+	numParameters int
+	// Checked against the schema with the current bindings, nil when that has
+	// to be done again
+	statement *engine.Statement
+
+	// Set once Step has run the statement, until it's reset
+	done   bool
+	rows   *Rows
+	err    error
+	result Result
+	closed bool
+}
+
+var errStmtClosed = errorf(ErrMisuse, "Statement is closed.")
+
+// Parses a statement to run later, or reuses one closed earlier with the same SQL
+func (db *DB) Prepare(sql string) (*Stmt, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.database == nil {
+		return nil, ErrClosed
+	}
+	if element, ok := db.cachedStatements[sql]; ok {
+		db.statementCache.Remove(element)
+		delete(db.cachedStatements, sql)
+		return element.Value.(*Stmt), nil
+	}
+
+	node, parameters, err := engine.ParseParameters(sql)
+	if err != nil {
+		return nil, err
+	}
+	stmt := &Stmt{db: db, sql: sql, node: node, parameters: parameters}
+	for _, parameter := range parameters {
+		if parameter.Index > stmt.numParameters {
+			stmt.numParameters = parameter.Index
+		}
+	}
+	return stmt, nil
+}
+
+// Keeps a closed statement for the next Prepare of the same SQL, dropping the
+// least recently closed one once the cache is full
+func (db *DB) cacheStatement(stmt *Stmt) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.database == nil {
+		return
+	}
+	if _, ok := db.cachedStatements[stmt.sql]; ok {
+		return
+	}
+	if db.statementCache == nil {
+		db.statementCache = list.New()
+		db.cachedStatements = make(map[string]*list.Element)
+	}
+	db.cachedStatements[stmt.sql] = db.statementCache.PushFront(stmt)
+	if db.statementCache.Len() > constants.STATEMENT_CACHE_SIZE {
+		oldest := db.statementCache.Back()
+		db.statementCache.Remove(oldest)
+		delete(db.cachedStatements, oldest.Value.(*Stmt).sql)
+	}
+}
+
+// How many values the statement takes, the highest parameter number in it
+func (stmt *Stmt) ParameterCount() int {
+	return stmt.numParameters
+}
+
+// Number of the parameter written as name, like ":id", or 0 if there's none
+func (stmt *Stmt) ParameterIndex(name string) int {
+	for _, parameter := range stmt.parameters {
+		if parameter.Name == name && name != "?" {
+			return parameter.Index
+		}
+	}
+	return 0
+}
+
+// How the parameter was written, empty for a plain ? or a number with no parameter
+func (stmt *Stmt) ParameterName(index int) string {
+	for _, parameter := range stmt.parameters {
+		if parameter.Index == index && parameter.Name != "?" {
+			return parameter.Name
+		}
+	}
+	return ""
+}
+
+// Binds a value to the parameter with the given number, counting from 1. The
+// value can be nil, an int64, float64, string or []byte, or an int or bool,
+// which are stored as int64. Binding has to wait until a statement that has
+// been stepped is reset.
+func (stmt *Stmt) Bind(index int, value interface{}) error {
+	if stmt.closed {
+		return errStmtClosed
+	}
+	if stmt.done {
+		return errorf(ErrMisuse, "Statement must be reset before binding.")
+	}
+	if index < 1 || index > stmt.numParameters {
+		return errorf(ErrMisuse, "Parameter %d is out of range, the statement has %d.", index, stmt.numParameters)
+	}
+	switch typed := value.(type) {
+	case nil, int64, float64, string:
+	case []byte:
+		// The caller may reuse the slice before the statement runs
+		value = append([]byte(nil), typed...)
+	case int:
+		value = int64(typed)
+	case bool:
+		value = int64(0)
+		if typed {
+			value = int64(1)
+		}
+	default:
+		return errorf(ErrMisuse, "Cannot bind a value of type %T.", value)
+	}
+
+	for _, parameter := range stmt.parameters {
+		if parameter.Index == index {
+			parameter.Value = value
+		}
+	}
+	stmt.statement = nil
+	return nil
+}
+
+func (stmt *Stmt) BindInt64(index int, value int64) error {
+	return stmt.Bind(index, value)
+}
+
+func (stmt *Stmt) BindFloat64(index int, value float64) error {
+	return stmt.Bind(index, value)
+}
+
+func (stmt *Stmt) BindText(index int, value string) error {
+	return stmt.Bind(index, value)
+}
+
+func (stmt *Stmt) BindBlob(index int, value []byte) error {
+	return stmt.Bind(index, value)
+}
+
+func (stmt *Stmt) BindNull(index int) error {
+	return stmt.Bind(index, nil)
+}
+
+// Binds values to the parameters numbered from 1, one for each
+func (stmt *Stmt) bindAll(values []interface{}) error {
+	if len(values) != stmt.numParameters {
+		return errorf(ErrMisuse, "%d values for %d parameters.", len(values), stmt.numParameters)
+	}
+	for i, value := range values {
+		if err := stmt.Bind(i+1, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sets every parameter back to NULL
+func (stmt *Stmt) ClearBindings() error {
+	for index := 1; index <= stmt.numParameters; index++ {
+		if err := stmt.Bind(index, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Runs the statement the first time it's called after a reset, then moves to
+// the next row it output. Returns false once there are no rows left, along
+// with the error if the statement failed. The statement runs to the end in
+// that first call, with every row it outputs kept in memory, so later calls
+// only read them back and the connection is free for other statements
+// meanwhile.
+func (stmt *Stmt) Step() (bool, error) {
+	if stmt.closed {
+		return false, errStmtClosed
+	}
+	if !stmt.done {
+		stmt.done = true
+		stmt.rows = &Rows{position: -1}
+		stmt.err = stmt.run(stmt.rows)
+	}
+	if stmt.err != nil {
+		return false, stmt.err
+	}
+	return stmt.rows.Next(), nil
+}
+
+// The names of the result columns, once Step has run the statement
+func (stmt *Stmt) Columns() []string {
+	if stmt.rows == nil {
+		return nil
+	}
+	return stmt.rows.Columns()
+}
+
+// The values of the row Step moved to
+func (stmt *Stmt) Values() []interface{} {
+	if stmt.rows == nil {
+		return nil
+	}
+	return stmt.rows.Values()
+}
+
+// What the statement changed the last time it ran
+func (stmt *Stmt) Result() Result {
+	return stmt.result
+}
+
+// Makes the statement ready to run again, keeping its bindings
+func (stmt *Stmt) Reset() error {
+	if stmt.closed {
+		return errStmtClosed
+	}
+	stmt.done, stmt.rows, stmt.err = false, nil, nil
+	return nil
+}
+
+// Hands the statement back to its connection for reuse. The Stmt can't be
+// used after this.
+func (stmt *Stmt) Close() error {
+	if stmt.closed {
+		return nil
+	}
+	stmt.closed = true
+	for _, parameter := range stmt.parameters {
+		parameter.Value = nil
+	}
+	// The cache gets a Stmt of its own, so this one stays closed
+	cached := &Stmt{db: stmt.db, sql: stmt.sql, node: stmt.node, parameters: stmt.parameters, numParameters: stmt.numParameters}
+	if stmt.numParameters == 0 {
+		cached.statement = stmt.statement
+	}
+	stmt.db.cacheStatement(cached)
+	return nil
+}
+
+// Checks the statement against the schema again if the bindings or the
+// schema changed since it last was
+func (stmt *Stmt) prepare() error {
+	databaseInstance := stmt.db.database
+	if err := engine.RefreshSchema(databaseInstance); err != nil {
+		return err
+	}
+	if stmt.statement != nil && stmt.statement.SchemaCookie == databaseInstance.SchemaCookie {
+		return nil
+	}
+	statement := &engine.Statement{}
+	if err := engine.PrepareNode(stmt.node, stmt.sql, statement, databaseInstance); err != nil {
+		return err
+	}
+	stmt.statement = statement
+	return nil
+}
+
+// Runs the statement on the connection, collecting the rows it outputs unless
+// rows is nil
+func (stmt *Stmt) run(rows *Rows) (err error) {
+	db := stmt.db
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.database == nil {
+		return ErrClosed
+	}
+	// Checking the statement can read the schema from a file that fails
+	defer engine.RecoverError(&err)
+	defer engine.PagerEndRead(db.database.Pager)
+
+	// A statement turned away because another connection is writing changed
+	// nothing, so it can simply be run again
+	deadline := time.Now().Add(db.busyTimeout)
+	err = stmt.runOnce(rows)
+	for errors.Is(err, ErrBusy) && time.Now().Before(deadline) {
+		time.Sleep(constants.BUSY_RETRY_INTERVAL)
+		err = stmt.runOnce(rows)
+	}
+	return err
+}
+
+// Checks and runs the statement once, starting over on the rows
+func (stmt *Stmt) runOnce(rows *Rows) error {
+	if err := stmt.prepare(); err != nil {
+		return err
+	}
+	statement := stmt.statement
+	vm := &engine.VM{}
+	if rows != nil {
+		rows.rows = nil
+		rows.describe(statement)
+		vm.Output = rows.append
+	}
+	if err := engine.ExecuteRecovered(statement, stmt.db.database, vm); err != nil {
+		return err
+	}
+	stmt.result = Result{RowsAffected: vm.Changes}
+	if statement.Type == constants.STATEMENT_INSERT {
+		stmt.result.LastInsertId = vm.LastInsertRowid
+	}
+	return nil
+}